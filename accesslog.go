@@ -0,0 +1,72 @@
+package dnslink
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// accessLog collects the DNSLink fields of a request for Caddy's access
+// log, where they are logged as the "dnslink" object.
+type accessLog struct {
+	namespace       string
+	identifier      string
+	cacheStatus     string
+	resolveDuration time.Duration
+	prefix          string
+	upstream        string
+
+	// skip leaves the fields to the later handler the request was passed
+	// on to.
+	skip bool
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler, omitting the fields
+// that are not known.
+func (l *accessLog) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if l.namespace != "" {
+		enc.AddString("namespace", l.namespace)
+	}
+	if l.identifier != "" {
+		enc.AddString("identifier", l.identifier)
+	}
+	if l.cacheStatus != "" {
+		enc.AddString("cache", l.cacheStatus)
+		enc.AddBool("cache_hit", l.cacheStatus == cacheStatusHit)
+		enc.AddDuration("resolve_duration", l.resolveDuration)
+	}
+	if l.prefix != "" {
+		enc.AddString("prefix", l.prefix)
+	}
+	if l.upstream != "" {
+		enc.AddString("upstream", l.upstream)
+	}
+	return nil
+}
+
+// setPrefix records the prefix matched and its upstream, or the source
+// module of its dynamic upstreams.
+func (l *accessLog) setPrefix(d *DNSLink, prefix string) {
+	l.prefix = prefix
+	upstream, dynamic := d.upstream(prefix)
+	l.upstream = upstream
+	if l.upstream == "" && dynamic != nil {
+		l.upstream = "dynamic"
+	}
+}
+
+// write adds the fields to the access log of r. Requests not served by
+// Caddy's HTTP server, as in tests, have no access log.
+func (l *accessLog) write(r *http.Request) {
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok || l.skip {
+		return
+	}
+	extra.Set(zap.Object("dnslink", l))
+}
+
+// Interface guards
+var _ zapcore.ObjectMarshaler = (*accessLog)(nil)
@@ -0,0 +1,60 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAccessLog(t *testing.T) {
+	d := &DNSLink{
+		Upstreams:        map[string]string{"/ipfs": "localhost:8080"},
+		DynamicUpstreams: map[string]json.RawMessage{"/ipns": json.RawMessage(`{"source":"srv"}`)},
+	}
+	tests := []struct {
+		name string
+		log  accessLog
+		want map[string]any
+	}{
+		{
+			name: "miss",
+			log:  accessLog{cacheStatus: cacheStatusMiss, resolveDuration: time.Millisecond},
+			want: map[string]any{"cache": "miss", "cache_hit": false, "resolve_duration": time.Millisecond},
+		},
+		{
+			name: "proxied",
+			log:  accessLog{namespace: "ipfs", identifier: "QmSite", cacheStatus: cacheStatusHit, prefix: "/ipfs"},
+			want: map[string]any{
+				"namespace": "ipfs", "identifier": "QmSite", "cache": "hit", "cache_hit": true,
+				"resolve_duration": time.Duration(0), "prefix": "/ipfs", "upstream": "localhost:8080",
+			},
+		},
+		{
+			name: "dynamic",
+			log:  accessLog{namespace: "ipns", prefix: "/ipns"},
+			want: map[string]any{"namespace": "ipns", "prefix": "/ipns", "upstream": "dynamic"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tt.log
+			if l.prefix != "" {
+				l.setPrefix(d, l.prefix)
+			}
+			enc := zapcore.NewMapObjectEncoder()
+			if err := l.MarshalLogObject(enc); err != nil {
+				t.Fatal(err)
+			}
+			if len(enc.Fields) != len(tt.want) {
+				t.Errorf("fields = %v, want %v", enc.Fields, tt.want)
+			}
+			for key, want := range tt.want {
+				if got := enc.Fields[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// apps tracks the provisioned dnslink apps, including those private to a
+// handler, so the admin API can reach their caches.
+var (
+	appsMu sync.RWMutex
+	apps   = make(map[*App]struct{})
+)
+
+func registerApp(a *App) {
+	appsMu.Lock()
+	apps[a] = struct{}{}
+	appsMu.Unlock()
+}
+
+func unregisterApp(a *App) {
+	appsMu.Lock()
+	delete(apps, a)
+	appsMu.Unlock()
+}
+
+// activeApps returns all provisioned apps.
+func activeApps() []*App {
+	appsMu.RLock()
+	defer appsMu.RUnlock()
+
+	active := make([]*App, 0, len(apps))
+	for a := range apps {
+		active = append(active, a)
+	}
+	return active
+}
+
+// activeCaches returns the distinct caches of all provisioned apps.
+func activeCaches() []Cache {
+	seen := make(map[Cache]struct{})
+	var caches []Cache
+	for _, a := range activeApps() {
+		if _, ok := seen[a.cache]; ok {
+			continue
+		}
+		seen[a.cache] = struct{}{}
+		caches = append(caches, a.cache)
+	}
+	return caches
+}
+
+// adminAPI is a module that provides the /dnslink/ endpoints for the
+// Caddy admin API. This allows operators to inspect and purge the
+// resolution cache.
+type adminAPI struct{}
+
+// cacheStatus describes a single cached resolution.
+type cacheStatus struct {
+	Host       string    `json:"host"`
+	Namespace  string    `json:"namespace"`
+	Identifier string    `json:"identifier"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.dnslink",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes for the /dnslink/ endpoints.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/dnslink/cache",
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+		{
+			Pattern: "/dnslink/cache/",
+			Handler: caddy.AdminHandlerFunc(a.handleCacheHost),
+		},
+		{
+			Pattern: "/dnslink/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/dnslink/history",
+			Handler: caddy.AdminHandlerFunc(a.handleHistory),
+		},
+		{
+			Pattern: "/dnslink/history/",
+			Handler: caddy.AdminHandlerFunc(a.handleHistory),
+		},
+		{
+			Pattern: "/dnslink/records/",
+			Handler: caddy.AdminHandlerFunc(a.handleRecords),
+		},
+		{
+			Pattern: "/dnslink/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/dnslink/upstreams",
+			Handler: caddy.AdminHandlerFunc(a.handleUpstreams),
+		},
+		{
+			Pattern: "/dnslink/upstreams/",
+			Handler: caddy.AdminHandlerFunc(a.handleUpstream),
+		},
+		{
+			Pattern: "/dnslink/warm",
+			Handler: caddy.AdminHandlerFunc(a.handleWarm),
+		},
+	}
+}
+
+// handleCache lists the entries of every active resolution cache, or
+// flushes them all.
+func (adminAPI) handleCache(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return listCache(w, r)
+	case http.MethodDelete:
+		for _, a := range activeApps() {
+			if err := a.purge(r.Context()); err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusInternalServerError,
+					Err:        fmt.Errorf("purging cache: %v", err),
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleCacheHost evicts a single host from every active resolution cache.
+func (adminAPI) handleCacheHost(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	host := strings.TrimPrefix(r.URL.Path, "/dnslink/cache/")
+	if host == "" || strings.Contains(host, "/") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid host '%s'", host),
+		}
+	}
+
+	for _, a := range activeApps() {
+		if err := a.evict(r.Context(), host); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("evicting %s: %v", host, err),
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleWarm resolves the posted JSON list of hosts into every active
+// resolution cache.
+func (adminAPI) handleWarm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var hosts []string
+	if err := json.NewDecoder(r.Body).Decode(&hosts); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+
+	results := []warmResult{}
+	for _, a := range activeApps() {
+		results = a.warm(r.Context(), hosts)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleHistory writes the recorded links of one host, or of every host,
+// as JSON.
+func (adminAPI) handleHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	results := []hostHistory{}
+	host, one := strings.CutPrefix(r.URL.Path, "/dnslink/history/")
+	if one {
+		if host == "" || strings.Contains(host, "/") {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid host '%s'", host),
+			}
+		}
+		host = mappingKey(host)
+	}
+	for _, a := range activeApps() {
+		if a.History == nil {
+			continue
+		}
+		if !one {
+			results = append(results, a.History.all()...)
+			continue
+		}
+		if records := a.History.get(host); len(records) > 0 {
+			results = append(results, hostHistory{Host: host, Records: records})
+		}
+	}
+	if one && len(results) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no history for %s", host),
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+
+	w.Header().Set("Content-Type", "application/json")
+	if one {
+		return json.NewEncoder(w).Encode(results[0])
+	}
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleRecords publishes the DNSLink record of a host, given as a JSON
+// object with the DNSLink value, through the first active app managing
+// its zone.
+func (adminAPI) handleRecords(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	host := strings.TrimPrefix(r.URL.Path, "/dnslink/records/")
+	if host == "" || strings.Contains(host, "/") || !isDomainName(mappingKey(host)) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid host '%s'", host),
+		}
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+
+	for _, a := range activeApps() {
+		if a.Publish == nil {
+			continue
+		}
+		record, err := a.publish(r.Context(), host, body.Value)
+		if errors.Is(err, errNotManaged) {
+			continue
+		}
+		var invalid *invalidValueError
+		switch {
+		case errors.As(err, &invalid):
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		case err != nil:
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadGateway,
+				Err:        fmt.Errorf("publishing %s: %v", host, err),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(record)
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("%s is not in a managed zone", host),
+	}
+}
+
+// handleStats writes the cache statistics of all active apps as JSON.
+func (adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(collectStats())
+}
+
+// handleUpstreams writes the upstreams of every active handler by prefix
+// as JSON.
+func (adminAPI) handleUpstreams(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(activeUpstreams())
+}
+
+// activeUpstreams lists the distinct upstreams of all active handlers,
+// sorted by prefix and upstream.
+func activeUpstreams() []prefixUpstream {
+	results := []prefixUpstream{}
+	seen := make(map[prefixUpstream]struct{})
+	for _, d := range activeHandlers() {
+		for _, u := range d.upstreams() {
+			if _, ok := seen[u]; ok {
+				continue
+			}
+			seen[u] = struct{}{}
+			results = append(results, u)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Prefix != results[j].Prefix {
+			return results[i].Prefix < results[j].Prefix
+		}
+		return results[i].Upstream < results[j].Upstream
+	})
+	return results
+}
+
+// handleUpstream points a prefix of every active handler at the upstream
+// given as a JSON object, or removes its upstream, until the next config
+// load.
+func (adminAPI) handleUpstream(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	prefix, err := upstreamPrefix(strings.TrimPrefix(r.URL.Path, "/dnslink/upstreams/"))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	if r.Method == http.MethodDelete {
+		var removed bool
+		for _, d := range activeHandlers() {
+			if d.removeUpstream(prefix) {
+				removed = true
+			}
+		}
+		if !removed {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no upstream for %s", prefix),
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	var body struct {
+		Upstream string `json:"upstream"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	upstream := normalizeUpstream(body.Upstream)
+	if upstream == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("no upstream"),
+		}
+	}
+	for _, d := range activeHandlers() {
+		if err := d.setUpstream(prefix, upstream); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("setting upstream of %s: %v", prefix, err),
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// listCache writes the entries of every active resolution cache as JSON.
+func listCache(w http.ResponseWriter, r *http.Request) error {
+	results := []cacheStatus{}
+	for _, c := range activeCaches() {
+		err := c.Range(r.Context(), func(host string, entry CacheEntry) bool {
+			results = append(results, cacheStatus{
+				Host:       host,
+				Namespace:  entry.Namespace,
+				Identifier: entry.Identifier,
+				ExpiresAt:  entry.ExpiresAt,
+			})
+			return true
+		})
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("listing cache entries: %v", err),
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,125 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestAdminCache(t *testing.T) {
+	ctx := context.Background()
+	a := &App{cache: new(MemoryCache)}
+	registerApp(a)
+	defer unregisterApp(a)
+
+	expires := time.Now().Add(time.Minute)
+	_ = a.cache.Store(ctx, "a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmA", ExpiresAt: expires})
+	_ = a.cache.Store(ctx, "b.example.com", CacheEntry{Namespace: "swarm", Identifier: "abc", ExpiresAt: expires})
+
+	api := adminAPI{}
+	list := func() []cacheStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := api.handleCache(rec, httptest.NewRequest(http.MethodGet, "/dnslink/cache", nil)); err != nil {
+			t.Fatalf("GET /dnslink/cache error = %v", err)
+		}
+		var results []cacheStatus
+		if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return results
+	}
+
+	if got := list(); len(got) != 2 {
+		t.Fatalf("listed %d entries, want 2", len(got))
+	}
+
+	rec := httptest.NewRecorder()
+	if err := api.handleCacheHost(rec, httptest.NewRequest(http.MethodDelete, "/dnslink/cache/a.example.com", nil)); err != nil {
+		t.Fatalf("DELETE /dnslink/cache/a.example.com error = %v", err)
+	}
+	got := list()
+	if len(got) != 1 || got[0].Host != "b.example.com" {
+		t.Fatalf("after evict, entries = %+v, want only b.example.com", got)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := api.handleCache(rec, httptest.NewRequest(http.MethodDelete, "/dnslink/cache", nil)); err != nil {
+		t.Fatalf("DELETE /dnslink/cache error = %v", err)
+	}
+	if got := list(); len(got) != 0 {
+		t.Fatalf("after purge, entries = %+v, want none", got)
+	}
+}
+
+func TestAdminHistory(t *testing.T) {
+	a := &App{History: &History{MaxEntries: 10, MaxHosts: 10}}
+	if err := a.History.provision(caddy.Context{}, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	registerApp(a)
+	defer unregisterApp(a)
+
+	since := time.Now().UTC()
+	a.History.record("example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOld"}, since)
+	a.History.record("example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmNew"}, since.Add(time.Hour))
+
+	api := adminAPI{}
+	rec := httptest.NewRecorder()
+	if err := api.handleHistory(rec, httptest.NewRequest(http.MethodGet, "/dnslink/history/Example.com", nil)); err != nil {
+		t.Fatalf("GET /dnslink/history/Example.com error = %v", err)
+	}
+	var history hostHistory
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if history.Host != "example.com" || len(history.Records) != 2 || history.Records[1].Identifier != "QmNew" {
+		t.Errorf("history = %+v, want QmOld then QmNew", history)
+	}
+
+	err := api.handleHistory(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dnslink/history/other.example.com", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("GET unknown host error = %v, want 404", err)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	ctx := context.Background()
+	a := &App{
+		CacheTTL: caddy.Duration(time.Minute),
+		cache:    new(MemoryCache),
+		logger:   zap.NewNop(),
+		chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+			return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmXyz"}}}}, nil
+		})},
+	}
+	registerApp(a)
+	defer unregisterApp(a)
+
+	_, _, _ = a.resolve(ctx, "a.example.com")
+	_, _, _ = a.resolve(ctx, "a.example.com")
+	_, _, _ = a.resolve(ctx, "b.example.com")
+	_ = a.evict(ctx, "b.example.com")
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleStats(rec, httptest.NewRequest(http.MethodGet, "/dnslink/stats", nil)); err != nil {
+		t.Fatalf("GET /dnslink/stats error = %v", err)
+	}
+	var stats cacheStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	want := cacheStats{Entries: 1, Hits: 1, Misses: 2, Evictions: 1}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,113 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func init() {
+	caddy.RegisterModule(new(API))
+	httpcaddyfile.RegisterHandlerDirective("dnslink_api", parseAPICaddyfile)
+}
+
+// API is a handler that exposes DNSLink resolution as a JSON service.
+// It answers requests like `GET /resolve?host=example.com` with the
+// full resolution result, using the cache shared through the dnslink app.
+type API struct {
+	app *App
+}
+
+// apiResponse is the JSON body returned by the API handler.
+type apiResponse struct {
+	Host       string                                 `json:"host"`
+	Namespace  string                                 `json:"namespace,omitempty"`
+	Identifier string                                 `json:"identifier,omitempty"`
+	Links      map[string]dnslinkpkg.NamespaceEntries `json:"links,omitempty"`
+	Cached     bool                                   `json:"cached"`
+	ExpiresAt  *time.Time                             `json:"expires_at,omitempty"`
+	Error      string                                 `json:"error,omitempty"`
+}
+
+func (*API) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.dnslink_api",
+		New: func() caddy.Module { return new(API) },
+	}
+}
+
+func (a *API) Provision(ctx caddy.Context) error {
+	appIface, err := ctx.App("dnslink")
+	if err != nil {
+		return fmt.Errorf("getting dnslink app: %v", err)
+	}
+	a.app = appIface.(*App)
+	return nil
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing host query parameter"))
+	}
+
+	entry, cached, err := a.app.resolve(r.Context(), host)
+	resp := apiResponse{
+		Host:       host,
+		Namespace:  entry.Namespace,
+		Identifier: entry.Identifier,
+		Links:      entry.Links,
+		Cached:     cached,
+	}
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		status = http.StatusBadGateway
+		resp.Error = err.Error()
+	case entry.Namespace == "":
+		status = http.StatusNotFound
+		resp.Error = "no DNSLink record found"
+	default:
+		resp.ExpiresAt = &entry.ExpiresAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// parseAPICaddyfile parses the dnslink_api directive, which takes no
+// arguments.
+// Syntax:
+//
+//	dnslink_api
+func parseAPICaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	a := new(API)
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		if h.NextBlock(0) {
+			return nil, h.Errf("unknown subdirective '%s'", h.Val())
+		}
+	}
+	return a, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*API)(nil)
+	_ caddy.Provisioner           = (*API)(nil)
+	_ caddyhttp.MiddlewareHandler = (*API)(nil)
+)
@@ -0,0 +1,56 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func TestAPI(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	app := &App{cache: new(MemoryCache)}
+	_ = app.cache.Store(context.Background(), "example.com", CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmXyz789",
+		Links: map[string]dnslinkpkg.NamespaceEntries{
+			"ipfs": {{Identifier: "QmXyz789", Ttl: 60}},
+		},
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	api := &API{app: app}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resolve?host=example.com", nil)
+	if err := api.ServeHTTP(rec, req, nil); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp apiResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Namespace != "ipfs" || resp.Identifier != "QmXyz789" || !resp.Cached {
+		t.Errorf("response = %+v, want cached ipfs/QmXyz789", resp)
+	}
+	if len(resp.Links["ipfs"]) != 1 {
+		t.Errorf("links = %+v, want one ipfs link", resp.Links)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/resolve", nil)
+	err := api.ServeHTTP(rec, req, nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing host error = %v, want status %d", err, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,1846 @@
+package dnslink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/certmagic"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(App))
+	httpcaddyfile.RegisterGlobalOption("dnslink", parseGlobalOption)
+}
+
+// App is the dnslink app. It owns the resolver configuration and the
+// resolution cache, which are shared by every dnslink handler so that
+// lookups are not duplicated across sites.
+type App struct {
+	// CacheTTL is the duration to cache DNS lookups. Default is 1 minute.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// PrefixCacheTTL overrides CacheTTL for the links of a prefix, e.g.
+	// "/ipns", since content behind some namespaces changes far more
+	// often than behind others.
+	PrefixCacheTTL map[string]caddy.Duration `json:"prefix_cache_ttl,omitempty"`
+
+	// RecordTTL caches resolutions for the TTL of their TXT records
+	// instead of CacheTTL. Prefixes in PrefixCacheTTL keep their
+	// override. The system resolver reports no TTLs, so this needs
+	// Resolvers or a resolver chain.
+	RecordTTL bool `json:"record_ttl,omitempty"`
+
+	// MinTTL and MaxTTL clamp record TTLs, so zones publishing a TTL of
+	// 0 still get cached and week-long TTLs don't pin stale content.
+	// Default is no clamping.
+	MinTTL caddy.Duration `json:"min_ttl,omitempty"`
+	MaxTTL caddy.Duration `json:"max_ttl,omitempty"`
+
+	// CacheJitter shortens the lifetime of each cached resolution by a
+	// random fraction of up to CacheJitter, e.g. 0.1 for up to 10%, so
+	// hosts resolved together, such as after a restart or a purge, don't
+	// all expire and re-resolve at once. Default is 0.
+	CacheJitter float64 `json:"cache_jitter,omitempty"`
+
+	// Persist writes resolved entries to the configured Caddy storage so a
+	// restart can warm-start the cache from the last known identifiers.
+	Persist bool `json:"persist,omitempty"`
+
+	// CacheRaw is the cache backend used to store resolved entries.
+	// Default is the in-memory cache.
+	CacheRaw json.RawMessage `json:"cache,omitempty" caddy:"namespace=dnslink.cache inline_key=backend"`
+
+	// Resolvers is a list of resolvers to query for DNSLink TXT records,
+	// tried in order. Each is either a nameserver (host or host:port,
+	// queried over UDP), a DNS-over-HTTPS endpoint URL starting with
+	// https://, or a DNS-over-TLS server starting with tls:// (port 853
+	// by default). Default is the system resolver.
+	Resolvers []string `json:"resolvers,omitempty"`
+
+	// ResolverTLS configures the TLS connections to DNS-over-TLS resolvers.
+	ResolverTLS *ResolverTLS `json:"resolver_tls,omitempty"`
+
+	// RequireAuthenticatedData only accepts TXT answers that the resolver
+	// marks as DNSSEC-validated with the AD flag. Other answers are treated
+	// as lookup failures, so requests fall through to the next handler.
+	// The DNSSEC chain is not validated here: the resolver is trusted to
+	// have done it, so Resolvers must be validating resolvers reached over
+	// DNS-over-TLS or DNS-over-HTTPS, whose AD flag cannot be forged on
+	// the way. The system resolver and plain UDP nameservers are rejected.
+	RequireAuthenticatedData bool `json:"require_authenticated_data,omitempty"`
+
+	// TXTLabel is the label DNSLink TXT records are looked up under, in
+	// place of _dnslink, for private deployments publishing their records
+	// under another convention, e.g. "_links" for _links.example.com. As
+	// with _dnslink, the host's own TXT records are tried if there is no
+	// such name. Default is "_dnslink".
+	TXTLabel string `json:"txt_label,omitempty"`
+
+	// TXTLabelOnly looks DNSLink records up under TXTLabel only, never
+	// falling back to the host's own TXT records, so unrelated TXT data at
+	// the apex is neither fetched nor parsed and a host without a record
+	// costs a single query.
+	TXTLabelOnly bool `json:"txt_label_only,omitempty"`
+
+	// LenientTXT parses TXT records directly instead of with the dnslink
+	// library, tolerating the listed kinds of malformed records:
+	// "whitespace" around the record and its "=", and a differently cased
+	// dnslink= key; "slash", a missing leading slash or repeated slashes;
+	// and "namespace", differently cased namespaces and a bare CID without
+	// one, read as /ipfs. Default is strict parsing.
+	LenientTXT []string `json:"lenient_txt,omitempty"`
+
+	// TXTExtensions reads key=value extensions following the link of a
+	// DNSLink record, as in "dnslink=/ipfs/bafy... ttl=300 priority=1",
+	// instead of taking them as part of the identifier. A ttl of seconds
+	// caps how long the links of the namespace are cached, down to
+	// MinTTL; priority orders the links of a namespace, lowest first; and
+	// weight is the default weight of a link for weighted selection.
+	// Handlers with DNSLinkHeaders send all extensions of the link a
+	// request is routed on upstream, in X-Dnslink-Ext-<Key> headers.
+	TXTExtensions bool `json:"txt_extensions,omitempty"`
+
+	// Remote delegates resolution to an external HTTP service instead of
+	// looking up TXT records locally. It cannot be combined with
+	// Resolvers.
+	Remote *RemoteResolver `json:"remote,omitempty"`
+
+	// ChainRaw is an ordered list of resolvers, tried in turn until one
+	// yields a link. It replaces Resolvers and Remote.
+	ChainRaw []json.RawMessage `json:"chain,omitempty" caddy:"namespace=dnslink.resolvers inline_key=resolver"`
+
+	// IPNS, if set, resolves /ipns links further to /ipfs paths through
+	// a Kubo node before routing.
+	IPNS *IPNS `json:"ipns,omitempty"`
+
+	// NamespacePriority decides which link is routed on when a host
+	// publishes links in several namespaces: the first namespace in the
+	// list that has a link wins. Hosts without links in any of them use
+	// the alphabetically first namespace.
+	NamespacePriority []string `json:"namespace_priority,omitempty"`
+
+	// Namespaces, if set, are the only namespaces whose links are kept
+	// from resolutions, e.g. those the handlers have upstreams for. A host
+	// publishing links in other namespaces only is treated, and cached, as
+	// having no DNSLink record. /dnslink links are always kept.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// ApexFallback lists leading labels, e.g. "www", that are stripped to
+	// retry resolution at the parent domain when a host has no DNSLink
+	// record of its own, since many publishers only set one for the apex.
+	ApexFallback []string `json:"apex_fallback,omitempty"`
+
+	// WalkParents is how many levels up the label hierarchy are tried
+	// when a host has no DNSLink record of its own, e.g. b.example.com
+	// and then example.com for a.b.example.com, for publishers that only
+	// set a record on a parent domain. Each level found is cached under
+	// its own name too, so sibling hosts reuse it. Default is 0.
+	WalkParents int `json:"walk_parents,omitempty"`
+
+	// MaxRedirects is how many /dnslink/<domain> links are followed when
+	// resolving a host, after which resolution fails. Default is 8.
+	MaxRedirects int `json:"max_redirects,omitempty"`
+
+	// LookupTimeout bounds how long a single resolution may take before
+	// the request falls through. Lookups are also cancelled when the
+	// request that triggered them goes away. Default is 5s.
+	LookupTimeout caddy.Duration `json:"lookup_timeout,omitempty"`
+
+	// LookupRetries is how many times a lookup is retried after a
+	// transient failure (SERVFAIL, timeouts and network errors) before
+	// the request falls through. Missing records are never retried.
+	// Retries share the LookupTimeout budget. Default is 0.
+	LookupRetries int `json:"lookup_retries,omitempty"`
+
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// one after. Default is 100ms.
+	RetryBackoff caddy.Duration `json:"retry_backoff,omitempty"`
+
+	// MaxConcurrentLookups caps the number of outbound DNS queries in
+	// flight at once. Lookups beyond the limit wait for a free slot
+	// within their timeout. Default is unlimited.
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+
+	// MaxRecordSize, MaxIdentifierLength and MaxLinks bound the data a
+	// zone can feed into path building and the cache: TXT records longer
+	// than MaxRecordSize bytes and links whose identifier is longer than
+	// MaxIdentifierLength are ignored, and at most MaxLinks links of a
+	// resolution are kept. Defaults are 2048, 1024 and 64.
+	MaxRecordSize       int `json:"max_record_size,omitempty"`
+	MaxIdentifierLength int `json:"max_identifier_length,omitempty"`
+	MaxLinks            int `json:"max_links,omitempty"`
+
+	// AllowHosts, if set, restricts resolution to hosts matching one of
+	// its patterns: an exact name ("example.com"), a wildcard for a single
+	// label ("*.example.com"), or a suffix for a domain and everything
+	// under it (".example.com"). Other hosts are treated as having no
+	// link, without any lookup.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+
+	// DenyHosts lists host patterns, as for AllowHosts, that are never
+	// resolved. It takes precedence over AllowHosts.
+	DenyHosts []string `json:"deny_hosts,omitempty"`
+
+	// RateLimit, if set, bounds how often uncached resolutions may be
+	// triggered per client IP and per host.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// Static maps hosts to DNSLink values (e.g. "/ipfs/QmXyz") that are
+	// served without querying DNS, for staging environments, internal
+	// hostnames, or emergency overrides. Hosts are matched
+	// case-insensitively.
+	Static map[string]string `json:"static,omitempty"`
+
+	// Fallback maps hosts to DNSLink values used only when live
+	// resolution fails (not when the host has no DNSLink record), so a
+	// DNS outage degrades to known-good content. Fallback results are
+	// not cached.
+	Fallback map[string]string `json:"fallback,omitempty"`
+
+	// LookupDomains maps request hosts to the domain whose DNSLink record
+	// they are served from, e.g. "preview.internal" to
+	// "mysite.example.org", for previews, vanity hosts and migrations. The
+	// mapped host shares the domain's cache entry, static mapping and
+	// allow and deny lists. Mappings are not followed transitively.
+	LookupDomains map[string]string `json:"lookup_domains,omitempty"`
+
+	// AliasDomains maps request hosts to domains tried in order when the
+	// host has no DNSLink record of its own, e.g. "example.org" to
+	// "legacy.example.org" and "example.net", so a site can move between
+	// domains without a hard cutover. The first domain with a link is
+	// served and cached under the requested host. Aliases are tried before
+	// ApexFallback and WalkParents, and are not followed transitively.
+	AliasDomains map[string][]string `json:"alias_domains,omitempty"`
+
+	// Grace keeps serving the last link resolved for a host for up to
+	// Grace past the expiry of its cache entry when live resolution fails
+	// (not when the host has no DNSLink record), so a resolver outage
+	// doesn't break every site. Stale links are cached for at most
+	// graceRetryInterval at a time, so resolution is retried while the
+	// outage lasts. Default is 0, which disables grace mode.
+	Grace caddy.Duration `json:"grace,omitempty"`
+
+	// Preload lists hosts resolved in parallel when the app starts, so
+	// known high-traffic domains are cached before the first request.
+	Preload []string `json:"preload,omitempty"`
+
+	// PreloadFile is the path of a file with more hosts to preload, one
+	// per line. Blank lines and lines starting with # are ignored.
+	PreloadFile string `json:"preload_file,omitempty"`
+
+	// History, if set, records the links each host resolves to over
+	// time, for the admin API.
+	History *History `json:"history,omitempty"`
+
+	// Watch, if set, periodically re-resolves a set of hosts and notifies
+	// a webhook when their links change.
+	Watch *Watch `json:"watch,omitempty"`
+
+	// AuditLog records every resolution in the dnslink.audit logger: the
+	// host, outcome, source of the link (cache, dns, static, fallback,
+	// stale or none), the link and the latency. Routing that logger to
+	// its own sink with Caddy's logging config keeps a record for
+	// compliance and analytics that doesn't depend on access logs.
+	AuditLog bool `json:"audit_log,omitempty"`
+
+	// Pin, if set, asks a pinning endpoint to pin the ipfs links of
+	// matching hosts the first time they are resolved.
+	Pin *Pin `json:"pin,omitempty"`
+
+	// CachePurge, if set, asks HTTP caches in front of the upstreams to
+	// purge a host once a live resolution finds its link changed.
+	CachePurge *CachePurge `json:"cache_purge,omitempty"`
+
+	// Probe, if set, only replaces the link of a host with a new one once
+	// a gateway serves its content root, serving the previous link until
+	// then.
+	Probe *Probe `json:"probe,omitempty"`
+
+	// Publish, if set, lets the admin API publish the DNSLink records of
+	// hosts in managed zones through a DNS provider.
+	Publish *Publish `json:"publish,omitempty"`
+
+	// MappingsFile is the path of a file with additional static mappings,
+	// either a JSON object of host to DNSLink value or hosts-style lines
+	// of "<host> <value>". The file is reloaded when it changes. Mappings
+	// in Static take precedence over those in the file.
+	MappingsFile string `json:"mappings_file,omitempty"`
+
+	// MappingsPollInterval is how often MappingsFile is checked for
+	// changes. Default is 1s.
+	MappingsPollInterval caddy.Duration `json:"mappings_poll_interval,omitempty"`
+
+	// OnMiss, OnError, ErrorPage and ErrorJSON are the defaults of the
+	// handler options of the same names, for handlers that don't set
+	// them. A handler setting either ErrorPage or ErrorJSON inherits
+	// neither.
+	OnMiss    int    `json:"on_miss,omitempty"`
+	OnError   int    `json:"on_error,omitempty"`
+	ErrorPage string `json:"error_page,omitempty"`
+	ErrorJSON bool   `json:"error_json,omitempty"`
+
+	// lookup queries TXT records using the configured transport.
+	lookup txtLookup
+
+	// txtParser parses TXT records if LenientTXT is set.
+	txtParser *txtParser
+
+	// chain holds the resolvers tried in order, if any. Otherwise links
+	// are found with lookup.
+	chain []Resolver
+
+	// static and fallback hold the parsed Static and Fallback mappings
+	// by normalized host.
+	static   map[string]CacheEntry
+	fallback map[string]CacheEntry
+
+	// lookupDomains holds LookupDomains by normalized host and domain.
+	lookupDomains map[string]string
+
+	// aliasDomains holds AliasDomains by normalized host and domain.
+	aliasDomains map[string][]string
+
+	// fileMappings holds the mappings currently loaded from MappingsFile.
+	fileMappings atomic.Pointer[map[string]CacheEntry]
+
+	// mappingsModTime is the modification time of the MappingsFile
+	// version last loaded, or last attempted.
+	mappingsModTime time.Time
+
+	// stopWatch stops the mappings file watcher.
+	stopWatch chan struct{}
+
+	// cache holds the DNS lookup results.
+	cache Cache
+
+	// storage is the Caddy storage used when Persist is enabled.
+	storage certmagic.Storage
+
+	// persisting tracks writes to storage in progress, so Cleanup can
+	// wait for them.
+	persisting sync.WaitGroup
+
+	// stats counts cache hits, misses and lookups in flight.
+	stats resolutionStats
+
+	// recent keeps the latest resolutions and errors for the status page.
+	recent recentActivity
+
+	// lastSeen holds the most recent live resolution per host, so changes
+	// can be detected after the cache entry has expired, until
+	// lastSeenRetention past its grace window. seenHosts counts its hosts
+	// roughly, and once it reaches seenSweepAt, the hosts kept past their
+	// retention are swept.
+	lastSeen     sync.Map
+	seenHosts    atomic.Int64
+	seenSweepAt  atomic.Int64
+	sweepingSeen sync.Mutex
+
+	// pending holds the background resolutions of async handlers by host,
+	// and resolving tracks them so Cleanup can wait for them.
+	pending   sync.Map
+	resolving sync.WaitGroup
+
+	events *caddyevents.App
+	ctx    caddy.Context
+
+	logger *zap.Logger
+
+	// auditLogger is the logger of AuditLog, or nil.
+	auditLogger *zap.Logger
+}
+
+func (*App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+func (a *App) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	a.logger = ctx.Logger()
+	if a.AuditLog {
+		a.auditLogger = a.logger.Named("audit")
+	}
+	dnslinkMetrics.init.Do(initMetrics)
+
+	eventsAppIface, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	a.events = eventsAppIface.(*caddyevents.App)
+
+	if a.CacheTTL == 0 {
+		a.CacheTTL = caddy.Duration(1 * time.Minute)
+	}
+	if a.MaxRedirects == 0 {
+		a.MaxRedirects = 8
+	}
+	if a.LookupTimeout == 0 {
+		a.LookupTimeout = caddy.Duration(5 * time.Second)
+	}
+
+	a.lookup, err = a.newLookup()
+	if err != nil {
+		return err
+	}
+	if a.txtParser, err = newTXTParser(a.LenientTXT); err != nil {
+		return err
+	}
+	switch {
+	case a.ChainRaw != nil:
+		if len(a.Resolvers) > 0 || a.RequireAuthenticatedData || a.Remote != nil {
+			return fmt.Errorf("chain cannot be combined with resolvers, require_authenticated_data or remote")
+		}
+		mods, err := ctx.LoadModule(a, "ChainRaw")
+		if err != nil {
+			return fmt.Errorf("loading resolver chain: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			a.chain = append(a.chain, mod.(Resolver))
+		}
+	case a.Remote != nil:
+		if len(a.Resolvers) > 0 || a.RequireAuthenticatedData {
+			return fmt.Errorf("remote cannot be combined with resolvers or require_authenticated_data")
+		}
+		if err := a.Remote.Provision(ctx); err != nil {
+			return fmt.Errorf("remote: %v", err)
+		}
+		a.chain = []Resolver{a.Remote}
+	}
+	if err := a.provisionStatic(); err != nil {
+		return err
+	}
+	if a.RateLimit != nil {
+		a.RateLimit.provision()
+	}
+	if a.IPNS != nil {
+		if err := a.IPNS.provision(); err != nil {
+			return fmt.Errorf("ipns: %v", err)
+		}
+	}
+	if a.History != nil {
+		if err := a.History.provision(ctx, a.logger); err != nil {
+			return fmt.Errorf("history: %v", err)
+		}
+	}
+	if a.Watch != nil {
+		if err := a.Watch.provision(); err != nil {
+			return fmt.Errorf("watch: %v", err)
+		}
+	}
+	if a.Pin != nil {
+		if err := a.Pin.provision(a.logger); err != nil {
+			return fmt.Errorf("pin: %v", err)
+		}
+	}
+	if a.CachePurge != nil {
+		if err := a.CachePurge.provision(a.logger); err != nil {
+			return fmt.Errorf("cache_purge: %v", err)
+		}
+	}
+	if a.Probe != nil {
+		if err := a.Probe.provision(); err != nil {
+			return fmt.Errorf("probe: %v", err)
+		}
+	}
+	if a.Publish != nil {
+		if err := a.Publish.provision(ctx); err != nil {
+			return fmt.Errorf("publish: %v", err)
+		}
+	}
+	if a.MappingsFile != "" {
+		if err := a.loadMappingsFile(); err != nil {
+			return fmt.Errorf("loading mappings file: %v", err)
+		}
+	}
+
+	if a.CacheRaw != nil {
+		mod, err := ctx.LoadModule(a, "CacheRaw")
+		if err != nil {
+			return fmt.Errorf("loading cache module: %v", err)
+		}
+		a.cache = mod.(Cache)
+	} else {
+		a.cache = new(MemoryCache)
+	}
+
+	if a.Persist {
+		a.storage = ctx.Storage()
+		if err := a.loadPersisted(ctx); err != nil {
+			return fmt.Errorf("loading persisted cache: %v", err)
+		}
+	}
+
+	registerApp(a)
+	return nil
+}
+
+// Validate rejects nonsensical cache durations and resolver settings that
+// would never take effect.
+func (a *App) Validate() error {
+	durations := map[string]caddy.Duration{
+		"cache_ttl":      a.CacheTTL,
+		"min_ttl":        a.MinTTL,
+		"max_ttl":        a.MaxTTL,
+		"lookup_timeout": a.LookupTimeout,
+		"retry_backoff":  a.RetryBackoff,
+		"grace":          a.Grace,
+	}
+	for prefix, ttl := range a.PrefixCacheTTL {
+		if err := validatePrefix(prefix); err != nil {
+			return fmt.Errorf("cache_ttl: %v", err)
+		}
+		durations["cache_ttl "+prefix] = ttl
+	}
+	for name, dur := range durations {
+		if dur < 0 {
+			return fmt.Errorf("negative %s %v", name, time.Duration(dur))
+		}
+	}
+	if (a.MinTTL != 0 || a.MaxTTL != 0) && !a.RecordTTL {
+		return fmt.Errorf("min_ttl and max_ttl only apply with record_ttl")
+	}
+	if a.MaxTTL != 0 && a.MinTTL > a.MaxTTL {
+		return fmt.Errorf("min_ttl %v is greater than max_ttl %v", time.Duration(a.MinTTL), time.Duration(a.MaxTTL))
+	}
+	if a.CacheJitter < 0 || a.CacheJitter >= 1 {
+		return fmt.Errorf("cache_jitter must be at least 0 and less than 1, got %v", a.CacheJitter)
+	}
+
+	if a.LookupRetries < 0 || a.MaxRedirects < 0 || a.MaxConcurrentLookups < 0 || a.WalkParents < 0 {
+		return fmt.Errorf("lookup_retries, max_redirects, max_concurrent_lookups and walk_parents cannot be negative")
+	}
+	if a.MaxRecordSize < 0 || a.MaxIdentifierLength < 0 || a.MaxLinks < 0 {
+		return fmt.Errorf("max_record_size, max_identifier_length and max_links cannot be negative")
+	}
+	if a.RetryBackoff != 0 && a.LookupRetries == 0 {
+		return fmt.Errorf("retry backoff is set but lookup_retries is 0")
+	}
+	if a.TXTLabel != "" {
+		if err := validateTXTLabel(a.TXTLabel); err != nil {
+			return err
+		}
+	}
+	if a.ErrorPage != "" && a.ErrorJSON {
+		return fmt.Errorf("error_page and error_json are mutually exclusive")
+	}
+	for _, ns := range a.Namespaces {
+		if ns == "" || strings.Contains(ns, "/") {
+			return fmt.Errorf("invalid namespace '%s'", ns)
+		}
+	}
+	if a.RequireAuthenticatedData {
+		if err := checkAuthenticatedData(a.Resolvers); err != nil {
+			return err
+		}
+	}
+	if a.ResolverTLS != nil && !slices.ContainsFunc(a.Resolvers, func(r string) bool { return strings.HasPrefix(r, "tls://") }) {
+		return fmt.Errorf("resolver_tls is set but no resolver uses tls://")
+	}
+	return nil
+}
+
+func (a *App) Start() error {
+	if a.MappingsFile != "" {
+		a.stopWatch = make(chan struct{})
+		go a.watchMappingsFile(a.stopWatch)
+	}
+	if err := a.preload(a.ctx); err != nil {
+		return fmt.Errorf("preloading hosts: %v", err)
+	}
+	if a.Watch != nil {
+		a.Watch.start(a.ctx, a)
+	}
+	return nil
+}
+
+func (a *App) Stop() error {
+	if a.stopWatch != nil {
+		close(a.stopWatch)
+		a.stopWatch = nil
+	}
+	if a.Watch != nil {
+		a.Watch.stopWatching()
+	}
+	return nil
+}
+
+// Cleanup stops the background goroutines, in case the app was never
+// started or stopped, and waits for pending writes to storage so the
+// next config finds them.
+func (a *App) Cleanup() error {
+	unregisterApp(a)
+	_ = a.Stop()
+	a.resolving.Wait()
+	a.persisting.Wait()
+	if a.History != nil {
+		a.History.persisting.Wait()
+	}
+	if a.Pin != nil {
+		a.Pin.stop()
+	}
+	if a.CachePurge != nil {
+		a.CachePurge.stop()
+	}
+	return nil
+}
+
+// resolve returns the DNSLink entry for host, from the cache if possible.
+// The boolean reports whether the entry was served from the cache. An
+// entry with an empty namespace means no usable link was found; failed
+// lookups are reported the same way, and the only error returned is the
+// cancellation of ctx.
+func (a *App) resolve(ctx context.Context, host string) (CacheEntry, bool, error) {
+	entry, cached, err := a.resolveEntry(ctx, host)
+	if err != nil && ctx.Err() == nil {
+		return entry, cached, nil
+	}
+	return entry, cached, err
+}
+
+// countResolution counts a resolution of host with outcome, keeps it for
+// the status page and, with AuditLog, records it along with the entry
+// served, if any, and the time taken since start.
+func (a *App) countResolution(host, outcome string, entry CacheEntry, start time.Time, err error) {
+	dnslinkMetrics.resolutions.WithLabelValues(outcome).Inc()
+	a.recent.resolved(host, outcome, entry, start, err)
+	if a.auditLogger == nil {
+		return
+	}
+	fields := []zap.Field{
+		zap.String("host", host),
+		zap.String("outcome", outcome),
+		zap.String("source", resolutionSource(outcome, entry)),
+		zap.Duration("latency", time.Since(start)),
+	}
+	if entry.Namespace != "" {
+		fields = append(fields, zap.String("namespace", entry.Namespace), zap.String("identifier", entry.Identifier))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	a.auditLogger.Info("dnslink resolution", fields...)
+}
+
+// resolutionSource returns where the entry of a resolution with outcome
+// came from, for the audit log.
+func resolutionSource(outcome string, entry CacheEntry) string {
+	switch outcome {
+	case outcomeHit:
+		return "cache"
+	case outcomeStatic, outcomeFallback, outcomeStale:
+		return outcome
+	case outcomeRateLimited:
+		if entry.Namespace != "" {
+			return outcomeStale
+		}
+		return "none"
+	case outcomeDenied, outcomePending:
+		return "none"
+	default:
+		return "dns"
+	}
+}
+
+// resolveEntry is like resolve, but also returns the error of lookups that
+// failed without an authoritative answer and without a fallback, so a
+// failing resolver can be told apart from a host without a link.
+func (a *App) resolveEntry(ctx context.Context, host string) (CacheEntry, bool, error) {
+	host = a.lookupDomain(host)
+	ctx, span := startSpan(ctx, "dnslink.resolve", attrHost.String(host))
+	defer span.End()
+	start := time.Now()
+
+	if !a.hostAllowed(host) {
+		a.countResolution(host, outcomeDenied, CacheEntry{}, start, nil)
+		return CacheEntry{}, false, nil
+	}
+
+	if entry, ok := a.lookupStatic(host); ok {
+		a.countResolution(host, outcomeStatic, entry, start, nil)
+		span.SetAttributes(attrNamespace.String(entry.Namespace), attrIdentifier.String(entry.Identifier))
+		return entry, false, nil
+	}
+
+	cached, ok, err := a.cache.Load(ctx, host)
+	if err != nil {
+		// A failing cache backend should not take down resolution.
+		a.logger.Warn("loading cache entry", zap.String("host", host), zap.Error(err))
+	}
+	span.SetAttributes(attrCacheHit.Bool(ok))
+	if ok {
+		a.countResolution(host, outcomeHit, cached, start, nil)
+		a.stats.hits.Add(1)
+		span.SetAttributes(attrNamespace.String(cached.Namespace), attrIdentifier.String(cached.Identifier))
+		return cached, true, nil
+	}
+
+	a.stats.misses.Add(1)
+
+	if a.RateLimit != nil && !a.RateLimit.allow(clientFrom(ctx), host, time.Now()) {
+		if stale, ok := a.lastSeenEntry(host, time.Now()); ok {
+			a.countResolution(host, outcomeRateLimited, stale, start, nil)
+			span.SetAttributes(attrNamespace.String(stale.Namespace), attrIdentifier.String(stale.Identifier))
+			return stale, true, nil
+		}
+		a.countResolution(host, outcomeRateLimited, CacheEntry{}, start, errRateLimited)
+		return CacheEntry{}, false, errRateLimited
+	}
+
+	if asyncRequested(ctx) {
+		entry, done, err := a.resolveAsync(host)
+		if !done {
+			a.countResolution(host, outcomePending, CacheEntry{}, start, nil)
+			return CacheEntry{}, false, errResolutionPending
+		}
+		return entry, false, err
+	}
+
+	entry, err := a.resolveLive(ctx, host)
+	return entry, false, err
+}
+
+// resolveLive resolves host without consulting the cache, then caches and
+// records the result. Errors are reported as for resolveEntry.
+func (a *App) resolveLive(ctx context.Context, host string) (CacheEntry, error) {
+	span := trace.SpanFromContext(ctx)
+
+	// Use the official dnslink library to resolve
+	lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(a.LookupTimeout))
+	lookupCtx, canonical := withCanonicalName(lookupCtx)
+	start := time.Now()
+	a.stats.inflight.Add(1)
+	result, namespace, identifier, err := a.resolveHostOrApex(lookupCtx, host)
+	a.stats.inflight.Add(-1)
+	dnslinkMetrics.resolutionDuration.Observe(time.Since(start).Seconds())
+	cancel()
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// The client went away; there is nobody to route and nothing
+		// worth reporting.
+		span.RecordError(err)
+		return CacheEntry{}, ctx.Err()
+	}
+	if err != nil {
+		outcome := lookupOutcome("", err)
+		span.RecordError(err)
+		if entry, ok := a.graceEntry(host, time.Now()); ok && outcome == outcomeError {
+			a.countResolution(host, outcomeStale, entry, start, err)
+			a.logger.Warn("dnslink resolution failed, serving stale link",
+				zap.String("host", host),
+				zap.String("namespace", entry.Namespace),
+				zap.String("identifier", entry.Identifier),
+				zap.Error(err))
+			span.SetAttributes(attrNamespace.String(entry.Namespace), attrIdentifier.String(entry.Identifier))
+			if err := a.cache.Store(ctx, host, entry); err != nil {
+				a.logger.Warn("storing cache entry", zap.String("host", host), zap.Error(err))
+			}
+			return entry, nil
+		}
+		if entry, ok := a.lookupFallback(host); ok && outcome == outcomeError {
+			a.countResolution(host, outcomeFallback, entry, start, err)
+			a.logger.Warn("dnslink resolution failed, using fallback",
+				zap.String("host", host),
+				zap.String("namespace", entry.Namespace),
+				zap.String("identifier", entry.Identifier),
+				zap.Error(err))
+			span.SetAttributes(attrNamespace.String(entry.Namespace), attrIdentifier.String(entry.Identifier))
+			return entry, nil
+		}
+		a.countResolution(host, outcome, CacheEntry{}, start, err)
+		a.emitResolution(host, CacheEntry{}, CacheEntry{}, false, err)
+		a.logger.Debug("dnslink resolution result", zap.String("host", host), zap.Error(err))
+		if outcome == outcomeError {
+			return CacheEntry{}, err
+		}
+		// If it's just that no link was found, we return empty string without error
+		// so the handler can continue to the next middleware.
+		return CacheEntry{}, nil
+	}
+
+	entry := a.newEntry(result, namespace, identifier)
+	entry.CanonicalName = canonical.get()
+	a.countResolution(host, lookupOutcome(namespace, nil), entry, start, nil)
+
+	if entry.Namespace == "ipns" && a.IPNS != nil {
+		if err := a.resolveIPNS(ctx, &entry); err != nil {
+			// Route on the IPNS link as published, but don't cache it so
+			// the next request tries again.
+			a.logger.Warn("resolving IPNS name",
+				zap.String("host", host),
+				zap.String("name", entry.Identifier),
+				zap.Error(err))
+			span.RecordError(err)
+			span.SetAttributes(attrNamespace.String(entry.Namespace), attrIdentifier.String(entry.Identifier))
+			return entry, nil
+		}
+	}
+
+	if prev, ok := a.lastSeenEntry(host, time.Now()); ok && a.Probe != nil && a.Probe.probes(prev, entry) {
+		if err := a.Probe.check(ctx, entry); err != nil {
+			// Keep the previous link, and probe the new one again soon.
+			a.logger.Warn("new link is not available yet, serving previous link",
+				zap.String("host", host),
+				zap.String("namespace", entry.Namespace),
+				zap.String("identifier", entry.Identifier),
+				zap.String("previous", prev.Identifier),
+				zap.Error(err))
+			prev.ExpiresAt = time.Now().Add(min(probeRetryInterval, time.Until(entry.ExpiresAt)))
+			span.SetAttributes(attrNamespace.String(prev.Namespace), attrIdentifier.String(prev.Identifier))
+			if err := a.cache.Store(ctx, host, prev); err != nil {
+				a.logger.Warn("storing cache entry", zap.String("host", host), zap.Error(err))
+			}
+			return prev, nil
+		}
+	}
+
+	span.SetAttributes(attrNamespace.String(entry.Namespace), attrIdentifier.String(entry.Identifier))
+
+	// Cache the result
+	if err := a.cache.Store(ctx, host, entry); err != nil {
+		a.logger.Warn("storing cache entry", zap.String("host", host), zap.Error(err))
+	}
+
+	prev, hadPrev := a.seen(host, entry, time.Now())
+	a.emitResolution(host, entry, prev, hadPrev, nil)
+	if a.History != nil {
+		a.History.record(host, entry, time.Now())
+	}
+	if a.Pin != nil {
+		a.Pin.pinNew(host, entry)
+	}
+	if a.CachePurge != nil && hadPrev {
+		a.CachePurge.purgeChanged(host, entry, prev)
+	}
+
+	if a.storage != nil {
+		a.persisting.Add(1)
+		go func() {
+			defer a.persisting.Done()
+			a.persist(host, entry)
+		}()
+	}
+
+	return entry, nil
+}
+
+// lastSeenRetention is how long the last resolution of a host is kept past
+// the expiry of its entry and the grace window, so the changes of hosts
+// requested now and then are still noticed.
+const lastSeenRetention = time.Hour
+
+// lastSeenEntry returns the last resolution of host, unless it is past its
+// retention at now.
+func (a *App) lastSeenEntry(host string, now time.Time) (CacheEntry, bool) {
+	val, ok := a.lastSeen.Load(host)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	entry := val.(CacheEntry)
+	if now.After(a.seenDeadline(entry)) {
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
+// seenDeadline returns when the last resolution entry is forgotten.
+func (a *App) seenDeadline(entry CacheEntry) time.Time {
+	return entry.ExpiresAt.Add(time.Duration(a.Grace) + lastSeenRetention)
+}
+
+// seen records entry as the last resolution of host, returning the
+// previous one if it is still retained at now. Once the hosts recorded
+// since the last sweep outnumber those it kept, the resolutions past their
+// retention are swept, so hosts that are never requested again don't pile
+// up while sweeping costs a constant time per host on average.
+func (a *App) seen(host string, entry CacheEntry, now time.Time) (CacheEntry, bool) {
+	val, ok := a.lastSeen.Swap(host, entry)
+	if !ok && a.seenHosts.Add(1) >= a.seenSweepAt.Load() && a.sweepingSeen.TryLock() {
+		var kept int64
+		a.lastSeen.Range(func(key, val any) bool {
+			if now.After(a.seenDeadline(val.(CacheEntry))) {
+				a.lastSeen.Delete(key)
+			} else {
+				kept++
+			}
+			return true
+		})
+		a.seenHosts.Store(kept)
+		a.seenSweepAt.Store(max(2*kept, minMemorySweep))
+		a.sweepingSeen.Unlock()
+	}
+	if !ok {
+		return CacheEntry{}, false
+	}
+	prev := val.(CacheEntry)
+	if now.After(a.seenDeadline(prev)) {
+		return CacheEntry{}, false
+	}
+	return prev, true
+}
+
+// graceRetryInterval bounds how long a stale link is cached in grace mode
+// before resolution is retried.
+const graceRetryInterval = 30 * time.Second
+
+// graceEntry returns the last link resolved for host if it expired less
+// than Grace ago, with an expiry bounded by graceRetryInterval and the end
+// of the grace window.
+func (a *App) graceEntry(host string, now time.Time) (CacheEntry, bool) {
+	if a.Grace <= 0 {
+		return CacheEntry{}, false
+	}
+	entry, ok := a.lastSeenEntry(host, now)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	deadline := entry.ExpiresAt.Add(time.Duration(a.Grace))
+	if entry.Namespace == "" || !now.Before(deadline) {
+		return CacheEntry{}, false
+	}
+	entry.ExpiresAt = now.Add(graceRetryInterval)
+	if deadline.Before(entry.ExpiresAt) {
+		entry.ExpiresAt = deadline
+	}
+	return entry, true
+}
+
+// resolveHost resolves host and selects the link to route on, following
+// /dnslink/<domain> links to the links of the referenced domain. The
+// returned result is that of the last domain resolved.
+func (a *App) resolveHost(ctx context.Context, host string) (result dnslinkpkg.Result, namespace, identifier string, err error) {
+	seen := map[string]bool{mappingKey(host): true}
+	for redirects := 0; ; redirects++ {
+		result, err = a.resolveLinks(ctx, host)
+		if err != nil {
+			return result, "", "", err
+		}
+		namespace, identifier = selectLink(result, a.NamespacePriority)
+		if namespace != "dnslink" {
+			return result, namespace, identifier, nil
+		}
+
+		if redirects >= a.MaxRedirects {
+			return result, "", "", fmt.Errorf("%s: more than %d dnslink redirects", host, a.MaxRedirects)
+		}
+		// The target may be followed by a path, which is not meaningful
+		// for routing.
+		host, _, _ = strings.Cut(identifier, "/")
+		if seen[mappingKey(host)] {
+			return result, "", "", fmt.Errorf("dnslink redirect loop at %s", host)
+		}
+		seen[mappingKey(host)] = true
+	}
+}
+
+// newEntry builds the cache entry for a resolution.
+func (a *App) newEntry(result dnslinkpkg.Result, namespace, identifier string) CacheEntry {
+	now := time.Now()
+	entry := CacheEntry{
+		Namespace:  namespace,
+		Identifier: identifier,
+		Links:      result.Links,
+		Extensions: a.linkExtensions(result),
+		ResolvedAt: now,
+	}
+	entry.ExpiresAt = now.Add(a.jitter(a.hintedTTL(a.entryTTL(result, namespace), entry, namespace)))
+	return entry
+}
+
+// jitter shortens ttl by a random fraction of up to CacheJitter.
+func (a *App) jitter(ttl time.Duration) time.Duration {
+	if a.CacheJitter == 0 || ttl <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*a.CacheJitter*float64(ttl))
+}
+
+// entryTTL returns how long a resolution selecting namespace is cached:
+// the lowest TTL of the namespace's records, clamped to MinTTL and MaxTTL,
+// if RecordTTL is set and the prefix has no override.
+func (a *App) entryTTL(result dnslinkpkg.Result, namespace string) time.Duration {
+	if _, ok := a.PrefixCacheTTL["/"+namespace]; ok || !a.RecordTTL {
+		return a.cacheTTL(namespace)
+	}
+	entries := result.Links[namespace]
+	if len(entries) == 0 {
+		return a.cacheTTL(namespace)
+	}
+	ttl := entries[0].Ttl
+	for _, e := range entries[1:] {
+		ttl = min(ttl, e.Ttl)
+	}
+	d := time.Duration(ttl) * time.Second
+	if d < time.Duration(a.MinTTL) {
+		d = time.Duration(a.MinTTL)
+	}
+	if a.MaxTTL != 0 && d > time.Duration(a.MaxTTL) {
+		d = time.Duration(a.MaxTTL)
+	}
+	return d
+}
+
+// cacheTTL returns how long links in namespace are cached.
+func (a *App) cacheTTL(namespace string) time.Duration {
+	if ttl, ok := a.PrefixCacheTTL["/"+namespace]; ok {
+		return time.Duration(ttl)
+	}
+	return time.Duration(a.CacheTTL)
+}
+
+// resolveHostOrApex is resolveHost, retrying at the AliasDomains of host if
+// it has no link, then at the parent domain if host starts with one of the
+// ApexFallback labels, and then walking up to WalkParents levels of parent
+// domains.
+func (a *App) resolveHostOrApex(ctx context.Context, host string) (result dnslinkpkg.Result, namespace, identifier string, err error) {
+	result, namespace, identifier, err = a.resolveHost(ctx, host)
+	if lookupOutcome(namespace, err) != outcomeNoLink {
+		return result, namespace, identifier, err
+	}
+	for _, alias := range a.aliasDomains[host] {
+		r, ns, id, err := a.resolveHost(ctx, alias)
+		if lookupOutcome(ns, err) != outcomeNoLink {
+			return r, ns, id, err
+		}
+	}
+	for _, label := range a.ApexFallback {
+		// Never fall back to a top-level domain.
+		if apex, ok := strings.CutPrefix(host, label+"."); ok && strings.Contains(apex, ".") {
+			r, ns, id, err := a.resolveHost(ctx, apex)
+			if lookupOutcome(ns, err) != outcomeNoLink {
+				return r, ns, id, err
+			}
+			break
+		}
+	}
+
+	parent := host
+	for depth := 0; depth < a.WalkParents; depth++ {
+		var ok bool
+		if _, parent, ok = strings.Cut(parent, "."); !ok || !strings.Contains(parent, ".") {
+			break
+		}
+		if cached, ok, _ := a.cache.Load(ctx, parent); ok && cached.Namespace != "" {
+			return dnslinkpkg.Result{Links: cached.Links}, cached.Namespace, cached.Identifier, nil
+		}
+		r, ns, id, err := a.resolveHost(ctx, parent)
+		if lookupOutcome(ns, err) == outcomeNoLink {
+			continue
+		}
+		if err == nil {
+			if err := a.cache.Store(ctx, parent, a.newEntry(r, ns, id)); err != nil {
+				a.logger.Warn("storing cache entry", zap.String("host", parent), zap.Error(err))
+			}
+		}
+		return r, ns, id, err
+	}
+	return result, namespace, identifier, err
+}
+
+// Default bounds of the data of a resolution.
+const (
+	defaultMaxRecordSize       = 2048
+	defaultMaxIdentifierLength = 1024
+	defaultMaxLinks            = 64
+)
+
+// withDefault returns n, or def if n is 0.
+func withDefault(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// resolveLinks finds the DNSLink links of host, through the resolver
+// chain if one is configured or with local TXT lookups otherwise. Links
+// embedding their own namespace path are moved to that namespace, the
+// links of each namespace are put in a deterministic order, and links
+// beyond the size limits are dropped.
+func (a *App) resolveLinks(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	var result dnslinkpkg.Result
+	var err error
+	if a.chain != nil {
+		result, err = resolveChain(ctx, a.chain, host)
+	} else {
+		lookup := recordSizeLookup(a.lookup, withDefault(a.MaxRecordSize, defaultMaxRecordSize))
+		result, err = resolveTXT(ctx, lookup, a.txtParser, host)
+	}
+	links := result.Links
+	var ext map[string]map[string]string
+	if a.TXTExtensions {
+		links, ext = stripExtensions(links), txtExtensions(result.TxtEntries)
+	}
+	links = prioritizeLinks(orderLinks(allowLinks(normalizeLinks(links), a.Namespaces)), ext)
+	result.Links = boundLinks(links, withDefault(a.MaxIdentifierLength, defaultMaxIdentifierLength), withDefault(a.MaxLinks, defaultMaxLinks))
+	return result, err
+}
+
+// newLookup returns the TXT lookup for the configured resolvers and
+// TXTLabel, retrying transient failures if LookupRetries is set and
+// limiting concurrency if MaxConcurrentLookups is set.
+func (a *App) newLookup() (txtLookup, error) {
+	lookup, err := a.transportLookup()
+	if err != nil {
+		return nil, err
+	}
+	lookup = labelLookup(lookup, a.TXTLabel, a.TXTLabelOnly)
+	// Limit individual queries rather than whole retry sequences, so no
+	// slot is held while backing off.
+	if a.MaxConcurrentLookups > 0 {
+		lookup = limitLookup(lookup, a.MaxConcurrentLookups)
+	}
+	if a.LookupRetries > 0 {
+		backoff := time.Duration(a.RetryBackoff)
+		if backoff == 0 {
+			backoff = defaultRetryBackoff
+		}
+		lookup = retryLookup(lookup, a.LookupRetries, backoff)
+	}
+	return lookup, nil
+}
+
+// transportLookup returns the TXT lookup querying the configured
+// resolvers, or the system resolver if there are none.
+func (a *App) transportLookup() (txtLookup, error) {
+	return newTransportLookup(a.Resolvers, a.ResolverTLS, a.RequireAuthenticatedData)
+}
+
+// newTransportLookup returns the TXT lookup querying resolvers in order,
+// or the system resolver if there are none. Global placeholders in the
+// resolver addresses, such as {env.DNS_RESOLVER}, are expanded.
+func newTransportLookup(resolvers []string, resolverTLS *ResolverTLS, requireAD bool) (txtLookup, error) {
+	if len(resolvers) == 0 {
+		if requireAD {
+			return nil, fmt.Errorf("require_authenticated_data needs explicit resolvers; the system resolver does not report DNSSEC validation")
+		}
+		return systemLookup, nil
+	}
+	tlsConfig, err := resolverTLS.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("resolver_tls: %v", err)
+	}
+	repl := caddy.NewReplacer()
+	resolvers = slices.Clone(resolvers)
+	exchanges := make([]exchangeFunc, len(resolvers))
+	for i, addr := range resolvers {
+		resolvers[i] = repl.ReplaceAll(addr, "")
+		exchange, err := newExchange(resolvers[i], tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		exchanges[i] = exchange
+	}
+	return exchangeLookup(fallbackExchange(resolvers, exchanges), requireAD), nil
+}
+
+// selectLink picks the namespace and identifier to route on from a
+// resolution result. Namespaces listed in priority win in that order;
+// otherwise the alphabetically first namespace is used, so the choice is
+// deterministic.
+func selectLink(result dnslinkpkg.Result, priority []string) (namespace, identifier string) {
+	for _, ns := range priority {
+		if entries := result.Links[ns]; len(entries) > 0 {
+			return ns, entries[0].Identifier
+		}
+	}
+	namespaces := make([]string, 0, len(result.Links))
+	for ns, entries := range result.Links {
+		if len(entries) > 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) == 0 {
+		return "", ""
+	}
+	sort.Strings(namespaces)
+	return namespaces[0], result.Links[namespaces[0]][0].Identifier
+}
+
+// evict removes the cached entry for host, along with the result of its
+// background resolution and its last resolution, so the next request
+// re-resolves it and nothing from before is served in its place.
+func (a *App) evict(ctx context.Context, host string) error {
+	host = a.lookupDomain(host)
+	if err := a.cache.Delete(ctx, host); err != nil {
+		return err
+	}
+	a.pending.Delete(host)
+	if _, ok := a.lastSeen.LoadAndDelete(host); ok {
+		a.seenHosts.Add(-1)
+	}
+	if a.storage != nil {
+		return a.unpersist(ctx, host)
+	}
+	return nil
+}
+
+// purge removes all cached entries, background resolution results and last
+// resolutions.
+func (a *App) purge(ctx context.Context) error {
+	if err := a.cache.Purge(ctx); err != nil {
+		return err
+	}
+	a.pending.Range(func(host, _ any) bool {
+		a.pending.Delete(host)
+		return true
+	})
+	a.lastSeen.Range(func(host, _ any) bool {
+		a.lastSeen.Delete(host)
+		return true
+	})
+	a.seenHosts.Store(0)
+	if a.storage != nil {
+		return a.unpersistAll(ctx)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the app from Caddyfile tokens. The same
+// cache settings are accepted in the global dnslink option and in a
+// handler block.
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			if err := a.unmarshalOption(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalOption parses the app option at the dispenser's current token.
+func (a *App) unmarshalOption(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "cache_ttl":
+		args := d.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			a.CacheTTL = caddy.Duration(dur)
+			break
+		}
+		if !strings.HasPrefix(args[0], "/") {
+			return d.Errf("cache_ttl prefix must start with '/': %s", args[0])
+		}
+		if a.PrefixCacheTTL == nil {
+			a.PrefixCacheTTL = make(map[string]caddy.Duration)
+		}
+		a.PrefixCacheTTL[args[0]] = caddy.Duration(dur)
+	case "record_ttl":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.RecordTTL = true
+	case "min_ttl", "max_ttl":
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return err
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if opt == "min_ttl" {
+			a.MinTTL = caddy.Duration(dur)
+		} else {
+			a.MaxTTL = caddy.Duration(dur)
+		}
+	case "cache_jitter":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		val, percent := strings.CutSuffix(d.Val(), "%")
+		jitter, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return d.Errf("invalid cache_jitter '%s'", d.Val())
+		}
+		if percent {
+			jitter /= 100
+		}
+		a.CacheJitter = jitter
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "cache":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, "dnslink.cache."+name)
+		if err != nil {
+			return err
+		}
+		a.CacheRaw = caddyconfig.JSONModuleObject(unm, "backend", name, nil)
+	case "persist":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.Persist = true
+	case "resolvers":
+		a.Resolvers = append(a.Resolvers, d.RemainingArgs()...)
+		if len(a.Resolvers) == 0 {
+			return d.ArgErr()
+		}
+	case "lookup_timeout":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return err
+		}
+		a.LookupTimeout = caddy.Duration(dur)
+	case "grace":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid grace '%s'", d.Val())
+		}
+		a.Grace = caddy.Duration(dur)
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "allow_hosts", "deny_hosts":
+		name := d.Val()
+		patterns := d.RemainingArgs()
+		if len(patterns) == 0 {
+			return d.ArgErr()
+		}
+		if name == "allow_hosts" {
+			a.AllowHosts = append(a.AllowHosts, patterns...)
+		} else {
+			a.DenyHosts = append(a.DenyHosts, patterns...)
+		}
+	case "namespace_priority":
+		namespaces := d.RemainingArgs()
+		if len(namespaces) == 0 {
+			return d.ArgErr()
+		}
+		for _, ns := range namespaces {
+			a.NamespacePriority = append(a.NamespacePriority, strings.Trim(ns, "/"))
+		}
+	case "namespaces":
+		namespaces := d.RemainingArgs()
+		if len(namespaces) == 0 {
+			return d.ArgErr()
+		}
+		for _, ns := range namespaces {
+			a.Namespaces = append(a.Namespaces, strings.Trim(ns, "/"))
+		}
+	case "rate_limit":
+		limit, err := unmarshalRateLimit(d)
+		if err != nil {
+			return err
+		}
+		a.RateLimit = limit
+	case "apex_fallback":
+		labels := d.RemainingArgs()
+		if len(labels) == 0 {
+			labels = []string{"www"}
+		}
+		for _, label := range labels {
+			a.ApexFallback = append(a.ApexFallback, strings.ToLower(strings.Trim(label, ".")))
+		}
+	case "walk_parents":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 0 {
+			return d.Errf("invalid walk_parents '%s'", d.Val())
+		}
+		a.WalkParents = n
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "max_redirects":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 1 {
+			return d.Errf("invalid max_redirects '%s'", d.Val())
+		}
+		a.MaxRedirects = n
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "lookup_retries":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 0 {
+			return d.Errf("invalid lookup_retries '%s'", d.Val())
+		}
+		a.LookupRetries = n
+		if d.NextArg() {
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			a.RetryBackoff = caddy.Duration(dur)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "max_concurrent_lookups":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n < 0 {
+			return d.Errf("invalid max_concurrent_lookups '%s'", d.Val())
+		}
+		a.MaxConcurrentLookups = n
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "max_record_size", "max_identifier_length", "max_links":
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil || n <= 0 {
+			return d.Errf("invalid %s '%s'", opt, d.Val())
+		}
+		switch opt {
+		case "max_record_size":
+			a.MaxRecordSize = n
+		case "max_identifier_length":
+			a.MaxIdentifierLength = n
+		default:
+			a.MaxLinks = n
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "history":
+		h, err := unmarshalHistory(d)
+		if err != nil {
+			return err
+		}
+		a.History = h
+	case "watch":
+		w, err := unmarshalWatch(d)
+		if err != nil {
+			return err
+		}
+		a.Watch = w
+	case "pin":
+		p, err := unmarshalPin(d)
+		if err != nil {
+			return err
+		}
+		a.Pin = p
+	case "cache_purge":
+		p, err := unmarshalCachePurge(d)
+		if err != nil {
+			return err
+		}
+		a.CachePurge = p
+	case "probe":
+		p, err := unmarshalProbe(d)
+		if err != nil {
+			return err
+		}
+		a.Probe = p
+	case "publish":
+		p, err := unmarshalPublish(d)
+		if err != nil {
+			return err
+		}
+		a.Publish = p
+	case "preload":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		a.Preload = append(a.Preload, args...)
+	case "preload_file":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		a.PreloadFile = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "mappings_file":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		a.MappingsFile = d.Val()
+		if d.NextArg() {
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return err
+			}
+			a.MappingsPollInterval = caddy.Duration(dur)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "remote":
+		unm, err := caddyfile.UnmarshalModule(d, "dnslink.resolvers.remote")
+		if err != nil {
+			return err
+		}
+		a.Remote = unm.(*RemoteResolver)
+	case "chain":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "dnslink.resolvers."+name)
+			if err != nil {
+				return err
+			}
+			a.ChainRaw = append(a.ChainRaw, caddyconfig.JSONModuleObject(unm, "resolver", name, nil))
+		}
+	case "ipns":
+		a.IPNS = new(IPNS)
+		if d.NextArg() {
+			a.IPNS.API = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+				a.IPNS.CacheTTL = caddy.Duration(dur)
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	case "static", "fallback":
+		option := d.Val()
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		if _, _, err := parseLink(args[1]); err != nil {
+			return d.Err(err.Error())
+		}
+		mappings := &a.Static
+		if option == "fallback" {
+			mappings = &a.Fallback
+		}
+		if *mappings == nil {
+			*mappings = make(map[string]string)
+		}
+		(*mappings)[args[0]] = args[1]
+	case "lookup_domain":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return d.ArgErr()
+		}
+		if a.LookupDomains == nil {
+			a.LookupDomains = make(map[string]string)
+		}
+		a.LookupDomains[args[0]] = args[1]
+	case "alias_domains":
+		args := d.RemainingArgs()
+		if len(args) < 2 {
+			return d.ArgErr()
+		}
+		if a.AliasDomains == nil {
+			a.AliasDomains = make(map[string][]string)
+		}
+		a.AliasDomains[args[0]] = append(a.AliasDomains[args[0]], args[1:]...)
+	case "audit_log":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.AuditLog = true
+	case "require_authenticated_data":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.RequireAuthenticatedData = true
+	case "require_dnssec":
+		return d.Err(errRenamedRequireDNSSEC)
+	case "txt_label":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		a.TXTLabel = strings.Trim(d.Val(), ".")
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "txt_label_only":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.TXTLabelOnly = true
+	case "txt_extensions":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.TXTExtensions = true
+	case "lenient_txt":
+		a.LenientTXT = d.RemainingArgs()
+		if len(a.LenientTXT) == 0 {
+			a.LenientTXT = txtTolerances
+		}
+		if _, err := newTXTParser(a.LenientTXT); err != nil {
+			return d.Err(err.Error())
+		}
+	case "resolver_tls":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if a.ResolverTLS == nil {
+			a.ResolverTLS = new(ResolverTLS)
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "server_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.ResolverTLS.ServerName = d.Val()
+			case "ca":
+				files := d.RemainingArgs()
+				if len(files) == 0 {
+					return d.ArgErr()
+				}
+				a.ResolverTLS.CAFiles = append(a.ResolverTLS.CAFiles, files...)
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	case "on_miss", "on_error":
+		opt := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		status, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid status '%s'", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if opt == "on_miss" {
+			a.OnMiss = status
+		} else {
+			a.OnError = status
+		}
+	case "error_page":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		a.ErrorPage = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case "error_json":
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		a.ErrorJSON = true
+	default:
+		return d.Errf("unknown subdirective '%s'", d.Val())
+	}
+	return nil
+}
+
+// parseGlobalOption parses the global dnslink option, which configures
+// the dnslink app.
+// Syntax:
+//
+//	{
+//	    dnslink {
+//	        cache_ttl 5m
+//	        cache_ttl /ipns 30s
+//	        record_ttl
+//	        min_ttl 30s
+//	        max_ttl 1h
+//	        cache_jitter 10%
+//	        cache redis {
+//	            address localhost:6379
+//	        }
+//	        persist
+//	        resolvers 10.0.0.53:53 https://cloudflare-dns.com/dns-query tls://9.9.9.9
+//	        resolver_tls {
+//	            server_name dns.quad9.net
+//	            ca /etc/ssl/dns-ca.pem
+//	        }
+//	        require_authenticated_data
+//	        txt_label _links
+//	        txt_label_only
+//	        lenient_txt [whitespace] [slash] [namespace]
+//	        txt_extensions
+//	        lookup_timeout 2s
+//	        lookup_retries 2 100ms
+//	        grace 1h
+//	        max_redirects 4
+//	        apex_fallback [<label>...]
+//	        walk_parents 2
+//	        namespace_priority ipfs swarm
+//	        namespaces ipfs ipns swarm
+//	        max_concurrent_lookups 256
+//	        max_record_size 2048
+//	        max_identifier_length 1024
+//	        max_links 64
+//	        allow_hosts .example.com *.dweb.example
+//	        deny_hosts internal.example.com
+//	        rate_limit {
+//	            per_client 30
+//	            per_host 10
+//	            window 1m
+//	        }
+//	        static staging.example.com /ipfs/QmXyz
+//	        fallback example.com /ipfs/QmKnownGood
+//	        lookup_domain preview.internal mysite.example.org
+//	        alias_domains example.org legacy.example.org example.net
+//	        mappings_file /etc/caddy/dnslink-mappings.json 5s
+//	        preload example.com example.org
+//	        preload_file /etc/caddy/dnslink-preload.txt
+//	        audit_log
+//	        history {
+//	            max_entries 20
+//	            max_hosts 10000
+//	            persist
+//	        }
+//	        watch example.com {
+//	            interval 5m
+//	            webhook https://hooks.internal/dnslink
+//	            header Authorization "Bearer {env.WEBHOOK_TOKEN}"
+//	        }
+//	        pin kubo http://ipfs:5001 {
+//	            hosts .example.com
+//	            token {env.PINNING_TOKEN}
+//	            timeout 10m
+//	        }
+//	        cache_purge http://varnish:8080 {
+//	            method BAN
+//	            hosts .example.com
+//	            header X-Purge-Token {env.PURGE_TOKEN}
+//	            timeout 10s
+//	        }
+//	        probe http://ipfs:8080 {
+//	            namespaces ipfs ipns
+//	            timeout 5s
+//	        }
+//	        publish {
+//	            dns cloudflare {env.CLOUDFLARE_API_TOKEN}
+//	            zones example.com
+//	            ttl 1m
+//	        }
+//	        remote https://resolver.internal/resolve {
+//	            header Authorization "Bearer {env.DNSLINK_TOKEN}"
+//	        }
+//	        ipns http://127.0.0.1:5001 {
+//	            cache_ttl 30s
+//	        }
+//	        chain {
+//	            dns 10.0.0.53 {
+//	                timeout 500ms
+//	            }
+//	            remote https://resolver.internal/resolve
+//	            file /etc/caddy/dnslink-mappings.json
+//	        }
+//	        on_miss 404
+//	        on_error 502
+//	        error_page /etc/caddy/dnslink-error.html
+//	        error_json
+//	    }
+//	}
+func parseGlobalOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(App)
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "dnslink",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// ResolverTLS configures TLS for DNS-over-TLS resolvers.
+type ResolverTLS struct {
+	// ServerName overrides the name used for SNI and certificate
+	// verification. Default is the host part of the resolver address.
+	ServerName string `json:"server_name,omitempty"`
+
+	// CAFiles are PEM files with the root certificates to trust instead
+	// of the system pool.
+	CAFiles []string `json:"ca_files,omitempty"`
+}
+
+// tlsConfig builds the TLS configuration template. A nil receiver yields
+// a nil config, meaning defaults.
+func (rt *ResolverTLS) tlsConfig() (*tls.Config, error) {
+	if rt == nil {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: rt.ServerName, MinVersion: tls.VersionTLS12}
+	if len(rt.CAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, file := range rt.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddy.Provisioner     = (*App)(nil)
+	_ caddy.Validator       = (*App)(nil)
+	_ caddy.CleanerUpper    = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
@@ -0,0 +1,527 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestGlobalOption(t *testing.T) {
+	input := `{
+		dnslink {
+			cache_ttl 10m
+			cache_ttl /ipns 30s
+			persist
+		}
+		order dnslink before reverse_proxy
+	}
+
+	:80 {
+		dnslink {
+			proxies {
+				/ipfs ipfs:8080
+			}
+		}
+	}`
+
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt() error = %v", err)
+	}
+
+	var cfg caddy.Config
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatalf("decoding adapted config: %v", err)
+	}
+	raw, ok := cfg.AppsRaw["dnslink"]
+	if !ok {
+		t.Fatalf("adapted config has no dnslink app: %s", out)
+	}
+
+	var app App
+	if err := json.Unmarshal(raw, &app); err != nil {
+		t.Fatalf("decoding dnslink app: %v", err)
+	}
+	if time.Duration(app.CacheTTL) != 10*time.Minute {
+		t.Errorf("CacheTTL = %v, want 10m", time.Duration(app.CacheTTL))
+	}
+	if ttl := time.Duration(app.PrefixCacheTTL["/ipns"]); ttl != 30*time.Second {
+		t.Errorf("PrefixCacheTTL[/ipns] = %v, want 30s", ttl)
+	}
+	if !app.Persist {
+		t.Error("Persist = false, want true")
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	// A nameserver that never answers.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	a := &App{
+		Resolvers:     []string{pc.LocalAddr().String()},
+		LookupTimeout: caddy.Duration(100 * time.Millisecond),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+	}
+	if a.lookup, err = a.newLookup(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	entry, _, err := a.resolve(context.Background(), "example.com")
+	if err != nil || entry.Namespace != "" {
+		t.Errorf("resolve() = %+v, %v, want no link and no error", entry, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("resolve() took %v, want it bounded by lookup_timeout", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := a.resolve(ctx, "example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("resolve() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDNSLinkRedirects(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	records := map[string]string{
+		"_dnslink.a.example.com":     "dnslink=/dnslink/b.example.com",
+		"_dnslink.b.example.com":     "dnslink=/dnslink/c.example.com/ignored/path",
+		"_dnslink.c.example.com":     "dnslink=/ipfs/QmTarget",
+		"_dnslink.loop1.example.com": "dnslink=/dnslink/loop2.example.com",
+		"_dnslink.loop2.example.com": "dnslink=/dnslink/LOOP1.example.com",
+	}
+	a := &App{
+		MaxRedirects:  2,
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if txt, ok := records[strings.ToLower(name)]; ok {
+				return []dnslinkpkg.LookupEntry{{Value: txt}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+
+	tests := []struct {
+		host       string
+		identifier string
+	}{
+		{host: "a.example.com", identifier: "QmTarget"},
+		{host: "loop1.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			entry, _, err := a.resolve(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if entry.Identifier != tt.identifier {
+				t.Errorf("resolve() identifier = %q, want %q", entry.Identifier, tt.identifier)
+			}
+		})
+	}
+
+	a.MaxRedirects = 1
+	if _, _, _, err := a.resolveHost(context.Background(), "a.example.com"); err == nil {
+		t.Error("resolveHost() beyond max_redirects succeeded, want error")
+	}
+}
+
+func TestSelectLink(t *testing.T) {
+	links := dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+		"swarm": {{Identifier: "abc123"}},
+		"ipfs":  {{Identifier: "QmXyz"}},
+		"ipns":  {},
+	}}
+	tests := []struct {
+		name      string
+		priority  []string
+		namespace string
+	}{
+		{name: "alphabetical without priority", namespace: "ipfs"},
+		{name: "priority wins", priority: []string{"swarm", "ipfs"}, namespace: "swarm"},
+		{name: "skips namespaces without links", priority: []string{"ipns", "arweave", "swarm"}, namespace: "swarm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				if ns, _ := selectLink(links, tt.priority); ns != tt.namespace {
+					t.Fatalf("selectLink() namespace = %q, want %q", ns, tt.namespace)
+				}
+			}
+		})
+	}
+	if ns, id := selectLink(dnslinkpkg.Result{}, nil); ns != "" || id != "" {
+		t.Errorf("selectLink(empty) = %q, %q, want no link", ns, id)
+	}
+}
+
+func TestApexFallback(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	records := map[string]string{
+		"_dnslink.example.com":     "dnslink=/ipfs/QmApex",
+		"_dnslink.www.own.example": "dnslink=/ipfs/QmOwn",
+		"_dnslink.own.example":     "dnslink=/ipfs/QmApexOfOwn",
+		"_dnslink.com":             "dnslink=/ipfs/QmTLD",
+	}
+	a := &App{
+		ApexFallback:  []string{"www", "app"},
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if txt, ok := records[name]; ok {
+				return []dnslinkpkg.LookupEntry{{Value: txt}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+
+	tests := []struct {
+		host       string
+		identifier string
+	}{
+		{host: "www.example.com", identifier: "QmApex"},
+		{host: "app.example.com", identifier: "QmApex"},
+		{host: "www.own.example", identifier: "QmOwn"},
+		{host: "blog.example.com"},
+		{host: "www.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			entry, _, err := a.resolve(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if entry.Identifier != tt.identifier {
+				t.Errorf("resolve() identifier = %q, want %q", entry.Identifier, tt.identifier)
+			}
+		})
+	}
+}
+
+func TestWalkParents(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var lookups []string
+	a := &App{
+		WalkParents:   2,
+		CacheTTL:      caddy.Duration(time.Minute),
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if strings.HasPrefix(name, "_dnslink.") {
+				lookups = append(lookups, name)
+			}
+			if name == "_dnslink.example.com" {
+				return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmParent"}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+
+	tests := []struct {
+		host       string
+		identifier string
+		lookups    int
+	}{
+		{host: "a.b.example.com", identifier: "QmParent", lookups: 3},
+		{host: "c.example.com", identifier: "QmParent", lookups: 1}, // parent level is cached
+		{host: "x.y.z.example.com", lookups: 3},                     // deeper than walk_parents
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			lookups = nil
+			entry, _, err := a.resolve(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if entry.Identifier != tt.identifier {
+				t.Errorf("resolve() identifier = %q, want %q", entry.Identifier, tt.identifier)
+			}
+			if len(lookups) != tt.lookups {
+				t.Errorf("lookups = %v, want %d", lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestGrace(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	now := time.Now()
+	a := &App{
+		Grace:  caddy.Duration(time.Hour),
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if strings.HasSuffix(name, "missing.example.com") {
+				return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(dns.RcodeServerFailure, name)
+		},
+	}
+	seen := map[string]time.Time{
+		"down.example.com":    now.Add(-10 * time.Minute),
+		"ending.example.com":  now.Add(-time.Hour + 5*time.Second),
+		"expired.example.com": now.Add(-2 * time.Hour),
+		"missing.example.com": now.Add(-time.Minute),
+	}
+	for host, expiresAt := range seen {
+		a.lastSeen.Store(host, CacheEntry{Namespace: "ipfs", Identifier: "QmLastKnown", ExpiresAt: expiresAt})
+	}
+
+	tests := []struct {
+		host      string
+		wantStale bool
+		maxExpiry time.Duration
+	}{
+		{host: "down.example.com", wantStale: true, maxExpiry: graceRetryInterval},
+		{host: "ending.example.com", wantStale: true, maxExpiry: 5 * time.Second},
+		{host: "expired.example.com"},
+		{host: "missing.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			entry, _, err := a.resolve(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if stale := entry.Identifier == "QmLastKnown"; stale != tt.wantStale {
+				t.Fatalf("resolve() = %+v, want stale %v", entry, tt.wantStale)
+			}
+			if !tt.wantStale {
+				return
+			}
+			if time.Until(entry.ExpiresAt) > tt.maxExpiry {
+				t.Errorf("stale entry expires in %v, want at most %v", time.Until(entry.ExpiresAt), tt.maxExpiry)
+			}
+			if cached, ok, _ := a.cache.Load(context.Background(), tt.host); !ok || cached.Identifier != "QmLastKnown" {
+				t.Error("stale entry was not cached until the next retry")
+			}
+		})
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	now := time.Now()
+	a := &App{
+		Grace:  caddy.Duration(time.Hour),
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+	}
+	current := CacheEntry{Namespace: "ipfs", Identifier: "QmLastKnown", ExpiresAt: now.Add(-time.Minute)}
+	forgotten := CacheEntry{Namespace: "ipfs", Identifier: "QmForgotten", ExpiresAt: now.Add(-2*time.Hour - time.Minute)}
+
+	a.seen("forgotten.example.com", forgotten, now)
+	if _, ok := a.lastSeenEntry("forgotten.example.com", now); ok {
+		t.Error("last resolution retained past its grace and retention")
+	}
+	if prev, ok := a.seen("forgotten.example.com", current, now); ok {
+		t.Errorf("seen() returned forgotten resolution %+v", prev)
+	}
+
+	a.seen("evicted.example.com", current, now)
+	if err := a.evict(context.Background(), "Evicted.example.com."); err != nil {
+		t.Fatalf("evict() error = %v", err)
+	}
+	if _, ok := a.graceEntry("evicted.example.com", now); ok {
+		t.Error("grace serves an evicted host's last resolution")
+	}
+
+	a.seen("purged.example.com", current, now)
+	if err := a.purge(context.Background()); err != nil {
+		t.Fatalf("purge() error = %v", err)
+	}
+	if _, ok := a.graceEntry("purged.example.com", now); ok {
+		t.Error("grace serves a purged host's last resolution")
+	}
+
+	for i := 0; i < minMemorySweep; i++ {
+		a.seen(fmt.Sprintf("old%d.example.com", i), forgotten, now)
+	}
+	a.seen("current.example.com", current, now)
+	var hosts []string
+	a.lastSeen.Range(func(host, _ any) bool {
+		hosts = append(hosts, host.(string))
+		return true
+	})
+	if len(hosts) != 1 || hosts[0] != "current.example.com" {
+		t.Errorf("lastSeen holds %v after sweeping, want [current.example.com]", hosts)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	a := &App{
+		CacheTTL:       caddy.Duration(10 * time.Minute),
+		PrefixCacheTTL: map[string]caddy.Duration{"/ipns": caddy.Duration(30 * time.Second)},
+	}
+	tests := []struct {
+		namespace string
+		want      time.Duration
+	}{
+		{namespace: "ipns", want: 30 * time.Second},
+		{namespace: "swarm", want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			if got := a.cacheTTL(tt.namespace); got != tt.want {
+				t.Errorf("cacheTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryTTL(t *testing.T) {
+	a := &App{
+		CacheTTL:       caddy.Duration(10 * time.Minute),
+		PrefixCacheTTL: map[string]caddy.Duration{"/ipns": caddy.Duration(30 * time.Second)},
+		RecordTTL:      true,
+		MinTTL:         caddy.Duration(time.Minute),
+		MaxTTL:         caddy.Duration(time.Hour),
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		ttls      []uint32
+		want      time.Duration
+	}{
+		{name: "lowest record ttl", namespace: "ipfs", ttls: []uint32{600, 300}, want: 5 * time.Minute},
+		{name: "clamped to min_ttl", namespace: "ipfs", ttls: []uint32{0}, want: time.Minute},
+		{name: "clamped to max_ttl", namespace: "ipfs", ttls: []uint32{604800}, want: time.Hour},
+		{name: "prefix override", namespace: "ipns", ttls: []uint32{600}, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries dnslinkpkg.NamespaceEntries
+			for _, ttl := range tt.ttls {
+				entries = append(entries, dnslinkpkg.NamespaceEntry{Identifier: "id", Ttl: ttl})
+			}
+			result := dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{tt.namespace: entries}}
+			if got := a.entryTTL(result, tt.namespace); got != tt.want {
+				t.Errorf("entryTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	a := &App{CacheJitter: 0.1}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		got := a.jitter(time.Minute)
+		if got > time.Minute || got < 54*time.Second {
+			t.Fatalf("jitter() = %v, want between 54s and 1m", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter() returned the same duration every time")
+	}
+	if got := new(App).jitter(time.Minute); got != time.Minute {
+		t.Errorf("jitter() without cache_jitter = %v, want 1m", got)
+	}
+}
+
+func TestAppValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     *App
+		wantErr bool
+	}{
+		{name: "valid", app: &App{CacheTTL: caddy.Duration(time.Minute), RecordTTL: true, MinTTL: caddy.Duration(time.Second), Resolvers: []string{"tls://9.9.9.9"}, ResolverTLS: &ResolverTLS{}}},
+		{name: "negative cache_ttl", app: &App{CacheTTL: -1}, wantErr: true},
+		{name: "bad prefix cache_ttl", app: &App{PrefixCacheTTL: map[string]caddy.Duration{"ipns": 1}}, wantErr: true},
+		{name: "min_ttl without record_ttl", app: &App{MinTTL: caddy.Duration(time.Second)}, wantErr: true},
+		{name: "min_ttl above max_ttl", app: &App{RecordTTL: true, MinTTL: 2, MaxTTL: 1}, wantErr: true},
+		{name: "jitter out of range", app: &App{CacheJitter: 1}, wantErr: true},
+		{name: "negative grace", app: &App{Grace: -1}, wantErr: true},
+		{name: "backoff without retries", app: &App{RetryBackoff: caddy.Duration(time.Second)}, wantErr: true},
+		{name: "resolver_tls without tls resolver", app: &App{Resolvers: []string{"10.0.0.53"}, ResolverTLS: &ResolverTLS{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.app.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	core, logs := observer.New(zap.InfoLevel)
+	a := &App{
+		AuditLog:      true,
+		Static:        map[string]string{"static.example.com": "/ipfs/QmStatic"},
+		CacheTTL:      caddy.Duration(time.Minute),
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		auditLogger:   zap.New(core),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if name == "_dnslink.example.com" {
+				return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmSite"}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"example.com", "example.com", "static.example.com", "missing.example.com"} {
+		if _, _, err := a.resolve(context.Background(), host); err != nil {
+			t.Fatalf("resolve(%s) error = %v", host, err)
+		}
+	}
+
+	want := []struct{ host, outcome, source, identifier string }{
+		{"example.com", outcomeMiss, "dns", "QmSite"},
+		{"example.com", outcomeHit, "cache", "QmSite"},
+		{"static.example.com", outcomeStatic, "static", "QmStatic"},
+		{"missing.example.com", outcomeNoLink, "dns", ""},
+	}
+	entries := logs.All()
+	if len(entries) != len(want) {
+		t.Fatalf("logged %d resolutions, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		fields := entries[i].ContextMap()
+		if fields["host"] != w.host || fields["outcome"] != w.outcome || fields["source"] != w.source {
+			t.Errorf("entry %d = %v, want %s %s from %s", i, fields, w.host, w.outcome, w.source)
+		}
+		if id, _ := fields["identifier"].(string); id != w.identifier {
+			t.Errorf("entry %d identifier = %q, want %q", i, id, w.identifier)
+		}
+		if _, ok := fields["latency"]; !ok {
+			t.Errorf("entry %d has no latency", i)
+		}
+	}
+}
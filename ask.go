@@ -0,0 +1,164 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(new(Ask))
+	caddy.RegisterModule(new(Permission))
+	httpcaddyfile.RegisterHandlerDirective("dnslink_ask", parseAskCaddyfile)
+}
+
+// Ask is a handler for Caddy's on_demand_tls ask endpoint. It answers
+// `GET /?domain=example.com` with 200 if the domain has a DNSLink record in
+// one of the configured namespaces and with 404 otherwise, so certificates
+// are only issued for domains that are actually served.
+type Ask struct {
+	// Namespaces lists the namespaces a domain needs a link in, e.g.
+	// "ipfs". If empty, a link in any namespace is enough.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	app *App
+}
+
+func (*Ask) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.dnslink_ask",
+		New: func() caddy.Module { return new(Ask) },
+	}
+}
+
+func (a *Ask) Provision(ctx caddy.Context) error {
+	appIface, err := ctx.App("dnslink")
+	if err != nil {
+		return fmt.Errorf("getting dnslink app: %v", err)
+	}
+	a.app = appIface.(*App)
+	return nil
+}
+
+func (a *Ask) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing domain query parameter"))
+	}
+
+	entry, _, err := a.app.resolve(r.Context(), domain)
+	if err != nil {
+		return err
+	}
+	if !hasLinkIn(entry, a.Namespaces) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// hasLinkIn reports whether entry has a link in one of namespaces, or in
+// any namespace if namespaces is empty.
+func hasLinkIn(entry CacheEntry, namespaces []string) bool {
+	if len(namespaces) == 0 {
+		return entry.Namespace != ""
+	}
+	for _, ns := range namespaces {
+		if len(entry.Links[ns]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAskCaddyfile parses the dnslink_ask directive.
+// Syntax:
+//
+//	dnslink_ask [<namespace>...]
+func parseAskCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	a := new(Ask)
+	for h.Next() {
+		for _, ns := range h.RemainingArgs() {
+			a.Namespaces = append(a.Namespaces, strings.Trim(ns, "/"))
+		}
+		if h.NextBlock(0) {
+			return nil, h.Errf("unknown subdirective '%s'", h.Val())
+		}
+	}
+	return a, nil
+}
+
+// Permission is an on-demand TLS permission module that allows
+// certificates only for domains with a DNSLink record in one of the
+// configured namespaces. It makes the same decision as Ask, but inside the
+// TLS app without an HTTP round trip.
+type Permission struct {
+	// Namespaces lists the namespaces a domain needs a link in. If
+	// empty, a link in any namespace is enough.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	app *App
+}
+
+func (*Permission) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.permission.dnslink",
+		New: func() caddy.Module { return new(Permission) },
+	}
+}
+
+func (p *Permission) Provision(ctx caddy.Context) error {
+	appIface, err := ctx.App("dnslink")
+	if err != nil {
+		return fmt.Errorf("getting dnslink app: %v", err)
+	}
+	p.app = appIface.(*App)
+	return nil
+}
+
+func (p *Permission) CertificateAllowed(ctx context.Context, name string) error {
+	entry, _, err := p.app.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !hasLinkIn(entry, p.Namespaces) {
+		return fmt.Errorf("%s: %w: no DNSLink record", name, caddytls.ErrPermissionDenied)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the permission module from Caddyfile tokens.
+// Syntax:
+//
+//	permission dnslink [<namespace>...]
+func (p *Permission) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for _, ns := range d.RemainingArgs() {
+			p.Namespaces = append(p.Namespaces, strings.Trim(ns, "/"))
+		}
+		if d.NextBlock(0) {
+			return d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Ask)(nil)
+	_ caddy.Provisioner           = (*Ask)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Ask)(nil)
+
+	_ caddy.Module                = (*Permission)(nil)
+	_ caddy.Provisioner           = (*Permission)(nil)
+	_ caddytls.OnDemandPermission = (*Permission)(nil)
+	_ caddyfile.Unmarshaler       = (*Permission)(nil)
+)
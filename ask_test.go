@@ -0,0 +1,81 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestAsk(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	app := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	_ = app.cache.Store(context.Background(), "ipfs.example.com", CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmXyz789",
+		Links:      map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmXyz789"}}},
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+	_ = app.cache.Store(context.Background(), "swarm.example.com", CacheEntry{
+		Namespace:  "swarm",
+		Identifier: "abc123",
+		Links:      map[string]dnslinkpkg.NamespaceEntries{"swarm": {{Identifier: "abc123"}}},
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+
+	tests := []struct {
+		namespaces []string
+		domain     string
+		want       int
+	}{
+		{domain: "ipfs.example.com", want: http.StatusOK},
+		{domain: "swarm.example.com", want: http.StatusOK},
+		{domain: "nolink.example.com", want: http.StatusNotFound},
+		{namespaces: []string{"ipfs"}, domain: "ipfs.example.com", want: http.StatusOK},
+		{namespaces: []string{"ipfs"}, domain: "swarm.example.com", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		ask := &Ask{Namespaces: tt.namespaces, app: app}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?domain="+tt.domain, nil)
+		if err := ask.ServeHTTP(rec, req, nil); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("ask %v for %s = %d, want %d", tt.namespaces, tt.domain, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestPermission(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	app := &App{cache: new(MemoryCache), logger: zap.NewNop()}
+	_ = app.cache.Store(context.Background(), "ipfs.example.com", CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmXyz789",
+		Links:      map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmXyz789"}}},
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+	p := &Permission{Namespaces: []string{"swarm"}, app: app}
+	if err := p.CertificateAllowed(context.Background(), "ipfs.example.com"); !errors.Is(err, caddytls.ErrPermissionDenied) {
+		t.Errorf("CertificateAllowed() error = %v, want %v", err, caddytls.ErrPermissionDenied)
+	}
+	p.Namespaces = []string{"ipfs"}
+	if err := p.CertificateAllowed(context.Background(), "ipfs.example.com"); err != nil {
+		t.Errorf("CertificateAllowed() error = %v, want nil", err)
+	}
+}
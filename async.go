@@ -0,0 +1,219 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// errResolutionPending is returned for resolutions left to the background
+// in async mode.
+var errResolutionPending = errors.New("resolution in progress")
+
+// defaultRetryAfter is the default AsyncResolution RetryAfter.
+const defaultRetryAfter = time.Second
+
+// asyncResultTTL is how long the result of a background resolution is kept
+// for the requests of its host, which matters for results that are not
+// cached, such as hosts without a link.
+const asyncResultTTL = time.Minute
+
+// AsyncResolution answers requests for hosts that are not cached right
+// away, with a 503 and a Retry-After header, while the host is resolved in
+// the background, instead of holding the request open for the lookup. The
+// retries of the client are then served from the cache. Refreshes and
+// requests for subdomain gateway hosts still wait for their resolution.
+type AsyncResolution struct {
+	// Status is the status of the response. Default is 503.
+	Status int `json:"status,omitempty"`
+
+	// RetryAfter is sent in the Retry-After header, rounded up to whole
+	// seconds. Default is 1s.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+
+	// Page is the path of an html/template file rendered as the response,
+	// e.g. a loading page refreshing itself, with the .Status, .Host and
+	// .Message of the response. Default is the handler's error response.
+	Page string `json:"page,omitempty"`
+
+	page *template.Template
+}
+
+// provision validates the configuration and sets the defaults.
+func (a *AsyncResolution) provision() error {
+	if a.Status == 0 {
+		a.Status = http.StatusServiceUnavailable
+	}
+	if a.Status < 400 || a.Status > 599 {
+		return fmt.Errorf("invalid status %d", a.Status)
+	}
+	if a.RetryAfter < 0 {
+		return fmt.Errorf("negative retry_after")
+	}
+	if a.RetryAfter == 0 {
+		a.RetryAfter = caddy.Duration(defaultRetryAfter)
+	}
+	if a.Page != "" {
+		page, err := template.ParseFiles(a.Page)
+		if err != nil {
+			return fmt.Errorf("loading page: %v", err)
+		}
+		a.page = page
+	}
+	return nil
+}
+
+// retryAfter returns the value of the Retry-After header.
+func (a *AsyncResolution) retryAfter() string {
+	return strconv.Itoa(int((time.Duration(a.RetryAfter) + time.Second - 1) / time.Second))
+}
+
+// servePending answers r, a request for host whose resolution is in
+// progress.
+func (d *DNSLink) servePending(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, host string) error {
+	f := failure{
+		Status:  d.Async.Status,
+		Host:    host,
+		Message: "resolving DNSLink for " + host + ", try again shortly",
+	}
+	if traceFrom(r) != nil {
+		return d.fail(w, r, next, f)
+	}
+	w.Header().Set("Retry-After", d.Async.retryAfter())
+	w.Header().Set("Cache-Control", "no-store")
+	if d.Async.page == nil {
+		return d.writeFailure(w, f)
+	}
+	// Render into a buffer so a failing template doesn't leave a
+	// half-written response.
+	var buf bytes.Buffer
+	if err := d.Async.page.Execute(&buf, f); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(f.Status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type asyncKey struct{}
+
+// withAsync returns ctx asking resolveEntry to resolve uncached hosts in
+// the background.
+func withAsync(ctx context.Context) context.Context {
+	return context.WithValue(ctx, asyncKey{}, true)
+}
+
+// asyncRequested reports whether ctx is from withAsync.
+func asyncRequested(ctx context.Context) bool {
+	async, _ := ctx.Value(asyncKey{}).(bool)
+	return async
+}
+
+// pendingResolution is a background resolution of a host. Once done, its
+// result is kept until expiresAt.
+type pendingResolution struct {
+	done      chan struct{}
+	entry     CacheEntry
+	err       error
+	expiresAt time.Time
+}
+
+// resolveAsync returns the result of the background resolution of host if
+// one finished, reporting whether it did. Otherwise it starts one, unless
+// one is in progress already. A result is kept for asyncResultTTL, or
+// until its entry expires if that is sooner, as a cached one would be.
+func (a *App) resolveAsync(host string) (CacheEntry, bool, error) {
+	p := &pendingResolution{done: make(chan struct{})}
+	for {
+		val, running := a.pending.LoadOrStore(host, p)
+		if !running {
+			break
+		}
+		prev := val.(*pendingResolution)
+		select {
+		case <-prev.done:
+			if time.Now().Before(prev.expiresAt) {
+				return prev.entry, true, prev.err
+			}
+			a.pending.CompareAndDelete(host, prev)
+		default:
+			return CacheEntry{}, false, nil
+		}
+	}
+
+	a.resolving.Add(1)
+	go func() {
+		defer a.resolving.Done()
+		p.entry, p.err = a.resolveLive(a.ctx, host)
+		ttl := asyncResultTTL
+		if !p.entry.ExpiresAt.IsZero() {
+			ttl = min(ttl, time.Until(p.entry.ExpiresAt))
+		}
+		p.expiresAt = time.Now().Add(ttl)
+		close(p.done)
+		if p.err != nil && a.ctx.Err() == nil {
+			a.logger.Debug("background dnslink resolution failed", zap.String("host", host), zap.Error(p.err))
+		}
+		time.AfterFunc(ttl, func() { a.pending.CompareAndDelete(host, p) })
+	}()
+	return CacheEntry{}, false, nil
+}
+
+// unmarshalAsync parses the async subdirective:
+//
+//	async {
+//	    status <code>
+//	    retry_after <duration>
+//	    page <file>
+//	}
+func unmarshalAsync(d *caddyfile.Dispenser) (*AsyncResolution, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	a := new(AsyncResolution)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "status":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil || status < 400 || status > 599 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			a.Status = status
+		case "retry_after":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			a.RetryAfter = caddy.Duration(dur)
+		case "page":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			a.Page = d.Val()
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return a, nil
+}
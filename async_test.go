@@ -0,0 +1,195 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestAsyncServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	release := make(chan struct{})
+	var lookups atomic.Int32
+	d := &DNSLink{
+		Async: &AsyncResolution{RetryAfter: caddy.Duration(1500 * time.Millisecond)},
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			ctx:      caddy.Context{Context: context.Background()},
+			chain: []Resolver{ResolverFunc(func(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+				lookups.Add(1)
+				<-release
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSlow"}}}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Async.provision(); err != nil {
+		t.Fatal(err)
+	}
+	var passed int
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		passed++
+		return nil
+	})
+	serve := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://slow.example.org/", nil), next); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := serve()
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" || w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("request %d: status %d, headers %v, want 503 with Retry-After 2", i, w.Code, w.Header())
+		}
+	}
+	close(release)
+	d.app.resolving.Wait()
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("lookups = %d, want 1", n)
+	}
+	// The namespace has no upstream, so the resolved request is passed on.
+	if w := serve(); w.Code != http.StatusOK || passed != 1 {
+		t.Errorf("resolved request: status %d, passed on %d times, want it passed on", w.Code, passed)
+	}
+}
+
+func TestResolveAsync(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var lookups atomic.Int32
+	a := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		ctx:    caddy.Context{Context: context.Background()},
+		chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+			lookups.Add(1)
+			return dnslinkpkg.Result{}, nil
+		})},
+	}
+	ctx := withAsync(context.Background())
+	if _, _, err := a.resolveEntry(ctx, "nolink.example.org"); !errors.Is(err, errResolutionPending) {
+		t.Fatalf("resolveEntry() error = %v, want %v", err, errResolutionPending)
+	}
+	a.resolving.Wait()
+	// Nothing is cached without a CacheTTL, so the next requests get the
+	// result of the background resolution until it expires.
+	for i := 0; i < 2; i++ {
+		entry, _, err := a.resolveEntry(ctx, "nolink.example.org")
+		if err != nil || entry.Namespace != "" {
+			t.Errorf("request %d: resolveEntry() = %+v, %v, want no link", i+2, entry, err)
+		}
+	}
+	a.resolving.Wait()
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("lookups = %d, want 1", n)
+	}
+}
+
+func TestResolveAsyncExpiry(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var lookups atomic.Int32
+	a := &App{
+		CacheTTL: caddy.Duration(50 * time.Millisecond),
+		cache:    new(MemoryCache),
+		logger:   zap.NewNop(),
+		ctx:      caddy.Context{Context: context.Background()},
+		chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+			n := lookups.Add(1)
+			if host == "nolink.example.org" {
+				return dnslinkpkg.Result{}, nil
+			}
+			return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: fmt.Sprintf("Qm%d", n)}}}}, nil
+		})},
+	}
+	ctx := withAsync(context.Background())
+	resolve := func(host string) (CacheEntry, error) {
+		t.Helper()
+		entry, _, err := a.resolveEntry(ctx, host)
+		a.resolving.Wait()
+		return entry, err
+	}
+
+	// Once the cached entry expires, the result of the background
+	// resolution that cached it has expired too.
+	if _, err := resolve("example.org"); !errors.Is(err, errResolutionPending) {
+		t.Fatalf("resolveEntry() error = %v, want %v", err, errResolutionPending)
+	}
+	if entry, err := resolve("example.org"); err != nil || entry.Identifier != "Qm1" {
+		t.Fatalf("resolveEntry() = %+v, %v, want Qm1", entry, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if entry, err := resolve("example.org"); !errors.Is(err, errResolutionPending) {
+		t.Errorf("resolveEntry() after the entry expired = %+v, %v, want %v", entry, err, errResolutionPending)
+	}
+	if entry, err := resolve("example.org"); err != nil || entry.Identifier != "Qm2" {
+		t.Errorf("resolveEntry() = %+v, %v, want Qm2", entry, err)
+	}
+
+	// Evicting, purging and refreshing a host drop its uncached result.
+	lookups.Store(0)
+	for name, drop := range map[string]func() error{
+		"evict":   func() error { return a.evict(context.Background(), "nolink.example.org") },
+		"purge":   func() error { return a.purge(context.Background()) },
+		"refresh": func() error { _, err := a.refreshEntry(context.Background(), "nolink.example.org"); return err },
+	} {
+		resolve("nolink.example.org")
+		if _, err := resolve("nolink.example.org"); err != nil {
+			t.Fatalf("%s: resolveEntry() error = %v", name, err)
+		}
+		if err := drop(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := resolve("nolink.example.org"); !errors.Is(err, errResolutionPending) {
+			t.Errorf("%s: resolveEntry() error = %v, want %v", name, err, errResolutionPending)
+		}
+	}
+}
+
+func TestUnmarshalAsync(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`async {
+		status 504
+		retry_after 5s
+		page /etc/caddy/loading.html
+	}`)
+	d.Next()
+	a, err := unmarshalAsync(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != http.StatusGatewayTimeout || a.RetryAfter != caddy.Duration(5*time.Second) || a.Page != "/etc/caddy/loading.html" {
+		t.Errorf("unmarshalAsync() = %+v", a)
+	}
+
+	for _, input := range []string{
+		"async on",
+		"async {\n status ok\n}",
+		"async {\n status 200\n}",
+		"async {\n retry_after 0s\n}",
+		"async {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalAsync(d); err == nil {
+			t.Errorf("unmarshalAsync(%q) succeeded", input)
+		}
+	}
+}
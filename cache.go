@@ -0,0 +1,220 @@
+package dnslink
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func init() {
+	caddy.RegisterModule(new(MemoryCache))
+}
+
+// CacheEntry is a resolved DNSLink result for a single host.
+type CacheEntry struct {
+	// Namespace and Identifier are the link selected for routing.
+	Namespace  string `json:"namespace"`
+	Identifier string `json:"identifier"`
+
+	// Links holds every link found in the host's records, by namespace.
+	Links map[string]dnslinkpkg.NamespaceEntries `json:"links,omitempty"`
+
+	// Extensions holds the key=value extensions of the links, by
+	// /<namespace>/<identifier> link, if txt_extensions is set.
+	Extensions map[string]map[string]string `json:"extensions,omitempty"`
+
+	// CanonicalName is the name the records were found at after
+	// following CNAME records, e.g. gateway.provider.example for a
+	// _dnslink.example.com aliased to it. It is empty if there were none,
+	// or if the resolver followed them without reporting it.
+	CanonicalName string `json:"canonical_name,omitempty"`
+
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// ResolvedAt is when the records were looked up. It is zero for
+	// configured mappings.
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// Expired reports whether the entry is no longer valid at t.
+func (e CacheEntry) Expired(t time.Time) bool {
+	return !t.Before(e.ExpiresAt)
+}
+
+// Cache is a storage backend for resolved DNSLink entries. Backends are
+// loaded as guest modules in the dnslink.cache namespace, which lets
+// multiple Caddy instances share resolutions through an external store.
+type Cache interface {
+	// Load returns the entry for host. The boolean is false if there is
+	// no entry or the entry has expired.
+	Load(ctx context.Context, host string) (CacheEntry, bool, error)
+
+	// Store saves the entry for host until its expiry.
+	Store(ctx context.Context, host string, entry CacheEntry) error
+
+	// Delete removes the entry for host, if any.
+	Delete(ctx context.Context, host string) error
+
+	// Range calls fn for each unexpired entry until fn returns false.
+	Range(ctx context.Context, fn func(host string, entry CacheEntry) bool) error
+
+	// Purge removes all entries.
+	Purge(ctx context.Context) error
+}
+
+// memoryShards is the number of independently locked shards of a
+// MemoryCache. It must be a power of two.
+const memoryShards = 64
+
+// minMemorySweep is the number of entries of a shard at which Store first
+// removes its expired entries.
+const minMemorySweep = 64
+
+// MemoryCache is the default, per-instance cache backend. Hosts are
+// spread over shards with their own locks, so concurrent requests for
+// different hosts rarely contend, and a hit neither allocates nor takes
+// a write lock.
+type MemoryCache struct {
+	shards [memoryShards]memoryShard
+
+	// evictions counts the entries removed before being replaced, whether
+	// expired, deleted or purged.
+	evictions atomic.Uint64
+}
+
+// memoryShard holds the entries of the hosts hashing to it. Expired
+// entries of hosts that are never requested again are removed by Store
+// once the shard has grown to sweepAt entries, which is then set to twice
+// the entries left, so sweeping costs Store a constant time on average.
+type memoryShard struct {
+	mu      sync.RWMutex
+	entries map[string]*memoryEntry
+	sweepAt int
+}
+
+// memoryEntry is a stored entry. It is never modified once stored, and
+// keeps its expiry apart so it can be checked without copying the entry.
+type memoryEntry struct {
+	entry     CacheEntry
+	expiresAt int64 // Unix nanoseconds
+}
+
+func (*MemoryCache) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.cache.memory",
+		New: func() caddy.Module { return new(MemoryCache) },
+	}
+}
+
+// shard returns the shard of host, using an inlined FNV-1a hash so the
+// lookup doesn't allocate.
+func (m *MemoryCache) shard(host string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(host); i++ {
+		h ^= uint32(host[i])
+		h *= 16777619
+	}
+	return &m.shards[h&(memoryShards-1)]
+}
+
+func (m *MemoryCache) Load(_ context.Context, host string) (CacheEntry, bool, error) {
+	s := m.shard(host)
+	s.mu.RLock()
+	e, ok := s.entries[host]
+	s.mu.RUnlock()
+	if !ok {
+		return CacheEntry{}, false, nil
+	}
+	if time.Now().UnixNano() >= e.expiresAt {
+		s.mu.Lock()
+		// Another goroutine may have stored a fresh entry meanwhile.
+		if s.entries[host] == e {
+			delete(s.entries, host)
+			m.evictions.Add(1)
+		}
+		s.mu.Unlock()
+		return CacheEntry{}, false, nil
+	}
+	return e.entry, true, nil
+}
+
+func (m *MemoryCache) Store(_ context.Context, host string, entry CacheEntry) error {
+	e := &memoryEntry{entry: entry, expiresAt: entry.ExpiresAt.UnixNano()}
+	s := m.shard(host)
+	s.mu.Lock()
+	if s.entries == nil {
+		s.entries = make(map[string]*memoryEntry)
+	}
+	if len(s.entries) >= s.sweepAt {
+		now := time.Now().UnixNano()
+		for h, old := range s.entries {
+			if now >= old.expiresAt {
+				delete(s.entries, h)
+				m.evictions.Add(1)
+			}
+		}
+		s.sweepAt = max(2*len(s.entries), minMemorySweep)
+	}
+	s.entries[host] = e
+	s.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryCache) Delete(_ context.Context, host string) error {
+	s := m.shard(host)
+	s.mu.Lock()
+	if _, ok := s.entries[host]; ok {
+		delete(s.entries, host)
+		m.evictions.Add(1)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Range calls fn outside of the shard locks, so fn may modify the cache.
+func (m *MemoryCache) Range(_ context.Context, fn func(host string, entry CacheEntry) bool) error {
+	now := time.Now().UnixNano()
+	type hostEntry struct {
+		host string
+		e    *memoryEntry
+	}
+	var batch []hostEntry
+	for i := range m.shards {
+		s := &m.shards[i]
+		batch = batch[:0]
+		s.mu.RLock()
+		for host, e := range s.entries {
+			if now < e.expiresAt {
+				batch = append(batch, hostEntry{host, e})
+			}
+		}
+		s.mu.RUnlock()
+		for _, he := range batch {
+			if !fn(he.host, he.e.entry) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryCache) Purge(_ context.Context) error {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		m.evictions.Add(uint64(len(s.entries)))
+		s.entries = nil
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module = (*MemoryCache)(nil)
+	_ Cache        = (*MemoryCache)(nil)
+)
@@ -0,0 +1,187 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	caddy.RegisterModule(new(RedisCache))
+}
+
+// RedisCache is a cache backend that stores entries in Redis so that a
+// fleet of Caddy instances shares resolutions and purges.
+type RedisCache struct {
+	// Address is the host:port of the Redis server. Default is "localhost:6379".
+	Address string `json:"address,omitempty"`
+
+	// Username and Password are used to authenticate with Redis. Global
+	// placeholders in Password, such as {env.REDIS_PASSWORD}, are expanded.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// DB is the Redis database number.
+	DB int `json:"db,omitempty"`
+
+	// KeyPrefix is prepended to every key. Default is "dnslink:".
+	KeyPrefix string `json:"key_prefix,omitempty"`
+
+	client redis.UniversalClient
+}
+
+func (*RedisCache) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.cache.redis",
+		New: func() caddy.Module { return new(RedisCache) },
+	}
+}
+
+func (c *RedisCache) Provision(ctx caddy.Context) error {
+	if c.Address == "" {
+		c.Address = "localhost:6379"
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = "dnslink:"
+	}
+	password := caddy.NewReplacer().ReplaceAll(c.Password, "")
+	if c.Password != "" && password == "" {
+		return fmt.Errorf("password '%s' is empty", c.Password)
+	}
+	c.client = redis.NewClient(&redis.Options{
+		Addr:     c.Address,
+		Username: c.Username,
+		Password: password,
+		DB:       c.DB,
+	})
+	return nil
+}
+
+func (c *RedisCache) Cleanup() error {
+	return c.client.Close()
+}
+
+func (c *RedisCache) Load(ctx context.Context, host string) (CacheEntry, bool, error) {
+	data, err := c.client.Get(ctx, c.KeyPrefix+host).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return CacheEntry{}, false, nil
+	}
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return CacheEntry{}, false, err
+	}
+	if entry.Expired(time.Now()) {
+		return CacheEntry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+func (c *RedisCache) Store(ctx context.Context, host string, entry CacheEntry) error {
+	ttl := time.Until(entry.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, c.KeyPrefix+host, data, ttl).Err()
+}
+
+func (c *RedisCache) Delete(ctx context.Context, host string) error {
+	return c.client.Del(ctx, c.KeyPrefix+host).Err()
+}
+
+func (c *RedisCache) Range(ctx context.Context, fn func(host string, entry CacheEntry) bool) error {
+	now := time.Now()
+	iter := c.client.Scan(ctx, 0, c.KeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		data, err := c.client.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// expired between SCAN and GET
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Expired(now) {
+			continue
+		}
+		if !fn(strings.TrimPrefix(key, c.KeyPrefix), entry) {
+			return nil
+		}
+	}
+	return iter.Err()
+}
+
+func (c *RedisCache) Purge(ctx context.Context) error {
+	iter := c.client.Scan(ctx, 0, c.KeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// UnmarshalCaddyfile sets up the cache backend from Caddyfile tokens.
+// Syntax:
+//
+//	redis {
+//	    address  localhost:6379
+//	    username <username>
+//	    password <password>
+//	    db       0
+//	    key_prefix dnslink:
+//	}
+func (c *RedisCache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			key := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch key {
+			case "address":
+				c.Address = d.Val()
+			case "username":
+				c.Username = d.Val()
+			case "password":
+				c.Password = d.Val()
+			case "db":
+				db, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid db number '%s': %v", d.Val(), err)
+				}
+				c.DB = db
+			case "key_prefix":
+				c.KeyPrefix = d.Val()
+			default:
+				return d.Errf("unknown subdirective '%s'", key)
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*RedisCache)(nil)
+	_ caddy.Provisioner     = (*RedisCache)(nil)
+	_ caddy.CleanerUpper    = (*RedisCache)(nil)
+	_ caddyfile.Unmarshaler = (*RedisCache)(nil)
+	_ Cache                 = (*RedisCache)(nil)
+)
@@ -0,0 +1,179 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is a Redis client keeping values in memory, for the commands
+// RedisCache uses. Scan only matches patterns of a prefix and "*", and
+// returns all the keys at once.
+type fakeRedis struct {
+	redis.UniversalClient
+
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: make(map[string]string), ttls: make(map[string]time.Duration)}
+}
+
+func (f *fakeRedis) Get(_ context.Context, key string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val, ok := f.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(val, nil)
+}
+
+func (f *fakeRedis) Set(_ context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = string(value.([]byte))
+	f.ttls[key] = expiration
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) Del(_ context.Context, keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := f.values[key]; ok {
+			delete(f.values, key)
+			delete(f.ttls, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (f *fakeRedis) Scan(_ context.Context, _ uint64, match string, _ int64) *redis.ScanCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.values {
+		if strings.HasPrefix(key, strings.TrimSuffix(match, "*")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return redis.NewScanCmdResult(keys, 0, nil)
+}
+
+func (f *fakeRedis) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeRedis()
+	c := &RedisCache{KeyPrefix: "dnslink:", client: fake}
+
+	want := CacheEntry{Namespace: "ipfs", Identifier: "QmXyz789", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := c.Store(ctx, "example.com", want); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if got := fake.keys(); !reflect.DeepEqual(got, []string{"dnslink:example.com"}) {
+		t.Errorf("keys = %v, want [dnslink:example.com]", got)
+	}
+	if ttl := fake.ttls["dnslink:example.com"]; ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL = %v, want the minute left until the entry expires", ttl)
+	}
+	got, ok, err := c.Load(ctx, "example.com")
+	if err != nil || !ok || got.Identifier != want.Identifier || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("Load() = %+v, %v, %v, want %+v, true", got, ok, err, want)
+	}
+	if err := c.Store(ctx, "expired.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOld", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("Store() of an expired entry error = %v", err)
+	}
+	if _, ok := fake.values["dnslink:expired.example.com"]; ok {
+		t.Error("Store() wrote an expired entry")
+	}
+
+	// Entries another instance stored are kept by Redis until their TTL,
+	// which may be past the expiry as seen here, and keys may hold values
+	// written by another version or outside the prefix.
+	stale, _ := json.Marshal(CacheEntry{Namespace: "ipfs", Identifier: "QmOld", ExpiresAt: time.Now().Add(-time.Second)})
+	fake.values["dnslink:stale.example.com"] = string(stale)
+	fake.values["dnslink:garbled.example.com"] = "not json"
+	fake.values["other:example.org"] = fake.values["dnslink:example.com"]
+
+	var hosts []string
+	if err := c.Range(ctx, func(host string, _ CacheEntry) bool {
+		hosts = append(hosts, host)
+		return true
+	}); err != nil {
+		t.Fatalf("Range() error = %v", err)
+	}
+	if !reflect.DeepEqual(hosts, []string{"example.com"}) {
+		t.Errorf("Range() hosts = %v, want [example.com]", hosts)
+	}
+	if _, ok, _ := c.Load(ctx, "stale.example.com"); ok {
+		t.Error("Load() returned an expired entry")
+	}
+
+	if err := c.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok, _ := c.Load(ctx, "example.com"); ok {
+		t.Error("expected deleted entry to miss")
+	}
+
+	if err := c.Purge(ctx); err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	if got := fake.keys(); !reflect.DeepEqual(got, []string{"other:example.org"}) {
+		t.Errorf("keys after Purge() = %v, want only [other:example.org] outside the prefix", got)
+	}
+}
+
+func TestRedisCachePassword(t *testing.T) {
+	t.Setenv("DNSLINK_TEST_REDIS_PASSWORD", "s3cret")
+	tests := []struct {
+		password string
+		want     string
+		wantErr  bool
+	}{
+		{password: "", want: ""},
+		{password: "plain", want: "plain"},
+		{password: "{env.DNSLINK_TEST_REDIS_PASSWORD}", want: "s3cret"},
+		{password: "{env.DNSLINK_TEST_REDIS_UNSET}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			c := &RedisCache{Password: tt.password}
+			err := c.Provision(caddy.Context{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer c.Cleanup()
+			if got := c.client.(*redis.Client).Options().Password; got != tt.want {
+				t.Errorf("password = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	c := new(MemoryCache)
+
+	if _, ok, _ := c.Load(ctx, "example.com"); ok {
+		t.Fatal("expected empty cache to miss")
+	}
+
+	want := CacheEntry{Namespace: "ipfs", Identifier: "QmXyz789", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := c.Store(ctx, "example.com", want); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	got, ok, _ := c.Load(ctx, "example.com")
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %+v, %v, want %+v, true", got, ok, want)
+	}
+
+	if err := c.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok, _ := c.Load(ctx, "example.com"); ok {
+		t.Error("expected deleted entry to miss")
+	}
+
+	expired := CacheEntry{Namespace: "swarm", Identifier: "abc123", ExpiresAt: time.Now().Add(-time.Second)}
+	_ = c.Store(ctx, "expired.example.com", expired)
+	if _, ok, _ := c.Load(ctx, "expired.example.com"); ok {
+		t.Error("expected expired entry to miss")
+	}
+}
+
+func TestMemoryCacheRange(t *testing.T) {
+	ctx := context.Background()
+	c := new(MemoryCache)
+	for i := 0; i < 100; i++ {
+		_ = c.Store(ctx, fmt.Sprintf("host%d.example.com", i), CacheEntry{Namespace: "ipfs", ExpiresAt: time.Now().Add(time.Minute)})
+	}
+	_ = c.Store(ctx, "expired.example.com", CacheEntry{Namespace: "ipfs", ExpiresAt: time.Now().Add(-time.Second)})
+
+	var n int
+	err := c.Range(ctx, func(host string, _ CacheEntry) bool {
+		n++
+		// Modifying the cache from fn must not deadlock.
+		return c.Delete(ctx, host) == nil
+	})
+	if err != nil || n != 100 {
+		t.Errorf("Range() visited %d entries, %v, want 100", n, err)
+	}
+	if _, ok, _ := c.Load(ctx, "host1.example.com"); ok {
+		t.Error("expected entry deleted during Range to miss")
+	}
+}
+
+func TestMemoryCacheSweep(t *testing.T) {
+	ctx := context.Background()
+	c := new(MemoryCache)
+	s := c.shard("fresh.example.com")
+
+	// Fill the shard with entries that expire and are never requested
+	// again, and one that doesn't.
+	_ = c.Store(ctx, "fresh.example.com", CacheEntry{Namespace: "ipfs", ExpiresAt: time.Now().Add(time.Minute)})
+	var hosts []string
+	for i := 0; len(hosts) < minMemorySweep; i++ {
+		if host := fmt.Sprintf("host%d.example.com", i); c.shard(host) == s {
+			hosts = append(hosts, host)
+		}
+	}
+	for _, host := range hosts[1:] {
+		_ = c.Store(ctx, host, CacheEntry{Namespace: "ipfs", ExpiresAt: time.Now().Add(-time.Second)})
+	}
+	if len(s.entries) != minMemorySweep {
+		t.Fatalf("shard holds %d entries, want %d", len(s.entries), minMemorySweep)
+	}
+
+	// Storing one more sweeps the expired ones.
+	_ = c.Store(ctx, hosts[0], CacheEntry{Namespace: "ipfs", ExpiresAt: time.Now().Add(time.Minute)})
+	if len(s.entries) != 2 || s.entries["fresh.example.com"] == nil || s.entries[hosts[0]] == nil {
+		t.Errorf("shard holds %d entries after the sweep, want the fresh one and the new one", len(s.entries))
+	}
+	if n := c.evictions.Load(); n != minMemorySweep-1 {
+		t.Errorf("evictions = %d, want %d", n, minMemorySweep-1)
+	}
+}
+
+// syncMapCache is the previous MemoryCache, kept as a benchmark baseline.
+type syncMapCache struct {
+	entries sync.Map
+}
+
+func (m *syncMapCache) Load(_ context.Context, host string) (CacheEntry, bool, error) {
+	val, ok := m.entries.Load(host)
+	if !ok {
+		return CacheEntry{}, false, nil
+	}
+	entry := val.(CacheEntry)
+	if entry.Expired(time.Now()) {
+		m.entries.Delete(host)
+		return CacheEntry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+func (m *syncMapCache) Store(_ context.Context, host string, entry CacheEntry) error {
+	m.entries.Store(host, entry)
+	return nil
+}
+
+// benchmarkCache runs parallel loads over many hosts, with one store for
+// every storeEvery loads.
+func benchmarkCache(b *testing.B, c interface {
+	Load(context.Context, string) (CacheEntry, bool, error)
+	Store(context.Context, string, CacheEntry) error
+}, storeEvery int) {
+	ctx := context.Background()
+	hosts := make([]string, 10000)
+	entry := CacheEntry{Namespace: "ipfs", Identifier: "QmXyz789", ExpiresAt: time.Now().Add(time.Hour)}
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d.example.com", i)
+		_ = c.Store(ctx, hosts[i], entry)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			host := hosts[i%len(hosts)]
+			if storeEvery > 0 && i%storeEvery == 0 {
+				_ = c.Store(ctx, host, entry)
+			} else {
+				_, _, _ = c.Load(ctx, host)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCache(b *testing.B) {
+	for _, storeEvery := range []int{0, 10} {
+		b.Run(fmt.Sprintf("sharded/store_every=%d", storeEvery), func(b *testing.B) {
+			benchmarkCache(b, new(MemoryCache), storeEvery)
+		})
+		b.Run(fmt.Sprintf("sync.Map/store_every=%d", storeEvery), func(b *testing.B) {
+			benchmarkCache(b, new(syncMapCache), storeEvery)
+		})
+	}
+}
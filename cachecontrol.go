@@ -0,0 +1,28 @@
+package dnslink
+
+import (
+	"strconv"
+	"time"
+)
+
+// maxAge returns how long responses for entry may be cached by clients: the
+// prefix's configured override, or else the time until the resolution
+// expires from the cache. Entries without an expiry, such as static
+// mappings, use the cache TTL of their namespace.
+func (d *DNSLink) maxAge(prefix string, entry CacheEntry, now time.Time) time.Duration {
+	if override, ok := d.MaxAge[prefix]; ok {
+		return time.Duration(override)
+	}
+	if entry.ExpiresAt.IsZero() {
+		return d.app.cacheTTL(entry.Namespace)
+	}
+	if remaining := entry.ExpiresAt.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// cacheControl formats a Cache-Control header for public caching for age.
+func cacheControl(age time.Duration) string {
+	return "public, max-age=" + strconv.FormatInt(int64(age/time.Second), 10)
+}
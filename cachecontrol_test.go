@@ -0,0 +1,40 @@
+package dnslink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestMaxAge(t *testing.T) {
+	now := time.Now()
+	d := &DNSLink{
+		MaxAge: map[string]caddy.Duration{"/ipfs": caddy.Duration(24 * time.Hour)},
+		app:    &App{CacheTTL: caddy.Duration(time.Minute)},
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		entry  CacheEntry
+		want   time.Duration
+	}{
+		{name: "override", prefix: "/ipfs", entry: CacheEntry{ExpiresAt: now.Add(time.Second)}, want: 24 * time.Hour},
+		{name: "remaining ttl", prefix: "/swarm", entry: CacheEntry{ExpiresAt: now.Add(30 * time.Second)}, want: 30 * time.Second},
+		{name: "expired", prefix: "/swarm", entry: CacheEntry{ExpiresAt: now.Add(-time.Second)}, want: 0},
+		{name: "no expiry", prefix: "/swarm", entry: CacheEntry{}, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.maxAge(tt.prefix, tt.entry, now); got != tt.want {
+				t.Errorf("maxAge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	if got, want := cacheControl(90*time.Second+500*time.Millisecond), "public, max-age=90"; got != want {
+		t.Errorf("cacheControl() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultPurgeTimeout bounds a purge request by default.
+const defaultPurgeTimeout = 10 * time.Second
+
+// CachePurge asks the HTTP caches in front of the upstreams, such as
+// Varnish, to drop what they hold for a host once its link changes, so the
+// content of the previous root stops being served right after a publish
+// instead of once it expires. A request is sent to each cache with the Host
+// header of the changed host, which the cache's configuration turns into
+// a purge or ban of that host.
+type CachePurge struct {
+	// URLs are those of the caches, e.g. http://varnish:8080. Each is
+	// requested as is, at / if it has no path.
+	URLs []string `json:"urls"`
+
+	// Method is the method of purge requests, e.g. BAN. Default is PURGE.
+	Method string `json:"method,omitempty"`
+
+	// Hosts are the patterns of the hosts purged, as in allow_hosts:
+	// "example.com", "*.example.com" or ".example.com". Default is every
+	// host.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Headers are added to purge requests, e.g. a secret the cache
+	// checks. Values may be global placeholders such as
+	// {env.PURGE_TOKEN}.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Timeout bounds a purge request. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	headers http.Header
+	client  *http.Client
+	logger  *zap.Logger
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	purging sync.WaitGroup
+}
+
+// provision validates the configuration and sets the defaults.
+func (p *CachePurge) provision(logger *zap.Logger) error {
+	if len(p.URLs) == 0 {
+		return fmt.Errorf("no cache urls")
+	}
+	for i, raw := range p.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url '%s'", raw)
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		p.URLs[i] = u.String()
+	}
+	if p.Method == "" {
+		p.Method = "PURGE"
+	}
+	p.Method = strings.ToUpper(p.Method)
+	if p.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = caddy.Duration(defaultPurgeTimeout)
+	}
+	repl := caddy.NewReplacer()
+	p.headers = make(http.Header, len(p.Headers))
+	for name, value := range p.Headers {
+		p.headers.Set(name, repl.ReplaceAll(value, ""))
+	}
+	if p.client == nil {
+		p.client = new(http.Client)
+	}
+	p.logger = logger
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// stop cancels the purge requests in progress and waits for them.
+func (p *CachePurge) stop() {
+	p.cancel()
+	p.purging.Wait()
+}
+
+// purgeChanged purges host from every cache, in the background, if its
+// link changed from prev to entry and it matches Hosts.
+func (p *CachePurge) purgeChanged(host string, entry, prev CacheEntry) {
+	if prev.Namespace == "" || (prev.Namespace == entry.Namespace && prev.Identifier == entry.Identifier) {
+		return
+	}
+	host = mappingKey(host)
+	matched := len(p.Hosts) == 0
+	for _, pattern := range p.Hosts {
+		if matchHost(pattern, host) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+	for _, u := range p.URLs {
+		p.purging.Add(1)
+		go func(u string) {
+			defer p.purging.Done()
+			if err := p.purge(u, host, prev); err != nil {
+				dnslinkMetrics.purges.WithLabelValues(outcomeError).Inc()
+				if p.ctx.Err() == nil {
+					p.logger.Warn("purging http cache", zap.String("host", host), zap.String("cache", u), zap.Error(err))
+				}
+				return
+			}
+			dnslinkMetrics.purges.WithLabelValues(outcomePurged).Inc()
+			p.logger.Info("purged http cache", zap.String("host", host), zap.String("cache", u), zap.String("previous_identifier", prev.Identifier))
+		}(u)
+	}
+}
+
+// purge sends the purge request of host to the cache at u. The previous
+// link is described in the headers of DNSLinkHeaders, for caches banning
+// by content root.
+func (p *CachePurge) purge(u, host string, prev CacheEntry) error {
+	ctx, cancel := context.WithTimeout(p.ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, p.Method, u, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	req.Host = host
+	setDNSLinkHeaders(req.Header, host, prev.Namespace, prev.Identifier)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Caches commonly answer 404 for a purge of nothing cached.
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// unmarshalCachePurge parses the cache_purge option:
+//
+//	cache_purge <url>... {
+//	    method <method>
+//	    hosts <pattern>...
+//	    header <name> <value>
+//	    timeout <duration>
+//	}
+func unmarshalCachePurge(d *caddyfile.Dispenser) (*CachePurge, error) {
+	p := &CachePurge{URLs: d.RemainingArgs()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "method":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			p.Method = d.Val()
+		case "hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return nil, d.ArgErr()
+			}
+			p.Hosts = append(p.Hosts, hosts...)
+			continue
+		case "header":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if p.Headers == nil {
+				p.Headers = make(map[string]string)
+			}
+			p.Headers[name] = d.Val()
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			p.Timeout = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	if len(p.URLs) == 0 {
+		return nil, d.Err("cache_purge needs a cache url")
+	}
+	return p, nil
+}
@@ -0,0 +1,129 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestCachePurge(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var mu sync.Mutex
+	var purged []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "BAN" {
+			t.Errorf("method = %s, want BAN", r.Method)
+		}
+		if got := r.Header.Get("X-Purge-Token"); got != "secret" {
+			t.Errorf("X-Purge-Token = %q, want secret", got)
+		}
+		if got := r.Header.Get(headerDNSLinkIdentifier); got != "old" {
+			t.Errorf("%s = %q, want the previous identifier", headerDNSLinkIdentifier, got)
+		}
+		mu.Lock()
+		purged = append(purged, r.Host)
+		mu.Unlock()
+		// Nothing cached is not a failure.
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := &CachePurge{URLs: []string{srv.URL}, Method: "ban", Hosts: []string{".example.com"}, Headers: map[string]string{"X-Purge-Token": "secret"}}
+	if err := p.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	prev := CacheEntry{Namespace: "ipfs", Identifier: "old"}
+	changed := CacheEntry{Namespace: "ipfs", Identifier: "new"}
+	p.purgeChanged("www.example.com.", changed, prev)
+	p.purgeChanged("example.com", prev, prev)
+	p.purgeChanged("example.org", changed, prev)
+	p.purgeChanged("new.example.com", changed, CacheEntry{})
+	p.purging.Wait()
+	if len(purged) != 1 || purged[0] != "www.example.com" {
+		t.Errorf("purged = %v, want www.example.com only", purged)
+	}
+}
+
+func TestCachePurgeOnChange(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var mu sync.Mutex
+	purges := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		purges++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	p := &CachePurge{URLs: []string{srv.URL}}
+	if err := p.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	var value string
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Second),
+		CachePurge:    p,
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=" + value}}, nil
+		},
+	}
+	for _, v := range []string{"/ipfs/QmOld", "/ipfs/QmOld", "/ipfs/QmNew"} {
+		value = v
+		if _, err := a.resolveLive(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		p.purging.Wait()
+	}
+	if purges != 1 {
+		t.Errorf("purges = %d, want 1 for the change", purges)
+	}
+}
+
+func TestParseCachePurge(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`cache_purge http://varnish:8080 http://varnish-2:8080/purge {
+		method BAN
+		hosts .example.com example.org
+		header X-Purge-Token {env.PURGE_TOKEN}
+		timeout 5s
+	}`)
+	d.Next()
+	p, err := unmarshalCachePurge(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.URLs) != 2 || p.Method != "BAN" || len(p.Hosts) != 2 || p.Headers["X-Purge-Token"] != "{env.PURGE_TOKEN}" {
+		t.Errorf("CachePurge = %+v", p)
+	}
+
+	for _, input := range []string{
+		"cache_purge",
+		"cache_purge http://varnish:8080 {\n timeout soon\n}",
+		"cache_purge http://varnish:8080 {\n header X-Purge-Token\n}",
+		"cache_purge http://varnish:8080 {\n ban\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalCachePurge(d); err == nil {
+			t.Errorf("unmarshalCachePurge(%q) succeeded", input)
+		}
+	}
+	if err := (&CachePurge{URLs: []string{"varnish:8080"}}).provision(zap.NewNop()); err == nil {
+		t.Error("provision() accepted a url without a scheme")
+	}
+}
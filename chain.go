@@ -0,0 +1,295 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func init() {
+	caddy.RegisterModule(new(DNSResolver))
+	caddy.RegisterModule(new(FileResolver))
+}
+
+// Resolver finds the DNSLink links of a host. Resolvers are loaded as
+// guest modules in the dnslink.resolvers namespace and can be chained,
+// each one tried in order until one yields a link. A host without a
+// DNSLink record should be reported as an NXDOMAIN DNSRCodeError or an
+// empty result.
+//
+// A DNSLink handler can also load a resolver module of its own by ID, and
+// Go programs can set a Resolver on it directly. The default, without one,
+// is the dnslink library over DNS, as DNSResolver.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(ctx context.Context, host string) (dnslinkpkg.Result, error)
+
+// Resolve calls f.
+func (f ResolverFunc) Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	return f(ctx, host)
+}
+
+// resolverTimeout is embedded by resolver modules to bound each of their
+// resolutions individually within a chain.
+type resolverTimeout struct {
+	// Timeout bounds a single resolution by this resolver. Default is
+	// to share the app's lookup_timeout with the rest of the chain.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+func (rt resolverTimeout) resolveTimeout() time.Duration { return time.Duration(rt.Timeout) }
+
+// unmarshalTimeout parses the timeout subdirective shared by resolver
+// modules.
+func (rt *resolverTimeout) unmarshalTimeout(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return err
+	}
+	rt.Timeout = caddy.Duration(dur)
+	return nil
+}
+
+// resolveChain tries each resolver in order until one yields a link. If
+// none does, the result is an error if any resolver failed, since a
+// missing link is only certain if every resolver reported it.
+func resolveChain(ctx context.Context, resolvers []Resolver, host string) (dnslinkpkg.Result, error) {
+	var result dnslinkpkg.Result
+	var firstErr error
+	for _, r := range resolvers {
+		res, err := resolveWithTimeout(ctx, r, host)
+		if err == nil && hasLink(res) {
+			return res, nil
+		}
+		var rcodeErr dnslinkpkg.DNSRCodeError
+		switch {
+		case err == nil, errors.As(err, &rcodeErr) && rcodeErr.DNSRCode == rcodeNXDomain:
+			result = res
+		case firstErr == nil:
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr != nil {
+		return dnslinkpkg.Result{}, firstErr
+	}
+	if !hasLink(result) {
+		return result, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	}
+	return result, nil
+}
+
+// resolveWithTimeout runs r, bounded by its own timeout if it has one.
+func resolveWithTimeout(ctx context.Context, r Resolver, host string) (dnslinkpkg.Result, error) {
+	if t, ok := r.(interface{ resolveTimeout() time.Duration }); ok && t.resolveTimeout() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.resolveTimeout())
+		defer cancel()
+	}
+	return r.Resolve(ctx, host)
+}
+
+// hasLink reports whether a result has at least one link.
+func hasLink(result dnslinkpkg.Result) bool {
+	for _, entries := range result.Links {
+		if len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DNSResolver looks up DNSLink TXT records, like the resolvers option of
+// the app. Without resolvers it uses the system resolver.
+type DNSResolver struct {
+	// Resolvers, TLS, RequireAuthenticatedData, TXTLabel, TXTLabelOnly and
+	// LenientTXT are as Resolvers, ResolverTLS, RequireAuthenticatedData,
+	// TXTLabel, TXTLabelOnly and LenientTXT on App.
+	Resolvers                []string     `json:"resolvers,omitempty"`
+	TLS                      *ResolverTLS `json:"tls,omitempty"`
+	RequireAuthenticatedData bool         `json:"require_authenticated_data,omitempty"`
+	TXTLabel                 string       `json:"txt_label,omitempty"`
+	TXTLabelOnly             bool         `json:"txt_label_only,omitempty"`
+	LenientTXT               []string     `json:"lenient_txt,omitempty"`
+	resolverTimeout
+
+	lookup txtLookup
+	parser *txtParser
+}
+
+func (*DNSResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.resolvers.dns",
+		New: func() caddy.Module { return new(DNSResolver) },
+	}
+}
+
+func (r *DNSResolver) Provision(caddy.Context) error {
+	if r.TXTLabel != "" {
+		if err := validateTXTLabel(r.TXTLabel); err != nil {
+			return err
+		}
+	}
+	lookup, err := newTransportLookup(r.Resolvers, r.TLS, r.RequireAuthenticatedData)
+	if err != nil {
+		return err
+	}
+	r.lookup = labelLookup(lookup, r.TXTLabel, r.TXTLabelOnly)
+	r.parser, err = newTXTParser(r.LenientTXT)
+	return err
+}
+
+func (r *DNSResolver) Validate() error {
+	if r.RequireAuthenticatedData {
+		return checkAuthenticatedData(r.Resolvers)
+	}
+	return nil
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	return resolveTXT(ctx, r.lookup, r.parser, host)
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens.
+// Syntax:
+//
+//	dns [<resolvers...>] {
+//	    require_authenticated_data
+//	    txt_label <label>
+//	    txt_label_only
+//	    lenient_txt [<tolerances...>]
+//	    timeout <duration>
+//	}
+func (r *DNSResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		r.Resolvers = append(r.Resolvers, d.RemainingArgs()...)
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "require_authenticated_data":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.RequireAuthenticatedData = true
+			case "require_dnssec":
+				return d.Err(errRenamedRequireDNSSEC)
+			case "txt_label":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.TXTLabel = strings.Trim(d.Val(), ".")
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "txt_label_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.TXTLabelOnly = true
+			case "lenient_txt":
+				r.LenientTXT = d.RemainingArgs()
+				if len(r.LenientTXT) == 0 {
+					r.LenientTXT = txtTolerances
+				}
+				if _, err := newTXTParser(r.LenientTXT); err != nil {
+					return d.Err(err.Error())
+				}
+			case "timeout":
+				if err := r.unmarshalTimeout(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// FileResolver serves the mappings of a file in the format of the app's
+// mappings_file. The file is read once at provisioning.
+type FileResolver struct {
+	// Path is the mappings file.
+	Path string `json:"path"`
+	resolverTimeout
+
+	mappings map[string]CacheEntry
+}
+
+func (*FileResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.resolvers.file",
+		New: func() caddy.Module { return new(FileResolver) },
+	}
+}
+
+func (r *FileResolver) Provision(caddy.Context) error {
+	var err error
+	r.mappings, err = readMappingsFile(r.Path)
+	return err
+}
+
+func (r *FileResolver) Resolve(_ context.Context, host string) (dnslinkpkg.Result, error) {
+	entry, ok := r.mappings[mappingKey(host)]
+	if !ok {
+		return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	}
+	return dnslinkpkg.Result{Links: entry.Links}, nil
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens.
+// Syntax:
+//
+//	file <path> {
+//	    timeout <duration>
+//	}
+func (r *FileResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		r.Path = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "timeout":
+				if err := r.unmarshalTimeout(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*DNSResolver)(nil)
+	_ caddy.Provisioner     = (*DNSResolver)(nil)
+	_ caddy.Validator       = (*DNSResolver)(nil)
+	_ caddyfile.Unmarshaler = (*DNSResolver)(nil)
+	_ Resolver              = (*DNSResolver)(nil)
+
+	_ caddy.Module          = (*FileResolver)(nil)
+	_ caddy.Provisioner     = (*FileResolver)(nil)
+	_ caddyfile.Unmarshaler = (*FileResolver)(nil)
+	_ Resolver              = (*FileResolver)(nil)
+
+	_ Resolver = ResolverFunc(nil)
+)
@@ -0,0 +1,174 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// fakeResolver returns a fixed result, optionally after a delay.
+type fakeResolver struct {
+	result dnslinkpkg.Result
+	err    error
+	delay  time.Duration
+	resolverTimeout
+}
+
+func (f *fakeResolver) Resolve(ctx context.Context, _ string) (dnslinkpkg.Result, error) {
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return dnslinkpkg.Result{}, ctx.Err()
+	}
+	return f.result, f.err
+}
+
+func TestResolveChain(t *testing.T) {
+	link := func(id string) dnslinkpkg.Result {
+		return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: id}}}}
+	}
+	nxdomain := dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, "example.com")
+	failure := errors.New("resolver down")
+	slow := &fakeResolver{result: link("QmSlow"), delay: time.Second}
+	slow.Timeout = caddy.Duration(10 * time.Millisecond)
+
+	tests := []struct {
+		name      string
+		resolvers []Resolver
+		want      string
+		outcome   string
+	}{
+		{
+			name:      "first link wins",
+			resolvers: []Resolver{&fakeResolver{result: link("QmA")}, &fakeResolver{result: link("QmB")}},
+			want:      "QmA",
+		},
+		{
+			name:      "skips failures and missing links",
+			resolvers: []Resolver{&fakeResolver{err: failure}, &fakeResolver{err: nxdomain}, &fakeResolver{result: link("QmC")}},
+			want:      "QmC",
+		},
+		{
+			name:      "per-resolver timeout",
+			resolvers: []Resolver{slow, &fakeResolver{result: link("QmFast")}},
+			want:      "QmFast",
+		},
+		{
+			name:      "no link anywhere",
+			resolvers: []Resolver{&fakeResolver{err: nxdomain}, &fakeResolver{}},
+			outcome:   outcomeNoLink,
+		},
+		{
+			name:      "failure beats missing link",
+			resolvers: []Resolver{&fakeResolver{err: nxdomain}, &fakeResolver{err: failure}},
+			outcome:   outcomeError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := resolveChain(context.Background(), tt.resolvers, "example.com")
+			if tt.outcome != "" {
+				if got := lookupOutcome("", err); got != tt.outcome {
+					t.Errorf("resolveChain() error = %v, want outcome %s", err, tt.outcome)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveChain() error = %v", err)
+			}
+			if got := result.Links["ipfs"][0].Identifier; got != tt.want {
+				t.Errorf("resolveChain() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mappings")
+	if err := os.WriteFile(path, []byte("example.com /ipfs/QmFile\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := &FileResolver{Path: path}
+	if err := r.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Resolve(context.Background(), "Example.com")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if entries := result.Links["ipfs"]; len(entries) != 1 || entries[0].Identifier != "QmFile" {
+		t.Errorf("Links[ipfs] = %+v, want QmFile", entries)
+	}
+	if _, err := r.Resolve(context.Background(), "other.example.com"); lookupOutcome("", err) != outcomeNoLink {
+		t.Errorf("Resolve(other) error = %v, want NXDOMAIN", err)
+	}
+}
+
+func TestUnmarshalChain(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`dnslink {
+		chain {
+			dns 10.0.0.53 https://dns.example/dns-query {
+				txt_label _links
+				timeout 500ms
+			}
+			remote https://resolver.internal/resolve {
+				header Authorization "Bearer token"
+			}
+			file /etc/caddy/mappings.txt
+		}
+	}`)
+	var a App
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	want := []string{
+		`{"resolvers":["10.0.0.53","https://dns.example/dns-query"],"txt_label":"_links","timeout":500000000,"resolver":"dns"}`,
+		`{"endpoint":"https://resolver.internal/resolve","headers":{"Authorization":"Bearer token"},"resolver":"remote"}`,
+		`{"path":"/etc/caddy/mappings.txt","resolver":"file"}`,
+	}
+	if len(a.ChainRaw) != len(want) {
+		t.Fatalf("ChainRaw has %d resolvers, want %d", len(a.ChainRaw), len(want))
+	}
+	for i, raw := range a.ChainRaw {
+		var got, expected map[string]any
+		_ = json.Unmarshal(raw, &got)
+		_ = json.Unmarshal([]byte(want[i]), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("ChainRaw[%d] = %s, want %s", i, raw, want[i])
+		}
+	}
+}
+
+func TestUnmarshalHandlerResolver(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`dnslink /ipfs ipfs:8080 {
+		resolver file /etc/caddy/mappings.txt {
+			timeout 1s
+		}
+	}`)
+	var h DNSLink
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	var got map[string]any
+	_ = json.Unmarshal(h.ResolverRaw, &got)
+	if want := map[string]any{"path": "/etc/caddy/mappings.txt", "timeout": float64(time.Second), "resolver": "file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ResolverRaw = %s", h.ResolverRaw)
+	}
+
+	for _, input := range []string{"dnslink {\n resolver\n}", "dnslink {\n resolver nonexistent\n}"} {
+		if err := new(DNSLink).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("UnmarshalCaddyfile(%q) succeeded", input)
+		}
+	}
+}
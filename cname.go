@@ -0,0 +1,79 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEHops bounds the queries made to follow the CNAME records of a
+// name whose target the resolver did not answer for.
+const maxCNAMEHops = 8
+
+// canonicalName collects the name the DNSLink records of a resolution were
+// found at after following CNAME records, e.g. the managed record of a
+// DNS provider _dnslink.example.com is aliased to.
+type canonicalName struct {
+	mu   sync.Mutex
+	name string
+}
+
+// canonicalKey is the context key of a resolution's canonicalName.
+type canonicalKey struct{}
+
+// withCanonicalName returns ctx with a canonicalName the lookups made
+// under it record their canonical names in.
+func withCanonicalName(ctx context.Context) (context.Context, *canonicalName) {
+	c := new(canonicalName)
+	return context.WithValue(ctx, canonicalKey{}, c), c
+}
+
+// recordCanonicalName records the canonical name of a lookup that found
+// records, empty if the name looked up had no CNAME. The last lookup
+// wins, as it is the one a resolution ends at.
+func recordCanonicalName(ctx context.Context, name string) {
+	if c, ok := ctx.Value(canonicalKey{}).(*canonicalName); ok {
+		c.mu.Lock()
+		c.name = name
+		c.mu.Unlock()
+	}
+}
+
+// get returns the canonical name recorded last.
+func (c *canonicalName) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// cnameTarget follows the CNAME records of the answer of resp from name,
+// returning the name the chain ends at and the lowest TTL of the records
+// followed. ok is false if name has no CNAME in the answer.
+func cnameTarget(resp *dns.Msg, name string) (target string, ttl uint32, ok bool) {
+	target = name
+	// Each record can be followed at most once, which also ends loops.
+	for range resp.Answer {
+		next := ""
+		for _, answer := range resp.Answer {
+			if cname, isCNAME := answer.(*dns.CNAME); isCNAME && strings.EqualFold(cname.Hdr.Name, target) {
+				next = cname.Target
+				if !ok || cname.Hdr.Ttl < ttl {
+					ttl = cname.Hdr.Ttl
+				}
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target, ok = next, true
+	}
+	return target, ttl, ok
+}
+
+// errCNAMEChain is returned for CNAME chains that loop or take more than
+// maxCNAMEHops queries to follow.
+var errCNAMEChain = errors.New("CNAME chain loops or is too long")
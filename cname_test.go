@@ -0,0 +1,108 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// cnameExchange answers TXT queries from records and cnames. With chase,
+// it follows CNAMEs as a recursive resolver does; otherwise it answers
+// with the CNAME alone, as some forwarders do. queries counts the queries.
+func cnameExchange(records map[string]string, cnames map[string]string, chase bool, queries *int) exchangeFunc {
+	return func(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		*queries++
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		name := msg.Question[0].Name
+		for hops := 0; hops < 10; hops++ {
+			target, ok := cnames[strings.ToLower(name)]
+			if !ok {
+				break
+			}
+			resp.Answer = append(resp.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+			name = target
+			if !chase {
+				return resp, nil
+			}
+		}
+		if txt, ok := records[strings.ToLower(name)]; ok {
+			resp.Answer = append(resp.Answer,
+				&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: []string{txt}},
+				// Records of other names in the answer are ignored.
+				&dns.TXT{Hdr: dns.RR_Header{Name: "stray.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: []string{"dnslink=/ipfs/QmStray"}},
+			)
+		} else if len(resp.Answer) == 0 {
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp, nil
+	}
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	records := map[string]string{"gw.provider.example.": "dnslink=/ipfs/QmManaged"}
+	cnames := map[string]string{
+		"_dnslink.example.com.":   "_dnslink.alias.example.",
+		"_dnslink.alias.example.": "GW.provider.example.",
+		"_dnslink.loop.example.":  "_dnslink.loop2.example.",
+		"_dnslink.loop2.example.": "_dnslink.loop.example.",
+	}
+	for _, chase := range []bool{true, false} {
+		queries := 0
+		lookup := exchangeLookup(cnameExchange(records, cnames, chase, &queries), false)
+		ctx, canonical := withCanonicalName(context.Background())
+		entries, err := lookup(ctx, "_dnslink.example.com")
+		if err != nil {
+			t.Fatalf("chase %v: lookup() error = %v", chase, err)
+		}
+		if len(entries) != 1 || entries[0].Value != "dnslink=/ipfs/QmManaged" || entries[0].Ttl != 60 {
+			t.Errorf("chase %v: entries = %+v, want the managed record with the CNAME ttl", chase, entries)
+		}
+		if got := canonical.get(); !strings.EqualFold(got, "gw.provider.example") {
+			t.Errorf("chase %v: canonical name = %q, want gw.provider.example", chase, got)
+		}
+		if want := map[bool]int{true: 1, false: 3}[chase]; queries != want {
+			t.Errorf("chase %v: %d queries, want %d", chase, queries, want)
+		}
+
+		if _, err := lookup(context.Background(), "_dnslink.loop.example"); !errors.Is(err, errCNAMEChain) {
+			t.Errorf("chase %v: lookup(loop) error = %v, want %v", chase, err, errCNAMEChain)
+		}
+	}
+}
+
+func TestResolveCanonicalName(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	queries := 0
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Second),
+		CacheTTL:      caddy.Duration(time.Minute),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: exchangeLookup(cnameExchange(
+			map[string]string{"gw.provider.example.": "dnslink=/ipfs/QmManaged", "_dnslink.direct.example.": "dnslink=/ipfs/QmDirect"},
+			map[string]string{"_dnslink.example.com.": "gw.provider.example."},
+			false, &queries,
+		), false),
+	}
+	entry, _, err := a.resolve(context.Background(), "example.com")
+	if err != nil || entry.Identifier != "QmManaged" || entry.CanonicalName != "gw.provider.example" {
+		t.Errorf("resolve() = %+v, %v, want QmManaged at gw.provider.example", entry, err)
+	}
+	if cached, ok, _ := a.cache.Load(context.Background(), "example.com"); !ok || cached.CanonicalName != "gw.provider.example" {
+		t.Errorf("cached entry = %+v, want the canonical name", cached)
+	}
+	if entry, _, _ := a.resolve(context.Background(), "direct.example"); entry.CanonicalName != "" {
+		t.Errorf("resolve(direct) canonical name = %q, want none", entry.CanonicalName)
+	}
+}
@@ -0,0 +1,310 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "dnslink",
+		Usage: "<command>",
+		Short: "Commands for working with DNSLink records",
+		Long: `
+Commands for debugging and operating the dnslink handler.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			resolveCmd := &cobra.Command{
+				Use:   "resolve [--resolver <addr>...] [--namespace <ns>...] [--namespace-priority <ns>...] [--txt-label <label>] [--lenient-txt] [--replacement <prefix> | --template <template>] [--path <path>] <host>",
+				Short: "Resolves the DNSLink record of a host",
+				Long: `
+Resolves the DNSLink record of a host using the same library, link
+filtering and link selection as the dnslink handler, then prints every
+link kept, the namespace and identifier the handler would route on, and
+the path it would send upstream. The host is normalized as that of a
+request: lowercased, without its port or trailing dot.
+
+The --resolver, --namespace and --namespace-priority flags mirror the
+resolvers, namespaces and namespace_priority options of the dnslink app
+and may be repeated, --txt-label mirrors txt_label, and --lenient-txt
+mirrors lenient_txt with every tolerance. The --replacement flag mirrors
+the optional replacement of a proxies entry, --template mirrors
+path_template, and --path is the request path to rewrite (default "/").`,
+				Example: "caddy dnslink resolve --replacement /bzz --path /index.html example.com",
+				Args:    cobra.ExactArgs(1),
+				RunE:    cmdResolve,
+			}
+			resolveCmd.Flags().StringSlice("resolver", nil, "Nameserver to query (default is the system resolver)")
+			resolveCmd.Flags().StringSlice("namespace", nil, "Namespace whose links are kept (default is all)")
+			resolveCmd.Flags().StringSlice("namespace-priority", nil, "Namespace to prefer when several are published")
+			resolveCmd.Flags().Bool("lenient-txt", false, "Tolerate malformed DNSLink records")
+			resolveCmd.Flags().String("txt-label", "", "Label to look up DNSLink records under (default \"_dnslink\")")
+			resolveCmd.Flags().Bool("txt-label-only", false, "Never fall back to the host's own TXT records")
+			resolveCmd.Flags().StringP("replacement", "r", "", "Path prefix replacing the namespace")
+			resolveCmd.Flags().StringP("template", "t", "", "Path template of the upstream URL")
+			resolveCmd.Flags().StringP("path", "p", "/", "Request path to rewrite")
+			cmd.AddCommand(resolveCmd)
+
+			warmCmd := &cobra.Command{
+				Use:   "warm [--address <interface>] [--config <path> [--adapter <name>]] [--file <path>] [<host>...]",
+				Short: "Pre-resolves hosts into a running instance's cache",
+				Long: `
+Asks a running Caddy instance, through its admin API, to resolve the
+given hosts so they are cached before traffic arrives. Hosts can be
+passed as arguments and/or read from a file with one host per line.
+
+The admin API address is determined the same way as for "caddy reload".`,
+				Example: "caddy dnslink warm --file hosts.txt example.com",
+				RunE:    cmdWarm,
+			}
+			warmCmd.Flags().StringP("address", "", "", "The address of the administration API")
+			warmCmd.Flags().StringP("config", "c", "", "Configuration file to determine the admin API address")
+			warmCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			warmCmd.Flags().StringP("file", "f", "", "File with one host per line")
+			cmd.AddCommand(warmCmd)
+
+			publishCmd := &cobra.Command{
+				Use:   "publish [--config <path> [--adapter <name>]] [--purge [--address <interface>]] <host> <value>",
+				Short: "Publishes the DNSLink record of a host",
+				Long: `
+Sets the DNSLink TXT record of a host to the given value, such as
+/ipfs/bafy..., through the DNS provider of the publish option of the
+dnslink app in the config, the same way as PUT /dnslink/records/<host>
+on the admin API, but without a running instance. This is meant for
+deploy scripts rolling out a new root.
+
+The config is loaded the same way as for "caddy run". With --purge, the
+host is also evicted from the cache of the running instance, whose admin
+API address is determined the same way as for "caddy reload".`,
+				Example: "caddy dnslink publish --purge www.example.com /ipfs/bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4",
+				Args:    cobra.ExactArgs(2),
+				RunE:    cmdPublish,
+			}
+			publishCmd.Flags().StringP("config", "c", "", "Configuration file with the publish option")
+			publishCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			publishCmd.Flags().Bool("purge", false, "Evict the host from the running instance's cache")
+			publishCmd.Flags().StringP("address", "", "", "The address of the administration API")
+			cmd.AddCommand(publishCmd)
+		},
+	})
+}
+
+func cmdWarm(cmd *cobra.Command, args []string) error {
+	addressFlag, _ := cmd.Flags().GetString("address")
+	configFlag, _ := cmd.Flags().GetString("config")
+	adapterFlag, _ := cmd.Flags().GetString("adapter")
+	fileFlag, _ := cmd.Flags().GetString("file")
+
+	hosts := args
+	if fileFlag != "" {
+		fromFile, err := readHostsFile(fileFlag)
+		if err != nil {
+			return fmt.Errorf("reading hosts file: %v", err)
+		}
+		hosts = append(hosts, fromFile...)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts to warm")
+	}
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(addressFlag, nil, configFlag, adapterFlag)
+	if err != nil {
+		return fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	body, err := json.Marshal(hosts)
+	if err != nil {
+		return err
+	}
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodPost, "/dnslink/warm", headers, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("warming cache: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var results []warmResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	out := cmd.OutOrStdout()
+	for _, res := range results {
+		if res.Namespace == "" {
+			fmt.Fprintf(out, "%s: no link\n", res.Host)
+			continue
+		}
+		fmt.Fprintf(out, "%s: /%s/%s\n", res.Host, res.Namespace, res.Identifier)
+	}
+	return nil
+}
+
+func cmdPublish(cmd *cobra.Command, args []string) error {
+	host, value := args[0], args[1]
+	configFlag, _ := cmd.Flags().GetString("config")
+	adapterFlag, _ := cmd.Flags().GetString("adapter")
+	purgeFlag, _ := cmd.Flags().GetBool("purge")
+	addressFlag, _ := cmd.Flags().GetString("address")
+
+	config, configFile, err := caddycmd.LoadConfig(configFlag, adapterFlag)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Apps struct {
+			DNSLink json.RawMessage `json:"dnslink"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return fmt.Errorf("decoding config: %v", err)
+	}
+	app := new(App)
+	if cfg.Apps.DNSLink != nil {
+		if err := json.Unmarshal(cfg.Apps.DNSLink, app); err != nil {
+			return fmt.Errorf("decoding dnslink app: %v", err)
+		}
+	}
+	if app.Publish == nil {
+		return fmt.Errorf("no publish option in the dnslink app of %s", configFile)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: cmd.Context()})
+	defer cancel()
+	app.logger = zap.NewNop()
+	if app.TXTLabel != "" {
+		if err := validateTXTLabel(app.TXTLabel); err != nil {
+			return err
+		}
+	}
+	if err := app.provisionStatic(); err != nil {
+		return err
+	}
+	if err := app.Publish.provision(ctx); err != nil {
+		return fmt.Errorf("publish: %v", err)
+	}
+	record, err := app.publish(ctx, host, value)
+	if errors.Is(err, errNotManaged) {
+		return fmt.Errorf("%s is not in a managed zone", host)
+	}
+	if err != nil {
+		return fmt.Errorf("publishing %s: %v", host, err)
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "%s: %s in %s: %s (ttl %s)\n", record.Host, record.Name, record.Zone, record.Value, record.TTL)
+
+	if !purgeFlag {
+		return nil
+	}
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(addressFlag, config, configFlag, adapterFlag)
+	if err != nil {
+		return fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodDelete, "/dnslink/cache/"+record.Host, nil, nil)
+	if err != nil {
+		return fmt.Errorf("purging cache: %v", err)
+	}
+	resp.Body.Close()
+	fmt.Fprintf(out, "%s: purged\n", record.Host)
+	return nil
+}
+
+func cmdResolve(cmd *cobra.Command, args []string) error {
+	replacement, _ := cmd.Flags().GetString("replacement")
+	tmpl, _ := cmd.Flags().GetString("template")
+	path, _ := cmd.Flags().GetString("path")
+	resolvers, _ := cmd.Flags().GetStringSlice("resolver")
+	namespaces, _ := cmd.Flags().GetStringSlice("namespace")
+	priority, _ := cmd.Flags().GetStringSlice("namespace-priority")
+	label, _ := cmd.Flags().GetString("txt-label")
+	labelOnly, _ := cmd.Flags().GetBool("txt-label-only")
+	lenient, _ := cmd.Flags().GetBool("lenient-txt")
+
+	app := &App{
+		Resolvers:         resolvers,
+		Namespaces:        namespaces,
+		NamespacePriority: priority,
+		TXTLabel:          label,
+		TXTLabelOnly:      labelOnly,
+	}
+	if label != "" {
+		if err := validateTXTLabel(label); err != nil {
+			return err
+		}
+	}
+	lookup, err := app.newLookup()
+	if err != nil {
+		return err
+	}
+	app.lookup = lookup
+	if lenient {
+		app.txtParser, _ = newTXTParser(txtTolerances)
+	}
+	return printResolution(cmd.Context(), cmd.OutOrStdout(), app, args[0], replacement, tmpl, path)
+}
+
+// printResolution resolves host with app as the handler would a request
+// for it, and prints the links kept, the namespace and identifier routed
+// on and the path sent upstream for the request path.
+func printResolution(ctx context.Context, out io.Writer, app *App, host, replacement, tmpl, path string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = app.lookupDomain(host)
+	result, err := app.resolveLinks(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %v", host, err)
+	}
+
+	namespaces := make([]string, 0, len(result.Links))
+	for ns := range result.Links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		for _, entry := range result.Links[ns] {
+			fmt.Fprintf(out, "link:       /%s/%s (ttl %d)\n", ns, entry.Identifier, entry.Ttl)
+		}
+	}
+	for _, stmt := range result.Log {
+		fmt.Fprintf(out, "log:        %s %s %s\n", stmt.Code, stmt.Entry, stmt.Reason)
+	}
+
+	namespace, identifier := selectLink(result, app.NamespacePriority)
+	if namespace == "" {
+		return fmt.Errorf("no DNSLink record found for %s", host)
+	}
+	fmt.Fprintf(out, "namespace:  %s\n", namespace)
+	fmt.Fprintf(out, "identifier: %s\n", identifier)
+	fmt.Fprintf(out, "prefix:     /%s\n", namespace)
+	escaped, err := escapeIdentifier(identifier)
+	if err != nil {
+		return err
+	}
+	if tmpl == "" && replacement == "" {
+		tmpl = defaultPathTemplates[namespace]
+	}
+	if tmpl == "" {
+		fmt.Fprintf(out, "path:       %s\n", buildPath(namespace, escaped, replacement, cleanPath(path)))
+		return nil
+	}
+	if err := validateTemplate(tmpl); err != nil {
+		return err
+	}
+	rawPath, rawQuery := expandTemplate(tmpl, namespace, escaped, cleanPath(path))
+	if rawQuery != "" {
+		rawPath += "?" + rawQuery
+	}
+	fmt.Fprintf(out, "path:       %s\n", rawPath)
+	return nil
+}
@@ -0,0 +1,67 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestPrintResolution(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	long := "Qm" + strings.Repeat("x", defaultMaxIdentifierLength)
+	records := map[string][]string{
+		"_dnslink.example.com": {"dnslink=/ipfs/QmSite", "dnslink=/swarm/" + long, "dnslink=/hyper/def"},
+	}
+	a := &App{
+		Namespaces:        []string{"ipfs", "swarm"},
+		NamespacePriority: []string{"swarm", "ipfs"},
+		LookupTimeout:     caddy.Duration(time.Second),
+		cache:             new(MemoryCache),
+		logger:            zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			var entries []dnslinkpkg.LookupEntry
+			for _, txt := range records[name] {
+				entries = append(entries, dnslinkpkg.LookupEntry{Value: txt})
+			}
+			if entries == nil {
+				return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+			}
+			return entries, nil
+		},
+	}
+	d := &DNSLink{app: a, logger: zap.NewNop()}
+
+	// The command routes on the link the handler does: /swarm is preferred
+	// but its only link is too long, and /hyper links are not kept.
+	for _, host := range []string{"example.com", "Example.COM", "example.com.", "example.com:8443"} {
+		t.Run(host, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := printResolution(context.Background(), &out, a, host, "", "", "/"); err != nil {
+				t.Fatalf("printResolution() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.Host = host
+			entry, _, err := a.resolve(context.Background(), d.requestHost(r))
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			want := "link:       /ipfs/QmSite (ttl 0)\n" +
+				"namespace:  " + entry.Namespace + "\n" +
+				"identifier: " + entry.Identifier + "\n" +
+				"prefix:     /ipfs\n" +
+				"path:       /ipfs/QmSite/\n"
+			if entry.Identifier != "QmSite" || out.String() != want {
+				t.Errorf("output = %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
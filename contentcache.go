@@ -0,0 +1,256 @@
+package dnslink
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+)
+
+// Defaults of the content cache.
+const (
+	defaultContentCacheSize = 256 << 20
+	defaultContentEntrySize = 8 << 20
+)
+
+// ContentCache keeps the responses of immutable links in memory, so
+// repeated requests for the same content are answered without contacting
+// the upstream, for gateways without a caching proxy in front of their
+// content store. Responses are keyed by the link, the request path and
+// query, and the Accept and Accept-Encoding headers of the request, and the
+// least recently used are evicted first. The cache is private to the
+// handler and emptied on config reloads.
+type ContentCache struct {
+	// MaxSize bounds the bytes of the cached bodies. Default is 256 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// MaxEntrySize bounds the body of a cached response; larger responses
+	// are proxied without being cached. Default is 8 MiB.
+	MaxEntrySize int64 `json:"max_entry_size,omitempty"`
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// cachedResponse is a response held by the content cache.
+type cachedResponse struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+}
+
+// provision validates the configuration and sets the defaults.
+func (c *ContentCache) provision() error {
+	if c.MaxSize < 0 || c.MaxEntrySize < 0 {
+		return fmt.Errorf("negative size")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultContentCacheSize
+	}
+	if c.MaxEntrySize == 0 {
+		c.MaxEntrySize = min(defaultContentEntrySize, c.MaxSize)
+	}
+	if c.MaxEntrySize > c.MaxSize {
+		return fmt.Errorf("max_entry_size %d exceeds max_size %d", c.MaxEntrySize, c.MaxSize)
+	}
+	c.lru = list.New()
+	c.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// contentKey returns the cache key of r for a link, or "" if the link is
+// mutable or r cannot be answered from the cache. identifier and path must
+// be escaped as for the upstream path.
+func contentKey(namespace, identifier, path string, r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if r.Header.Get("Range") != "" || r.Header.Get("Authorization") != "" || !immutableLink(namespace, identifier) {
+		return ""
+	}
+	return contentPath(namespace, identifier, path, r.URL.RawQuery) + "\n" + r.Header.Get("Accept") + "\n" + r.Header.Get("Accept-Encoding")
+}
+
+// load returns the response cached under key, marking it as recently used.
+func (c *ContentCache) load(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedResponse), true
+}
+
+// store caches resp, evicting the least recently used responses to make
+// room for it.
+func (c *ContentCache) store(resp *cachedResponse) {
+	size := int64(len(resp.body))
+	if size > c.MaxEntrySize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[resp.key]; ok {
+		c.remove(e)
+	}
+	for c.size+size > c.MaxSize {
+		c.remove(c.lru.Back())
+	}
+	c.entries[resp.key] = c.lru.PushFront(resp)
+	c.size += size
+}
+
+// remove evicts e. The caller must hold c.mu.
+func (c *ContentCache) remove(e *list.Element) {
+	resp := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, resp.key)
+	c.size -= int64(len(resp.body))
+}
+
+// serve answers r from the response cached under key, or else with proxy,
+// caching its response if it may be reused.
+func (c *ContentCache) serve(w http.ResponseWriter, r *http.Request, key string, proxy func(http.ResponseWriter) error) error {
+	if resp, ok := c.load(key); ok {
+		dnslinkMetrics.contentCache.WithLabelValues(outcomeHit).Inc()
+		for name, values := range resp.header {
+			w.Header()[name] = slices.Clone(values)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp.body)))
+		w.WriteHeader(resp.status)
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		_, err := w.Write(resp.body)
+		return err
+	}
+	dnslinkMetrics.contentCache.WithLabelValues(outcomeMiss).Inc()
+	if r.Method != http.MethodGet {
+		return proxy(w)
+	}
+
+	rec := &contentRecorder{ResponseWriter: w, before: w.Header().Clone(), limit: c.MaxEntrySize}
+	if err := proxy(rec); err != nil {
+		return err
+	}
+	if resp, ok := rec.response(key); ok {
+		c.store(resp)
+	}
+	return nil
+}
+
+// contentRecorder copies a response to the client, keeping a copy of it
+// for the content cache while it fits.
+type contentRecorder struct {
+	http.ResponseWriter
+	before   http.Header
+	limit    int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *contentRecorder) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if w.status == 0 && status >= 200 {
+		w.status = status
+		// Only keep the headers set for the response, not those set
+		// before it was proxied, which belong to this request.
+		w.header = make(http.Header)
+		for name, values := range w.Header() {
+			if !slices.Equal(w.before[name], values) {
+				w.header[name] = slices.Clone(values)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contentRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for flushing and hijacking.
+func (w *contentRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// response returns the recorded response to cache under key, if it is a
+// complete 200 response that may be shared.
+func (w *contentRecorder) response(key string) (*cachedResponse, bool) {
+	if w.status != http.StatusOK || w.overflow || w.header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	cc := strings.ToLower(strings.Join(w.header.Values("Cache-Control"), ","))
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+		return nil, false
+	}
+	if cl := w.header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.body.Len()) {
+		return nil, false
+	}
+	return &cachedResponse{key: key, status: w.status, header: w.header, body: bytes.Clone(w.body.Bytes())}, true
+}
+
+// unmarshalContentCache parses the content_cache subdirective:
+//
+//	content_cache {
+//	    max_size <size>
+//	    max_entry_size <size>
+//	}
+func unmarshalContentCache(d *caddyfile.Dispenser) (*ContentCache, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	c := new(ContentCache)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "max_size", "max_entry_size":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil || n == 0 || n > 1<<62 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "max_size" {
+				c.MaxSize = int64(n)
+			} else {
+				c.MaxEntrySize = int64(n)
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return c, nil
+}
+
+// Interface guards
+var _ http.ResponseWriter = (*contentRecorder)(nil)
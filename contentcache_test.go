@@ -0,0 +1,121 @@
+package dnslink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestContentKey(t *testing.T) {
+	const cid = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	get := httptest.NewRequest(http.MethodGet, "/index.html?format=raw", nil)
+	if key := contentKey("ipfs", cid, "/index.html", get); !strings.HasPrefix(key, "/ipfs/"+cid+"/index.html?format=raw\n") {
+		t.Errorf("contentKey() = %q", key)
+	}
+	if key := contentKey("ipns", "example.com", "/", get); key != "" {
+		t.Errorf("contentKey() of a mutable link = %q", key)
+	}
+	ranged := httptest.NewRequest(http.MethodGet, "/", nil)
+	ranged.Header.Set("Range", "bytes=0-99")
+	if key := contentKey("ipfs", cid, "/", ranged); key != "" {
+		t.Errorf("contentKey() of a range request = %q", key)
+	}
+	if key := contentKey("ipfs", cid, "/", httptest.NewRequest(http.MethodPost, "/", nil)); key != "" {
+		t.Errorf("contentKey() of a POST = %q", key)
+	}
+
+	gzip := httptest.NewRequest(http.MethodGet, "/index.html?format=raw", nil)
+	gzip.Header.Set("Accept-Encoding", "gzip")
+	if contentKey("ipfs", cid, "/index.html", gzip) == contentKey("ipfs", cid, "/index.html", get) {
+		t.Error("contentKey() ignores Accept-Encoding")
+	}
+}
+
+func TestContentCacheServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	c := &ContentCache{MaxSize: 10, MaxEntrySize: 6}
+	if err := c.provision(); err != nil {
+		t.Fatal(err)
+	}
+	hits := 0
+	proxy := func(body string, header http.Header) func(http.ResponseWriter) error {
+		return func(w http.ResponseWriter) error {
+			hits++
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			_, err := w.Write([]byte(body))
+			return err
+		}
+	}
+	serve := func(method, key string, upstream func(http.ResponseWriter) error) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Server", "Caddy")
+		if err := c.serve(rec, httptest.NewRequest(method, "/", nil), key, upstream); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	serve(http.MethodGet, "a", proxy("alpha", http.Header{"Content-Type": {"text/plain"}}))
+	rec := serve(http.MethodGet, "a", proxy("other", nil))
+	if hits != 1 || rec.Body.String() != "alpha" || rec.Header().Get("Content-Type") != "text/plain" || rec.Header().Get("Content-Length") != "5" {
+		t.Errorf("cached response = %q %v after %d upstream requests", rec.Body.String(), rec.Header(), hits)
+	}
+	if rec := serve(http.MethodHead, "a", proxy("", nil)); hits != 1 || rec.Body.Len() != 0 || rec.Code != http.StatusOK {
+		t.Errorf("HEAD = %d %q, want the cached headers", rec.Code, rec.Body.String())
+	}
+
+	// Responses that may not be shared or don't fit are not kept.
+	serve(http.MethodGet, "private", proxy("x", http.Header{"Cache-Control": {"private"}}))
+	serve(http.MethodGet, "large", proxy("too large", nil))
+	serve(http.MethodGet, "private", proxy("x", nil))
+	serve(http.MethodGet, "large", proxy("too large", nil))
+	if hits != 5 {
+		t.Errorf("upstream requests = %d, want 5", hits)
+	}
+
+	// The least recently used response is evicted first.
+	serve(http.MethodGet, "a", proxy("", nil))
+	serve(http.MethodGet, "b", proxy("bravo", nil))
+	if _, ok := c.load("private"); ok {
+		t.Error("least recently used response was kept")
+	}
+	if _, ok := c.load("a"); !ok {
+		t.Error("recently used response was evicted")
+	}
+	if c.size != 10 {
+		t.Errorf("size = %d, want 10", c.size)
+	}
+}
+
+func TestParseContentCache(t *testing.T) {
+	d := caddyfile.NewTestDispenser("content_cache {\n max_size 1GiB\n max_entry_size 16MiB\n}")
+	d.Next()
+	c, err := unmarshalContentCache(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxSize != 1<<30 || c.MaxEntrySize != 16<<20 {
+		t.Errorf("ContentCache = %+v", c)
+	}
+
+	for _, input := range []string{
+		"content_cache 1GiB",
+		"content_cache {\n max_size lots\n}",
+		"content_cache {\n ttl 1h\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalContentCache(d); err == nil {
+			t.Errorf("unmarshalContentCache(%q) succeeded", input)
+		}
+	}
+	if err := (&ContentCache{MaxSize: 1 << 20, MaxEntrySize: 2 << 20}).provision(); err == nil {
+		t.Error("provision() accepted an entry size above the cache size")
+	}
+}
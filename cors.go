@@ -0,0 +1,144 @@
+package dnslink
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// CORSPolicy configures the CORS headers attached to responses for a
+// prefix.
+type CORSPolicy struct {
+	// AllowOrigins lists the origins allowed to read responses. "*", the
+	// default, allows any origin.
+	AllowOrigins []string `json:"allow_origins,omitempty"`
+
+	// AllowMethods lists the methods allowed in cross-origin requests.
+	// Default is GET, HEAD and OPTIONS.
+	AllowMethods []string `json:"allow_methods,omitempty"`
+
+	// AllowHeaders lists the request headers allowed in cross-origin
+	// requests.
+	AllowHeaders []string `json:"allow_headers,omitempty"`
+
+	// ExposeHeaders lists the response headers readable by scripts.
+	ExposeHeaders []string `json:"expose_headers,omitempty"`
+
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if the origin is not allowed.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if len(p.AllowOrigins) == 0 {
+		return "*"
+	}
+	for _, allowed := range p.AllowOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// headers returns the CORS headers for a request from origin. An empty
+// origin means the request is not cross-origin and gets no headers.
+func (p *CORSPolicy) headers(origin string) http.Header {
+	h := make(http.Header)
+	if origin == "" {
+		return h
+	}
+	allowed := p.allowOrigin(origin)
+	if allowed != "*" {
+		h.Set("Vary", "Origin")
+	}
+	if allowed == "" {
+		return h
+	}
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if len(p.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+	}
+	return h
+}
+
+// preflightHeaders returns the headers answering a preflight request from
+// origin.
+func (p *CORSPolicy) preflightHeaders(origin string) http.Header {
+	h := p.headers(origin)
+	h.Del("Access-Control-Expose-Headers")
+	if h.Get("Access-Control-Allow-Origin") == "" {
+		return h
+	}
+	methods := p.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowHeaders, ", "))
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.FormatInt(int64(time.Duration(p.MaxAge)/time.Second), 10))
+	}
+	return h
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// unmarshalCORS parses a cors subdirective:
+//
+//	cors <prefix> {
+//	    origins <origin>...
+//	    methods <method>...
+//	    headers <header>...
+//	    expose <header>...
+//	    max_age <duration>
+//	}
+func unmarshalCORS(d *caddyfile.Dispenser) (string, *CORSPolicy, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	p := new(CORSPolicy)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "origins":
+			p.AllowOrigins = append(p.AllowOrigins, d.RemainingArgs()...)
+		case "methods":
+			p.AllowMethods = append(p.AllowMethods, d.RemainingArgs()...)
+		case "headers":
+			p.AllowHeaders = append(p.AllowHeaders, d.RemainingArgs()...)
+		case "expose":
+			p.ExposeHeaders = append(p.ExposeHeaders, d.RemainingArgs()...)
+		case "max_age":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return "", nil, err
+			}
+			p.MaxAge = caddy.Duration(dur)
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return prefix, p, nil
+}
@@ -0,0 +1,96 @@
+package dnslink
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCORSHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     CORSPolicy
+		origin     string
+		wantOrigin string
+		wantVary   string
+	}{
+		{name: "any origin by default", origin: "https://dapp.example", wantOrigin: "*"},
+		{name: "same origin request", origin: ""},
+		{
+			name:       "listed origin",
+			policy:     CORSPolicy{AllowOrigins: []string{"https://dapp.example"}},
+			origin:     "https://DApp.example",
+			wantOrigin: "https://DApp.example",
+			wantVary:   "Origin",
+		},
+		{
+			name:     "unlisted origin",
+			policy:   CORSPolicy{AllowOrigins: []string{"https://dapp.example"}},
+			origin:   "https://evil.example",
+			wantVary: "Origin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.policy.headers(tt.origin)
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := h.Get("Vary"); got != tt.wantVary {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightHeaders(t *testing.T) {
+	p := &CORSPolicy{
+		AllowHeaders:  []string{"Range"},
+		ExposeHeaders: []string{"X-Ipfs-Path"},
+		MaxAge:        caddy.Duration(time.Hour),
+	}
+	h := p.preflightHeaders("https://dapp.example")
+	want := map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Allow-Methods":  "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers":  "Range",
+		"Access-Control-Max-Age":        "3600",
+		"Access-Control-Expose-Headers": "",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestIsPreflight(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodOptions, "/", nil)
+	r.Header.Set("Origin", "https://dapp.example")
+	if isPreflight(r) {
+		t.Error("isPreflight() = true without Access-Control-Request-Method")
+	}
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	if !isPreflight(r) {
+		t.Error("isPreflight() = false for a preflight request")
+	}
+}
+
+func TestUnmarshalCORS(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`cors /ipfs {
+		origins https://a.example https://b.example
+		methods GET
+		max_age 10m
+	}`)
+	d.Next()
+	prefix, p, err := unmarshalCORS(d)
+	if err != nil {
+		t.Fatalf("unmarshalCORS() error = %v", err)
+	}
+	if prefix != "/ipfs" || len(p.AllowOrigins) != 2 || len(p.AllowMethods) != 1 || p.MaxAge != caddy.Duration(10*time.Minute) {
+		t.Errorf("unmarshalCORS() = %q, %+v", prefix, p)
+	}
+}
@@ -0,0 +1,432 @@
+package dnslink
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Bounds of the denylist.
+const (
+	defaultDenylistInterval = time.Hour
+	denylistFetchTimeout    = time.Minute
+	maxDenylistSize         = 256 << 20
+)
+
+// Denylist refuses to proxy denied content, answering 410 Gone or 451
+// Unavailable For Legal Reasons instead, so public gateways can honor
+// takedowns at the routing layer. Rules are given inline or loaded from
+// files and URLs, in the compact denylist format of lists such as
+// badbits:
+//
+//	/ipfs/<cid>           the CID and every path under it
+//	/ipfs/<cid>/<path>    the path and every path under it
+//	/ipns/<name>          an IPNS name or domain, likewise
+//	/<namespace>/<id>     the identifier of any other namespace
+//	//<sha256 hex>        the legacy badbits hash of "<CIDv1 base32>/<path>"
+//
+// Blank lines, comments starting with #, the header of the list up to a
+// "---" line, and allow rules starting with ! are ignored. CIDs match
+// regardless of their version and encoding.
+type Denylist struct {
+	// Entries are rules given inline.
+	Entries []string `json:"entries,omitempty"`
+
+	// Files are the paths of files with more rules.
+	Files []string `json:"files,omitempty"`
+
+	// URLs are the http or https URLs of lists with more rules. They may
+	// contain global placeholders such as {env.DENYLIST_URL}.
+	URLs []string `json:"urls,omitempty"`
+
+	// Interval is how often Files and URLs are reloaded. A source that
+	// fails to load keeps its previous rules. Default is 1h.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Status is the status of denied requests: 410 (the default) or 451.
+	Status int `json:"status,omitempty"`
+
+	// rules holds the rules of all the sources.
+	rules atomic.Pointer[denyRules]
+
+	// inline holds the parsed Entries, and loaded the rules last loaded
+	// from each file and URL. loaded is only used by the loader.
+	inline *denyRules
+	loaded map[string]*denyRules
+
+	// urls holds the URLs with their placeholders replaced.
+	urls []string
+
+	client *http.Client
+	logger *zap.Logger
+
+	// cancel stops the loader goroutine, which closes done on exit.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// denyRules is a parsed denylist.
+type denyRules struct {
+	// paths maps the key of a denied identifier to the denied paths
+	// under it, "/" denying all of them.
+	paths map[string][]string
+
+	// hashes holds the legacy badbits hashes.
+	hashes map[string]struct{}
+}
+
+func newDenyRules() *denyRules {
+	return &denyRules{paths: make(map[string][]string), hashes: make(map[string]struct{})}
+}
+
+// add parses rule into rules. Lines to ignore are not rules and must be
+// filtered out before.
+func (rules *denyRules) add(rule string) error {
+	if hash, ok := strings.CutPrefix(rule, "//"); ok {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return fmt.Errorf("invalid hash rule '%s'", rule)
+		}
+		rules.hashes[strings.ToLower(hash)] = struct{}{}
+		return nil
+	}
+	namespace, rest, ok := strings.Cut(strings.TrimPrefix(rule, "/"), "/")
+	if !strings.HasPrefix(rule, "/") || !ok || namespace == "" || rest == "" {
+		return fmt.Errorf("invalid rule '%s': want /<namespace>/<identifier>[/<path>]", rule)
+	}
+	identifier, subpath, _ := strings.Cut(rest, "/")
+	key := denyKey(namespace, identifier)
+	rules.paths[key] = append(rules.paths[key], path.Clean("/"+subpath))
+	return nil
+}
+
+// merge adds the rules of other to rules.
+func (rules *denyRules) merge(other *denyRules) {
+	for key, paths := range other.paths {
+		rules.paths[key] = append(rules.paths[key], paths...)
+	}
+	for hash := range other.hashes {
+		rules.hashes[hash] = struct{}{}
+	}
+}
+
+// denied reports whether rules deny the content at contentPath, an
+// unescaped path, under identifier.
+func (rules *denyRules) denied(namespace, identifier, contentPath string) bool {
+	for _, denied := range rules.paths[denyKey(namespace, identifier)] {
+		if denied == "/" || contentPath == denied || strings.HasPrefix(contentPath, denied+"/") {
+			return true
+		}
+	}
+	if len(rules.hashes) > 0 && namespace == "ipfs" {
+		root := denyKey(namespace, identifier)[len("ipfs/"):]
+		for _, p := range []string{"/", contentPath} {
+			sum := sha256.Sum256([]byte(root + p))
+			if _, ok := rules.hashes[hex.EncodeToString(sum[:])]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denyKey returns the key of identifier in rules, its normalized form, so
+// that any encoding of an identifier matches.
+func denyKey(namespace, identifier string) string {
+	return namespace + "/" + normalizeRoot(namespace, identifier)
+}
+
+// parseDenylist reads the rules of a denylist from r. Lines that are not
+// valid rules are counted in skipped rather than failing the whole list,
+// as lists may use syntax this handler doesn't support.
+func parseDenylist(r io.Reader) (rules *denyRules, skipped int, err error) {
+	var lines []string
+	var header bool
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<10)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "---" && !header {
+			// Everything so far was the header.
+			lines, header = lines[:0], true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	rules = newDenyRules()
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		if err := rules.add(line); err != nil {
+			skipped++
+		}
+	}
+	return rules, skipped, nil
+}
+
+// provision validates the configuration, loads the files and sets the
+// defaults. URLs are first fetched by start.
+func (l *Denylist) provision(logger *zap.Logger) error {
+	switch l.Status {
+	case 0:
+		l.Status = http.StatusGone
+	case http.StatusGone, http.StatusUnavailableForLegalReasons:
+	default:
+		return fmt.Errorf("invalid status %d: must be 410 or 451", l.Status)
+	}
+	if l.Interval < 0 {
+		return fmt.Errorf("negative interval %v", time.Duration(l.Interval))
+	}
+	if l.Interval == 0 {
+		l.Interval = caddy.Duration(defaultDenylistInterval)
+	}
+	if len(l.Entries) == 0 && len(l.Files) == 0 && len(l.URLs) == 0 {
+		return fmt.Errorf("no entries, files or urls")
+	}
+	l.logger = logger
+	repl := caddy.NewReplacer()
+	l.urls = make([]string, len(l.URLs))
+	for i, raw := range l.URLs {
+		l.urls[i] = repl.ReplaceAll(raw, "")
+		u, err := url.Parse(l.urls[i])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url '%s'", raw)
+		}
+	}
+
+	l.inline = newDenyRules()
+	for _, entry := range l.Entries {
+		if err := l.inline.add(strings.TrimSpace(entry)); err != nil {
+			return err
+		}
+	}
+	l.loaded = make(map[string]*denyRules)
+	for _, file := range l.Files {
+		rules, err := l.loadFile(file)
+		if err != nil {
+			return err
+		}
+		l.loaded[file] = rules
+	}
+	if l.client == nil {
+		l.client = &http.Client{Timeout: denylistFetchTimeout}
+	}
+	l.publish()
+	return nil
+}
+
+// publish makes the inline and loaded rules active.
+func (l *Denylist) publish() {
+	rules := newDenyRules()
+	rules.merge(l.inline)
+	for _, loaded := range l.loaded {
+		rules.merge(loaded)
+	}
+	l.rules.Store(rules)
+}
+
+// loadFile reads the rules of a denylist file.
+func (l *Denylist) loadFile(file string) (*denyRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, skipped, err := parseDenylist(io.LimitReader(f, maxDenylistSize))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if skipped > 0 {
+		l.logger.Warn("skipped unsupported denylist rules", zap.String("file", file), zap.Int("count", skipped))
+	}
+	return rules, nil
+}
+
+// fetch downloads the rules of a denylist URL.
+func (l *Denylist) fetch(ctx context.Context, u string) (*denyRules, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	rules, skipped, err := parseDenylist(io.LimitReader(resp.Body, maxDenylistSize))
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		l.logger.Warn("skipped unsupported denylist rules", zap.String("host", req.URL.Host), zap.Int("count", skipped))
+	}
+	return rules, nil
+}
+
+// reload reloads every file and URL, keeping the previous rules of those
+// that fail, and makes the result active.
+func (l *Denylist) reload(ctx context.Context, files bool) {
+	if files {
+		for _, file := range l.Files {
+			rules, err := l.loadFile(file)
+			if err != nil {
+				l.logger.Error("reloading denylist", zap.String("file", file), zap.Error(err))
+				continue
+			}
+			l.loaded[file] = rules
+		}
+	}
+	for i, u := range l.urls {
+		rules, err := l.fetch(ctx, u)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Log the URL as configured, without any secrets.
+			l.logger.Error("fetching denylist", zap.String("url", l.URLs[i]), zap.Error(err))
+			continue
+		}
+		l.loaded[u] = rules
+	}
+	l.publish()
+}
+
+// start runs the loader, which fetches the URLs right away and reloads
+// every source each Interval, until stop is called or ctx is done.
+func (l *Denylist) start(ctx context.Context) {
+	if len(l.Files) == 0 && len(l.URLs) == 0 {
+		return
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go func(done chan<- struct{}) {
+		defer close(done)
+		if len(l.URLs) > 0 {
+			l.reload(ctx, false)
+		}
+		ticker := time.NewTicker(time.Duration(l.Interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.reload(ctx, true)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(l.done)
+}
+
+// stop stops the loader started by start and waits for it to exit.
+func (l *Denylist) stop() {
+	if l.cancel != nil {
+		l.cancel()
+		<-l.done
+		l.cancel = nil
+	}
+}
+
+// denied reports whether the content at requestPath, an escaped path,
+// under the link identifier of namespace is denied. A path within the
+// identifier itself counts as part of the content path.
+func (l *Denylist) denied(namespace, identifier, requestPath string) bool {
+	rules := l.rules.Load()
+	if rules == nil {
+		return false
+	}
+	root, subpath, _ := strings.Cut(identifier, "/")
+	contentPath, err := url.PathUnescape(requestPath)
+	if err != nil {
+		contentPath = requestPath
+	}
+	contentPath = path.Clean("/" + subpath + contentPath)
+	return rules.denied(namespace, root, contentPath)
+}
+
+// unmarshalDenylist parses the denylist subdirective:
+//
+//	denylist [<file|url>...] {
+//	    deny <rule>...
+//	    file <path>...
+//	    url <url>...
+//	    interval <duration>
+//	    status 410|451
+//	}
+func unmarshalDenylist(d *caddyfile.Dispenser) (*Denylist, error) {
+	l := new(Denylist)
+	addSources := func(sources []string) {
+		for _, source := range sources {
+			if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+				l.URLs = append(l.URLs, source)
+			} else {
+				l.Files = append(l.Files, source)
+			}
+		}
+	}
+	addSources(d.RemainingArgs())
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "deny", "file", "url":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			switch opt {
+			case "deny":
+				l.Entries = append(l.Entries, args...)
+			case "file":
+				l.Files = append(l.Files, args...)
+			default:
+				l.URLs = append(l.URLs, args...)
+			}
+		case "interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, err
+			}
+			l.Interval = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "status":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid status '%s'", d.Val())
+			}
+			l.Status = status
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return l, nil
+}
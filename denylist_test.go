@@ -0,0 +1,196 @@
+package dnslink
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+const (
+	testDeniedCIDv0 = "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR"
+	testDeniedCIDv1 = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+)
+
+func TestParseDenylist(t *testing.T) {
+	list := `version: 1
+name: test
+---
+# comment
+/ipfs/` + testDeniedCIDv0 + `
+
+!/ipfs/` + testDeniedCIDv0 + `/allowed
+/ipns/Example.COM
+unsupported
+//zQmHash
+`
+	rules, skipped, err := parseDenylist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+	if len(rules.paths) != 2 {
+		t.Errorf("rules = %v, want the ipfs and ipns rules", rules.paths)
+	}
+}
+
+func TestDenylistDenied(t *testing.T) {
+	sum := sha256.Sum256([]byte(testDeniedCIDv1 + "/legacy.txt"))
+	l := &Denylist{Entries: []string{
+		"/ipfs/" + testDeniedCIDv1 + "/private",
+		"/ipns/example.com",
+		"/swarm/abc",
+		"//" + hex.EncodeToString(sum[:]),
+	}}
+	if err := l.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		namespace, identifier, path string
+		want                        bool
+	}{
+		{"ipfs", testDeniedCIDv0, "/private", true},
+		{"ipfs", testDeniedCIDv0, "/private/a.txt", true},
+		{"ipfs", testDeniedCIDv0, "/%70rivate/", true},
+		{"ipfs", testDeniedCIDv0 + "/private", "/", true},
+		{"ipfs", testDeniedCIDv1, "/public/../private", true},
+		{"ipfs", testDeniedCIDv1, "/privateer", false},
+		{"ipfs", testDeniedCIDv1, "/", false},
+		{"ipfs", testDeniedCIDv1, "/legacy.txt", true},
+		{"ipns", "EXAMPLE.com.", "/", true},
+		{"ipns", "example.org", "/", false},
+		{"swarm", "abc", "/any", true},
+		{"bzz", "abc", "/any", false},
+	}
+	for _, tt := range tests {
+		if got := l.denied(tt.namespace, tt.identifier, tt.path); got != tt.want {
+			t.Errorf("denied(%s, %s, %s) = %v, want %v", tt.namespace, tt.identifier, tt.path, got, tt.want)
+		}
+	}
+
+	for _, l := range []*Denylist{
+		{},
+		{Entries: []string{"ipfs/" + testDeniedCIDv1}},
+		{Entries: []string{"/ipfs/"}},
+		{Entries: []string{"/swarm/abc"}, Status: http.StatusForbidden},
+		{URLs: []string{"ftp://lists.example/deny"}},
+		{Files: []string{filepath.Join(t.TempDir(), "missing")}},
+	} {
+		if err := l.provision(zap.NewNop()); err == nil {
+			t.Errorf("provision(%+v) succeeded", l)
+		}
+	}
+}
+
+func TestDenylistReload(t *testing.T) {
+	remote := "/ipfs/" + testDeniedCIDv1 + "\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if remote == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(remote))
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "denylist")
+	if err := os.WriteFile(file, []byte("/swarm/abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Denylist{Files: []string{file}, URLs: []string{srv.URL}}
+	if err := l.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if !l.denied("swarm", "abc", "/") || l.denied("ipfs", testDeniedCIDv1, "/") {
+		t.Error("provision() did not load only the file")
+	}
+	l.reload(context.Background(), false)
+	if !l.denied("swarm", "abc", "/") || !l.denied("ipfs", testDeniedCIDv1, "/") {
+		t.Error("reload() did not add the rules of the URL")
+	}
+
+	// Failing sources keep their previous rules.
+	remote = ""
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	l.reload(context.Background(), true)
+	if !l.denied("swarm", "abc", "/") || !l.denied("ipfs", testDeniedCIDv1, "/") {
+		t.Error("reload() dropped the rules of failing sources")
+	}
+}
+
+func TestDenylistServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "localhost:8080"},
+		Denylist:  &Denylist{Entries: []string{"/ipfs/" + testDeniedCIDv1}, Status: http.StatusUnavailableForLegalReasons},
+		proxies:   map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: testDeniedCIDv0}}}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Denylist.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://denied.example.org/index.html", nil)
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		t.Error("denied request was passed on")
+		return nil
+	})
+	if err := d.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnavailableForLegalReasons)
+	}
+}
+
+func TestUnmarshalDenylist(t *testing.T) {
+	input := `denylist /etc/caddy/badbits.deny https://badbits.dwebops.pub/badbits.deny {
+		deny /ipfs/` + testDeniedCIDv1 + ` /ipns/example.com
+		interval 30m
+		status 451
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	d.Next()
+	l, err := unmarshalDenylist(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Files) != 1 || len(l.URLs) != 1 || len(l.Entries) != 2 || l.Status != http.StatusUnavailableForLegalReasons {
+		t.Errorf("unmarshalDenylist() = %+v", l)
+	}
+
+	for _, input := range []string{
+		"denylist {\n deny\n}",
+		"denylist {\n status gone\n}",
+		"denylist {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalDenylist(d); err == nil {
+			t.Errorf("unmarshalDenylist(%q) succeeded", input)
+		}
+	}
+}
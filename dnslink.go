@@ -1,18 +1,32 @@
 package dnslink
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"html/template"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	dnslinkpkg "github.com/dnslink-std/go"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
 )
 
@@ -23,27 +37,381 @@ func init() {
 
 type DNSLink struct {
 	// Upstreams maps a prefix (e.g. "/swarm") to a reverse proxy upstream (e.g. "varnish:8080").
+	// The "default" prefix catches namespaces without a prefix or alias of
+	// their own; use {namespace} in its path template, or no replacement,
+	// to keep the namespace in the upstream path.
 	Upstreams map[string]string `json:"upstreams,omitempty"`
 
+	// DynamicUpstreams maps a prefix to a source of upstreams discovered at
+	// request time, as the dynamic upstreams of reverse_proxy, e.g. SRV or
+	// A/AAAA records re-resolved on an interval, so backends managed by
+	// service discovery can move without a config reload. A prefix has
+	// either an entry in Upstreams or one here.
+	DynamicUpstreams map[string]json.RawMessage `json:"dynamic_upstreams,omitempty" caddy:"namespace=http.reverse_proxy.upstreams inline_key=source"`
+
+	// Routes maps a prefix to the name of a route of the server's
+	// named_routes that serves its requests once rewritten, instead of a
+	// reverse proxy, so they can go through other handlers such as encode
+	// or authentication before their own reverse_proxy. A prefix has
+	// either an upstream or a route.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// Failover maps a prefix to the alternate upstreams its requests are
+	// retried against when its upstream fails.
+	Failover map[string]*Failover `json:"failover,omitempty"`
+
+	// Mirrors maps a prefix to the shadow upstream a share of its requests
+	// is copied to, with the responses discarded.
+	Mirrors map[string]*Mirror `json:"mirrors,omitempty"`
+
+	// UpstreamLimits maps a prefix to the caps on the rate and concurrency
+	// of the requests sent to its upstreams.
+	UpstreamLimits map[string]*UpstreamLimit `json:"upstream_limits,omitempty"`
+
+	// Transports maps a prefix to the tuning of the connections to its
+	// upstreams, including its Failover ones.
+	Transports map[string]*Transport `json:"transports,omitempty"`
+
+	// Streaming maps a prefix to how its proxied bodies are flushed and
+	// buffered, for large downloads, video and websocket upgrades.
+	Streaming map[string]*Streaming `json:"streaming,omitempty"`
+
+	// Trustless maps a prefix whose upstreams are trustless gateways to the
+	// verification of their responses: the requested files are fetched as
+	// CARs and served only once every block matches the CID of the link.
+	Trustless map[string]*Trustless `json:"trustless,omitempty"`
+
 	// Replacements maps a prefix (e.g. "/swarm") to the actual path prefix (e.g. "/bzz").
 	Replacements map[string]string `json:"replacements,omitempty"`
 
-	// CacheTTL is the duration to cache DNS lookups. Default is 1 minute.
-	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// PathTemplates maps a prefix to the layout of the upstream URL, e.g.
+	// "/bzz/{identifier}{path}" or "/api/v0/cat?arg={identifier}{path}".
+	// {namespace}, {identifier} and {path} are replaced with the link's
+	// namespace, its identifier and the request path. A template replaces
+	// the prefix's replacement; placeholders after the ? are query-escaped
+	// and the template's query is put before the request's own, from which
+	// parameters named like the template's are dropped.
+	PathTemplates map[string]string `json:"path_templates,omitempty"`
+
+	// HostHeaders maps a prefix to the Host header sent to its upstream:
+	// "keep" (the default) passes the client's Host through, "upstream"
+	// sets it to the upstream address, and any other value is used as the
+	// Host verbatim. The original host is always sent in X-Forwarded-Host.
+	HostHeaders map[string]string `json:"host_headers,omitempty"`
+
+	// PathModes maps a prefix to how the request path is combined with
+	// the upstream path of its links: "keep" (the default) appends it,
+	// "drop" leaves it out, for upstreams serving the content at a fixed
+	// URL, and any value starting with "/" is stripped from the front of
+	// the path first, for sites mounted under a path of the host. The
+	// request's own path and query are always sent in X-Original-Path.
+	PathModes map[string]string `json:"path_modes,omitempty"`
+
+	// NormalizePaths lists the prefixes whose request paths have runs of
+	// slashes collapsed before they are combined with the upstream path,
+	// for backends that would treat "//a" differently from "/a". Dot
+	// segments are always resolved.
+	NormalizePaths []string `json:"normalize_paths,omitempty"`
+
+	// HandleResponse maps a prefix to the response handlers of its reverse
+	// proxy, as the handle_response of reverse_proxy, so upstream responses
+	// such as a gateway's 404 can be replaced with a custom error page or
+	// retried against another backend.
+	HandleResponse map[string][]caddyhttp.ResponseHandler `json:"handle_response,omitempty"`
+
+	// Headers maps a prefix to manipulations of the headers of its proxied
+	// requests and responses, as the headers of reverse_proxy, e.g. to
+	// attach an auth token for a protected gateway or strip internal
+	// response headers. Values may contain placeholders. A HostHeaders
+	// entry for the prefix takes precedence over a Host set here.
+	Headers map[string]*headers.Handler `json:"headers,omitempty"`
+
+	// UpstreamAuth maps a prefix to the credentials sent to its upstreams,
+	// as basic authentication, a bearer token or a custom header. They
+	// take precedence over the same header set in Headers.
+	UpstreamAuth map[string]*UpstreamAuth `json:"upstream_auth,omitempty"`
+
+	// DialMultiaddrs proxies links whose identifier is a multiaddr, such as
+	// /dns4/example.com/tcp/443/https, /ip4/192.0.2.1/tcp/8080/http or
+	// /dnsaddr/example.com, to the endpoint they describe, when their
+	// namespace has no prefix or alias of its own. dnsaddr names are
+	// resolved to the first dialable address in their records. Links from
+	// any host can make Caddy connect to any address, so this should be
+	// combined with allowed hosts.
+	DialMultiaddrs bool `json:"dial_multiaddrs,omitempty"`
+
+	// SwarmFeeds, if set, resolves swarm and bzz links naming a feed to the
+	// feed's current reference through the Bee API before proxying.
+	SwarmFeeds *SwarmFeeds `json:"swarm_feeds,omitempty"`
+
+	// Aliases maps a namespace (e.g. "ipns") to the prefix whose upstream
+	// and replacement serve it (e.g. "/ipfs"), for namespaces without a
+	// prefix of their own.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Selection maps a prefix to the strategy used when a host publishes
+	// several entries in the prefix's namespace.
+	Selection map[string]*LinkSelection `json:"selection,omitempty"`
+
+	// ValidateIdentifiers rejects identifiers that are not well-formed
+	// for their namespace (CIDs for ipfs and ipns, hex references for
+	// swarm) instead of proxying them. Rejected links are logged and the
+	// request falls through as if there were no link.
+	ValidateIdentifiers bool `json:"validate_identifiers,omitempty"`
+
+	// LinksHeader, if set, is the name of a request header in which every
+	// resolved link is sent upstream as a comma-separated list of
+	// /<namespace>/<identifier> values, so upstreams can make their own
+	// routing decisions. Any such header sent by the client is removed.
+	LinksHeader string `json:"links_header,omitempty"`
+
+	// DNSLinkHeaders sends the host, the namespace and the identifier of
+	// the link a request is routed on upstream, in the X-Dnslink-Host,
+	// X-Dnslink-Namespace and X-Dnslink-Identifier request headers, so
+	// upstreams can log, vary and cache on the content root, along with
+	// the extensions of the link with txt_extensions. Any such headers
+	// sent by the client are removed.
+	DNSLinkHeaders bool `json:"dnslink_headers,omitempty"`
+
+	// GatewayHeaders sets the X-Ipfs-Path and X-Ipfs-Roots headers of the
+	// IPFS gateway specification on responses for ipfs and ipns links,
+	// describing the content path before it was rewritten for the
+	// upstream. Headers of the same name sent by the upstream are replaced.
+	GatewayHeaders bool `json:"gateway_headers,omitempty"`
+
+	// ProtocolLinks adds Link headers with the protocol-native address of
+	// responses, e.g. <ipfs://bafy.../index.html>; rel="alternate", and for
+	// the ipfs and ipns links of DNSLink hosts <ipns://example.com/...>;
+	// rel="canonical", for dweb clients and browser extensions to discover.
+	// Link headers sent by the upstream are kept.
+	ProtocolLinks bool `json:"protocol_links,omitempty"`
+
+	// WellKnown answers /.well-known/dnslink on every host with a link
+	// with a JSON description of it: the namespace, identifier and links
+	// resolved, when they were resolved and how many seconds they stay
+	// cached, so clients and monitoring can check what the gateway serves
+	// without DNS access.
+	WellKnown bool `json:"well_known,omitempty"`
+
+	// ServerTiming adds the resolution time and cache status, and the time
+	// the upstream took to respond, to the Server-Timing header of
+	// responses, for browser devtools and CDN logs.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// Refresh, if set, lets authorized requests force a fresh resolution of
+	// their host, updating the cache.
+	Refresh *Refresh `json:"refresh,omitempty"`
+
+	// Async, if set, answers requests for uncached hosts right away with a
+	// 503 and Retry-After while they are resolved in the background.
+	Async *AsyncResolution `json:"async,omitempty"`
+
+	// Trace, if set, answers authorized requests asking for it with a JSON
+	// description of how they would have been routed instead of routing
+	// them, for debugging.
+	Trace *Trace `json:"trace,omitempty"`
+
+	// HostOverride, if set, lets authorized requests name the domain that
+	// is resolved instead of their host, for testing a domain's routing
+	// before its DNS points at the gateway.
+	HostOverride *HostOverride `json:"host_override,omitempty"`
+
+	// Denylist, if set, answers requests for denied content with 410 or
+	// 451 instead of proxying them.
+	Denylist *Denylist `json:"denylist,omitempty"`
+
+	// RedirectsFile, if set, applies the _redirects file of the content
+	// root to requests the upstream answers with 404, as IPFS gateways do.
+	RedirectsFile *Redirects `json:"redirects_file,omitempty"`
+
+	// SubdomainRedirect, if set, redirects requests for ipfs and ipns
+	// links to a subdomain gateway instead of proxying them, for origin
+	// isolation between sites.
+	SubdomainRedirect *SubdomainRedirect `json:"subdomain_redirect,omitempty"`
+
+	// SubdomainGateways lists domains under which hosts of the form
+	// <cid>.ipfs.<domain>, <key>.ipns.<domain> and
+	// <inlined-domain>.ipns.<domain> are served like a subdomain gateway:
+	// CIDs and IPNS keys are routed without a lookup, and inlined domains,
+	// with "-" for "." and "--" for "-", by their DNSLink record.
+	SubdomainGateways []string `json:"subdomain_gateways,omitempty"`
+
+	// HostSuffixes lists suffixes, e.g. ".dweb.example.com", stripped from
+	// request hosts before resolution, so mysite.org.dweb.example.com
+	// serves the DNSLink of mysite.org under a single wildcard
+	// certificate. The longest matching suffix is stripped. Hosts of
+	// SubdomainGateways are left as they are.
+	HostSuffixes []string `json:"host_suffixes,omitempty"`
+
+	// RebaseLinks rewrites links in HTML and CSS responses that are rooted
+	// at the upstream path of the served identifier, such as
+	// "/ipfs/<cid>/style.css" or "/bzz/<hash>/app.js", to site-relative
+	// ones like "/style.css", for upstreams that emit gateway-rooted URLs.
+	// Upstream responses are requested uncompressed, and only those up to
+	// 10 MiB are rewritten.
+	RebaseLinks bool `json:"rebase_links,omitempty"`
+
+	// ETag sets an ETag derived from the identifier and request path on
+	// successful responses for content-addressed links (ipfs, swarm, bzz
+	// and Arweave transactions), replacing the upstream's, and answers
+	// matching If-None-Match requests with 304 Not Modified without
+	// contacting the upstream.
+	ETag bool `json:"etag,omitempty"`
+
+	// CacheControl sets "Cache-Control: public, max-age=N" on successful
+	// responses, replacing the upstream's, where N is the time until the
+	// host's resolution expires from the cache, so clients and CDNs cache
+	// content no longer than the record it was served from.
+	CacheControl bool `json:"cache_control,omitempty"`
+
+	// MaxAge overrides the max-age set by CacheControl per prefix, e.g. a
+	// long one for immutable content. Setting it enables CacheControl.
+	MaxAge map[string]caddy.Duration `json:"max_age,omitempty"`
+
+	// ContentCache, if set, answers GET and HEAD requests for immutable
+	// links from successful responses kept in memory, without contacting
+	// the upstream.
+	ContentCache *ContentCache `json:"content_cache,omitempty"`
+
+	// CORS maps a prefix to the CORS headers attached to its responses.
+	// Preflight requests are answered directly instead of being proxied.
+	CORS map[string]*CORSPolicy `json:"cors,omitempty"`
+
+	// OnMiss, if set, is the status returned for hosts without a usable
+	// link, for namespaces without an upstream, and for rejected
+	// identifiers, instead of passing the request on to the next handler.
+	OnMiss int `json:"on_miss,omitempty"`
+
+	// OnError, if set, is the status returned when resolution fails, e.g.
+	// 502 or 503, instead of passing the request on to the next handler.
+	OnError int `json:"on_error,omitempty"`
+
+	// ErrorPage is the path of an html/template file rendered for the
+	// responses of OnMiss and OnError, with the .Status, .Host, .Namespace
+	// and .Message of the failure. It implies an OnMiss of 404.
+	ErrorPage string `json:"error_page,omitempty"`
+
+	// ErrorJSON renders the responses of OnMiss and OnError as
+	// application/problem+json instead of plain text. It implies an
+	// OnMiss of 404.
+	ErrorJSON bool `json:"error_json,omitempty"`
+
+	// TrustForwardedHost resolves the host in the X-Forwarded-Host header
+	// instead of the request's Host when the request comes from a trusted
+	// proxy, e.g. a CDN in front of Caddy. Proxies are trusted if they are
+	// in TrustedProxies or in the server's trusted_proxies.
+	TrustForwardedHost bool `json:"trust_forwarded_host,omitempty"`
+
+	// TrustedProxies lists the IP ranges (CIDR or single addresses, or
+	// "private_ranges") whose X-Forwarded-Host is trusted.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// SNIFallback resolves the TLS server name of the connection instead
+	// of the request's host when the host is missing, an IP address, or
+	// not a valid domain name, for HTTPS clients with broken Host
+	// handling.
+	SNIFallback bool `json:"sni_fallback,omitempty"`
+
+	// MatchRaw, if set, holds request matcher sets of which at least one
+	// must match for the handler to apply. Other requests are passed on
+	// untouched, e.g. to keep DNSLink routing off "/admin/*" with a "not"
+	// matcher without wrapping the handler in a subroute.
+	MatchRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+
+	// CacheTTL, PrefixCacheTTL, Persist and CacheRaw configure a cache
+	// private to this handler, as described on App. If none of them are
+	// set, the handler uses the resolver and cache shared through the
+	// dnslink app.
+	CacheTTL       caddy.Duration            `json:"cache_ttl,omitempty"`
+	PrefixCacheTTL map[string]caddy.Duration `json:"prefix_cache_ttl,omitempty"`
+	Persist        bool                      `json:"persist,omitempty"`
+	CacheRaw       json.RawMessage           `json:"cache,omitempty" caddy:"namespace=dnslink.cache inline_key=backend"`
+
+	// HostConfigs overrides the upstreams, headers, error handling and
+	// cache TTL of the handler for some hosts. The first one matching a
+	// host applies.
+	HostConfigs []*HostConfig `json:"host_configs,omitempty"`
+
+	// ResolverRaw is a resolver module of the dnslink.resolvers
+	// namespace, e.g. a third-party plugin, that finds the links of hosts
+	// for this handler instead of the dnslink app's resolvers. It gives
+	// the handler a private cache.
+	ResolverRaw json.RawMessage `json:"resolver,omitempty" caddy:"namespace=dnslink.resolvers inline_key=resolver"`
+
+	// Resolver, if set, finds the links of hosts for this handler instead
+	// of the dnslink app's resolvers, e.g. for Go programs embedding the
+	// handler with their own resolution logic, or for fakes in tests. It
+	// cannot be set from JSON, takes precedence over ResolverRaw, and
+	// gives the handler a private cache.
+	Resolver Resolver `json:"-"`
+
+	// intercepts holds the intercept blocks of the Caddyfile until they
+	// are parsed into HandleResponse.
+	intercepts []intercept
+
+	// matchers holds the loaded MatchRaw.
+	matchers caddyhttp.MatcherSets
 
 	// proxies holds the initialized reverse proxy handlers.
 	proxies map[string]*reverseproxy.Handler
 
-	// cache holds the DNS lookup results.
-	cache sync.Map
+	// upstreamsMu guards proxies, Upstreams and DynamicUpstreams once the
+	// handler is provisioned, as the admin API can replace them. They are
+	// copied on write, so readers only hold it to load them.
+	upstreamsMu sync.RWMutex
 
-	logger *zap.Logger
-}
+	// alternates holds the reverse proxy handlers of the Failover
+	// upstreams, in order.
+	alternates map[string][]*reverseproxy.Handler
+
+	// mirrorProxies holds the reverse proxy handlers of the Mirrors
+	// upstreams.
+	mirrorProxies map[string]*reverseproxy.Handler
 
-type cachedLookup struct {
-	namespace  string
-	identifier string
-	expiresAt  time.Time
+	// limiters holds the state of UpstreamLimits.
+	limiters map[string]*upstreamLimiter
+
+	// mirroring tracks mirrored requests in progress, and mirrorsInFlight
+	// counts them. Cleanup calls cancelMirrors to abort them rather than
+	// wait for a slow shadow upstream.
+	mirroring       sync.WaitGroup
+	mirrorsInFlight atomic.Int32
+	mirrorsCtx      context.Context
+	cancelMirrors   context.CancelFunc
+
+	// multiaddrProxies holds the plain and TLS reverse proxies dialing
+	// multiaddr links, if DialMultiaddrs is set.
+	multiaddrProxies [2]*reverseproxy.Handler
+
+	// app resolves and caches DNSLink records for this handler.
+	app *App
+
+	// privateApp is set if app is owned by this handler rather than
+	// shared through the dnslink app.
+	privateApp bool
+
+	// trustedProxies holds the parsed TrustedProxies.
+	trustedProxies []netip.Prefix
+
+	// errorPage is the parsed ErrorPage template.
+	errorPage *template.Template
+
+	// site is the module holding the routes of the handler's site, and
+	// order the position of the handler among all handlers, for passing
+	// requests on to the site's later dnslink handlers.
+	site  caddy.Module
+	order uint64
+
+	// parent is the handler d is the copy of, if d serves a host config.
+	// The copy uses the denylist, content cache, mirrors and multiaddr
+	// proxies of its parent, which owns them.
+	parent *DNSLink
+
+	// ctx is the context the handler was provisioned with, for the
+	// reverse proxies of upstreams set at runtime.
+	ctx caddy.Context
+
+	logger *zap.Logger
 }
 
 func (d *DNSLink) CaddyModule() caddy.ModuleInfo {
@@ -54,71 +422,940 @@ func (d *DNSLink) CaddyModule() caddy.ModuleInfo {
 }
 
 func (d *DNSLink) Provision(ctx caddy.Context) error {
-	d.logger = ctx.Logger(d)
+	// Host configs start from the handler's own configuration, before it
+	// is provisioned.
+	var base []byte
+	if len(d.HostConfigs) > 0 {
+		var err error
+		if base, err = json.Marshal(d); err != nil {
+			return err
+		}
+	}
+	d.ctx, d.logger = ctx, ctx.Logger(d)
 	d.proxies = make(map[string]*reverseproxy.Handler)
+	d.alternates = make(map[string][]*reverseproxy.Handler)
+	d.mirrorProxies = make(map[string]*reverseproxy.Handler)
+	d.mirrorsCtx, d.cancelMirrors = context.WithCancel(context.Background())
+	d.limiters = make(map[string]*upstreamLimiter)
+	for prefix, l := range d.UpstreamLimits {
+		d.limiters[prefix] = l.newLimiter()
+	}
 
-	if d.CacheTTL == 0 {
-		d.CacheTTL = caddy.Duration(1 * time.Minute)
+	if d.ResolverRaw != nil && d.Resolver == nil {
+		mod, err := ctx.LoadModule(d, "ResolverRaw")
+		if err != nil {
+			return fmt.Errorf("loading resolver: %v", err)
+		}
+		d.Resolver = mod.(Resolver)
+	}
+	if d.CacheTTL != 0 || len(d.PrefixCacheTTL) > 0 || d.Persist || d.CacheRaw != nil || d.Resolver != nil {
+		d.app = &App{CacheTTL: d.CacheTTL, PrefixCacheTTL: d.PrefixCacheTTL, Persist: d.Persist, CacheRaw: d.CacheRaw}
+		if d.Resolver != nil {
+			d.app.chain = []Resolver{d.Resolver}
+		}
+		if err := d.app.Provision(ctx); err != nil {
+			return err
+		}
+		d.privateApp = true
+	} else {
+		appIface, err := ctx.App("dnslink")
+		if err != nil {
+			return fmt.Errorf("getting dnslink app: %v", err)
+		}
+		d.app = appIface.(*App)
+	}
+
+	trusted, err := parseTrustedProxies(d.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %v", err)
+	}
+	d.trustedProxies = trusted
+
+	if d.MatchRaw != nil {
+		matcherSets, err := ctx.LoadModule(d, "MatchRaw")
+		if err != nil {
+			return fmt.Errorf("loading matchers: %v", err)
+		}
+		if err := d.matchers.FromInterface(matcherSets); err != nil {
+			return fmt.Errorf("loading matchers: %v", err)
+		}
+	}
+
+	if shared, err := ctx.AppIfConfigured("dnslink"); err == nil {
+		d.inheritDefaults(shared.(*App))
+	}
+	if d.ErrorPage != "" && d.ErrorJSON {
+		return fmt.Errorf("error_page and error_json are mutually exclusive")
+	}
+	if d.ErrorPage != "" {
+		page, err := template.ParseFiles(d.ErrorPage)
+		if err != nil {
+			return fmt.Errorf("loading error page: %v", err)
+		}
+		d.errorPage = page
+	}
+	if (d.ErrorPage != "" || d.ErrorJSON) && d.OnMiss == 0 {
+		d.OnMiss = http.StatusNotFound
+	}
+	for _, status := range []int{d.OnMiss, d.OnError} {
+		if status != 0 && (status < 400 || status > 599) {
+			return fmt.Errorf("invalid error status %d", status)
+		}
+	}
+
+	for i, gateway := range d.SubdomainGateways {
+		d.SubdomainGateways[i] = strings.ToLower(strings.Trim(gateway, "."))
+	}
+	if err := d.provisionHostSuffixes(); err != nil {
+		return err
+	}
+	if d.Refresh != nil {
+		if err := d.Refresh.provision(); err != nil {
+			return fmt.Errorf("refresh: %v", err)
+		}
+	}
+	if d.Async != nil {
+		if err := d.Async.provision(); err != nil {
+			return fmt.Errorf("async: %v", err)
+		}
+	}
+	if d.HostOverride != nil {
+		if err := d.HostOverride.provision(); err != nil {
+			return fmt.Errorf("host override: %v", err)
+		}
+	}
+	if d.Denylist != nil {
+		if err := d.Denylist.provision(d.logger); err != nil {
+			return fmt.Errorf("denylist: %v", err)
+		}
+	}
+	if d.RedirectsFile != nil {
+		if err := d.RedirectsFile.provision(d.logger); err != nil {
+			return fmt.Errorf("redirects file: %v", err)
+		}
+	}
+	if d.Trace != nil {
+		if err := d.Trace.provision(); err != nil {
+			return fmt.Errorf("trace: %v", err)
+		}
+	}
+	if d.SwarmFeeds != nil {
+		if err := d.SwarmFeeds.provision(); err != nil {
+			return fmt.Errorf("swarm feeds: %v", err)
+		}
+	}
+	if d.SubdomainRedirect != nil {
+		if err := d.SubdomainRedirect.provision(); err != nil {
+			return fmt.Errorf("subdomain redirect: %v", err)
+		}
+	}
+	if d.ContentCache != nil {
+		if err := d.ContentCache.provision(); err != nil {
+			return fmt.Errorf("content cache: %v", err)
+		}
+	}
+
+	for prefix, sel := range d.Selection {
+		if err := sel.validate(); err != nil {
+			return fmt.Errorf("selection for %s: %v", prefix, err)
+		}
+	}
+
+	d.expandPlaceholders()
+	for prefix, tmpl := range d.PathTemplates {
+		if _, ok := d.Replacements[prefix]; ok {
+			return fmt.Errorf("prefix %s has both a replacement and a path template", prefix)
+		}
+		if err := validateTemplate(tmpl); err != nil {
+			return err
+		}
 	}
 
 	for prefix, upstream := range d.Upstreams {
-		// Create a reverse proxy handler for this upstream
-		rp := &reverseproxy.Handler{
-			Upstreams: reverseproxy.UpstreamPool{
-				{Dial: upstream},
-			},
+		rp, err := d.newProxy(ctx, prefix, &reverseproxy.Handler{Upstreams: staticPool(upstream)})
+		if err != nil {
+			return err
 		}
-		// We need to provision the reverse proxy
-		if err := rp.Provision(ctx); err != nil {
-			return fmt.Errorf("provisioning reverse proxy for %s: %v", prefix, err)
+		d.proxies[prefix] = rp
+	}
+	for prefix, source := range d.DynamicUpstreams {
+		rp, err := d.newProxy(ctx, prefix, &reverseproxy.Handler{DynamicUpstreamsRaw: source})
+		if err != nil {
+			return err
 		}
 		d.proxies[prefix] = rp
 	}
+	for prefix, f := range d.Failover {
+		for _, upstream := range f.Upstreams {
+			rp, err := d.newProxy(ctx, prefix, &reverseproxy.Handler{Upstreams: staticPool(upstream)})
+			if err != nil {
+				return err
+			}
+			d.alternates[prefix] = append(d.alternates[prefix], rp)
+		}
+	}
+	for prefix, m := range d.Mirrors {
+		rp, err := d.newProxy(ctx, prefix, &reverseproxy.Handler{Upstreams: staticPool(m.Upstream)})
+		if err != nil {
+			return err
+		}
+		d.mirrorProxies[prefix] = rp
+	}
+	if d.DialMultiaddrs {
+		plain, secure := newMultiaddrProxies()
+		for i, rp := range []*reverseproxy.Handler{plain, secure} {
+			pooled, err := loadProxy(ctx, rp)
+			if err != nil {
+				return fmt.Errorf("provisioning reverse proxy for multiaddrs: %v", err)
+			}
+			d.multiaddrProxies[i] = pooled
+		}
+	}
+	d.site, d.order = siteOf(ctx, d), handlerOrder.Add(1)
+	registerHandler(d)
+	if d.Denylist != nil {
+		d.Denylist.start(ctx)
+	}
+	return d.provisionHostConfigs(ctx, base)
+}
+
+// expandPlaceholders replaces the global placeholders in the upstream
+// addresses and replacements, e.g. {env.BEE_UPSTREAM}, so one config can
+// serve several environments. Other placeholders are left to the reverse
+// proxy, which expands request placeholders in upstream addresses.
+func (d *DNSLink) expandPlaceholders() {
+	repl := caddy.NewReplacer()
+	for prefix, upstream := range d.Upstreams {
+		d.Upstreams[prefix] = repl.ReplaceKnown(upstream, "")
+	}
+	for _, f := range d.Failover {
+		for i, upstream := range f.Upstreams {
+			f.Upstreams[i] = repl.ReplaceKnown(upstream, "")
+		}
+	}
+	for _, m := range d.Mirrors {
+		m.Upstream = repl.ReplaceKnown(m.Upstream, "")
+	}
+	for prefix, replacement := range d.Replacements {
+		d.Replacements[prefix] = repl.ReplaceKnown(replacement, "")
+	}
+}
+
+// inheritDefaults sets the error options d leaves unset to the defaults
+// of the dnslink app.
+func (d *DNSLink) inheritDefaults(a *App) {
+	if d.OnMiss == 0 {
+		d.OnMiss = a.OnMiss
+	}
+	if d.OnError == 0 {
+		d.OnError = a.OnError
+	}
+	if d.ErrorPage == "" && !d.ErrorJSON {
+		d.ErrorPage, d.ErrorJSON = a.ErrorPage, a.ErrorJSON
+	}
+}
+
+// staticPool returns the upstream pool of a single upstream address.
+func staticPool(upstream string) reverseproxy.UpstreamPool {
+	return reverseproxy.UpstreamPool{
+		{Dial: upstream},
+	}
+}
+
+// newProxy sets up rp as a reverse proxy of prefix.
+func (d *DNSLink) newProxy(ctx caddy.Context, prefix string, rp *reverseproxy.Handler) (*reverseproxy.Handler, error) {
+	rp.Headers = proxyHeaders(d.Headers[prefix], d.HostHeaders[prefix], d.UpstreamAuth[prefix])
+	if t, ok := d.Transports[prefix]; ok {
+		rp.TransportRaw = caddyconfig.JSONModuleObject(t.httpTransport(), "protocol", "http", nil)
+	}
+	if s, ok := d.Streaming[prefix]; ok {
+		s.apply(rp)
+	}
+	handlers, err := d.responseHandlers(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("copying response handlers for %s: %v", prefix, err)
+	}
+	rp.HandleResponse = handlers
+	// We need to provision the reverse proxy, unless a handler of this or
+	// the previous config already has one of the same config
+	pooled, err := loadProxy(ctx, rp)
+	if err != nil {
+		return nil, fmt.Errorf("provisioning reverse proxy for %s: %v", prefix, err)
+	}
+	return pooled, nil
+}
+
+// Validate rejects configurations that would misbehave at request time.
+// Prefixes must be a single path segment such as "/ipfs", every upstream
+// needs an address and every route a name, aliases must point to a prefix
+// with an upstream or a route, and two prefixes of the same upstream
+// cannot share a replacement, since the upstream couldn't tell their links
+// apart.
+func (d *DNSLink) Validate() error {
+	for prefix, upstream := range d.Upstreams {
+		if err := validatePrefix(prefix); err != nil {
+			return err
+		}
+		if strings.TrimSpace(upstream) == "" {
+			return fmt.Errorf("prefix %s has an empty upstream address", prefix)
+		}
+	}
+	for prefix, name := range d.Routes {
+		if err := validatePrefix(prefix); err != nil {
+			return err
+		}
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("prefix %s has an empty route name", prefix)
+		}
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if static || dynamic {
+			return fmt.Errorf("prefix %s has both an upstream and a route", prefix)
+		}
+	}
+	for prefix, mode := range d.PathModes {
+		if mode != pathModeKeep && mode != pathModeDrop && !strings.HasPrefix(mode, "/") {
+			return fmt.Errorf("invalid path mode '%s' for %s", mode, prefix)
+		}
+	}
+	for _, prefixes := range []map[string]string{d.Replacements, d.PathTemplates, d.HostHeaders, d.PathModes} {
+		for prefix := range prefixes {
+			if err := validatePrefix(prefix); err != nil {
+				return err
+			}
+		}
+	}
+	for prefix := range d.Headers {
+		if err := validatePrefix(prefix); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range d.NormalizePaths {
+		if err := validatePrefix(prefix); err != nil {
+			return err
+		}
+	}
+	for prefix := range d.Replacements {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		_, routed := d.Routes[prefix]
+		if !static && !dynamic && !routed {
+			return fmt.Errorf("replacement for %s, which has no upstream", prefix)
+		}
+	}
+	for prefix, auth := range d.UpstreamAuth {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("upstream_auth for %s, which has no upstream", prefix)
+		}
+		if err := auth.validate(); err != nil {
+			return fmt.Errorf("upstream_auth for %s: %v", prefix, err)
+		}
+	}
+	for prefix := range d.HandleResponse {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("response handlers for %s, which has no upstream", prefix)
+		}
+	}
+	for prefix, f := range d.Failover {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("failover for %s, which has no upstream", prefix)
+		}
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("failover for %s: %v", prefix, err)
+		}
+	}
+	for prefix, m := range d.Mirrors {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("mirror for %s, which has no upstream", prefix)
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("mirror for %s: %v", prefix, err)
+		}
+	}
+	for prefix, l := range d.UpstreamLimits {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		_, routed := d.Routes[prefix]
+		if !static && !dynamic && !routed {
+			return fmt.Errorf("upstream_limit for %s, which has no upstream", prefix)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("upstream_limit for %s: %v", prefix, err)
+		}
+	}
+	for prefix, t := range d.Transports {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("transport for %s, which has no upstream", prefix)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("transport for %s: %v", prefix, err)
+		}
+	}
+	for prefix, s := range d.Streaming {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("streaming for %s, which has no upstream", prefix)
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("streaming for %s: %v", prefix, err)
+		}
+	}
+	for prefix, t := range d.Trustless {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		if !static && !dynamic {
+			return fmt.Errorf("trustless for %s, which has no upstream", prefix)
+		}
+		_, replaced := d.Replacements[prefix]
+		_, templated := d.PathTemplates[prefix]
+		if replaced || templated {
+			return fmt.Errorf("trustless for %s, which rewrites the upstream path", prefix)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("trustless for %s: %v", prefix, err)
+		}
+	}
+	for prefix := range d.DynamicUpstreams {
+		if err := validatePrefix(prefix); err != nil {
+			return err
+		}
+		if _, ok := d.Upstreams[prefix]; ok {
+			return fmt.Errorf("prefix %s has both a static and a dynamic upstream", prefix)
+		}
+	}
+
+	sharing := make(map[[2]string]string)
+	for prefix, upstream := range d.Upstreams {
+		replacement, ok := d.Replacements[prefix]
+		if !ok {
+			continue
+		}
+		key := [2]string{upstream, path.Clean("/" + replacement)}
+		if other, ok := sharing[key]; ok {
+			return fmt.Errorf("prefixes %s and %s both use replacement %s on upstream %s", min(prefix, other), max(prefix, other), replacement, upstream)
+		}
+		sharing[key] = prefix
+	}
+
+	for namespace, prefix := range d.Aliases {
+		_, static := d.Upstreams[prefix]
+		_, dynamic := d.DynamicUpstreams[prefix]
+		_, routed := d.Routes[prefix]
+		if !static && !dynamic && !routed {
+			return fmt.Errorf("alias %s points to prefix %s, which has no upstream", namespace, prefix)
+		}
+	}
+
+	if d.CacheTTL < 0 {
+		return fmt.Errorf("negative cache_ttl %v", time.Duration(d.CacheTTL))
+	}
+	for prefix, age := range d.MaxAge {
+		if age < 0 {
+			return fmt.Errorf("negative max age %v for %s", time.Duration(age), prefix)
+		}
+	}
+	if d.privateApp {
+		return d.app.Validate()
+	}
 	return nil
 }
 
+// validatePrefix checks that prefix is a slash followed by a namespace.
+func validatePrefix(prefix string) error {
+	if prefix == defaultPrefix {
+		return nil
+	}
+	if !strings.HasPrefix(prefix, "/") || len(prefix) == 1 || strings.Contains(prefix[1:], "/") {
+		return fmt.Errorf("invalid prefix '%s': must be '/' followed by a namespace, e.g. /ipfs", prefix)
+	}
+	return nil
+}
+
+// Cleanup releases the reverse proxies, which are not loaded as modules
+// and so are not cleaned up by Caddy, along with the private app if any.
+// Proxies still used by the handlers of another config are kept.
+func (d *DNSLink) Cleanup() error {
+	unregisterHandler(d)
+	// A copy serving a host config leaves what it shares to its parent.
+	if d.Denylist != nil && d.parent == nil {
+		d.Denylist.stop()
+	}
+	var errs []error
+	for _, hc := range d.HostConfigs {
+		if hc.handler != nil {
+			errs = append(errs, hc.handler.Cleanup())
+		}
+	}
+	d.upstreamsMu.Lock()
+	proxies := d.proxies
+	d.proxies = nil
+	d.upstreamsMu.Unlock()
+	for prefix, rp := range proxies {
+		if err := releaseProxy(rp); err != nil {
+			errs = append(errs, fmt.Errorf("cleaning up reverse proxy for %s: %v", prefix, err))
+		}
+	}
+	for prefix, alternates := range d.alternates {
+		for _, rp := range alternates {
+			if err := releaseProxy(rp); err != nil {
+				errs = append(errs, fmt.Errorf("cleaning up reverse proxy for %s: %v", prefix, err))
+			}
+		}
+	}
+	if d.cancelMirrors != nil {
+		d.cancelMirrors()
+	}
+	d.mirroring.Wait()
+	for prefix, rp := range d.mirrorProxies {
+		if err := releaseProxy(rp); err != nil {
+			errs = append(errs, fmt.Errorf("cleaning up mirror reverse proxy for %s: %v", prefix, err))
+		}
+	}
+	for _, rp := range d.multiaddrProxies {
+		if rp == nil || d.parent != nil {
+			continue
+		}
+		if err := releaseProxy(rp); err != nil {
+			errs = append(errs, fmt.Errorf("cleaning up reverse proxy for multiaddrs: %v", err))
+		}
+	}
+	d.alternates, d.mirrorProxies, d.multiaddrProxies = nil, nil, [2]*reverseproxy.Handler{}
+	if d.privateApp {
+		errs = append(errs, d.app.Cleanup())
+	}
+	return errors.Join(errs...)
+}
+
 func (d *DNSLink) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !d.matchers.AnyMatch(r) {
+		return next.ServeHTTP(w, r)
+	}
 	d.logger.Debug("handling request", zap.String("uri", r.RequestURI), zap.String("host", r.Host))
-	host := r.Host
-	if h, _, err := net.SplitHostPort(host); err == nil {
-		host = h
+	host := d.requestHost(r)
+	if d.HostOverride != nil {
+		if override, ok := d.HostOverride.host(r); ok {
+			d.logger.Info("overriding dnslink host", zap.String("host", host), zap.String("override", override), zap.String("client", clientFrom(withClient(r.Context(), r))))
+			host = override
+		}
+	}
+	return d.hostHandler(host).serveHost(w, r, next, host)
+}
+
+// serveHost routes r, a request for host.
+func (d *DNSLink) serveHost(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, host string) error {
+	if d.LinksHeader != "" {
+		r.Header.Del(d.LinksHeader)
+	}
+	if d.DNSLinkHeaders {
+		setDNSLinkHeaders(r.Header, "", "", "")
+		setExtensionHeaders(r.Header, nil)
+	}
+
+	// A trace started by an earlier dnslink handler of the site follows
+	// the request.
+	tr := traceFrom(r)
+	if tr == nil && d.Trace != nil && d.Trace.requested(r) {
+		tr = &requestTrace{Host: host}
+		r = withTrace(r, tr)
 	}
+	out := w
+	al := new(accessLog)
+	defer al.write(r)
 
-	namespace, identifier, err := d.resolve(host)
+	var entry CacheEntry
+	var cacheStatus string
+	var err error
+	start := time.Now()
+	subNamespace, subLabel, subdomain := subdomainHost(host, d.SubdomainGateways)
+	shared, reused := resolution(r, d.app, host)
+	switch {
+	case subdomain:
+		entry, err = d.resolveSubdomain(withClient(r.Context(), r), subNamespace, subLabel)
+		cacheStatus = "subdomain"
+	case reused:
+		entry, cacheStatus = shared.entry, shared.cacheStatus
+	default:
+		entry, cacheStatus, err = d.resolveRequest(r, host)
+	}
+	al.cacheStatus, al.resolveDuration, al.namespace = cacheStatus, time.Since(start), entry.Namespace
+	// A reused resolution was timed by the handler that made it.
+	if d.ServerTiming && !reused {
+		w.Header().Add("Server-Timing", resolutionTiming(cacheStatus, al.resolveDuration))
+	}
+	if tr != nil {
+		tr.Cache = cacheStatus
+		tr.setEntry(entry)
+	}
 	if err != nil {
 		d.logger.Debug("dns lookup failed", zap.String("host", host), zap.Error(err))
-		return next.ServeHTTP(w, r)
+		if tr != nil {
+			tr.Error = err.Error()
+		}
+		if r.Context().Err() != nil {
+			return next.ServeHTTP(w, r)
+		}
+		if errors.Is(err, errRateLimited) {
+			return d.fail(w, r, next, failure{
+				Status:  http.StatusTooManyRequests,
+				Host:    host,
+				Message: "too many DNSLink resolutions, try again later",
+			})
+		}
+		if errors.Is(err, errResolutionPending) {
+			return d.servePending(w, r, next, host)
+		}
+		return d.fail(w, r, next, failure{
+			Status:  d.OnError,
+			Host:    host,
+			Message: "DNSLink resolution failed for " + host,
+		})
 	}
+	namespace := entry.Namespace
 
 	if namespace == "" {
-		return next.ServeHTTP(w, r)
+		return d.fail(w, r, next, failure{
+			Status:  d.OnMiss,
+			Host:    host,
+			Message: "no DNSLink record found for " + host,
+		})
+	}
+	if d.WellKnown && r.URL.Path == wellKnownPath {
+		return serveWellKnown(w, r, newWellKnownDocument(host, entry, cacheStatus, time.Now()))
+	}
+
+	if d.dialsMultiaddr(namespace) {
+		identifier := d.selectIdentifier("/"+namespace, entry)
+		link, _ := multiaddrLink(namespace, identifier)
+		al.identifier = identifier
+		if tr != nil {
+			tr.Identifier = identifier
+		}
+		if d.DNSLinkHeaders {
+			setDNSLinkHeaders(r.Header, host, namespace, identifier)
+			setExtensionHeaders(r.Header, entry.extensions(namespace, identifier))
+		}
+		r.Header.Set(headerOriginalPath, r.URL.RequestURI())
+		return d.serveMultiaddr(w, r, next, host, link, al)
 	}
 
 	// Match prefix
 	// We assume the prefix in Caddyfile matches /namespace
-	prefix := "/" + namespace
-	if proxy, ok := d.proxies[prefix]; ok {
+	prefix := d.prefixFor(namespace)
+	// The proxy is read once, so an upstream removed meanwhile can't leave
+	// the request matched without one.
+	proxy, ok := d.proxy(prefix)
+	if _, route := d.Routes[prefix]; ok || route {
 		// Match found!
+		identifier := d.selectIdentifier(prefix, entry)
+		ext := entry.extensions(namespace, identifier)
+		if owner, topic, rest, ok := parseFeed(identifier); ok && d.SwarmFeeds != nil && (namespace == "swarm" || namespace == "bzz") {
+			ref, expiresAt, err := d.SwarmFeeds.resolve(withClient(r.Context(), r), owner, topic)
+			if err != nil {
+				d.logger.Debug("swarm feed lookup failed", zap.String("host", host), zap.Error(err))
+				if r.Context().Err() != nil {
+					return next.ServeHTTP(w, r)
+				}
+				return d.fail(w, r, next, failure{
+					Status:    d.OnError,
+					Host:      host,
+					Namespace: namespace,
+					Message:   "Swarm feed lookup failed for " + host,
+				})
+			}
+			identifier = ref + rest
+			// Responses must not be cached longer than the feed's reference.
+			if entry.ExpiresAt.IsZero() || expiresAt.Before(entry.ExpiresAt) {
+				entry.ExpiresAt = expiresAt
+			}
+		}
+		al.identifier = identifier
+		al.setPrefix(d, prefix)
+		if tr != nil {
+			tr.setPrefix(d, prefix)
+			tr.Identifier = identifier
+		}
+		if d.ValidateIdentifiers {
+			if err := validateIdentifier(namespace, identifier); err != nil {
+				d.logger.Warn("ignoring dnslink", zap.String("host", host), zap.Error(err))
+				return d.fail(w, r, next, failure{
+					Status:    d.OnMiss,
+					Host:      host,
+					Namespace: namespace,
+					Message:   "invalid DNSLink record for " + host,
+				})
+			}
+		}
 		d.logger.Debug("dnslink match", zap.String("host", host), zap.String("namespace", namespace), zap.String("identifier", identifier))
 
-		replacement := d.Replacements[prefix]
-		r.URL.Path = buildPath(namespace, identifier, replacement, r.URL.Path)
+		if d.LinksHeader != "" {
+			r.Header.Set(d.LinksHeader, formatLinks(entry.Links))
+		}
+
+		escaped, err := escapeIdentifier(identifier)
+		if err != nil {
+			d.logger.Warn("ignoring dnslink", zap.String("host", host), zap.Error(err))
+			return d.fail(w, r, next, failure{
+				Status:    d.OnMiss,
+				Host:      host,
+				Namespace: namespace,
+				Message:   "invalid DNSLink record for " + host,
+			})
+		}
+		if d.DNSLinkHeaders {
+			setDNSLinkHeaders(r.Header, host, namespace, escaped)
+			setExtensionHeaders(r.Header, ext)
+		}
+		r.Header.Set(headerOriginalPath, r.URL.RequestURI())
+		tmpl, hasTemplate := d.pathTemplate(prefix)
+		if hasTemplate && hasMultiaddrPlaceholders(tmpl) {
+			link, _ := multiaddrLink(namespace, identifier)
+			m, err := parseMultiaddr(link)
+			if err != nil {
+				d.logger.Warn("ignoring dnslink", zap.String("host", host), zap.Error(err))
+				return d.fail(w, r, next, failure{
+					Status:    d.OnMiss,
+					Host:      host,
+					Namespace: namespace,
+					Message:   "invalid DNSLink record for " + host,
+				})
+			}
+			tmpl = expandMultiaddr(tmpl, m.withDefaults())
+		}
+		requestPath := cleanPath(r.URL.EscapedPath())
+		if d.Denylist != nil && d.Denylist.denied(namespace, identifier, requestPath) {
+			d.logger.Info("denied dnslink content", zap.String("host", host), zap.String("namespace", namespace), zap.String("identifier", identifier), zap.String("path", requestPath))
+			dnslinkMetrics.deniedContent.WithLabelValues(namespace).Inc()
+			return d.fail(w, r, next, failure{
+				Status:    d.Denylist.Status,
+				Host:      host,
+				Namespace: namespace,
+				Message:   "this content is unavailable",
+			})
+		}
+		if d.SubdomainRedirect != nil && !subdomain {
+			loc, ok, err := d.SubdomainRedirect.location(namespace, escaped, requestPath, r.URL.RawQuery)
+			if err != nil {
+				d.logger.Warn("ignoring dnslink", zap.String("host", host), zap.Error(err))
+				return d.fail(w, r, next, failure{
+					Status:    d.OnMiss,
+					Host:      host,
+					Namespace: namespace,
+					Message:   "invalid DNSLink record for " + host,
+				})
+			}
+			if ok && tr != nil {
+				tr.Redirect, tr.Outcome, tr.Status = loc, traceRedirect, d.SubdomainRedirect.Status
+				return tr.write(out)
+			}
+			if ok {
+				http.Redirect(w, r, loc, d.SubdomainRedirect.Status)
+				return nil
+			}
+		}
+		ow := newOverrideHeadersWriter(w)
+		if policy, ok := d.CORS[prefix]; ok {
+			origin := r.Header.Get("Origin")
+			if isPreflight(r) && tr == nil {
+				for name, values := range policy.preflightHeaders(origin) {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			}
+			for name, values := range policy.headers(origin) {
+				// Vary must be merged with the upstream's, so add it to
+				// the response before the upstream's headers are copied.
+				if name == "Vary" {
+					w.Header()[name] = append(w.Header()[name], values...)
+					continue
+				}
+				ow.headers[name] = values
+			}
+		}
+		if d.GatewayHeaders {
+			for name, values := range gatewayHeaders(namespace, escaped, requestPath) {
+				ow.headers[name] = values
+			}
+		}
+		if d.ProtocolLinks {
+			canonicalHost := host
+			if subdomain {
+				canonicalHost = ""
+			}
+			// Like Vary, Link is merged with the upstream's.
+			for _, link := range protocolLinks(namespace, escaped, requestPath, canonicalHost) {
+				w.Header().Add("Link", link)
+			}
+		}
+		if d.CacheControl || len(d.MaxAge) > 0 {
+			ow.successHeaders.Set("Cache-Control", cacheControl(d.maxAge(prefix, entry, time.Now())))
+		}
+		if d.ETag {
+			if etag := identifierETag(namespace, escaped, requestPath, r.URL.RawQuery); etag != "" {
+				if (r.Method == http.MethodGet || r.Method == http.MethodHead) && tr == nil && etagMatches(r.Header.Get("If-None-Match"), etag) {
+					dnslinkMetrics.notModified.WithLabelValues(namespace).Inc()
+					notModified(ow, etag)
+					return nil
+				}
+				ow.successHeaders.Set("ETag", etag)
+			}
+		}
+		if len(ow.headers) > 0 || len(ow.successHeaders) > 0 {
+			w = ow
+		}
+		var rw *rebaseWriter
+		if d.RebaseLinks && r.Method != http.MethodHead && tr == nil {
+			rw = newRebaseWriter(w, rebaseRoots(namespace, escaped, d.Replacements[prefix]))
+			w = rw
+			r.Header.Del("Accept-Encoding")
+		}
+		var contentCacheKey string
+		if d.ContentCache != nil {
+			contentCacheKey = contentKey(namespace, escaped, requestPath, r)
+		}
+		// setPath points r at the upstream path of linkPath, an escaped
+		// path of the content root.
+		query := r.URL.RawQuery
+		setPath := func(r *http.Request, linkPath string) error {
+			var rawPath string
+			if slices.Contains(d.NormalizePaths, prefix) {
+				linkPath = collapseSlashes(linkPath)
+			}
+			linkPath = combinedPath(d.PathModes[prefix], linkPath)
+			if hasTemplate {
+				var rawQuery string
+				rawPath, rawQuery = expandTemplate(tmpl, namespace, escaped, linkPath)
+				r.URL.RawQuery = mergeQuery(rawQuery, query)
+			} else {
+				rawPath = buildPath(namespace, escaped, d.Replacements[prefix], linkPath)
+			}
+			upstreamPath, err := url.PathUnescape(rawPath)
+			if err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("building upstream path: %v", err))
+			}
+			r.URL.Path, r.URL.RawPath = upstreamPath, rawPath
+			return nil
+		}
+		if err := setPath(r, requestPath); err != nil {
+			return err
+		}
+
+		if tr != nil {
+			tr.UpstreamPath, tr.Outcome = r.URL.EscapedPath(), traceProxy
+			if r.URL.RawQuery != "" {
+				tr.UpstreamPath += "?" + r.URL.RawQuery
+			}
+			return tr.write(out)
+		}
+
+		ctx, span := startSpan(r.Context(), "dnslink.proxy",
+			attrHost.String(host),
+			attrNamespace.String(namespace),
+			attrIdentifier.String(identifier),
+		)
+		defer span.End()
 
 		// Delegate to the reverse proxy
-		return proxy.ServeHTTP(w, r, next)
+		r = r.WithContext(ctx)
+		if d.ServerTiming {
+			w = newServerTimingWriter(w)
+		}
+		proxyRequest := func(w http.ResponseWriter, r *http.Request) error {
+			if l, ok := d.limiters[prefix]; ok {
+				release, err := l.acquire(r.Context(), time.Now())
+				if err != nil {
+					return d.rejectLimited(w, r, prefix, host, namespace, err)
+				}
+				defer release()
+			}
+			dnslinkMetrics.proxiedRequests.WithLabelValues(namespace).Inc()
+			if name, ok := d.Routes[prefix]; ok {
+				return invokeRoute(w, r, next, name)
+			}
+			d.mirror(r, prefix)
+			if t, ok := d.Trustless[prefix]; ok {
+				return t.serve(w, r, prefix, func(w http.ResponseWriter, r *http.Request) error {
+					return d.serveFailover(w, r, next, prefix, proxy)
+				})
+			}
+			return d.serveFailover(w, r, next, prefix, proxy)
+		}
+		serve := func(w http.ResponseWriter) error {
+			if d.RedirectsFile != nil {
+				key := "/" + namespace + "/" + escaped
+				return d.RedirectsFile.serve(w, r, key, requestPath, immutableLink(namespace, identifier), setPath, proxyRequest)
+			}
+			return proxyRequest(w, r)
+		}
+		if contentCacheKey != "" {
+			err = d.ContentCache.serve(w, r, contentCacheKey, serve)
+		} else {
+			err = serve(w)
+		}
+		if err == nil && rw != nil {
+			err = rw.finish()
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			if r.Context().Err() == nil {
+				d.app.recent.failed(host, prefix, err)
+			}
+		}
+		return err
 	}
 
+	if !subdomain && d.defers(namespace) {
+		d.logger.Debug("passing request to a later dnslink handler", zap.String("host", host), zap.String("namespace", namespace))
+		al.skip = true
+		return next.ServeHTTP(w, withResolution(r, sharedResolution{app: d.app, host: host, entry: entry, cacheStatus: cacheStatus}))
+	}
 	d.logger.Debug("no matching prefix found", zap.String("host", host), zap.String("namespace", namespace))
-	return next.ServeHTTP(w, r)
+	return d.fail(w, r, next, failure{
+		Status:    d.OnMiss,
+		Host:      host,
+		Namespace: namespace,
+		Message:   "namespace " + namespace + " is not served for " + host,
+	})
+}
+
+// fail ends a request that cannot be routed: with an error response if
+// f has a status, or by passing it on to next. Traced requests get their
+// trace instead.
+func (d *DNSLink) fail(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, f failure) error {
+	if tr := traceFrom(r); tr != nil {
+		tr.Outcome, tr.Status, tr.Message = traceFail, f.Status, f.Message
+		if f.Status == 0 {
+			tr.Outcome = traceNext
+		}
+		return tr.write(w)
+	}
+	if f.Status == 0 {
+		return next.ServeHTTP(w, r)
+	}
+	return d.writeFailure(w, f)
 }
 
 // buildPath constructs the rewritten path for proxying.
 // It combines the replacement (or namespace prefix), identifier, and original path.
+// The identifier and original path are escaped already, so escaped slashes
+// in the request reach the upstream as they were sent.
 func buildPath(namespace, identifier, replacement, originalPath string) string {
 	// Start with replacement or namespace prefix
 	base := "/" + namespace
 	if replacement != "" {
-		base = replacement
+		base = escapePath(replacement)
 	}
 
 	// Ensure base ends with /
@@ -141,110 +1378,905 @@ func buildPath(namespace, identifier, replacement, originalPath string) string {
 	return newPath
 }
 
-func (d *DNSLink) resolve(host string) (string, string, error) {
-	if val, ok := d.cache.Load(host); ok {
-		entry := val.(cachedLookup)
-		if time.Now().Before(entry.expiresAt) {
-			return entry.namespace, entry.identifier, nil
+// hostHeaderOps returns the header operations rewriting the upstream Host
+// header as configured in HostHeaders, or nil to keep the client's Host.
+func hostHeaderOps(host string) *headers.Handler {
+	switch host {
+	case "", "keep":
+		return nil
+	case "upstream":
+		host = "{http.reverse_proxy.upstream.hostport}"
+	}
+	return &headers.Handler{
+		Request: &headers.HeaderOps{
+			Set: http.Header{"Host": []string{host}},
+		},
+	}
+}
+
+// proxyHeaders combines the header operations configured for a prefix with
+// those of its HostHeaders and UpstreamAuth settings, which take
+// precedence.
+func proxyHeaders(ops *headers.Handler, host string, auth *UpstreamAuth) *headers.Handler {
+	set := make(http.Header)
+	if hostOps := hostHeaderOps(host); hostOps != nil {
+		set.Set("Host", hostOps.Request.Set.Get("Host"))
+	}
+	if auth != nil {
+		name, value := auth.header()
+		set.Set(name, value)
+	}
+	if len(set) == 0 {
+		return ops
+	}
+	var merged headers.Handler
+	if ops != nil {
+		merged = *ops
+	}
+	var req headers.HeaderOps
+	if merged.Request != nil {
+		req = *merged.Request
+	}
+	req.Set = req.Set.Clone()
+	if req.Set == nil {
+		req.Set = make(http.Header)
+	}
+	for name, values := range set {
+		req.Set[name] = values
+	}
+	merged.Request = &req
+	return &merged
+}
+
+// escapeIdentifier percent-encodes each /-separated segment of identifier
+// so it cannot inject query strings, fragments or encoded slashes into the
+// upstream path. Identifiers with . or .. segments are rejected, since they
+// would let a TXT record reach paths outside its own on the upstream.
+func escapeIdentifier(identifier string) (string, error) {
+	segments := strings.Split(identifier, "/")
+	for i, seg := range segments {
+		if seg == "." || seg == ".." {
+			return "", fmt.Errorf("identifier %q contains a %q segment", identifier, seg)
 		}
-		d.cache.Delete(host)
+		segments[i] = url.PathEscape(seg)
 	}
+	return strings.Join(segments, "/"), nil
+}
 
-	// Use the official dnslink library to resolve
-	result, err := dnslinkpkg.Resolve(host)
-	if err != nil {
-		// If it's just that no link was found, we return empty string without error
-		// so the handler can continue to the next middleware.
-		d.logger.Debug("dnslink resolution result", zap.String("host", host), zap.Error(err))
-		return "", "", nil
+// cleanPath resolves . and .. segments of an escaped request path, including
+// percent-encoded ones, so the path cannot climb above the identifier it is
+// appended to. Unlike path.Clean it keeps empty segments and trailing
+// slashes.
+func cleanPath(p string) string {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	cleaned := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			unescaped = seg
+		}
+		switch unescaped {
+		case ".":
+		case "..":
+			if len(cleaned) > 0 {
+				cleaned = cleaned[:len(cleaned)-1]
+			}
+		default:
+			cleaned = append(cleaned, seg)
+			continue
+		}
+		if last {
+			cleaned = append(cleaned, "")
+		}
 	}
+	return "/" + strings.Join(cleaned, "/")
+}
 
-	// Find a link
-	var namespace, identifier string
-	for ns, entries := range result.Links {
-		if len(entries) > 0 {
-			namespace = ns
-			// TODO: Should we find the first entry that matches one of the configured prefixes?
-			identifier = entries[0].Identifier
-			break
+// collapseSlashes replaces the runs of slashes in p with single ones.
+func collapseSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
 		}
+		b.WriteByte(p[i])
 	}
+	return b.String()
+}
 
-	// Cache the result
-	d.cache.Store(host, cachedLookup{
-		namespace:  namespace,
-		identifier: identifier,
-		expiresAt:  time.Now().Add(time.Duration(d.CacheTTL)),
-	})
+// escapePath returns the escaped form of the configured path p, for
+// joining it with escaped request paths.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// defaultPrefix is the prefix serving namespaces without one of their own.
+const defaultPrefix = "default"
+
+// pathTemplate returns the path template of prefix: its own, or the
+// default one of its namespace if it has no replacement either.
+func (d *DNSLink) pathTemplate(prefix string) (string, bool) {
+	if tmpl, ok := d.PathTemplates[prefix]; ok {
+		return tmpl, true
+	}
+	if _, ok := d.Replacements[prefix]; ok {
+		return "", false
+	}
+	tmpl, ok := defaultPathTemplates[strings.TrimPrefix(prefix, "/")]
+	return tmpl, ok
+}
+
+// prefixFor returns the configured prefix serving namespace: /namespace
+// itself, the prefix namespace is aliased to if /namespace has no
+// upstream or route, or else the default prefix if there is one.
+func (d *DNSLink) prefixFor(namespace string) string {
+	prefix := "/" + namespace
+	if d.handles(prefix) {
+		return prefix
+	}
+	if alias, ok := d.Aliases[namespace]; ok {
+		return alias
+	}
+	if d.handles(defaultPrefix) {
+		return defaultPrefix
+	}
+	return prefix
+}
+
+// headerOriginalPath is the request header carrying the path and query of
+// a request as received, before they were rewritten for the upstream.
+const headerOriginalPath = "X-Original-Path"
+
+// Path modes of PathModes, besides a prefix to strip.
+const (
+	pathModeKeep = "keep"
+	pathModeDrop = "drop"
+)
+
+// combinedPath returns the part of the cleaned request path appended to
+// the upstream path of a link under mode. A stripped prefix only matches
+// whole segments, and paths outside of it are kept as they are.
+func combinedPath(mode, requestPath string) string {
+	switch {
+	case mode == pathModeDrop:
+		return "/"
+	case strings.HasPrefix(mode, "/"):
+		strip := escapePath(strings.TrimSuffix(mode, "/"))
+		if rest, ok := strings.CutPrefix(requestPath, strip); ok && (rest == "" || rest[0] == '/') {
+			return "/" + strings.TrimPrefix(rest, "/")
+		}
+	}
+	return requestPath
+}
+
+// Request headers of DNSLinkHeaders.
+const (
+	headerDNSLinkHost       = "X-Dnslink-Host"
+	headerDNSLinkNamespace  = "X-Dnslink-Namespace"
+	headerDNSLinkIdentifier = "X-Dnslink-Identifier"
+)
+
+// setDNSLinkHeaders sets the DNSLinkHeaders of a request for the link of
+// host, removing those whose value is empty.
+func setDNSLinkHeaders(h http.Header, host, namespace, identifier string) {
+	for name, value := range map[string]string{
+		headerDNSLinkHost:       host,
+		headerDNSLinkNamespace:  namespace,
+		headerDNSLinkIdentifier: identifier,
+	} {
+		if value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, value)
+		}
+	}
+}
 
-	return namespace, identifier, nil
+// formatLinks renders links as a comma-separated list of
+// /<namespace>/<identifier> values, sorted by namespace and identifier.
+func formatLinks(links map[string]dnslinkpkg.NamespaceEntries) string {
+	values := make([]string, 0, len(links))
+	for ns, entries := range links {
+		for _, e := range entries {
+			values = append(values, "/"+ns+"/"+e.Identifier)
+		}
+	}
+	sort.Strings(values)
+	return strings.Join(values, ", ")
 }
 
-// parseCaddyfile parses the dnslink directive.
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
 // Syntax:
 //
-//	dnslink {
+//	dnslink [<prefix> [<replacement>] <upstream>] {
 //	    proxies {
-//	        /swarm varnish:8080
-//	        /ipfs  ipfs:8080
+//	        /swarm  varnish:8080
+//	        /ipfs   ipfs:8080
+//	        default gateway:8080
+//	        /ipns   invoke ipns-route
+//	    }
+//	    replace /swarm /bzz
+//	    dynamic /ipfs srv|a|multi ... {
+//	        <source options>
+//	    }
+//	    failover /ipfs <upstream>... {
+//	        retry_count <n>
+//	        status <code>...
+//	        methods <method>...
+//	    }
+//	    upstream_limit /swarm {
+//	        rate <requests per second>
+//	        burst <n>
+//	        max_in_flight <n>
+//	        queue <n>
+//	        queue_timeout <duration>
+//	    }
+//	    mirror /ipfs <upstream> {
+//	        percent <percent>
+//	        timeout <duration>
+//	    }
+//	    transport /ipfs {
+//	        dial_timeout <duration>
+//	        response_header_timeout <duration>
+//	        keepalive <duration>|off
+//	        keepalive_interval <duration>
+//	        max_idle_conns <n>
+//	        max_idle_conns_per_host <n>
+//	        h2c
+//	        http3
+//	    }
+//	    streaming /ipfs {
+//	        flush_interval <duration>|-1
+//	        request_buffers <size>|unlimited
+//	        response_buffers <size>|unlimited
+//	        stream_timeout <duration>
+//	        stream_close_delay <duration>
+//	    }
+//	    trustless /ipfs {
+//	        max_size <size>
+//	    }
+//	    path_template /ipfs /api/v0/cat?arg={identifier}{path}
+//	    identifier_query /ipfs /api/v0/dag/get [<param>]
+//	    host_header /swarm keep|upstream|<host>
+//	    upstream_auth /ipfs basic|bearer|header <credentials>...
+//	    path_mode /ipfs keep|drop|strip <path>
+//	    normalize_path <prefix>...
+//	    header_up /ipfs [+|-]<field> [<value|regexp> [<replacement>]]
+//	    header_down /ipfs [+|-]<field> [<value|regexp> [<replacement>]]
+//	    aliases {
+//	        ipns /ipfs
+//	    }
+//	    validate_identifiers
+//	    links_header [<name>]
+//	    dnslink_headers
+//	    gateway_headers
+//	    protocol_links
+//	    well_known
+//	    server_timing
+//	    dial_multiaddrs
+//	    refresh {
+//	        header <name>
+//	        query <name>
+//	        secret <secret>
+//	        trusted_ips <ranges>...
+//	    }
+//	    async {
+//	        status <code>
+//	        retry_after <duration>
+//	        page <file>
+//	    }
+//	    trace {
+//	        header <name>
+//	        secret <secret>
+//	        trusted_ips <ranges>...
+//	    }
+//	    host_override {
+//	        header <name>
+//	        token_header <name>
+//	        secret <secret>
+//	        trusted_ips <ranges>...
+//	    }
+//	    match {
+//	        <matchers...>
+//	    }
+//	    intercept /ipfs {
+//	        @name <response matcher>
+//	        replace_status [@name] <status>
+//	        handle_response [@name] {
+//	            <directives...>
+//	        }
+//	    }
+//	    denylist [<file|url>...] {
+//	        deny <rule>...
+//	        file <path>...
+//	        url <url>...
+//	        interval <duration>
+//	        status 410|451
+//	    }
+//	    redirects_file {
+//	        max_entries <n>
+//	    }
+//	    swarm_feeds <api> {
+//	        ttl <duration>
+//	        timeout <duration>
+//	    }
+//	    subdomain_redirect <gateway> [<status>] {
+//	        scheme http|https
+//	    }
+//	    subdomain_gateway <domain>...
+//	    host_suffix <suffix>...
+//	    rebase_links
+//	    etag
+//	    cache_control [<prefix> <max_age>]
+//	    content_cache {
+//	        max_size <size>
+//	        max_entry_size <size>
+//	    }
+//	    trust_forwarded_host [<ranges>...]
+//	    sni_fallback
+//	    on_miss 404
+//	    on_error 502
+//	    error_page <file> | error_json
+//	    cors /ipfs {
+//	        origins <origin>...
+//	    }
+//	    select /ipfs round_robin
+//	    select /swarm weighted {
+//	        <identifier> <weight>
 //	    }
 //	    cache_ttl 1m
+//	    cache_ttl /ipns 30s
+//	    cache redis {
+//	        address localhost:6379
+//	    }
+//	    persist
+//	    resolver <module> {
+//	        ...
+//	    }
+//	    host <pattern>... {
+//	        proxies {
+//	            /ipfs tenant-gateway:8080
+//	        }
+//	        header_up /ipfs Authorization "Bearer {env.TENANT_TOKEN}"
+//	        on_miss 404
+//	        cache_ttl 10s
+//	    }
 //	}
-func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	d := new(DNSLink)
-	d.Upstreams = make(map[string]string)
-	d.Replacements = make(map[string]string)
+func (d *DNSLink) UnmarshalCaddyfile(h *caddyfile.Dispenser) error {
+	if d.Upstreams == nil {
+		d.Upstreams = make(map[string]string)
+	}
+	if d.Replacements == nil {
+		d.Replacements = make(map[string]string)
+	}
+
+	// local collects the options of a handler-private cache.
+	var local App
 
 	for h.Next() {
+		// The shorthand takes a single proxies line as arguments.
+		if args := h.RemainingArgs(); len(args) > 0 {
+			if err := d.unmarshalProxy(h, args); err != nil {
+				return err
+			}
+		}
 		for h.NextBlock(0) {
 			switch h.Val() {
 			case "proxies":
 				for h.NextBlock(1) {
-					prefix := h.Val()
+					args := append([]string{h.Val()}, h.RemainingArgs()...)
+					if err := d.unmarshalProxy(h, args); err != nil {
+						return err
+					}
+				}
+			case "replace":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				prefix := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				d.Replacements[prefix] = h.Val()
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+			case "dynamic":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				prefix := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				source := h.Val()
+				if _, ok := d.DynamicUpstreams[prefix]; ok {
+					return h.Errf("dynamic upstreams for %s already specified", prefix)
+				}
+				unm, err := caddyfile.UnmarshalModule(h, "http.reverse_proxy.upstreams."+source)
+				if err != nil {
+					return err
+				}
+				if _, ok := unm.(reverseproxy.UpstreamSource); !ok {
+					return h.Errf("module %s is not an upstream source", source)
+				}
+				if d.DynamicUpstreams == nil {
+					d.DynamicUpstreams = make(map[string]json.RawMessage)
+				}
+				d.DynamicUpstreams[prefix] = caddyconfig.JSONModuleObject(unm, "source", source, nil)
+			case "failover":
+				prefix, f, err := unmarshalFailover(h)
+				if err != nil {
+					return err
+				}
+				if d.Failover == nil {
+					d.Failover = make(map[string]*Failover)
+				}
+				d.Failover[prefix] = f
+			case "upstream_limit":
+				prefix, l, err := unmarshalUpstreamLimit(h)
+				if err != nil {
+					return err
+				}
+				if d.UpstreamLimits == nil {
+					d.UpstreamLimits = make(map[string]*UpstreamLimit)
+				}
+				d.UpstreamLimits[prefix] = l
+			case "mirror":
+				prefix, m, err := unmarshalMirror(h)
+				if err != nil {
+					return err
+				}
+				if d.Mirrors == nil {
+					d.Mirrors = make(map[string]*Mirror)
+				}
+				d.Mirrors[prefix] = m
+			case "transport":
+				prefix, t, err := unmarshalTransport(h)
+				if err != nil {
+					return err
+				}
+				if d.Transports == nil {
+					d.Transports = make(map[string]*Transport)
+				}
+				d.Transports[prefix] = t
+			case "streaming":
+				prefix, s, err := unmarshalStreaming(h)
+				if err != nil {
+					return err
+				}
+				if d.Streaming == nil {
+					d.Streaming = make(map[string]*Streaming)
+				}
+				d.Streaming[prefix] = s
+			case "trustless":
+				prefix, t, err := unmarshalTrustless(h)
+				if err != nil {
+					return err
+				}
+				if d.Trustless == nil {
+					d.Trustless = make(map[string]*Trustless)
+				}
+				d.Trustless[prefix] = t
+			case "path_template":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				prefix := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				tmpl := h.Val()
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				if d.PathTemplates == nil {
+					d.PathTemplates = make(map[string]string)
+				}
+				d.PathTemplates[prefix] = tmpl
+			case "identifier_query":
+				args := h.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return h.ArgErr()
+				}
+				param := "arg"
+				if len(args) == 3 {
+					param = args[2]
+				}
+				if d.PathTemplates == nil {
+					d.PathTemplates = make(map[string]string)
+				}
+				d.PathTemplates[args[0]] = identifierQueryTemplate(args[1], param)
+			case "upstream_auth":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				prefix := h.Val()
+				auth, err := unmarshalUpstreamAuth(h)
+				if err != nil {
+					return err
+				}
+				if d.UpstreamAuth == nil {
+					d.UpstreamAuth = make(map[string]*UpstreamAuth)
+				}
+				d.UpstreamAuth[prefix] = auth
+			case "host_header":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				prefix := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				host := h.Val()
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				if d.HostHeaders == nil {
+					d.HostHeaders = make(map[string]string)
+				}
+				d.HostHeaders[prefix] = host
+			case "path_mode":
+				args := h.RemainingArgs()
+				if len(args) < 2 {
+					return h.ArgErr()
+				}
+				mode := args[1]
+				switch {
+				case mode == "strip" && len(args) == 3 && strings.HasPrefix(args[2], "/"):
+					mode = args[2]
+				case (mode == pathModeKeep || mode == pathModeDrop) && len(args) == 2:
+				default:
+					return h.Errf("invalid path_mode '%s'", strings.Join(args[1:], " "))
+				}
+				if d.PathModes == nil {
+					d.PathModes = make(map[string]string)
+				}
+				d.PathModes[args[0]] = mode
+			case "normalize_path":
+				prefixes := h.RemainingArgs()
+				if len(prefixes) == 0 {
+					return h.ArgErr()
+				}
+				d.NormalizePaths = append(d.NormalizePaths, prefixes...)
+			case "header_up", "header_down":
+				opt := h.Val()
+				args := h.RemainingArgs()
+				if len(args) < 2 || len(args) > 4 {
+					return h.ArgErr()
+				}
+				prefix := args[0]
+				if d.Headers == nil {
+					d.Headers = make(map[string]*headers.Handler)
+				}
+				hdr := d.Headers[prefix]
+				if hdr == nil {
+					hdr = new(headers.Handler)
+					d.Headers[prefix] = hdr
+				}
+				var ops *headers.HeaderOps
+				if opt == "header_up" {
+					if hdr.Request == nil {
+						hdr.Request = new(headers.HeaderOps)
+					}
+					ops = hdr.Request
+				} else {
+					if hdr.Response == nil {
+						hdr.Response = &headers.RespHeaderOps{HeaderOps: new(headers.HeaderOps)}
+					}
+					ops = hdr.Response.HeaderOps
+				}
+				var value string
+				var replacement *string
+				if len(args) > 2 {
+					value = args[2]
+				}
+				if len(args) > 3 {
+					replacement = &args[3]
+				}
+				if err := headers.CaddyfileHeaderOp(ops, args[1], value, replacement); err != nil {
+					return h.Err(err.Error())
+				}
+			case "aliases":
+				for h.NextBlock(1) {
+					namespace := strings.TrimPrefix(h.Val(), "/")
 					if !h.NextArg() {
-						return nil, h.ArgErr()
+						return h.ArgErr()
+					}
+					prefix := h.Val()
+					if !strings.HasPrefix(prefix, "/") {
+						prefix = "/" + prefix
 					}
-					arg2 := h.Val()
-
-					var upstream, replacement string
-
 					if h.NextArg() {
-						// 3 arguments: prefix replacement upstream
-						replacement = arg2
-						upstream = h.Val()
-					} else {
-						// 2 arguments: prefix upstream
-						upstream = arg2
+						return h.ArgErr()
 					}
-
-					upstream = strings.TrimPrefix(upstream, "http://")
-					upstream = strings.TrimPrefix(upstream, "https://")
-					d.Upstreams[prefix] = upstream
-
-					if replacement != "" {
-						d.Replacements[prefix] = replacement
+					if d.Aliases == nil {
+						d.Aliases = make(map[string]string)
 					}
+					d.Aliases[namespace] = prefix
+				}
+			case "validate_identifiers":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ValidateIdentifiers = true
+			case "protocol_links":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ProtocolLinks = true
+			case "well_known":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.WellKnown = true
+			case "gateway_headers":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.GatewayHeaders = true
+			case "server_timing":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ServerTiming = true
+			case "dial_multiaddrs":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.DialMultiaddrs = true
+			case "refresh":
+				refresh, err := unmarshalRefresh(h)
+				if err != nil {
+					return err
+				}
+				d.Refresh = refresh
+			case "async":
+				async, err := unmarshalAsync(h)
+				if err != nil {
+					return err
+				}
+				d.Async = async
+			case "trace":
+				trace, err := unmarshalTrace(h)
+				if err != nil {
+					return err
 				}
-			case "cache_ttl":
+				d.Trace = trace
+			case "host_override":
+				override, err := unmarshalHostOverride(h)
+				if err != nil {
+					return err
+				}
+				d.HostOverride = override
+			case "match":
+				matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(h)
+				if err != nil {
+					return err
+				}
+				d.MatchRaw = append(d.MatchRaw, matcherSet)
+			case "intercept":
+				if err := d.unmarshalIntercept(h); err != nil {
+					return err
+				}
+			case "denylist":
+				denylist, err := unmarshalDenylist(h)
+				if err != nil {
+					return err
+				}
+				d.Denylist = denylist
+			case "redirects_file":
+				redirects, err := unmarshalRedirects(h)
+				if err != nil {
+					return err
+				}
+				d.RedirectsFile = redirects
+			case "swarm_feeds":
+				feeds, err := unmarshalSwarmFeeds(h)
+				if err != nil {
+					return err
+				}
+				d.SwarmFeeds = feeds
+			case "subdomain_redirect":
+				redirect, err := unmarshalSubdomainRedirect(h)
+				if err != nil {
+					return err
+				}
+				d.SubdomainRedirect = redirect
+			case "content_cache":
+				cache, err := unmarshalContentCache(h)
+				if err != nil {
+					return err
+				}
+				d.ContentCache = cache
+			case "subdomain_gateway":
+				gateways := h.RemainingArgs()
+				if len(gateways) == 0 {
+					return h.ArgErr()
+				}
+				d.SubdomainGateways = append(d.SubdomainGateways, gateways...)
+			case "host_suffix":
+				suffixes := h.RemainingArgs()
+				if len(suffixes) == 0 {
+					return h.ArgErr()
+				}
+				d.HostSuffixes = append(d.HostSuffixes, suffixes...)
+			case "rebase_links":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.RebaseLinks = true
+			case "etag":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ETag = true
+			case "cache_control":
+				d.CacheControl = true
+				if !h.NextArg() {
+					break
+				}
+				prefix := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				age, err := caddy.ParseDuration(h.Val())
+				if err != nil {
+					return err
+				}
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				if d.MaxAge == nil {
+					d.MaxAge = make(map[string]caddy.Duration)
+				}
+				d.MaxAge[prefix] = caddy.Duration(age)
+			case "cors":
+				prefix, policy, err := unmarshalCORS(h)
+				if err != nil {
+					return err
+				}
+				if d.CORS == nil {
+					d.CORS = make(map[string]*CORSPolicy)
+				}
+				d.CORS[prefix] = policy
+			case "trust_forwarded_host":
+				d.TrustForwardedHost = true
+				d.TrustedProxies = append(d.TrustedProxies, h.RemainingArgs()...)
+			case "sni_fallback":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.SNIFallback = true
+			case "on_miss", "on_error":
+				name := h.Val()
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				status, err := strconv.Atoi(h.Val())
+				if err != nil {
+					return h.Errf("invalid status '%s'", h.Val())
+				}
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				if name == "on_miss" {
+					d.OnMiss = status
+				} else {
+					d.OnError = status
+				}
+			case "error_page":
+				if !h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ErrorPage = h.Val()
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+			case "error_json":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.ErrorJSON = true
+			case "dnslink_headers":
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+				d.DNSLinkHeaders = true
+			case "links_header":
+				d.LinksHeader = "X-Dnslink-Links"
+				if h.NextArg() {
+					d.LinksHeader = h.Val()
+				}
+				if h.NextArg() {
+					return h.ArgErr()
+				}
+			case "select":
+				prefix, sel, err := unmarshalSelection(h)
+				if err != nil {
+					return err
+				}
+				if d.Selection == nil {
+					d.Selection = make(map[string]*LinkSelection)
+				}
+				d.Selection[prefix] = sel
+			case "cache_ttl", "cache", "persist":
+				if err := local.unmarshalOption(h); err != nil {
+					return err
+				}
+			case "resolver":
 				if !h.NextArg() {
-					return nil, h.ArgErr()
+					return h.ArgErr()
 				}
-				dur, err := caddy.ParseDuration(h.Val())
+				name := h.Val()
+				unm, err := caddyfile.UnmarshalModule(h, "dnslink.resolvers."+name)
 				if err != nil {
-					return nil, err
+					return err
 				}
-				d.CacheTTL = caddy.Duration(dur)
+				d.ResolverRaw = caddyconfig.JSONModuleObject(unm, "resolver", name, nil)
+			case "host":
+				hc, err := unmarshalHostConfig(h)
+				if err != nil {
+					return err
+				}
+				d.HostConfigs = append(d.HostConfigs, hc)
 			default:
-				return nil, h.Errf("unknown subdirective '%s'", h.Val())
+				return h.Errf("unknown subdirective '%s'", h.Val())
 			}
 		}
 	}
-	return d, nil
+
+	d.CacheTTL = local.CacheTTL
+	d.PrefixCacheTTL = local.PrefixCacheTTL
+	d.Persist = local.Persist
+	d.CacheRaw = local.CacheRaw
+	return nil
+}
+
+// unmarshalProxy adds the upstream of a proxies line, either
+// "<prefix> <upstream>" or "<prefix> <replacement> <upstream>".
+func (d *DNSLink) unmarshalProxy(h *caddyfile.Dispenser, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return h.ArgErr()
+	}
+	prefix, upstream := args[0], args[len(args)-1]
+	if len(args) == 3 && args[1] == "invoke" {
+		if d.Routes == nil {
+			d.Routes = make(map[string]string)
+		}
+		d.Routes[prefix] = upstream
+		return nil
+	}
+	upstream = strings.TrimPrefix(upstream, "http://")
+	upstream = strings.TrimPrefix(upstream, "https://")
+	d.Upstreams[prefix] = upstream
+	if len(args) == 3 && args[1] != "" {
+		d.Replacements[prefix] = args[1]
+	}
+	return nil
+}
+
+// parseCaddyfile parses the dnslink directive, as UnmarshalCaddyfile.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	d := new(DNSLink)
+	if err := d.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	d.registerRoutes(h)
+	return d, d.finalizeUnmarshalCaddyfile(h)
 }
 
 // Interface guards
 var (
 	_ caddy.Module                = (*DNSLink)(nil)
 	_ caddy.Provisioner           = (*DNSLink)(nil)
+	_ caddy.Validator             = (*DNSLink)(nil)
+	_ caddy.CleanerUpper          = (*DNSLink)(nil)
 	_ caddyhttp.MiddlewareHandler = (*DNSLink)(nil)
+	_ caddyfile.Unmarshaler       = (*DNSLink)(nil)
 )
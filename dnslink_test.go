@@ -1,7 +1,21 @@
 package dnslink
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
 )
 
 func TestBuildPath(t *testing.T) {
@@ -21,6 +35,14 @@ func TestBuildPath(t *testing.T) {
 			originalPath: "/",
 			expected:     "/bzz/abc123/",
 		},
+		{
+			name:         "escaped replacement and path",
+			namespace:    "ipfs",
+			identifier:   "QmXyz789",
+			replacement:  "/my gateway",
+			originalPath: "/a%2Fb%3F.txt",
+			expected:     "/my%20gateway/QmXyz789/a%2Fb%3F.txt",
+		},
 		{
 			name:         "swarm with bzz replacement, subpath",
 			namespace:    "swarm",
@@ -136,3 +158,725 @@ func TestBuildPath(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCaddyfile(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/swarm /bzz varnish:8080
+			/ipfs  http://ipfs:8080
+		}
+		cache_ttl 5m
+		cache redis {
+			address redis:6379
+			db 2
+		}
+		persist
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	d := handler.(*DNSLink)
+
+	if got := d.Upstreams["/ipfs"]; got != "ipfs:8080" {
+		t.Errorf("Upstreams[/ipfs] = %q, want %q", got, "ipfs:8080")
+	}
+	if got := d.Replacements["/swarm"]; got != "/bzz" {
+		t.Errorf("Replacements[/swarm] = %q, want %q", got, "/bzz")
+	}
+	if time.Duration(d.CacheTTL) != 5*time.Minute {
+		t.Errorf("CacheTTL = %v, want 5m", time.Duration(d.CacheTTL))
+	}
+	if !d.Persist {
+		t.Error("Persist = false, want true")
+	}
+	wantCache := `{"address":"redis:6379","backend":"redis","db":2}`
+	if string(d.CacheRaw) != wantCache {
+		t.Errorf("CacheRaw = %s, want %s", d.CacheRaw, wantCache)
+	}
+}
+
+func TestParseShorthand(t *testing.T) {
+	tests := []struct {
+		input            string
+		wantUpstreams    map[string]string
+		wantReplacements map[string]string
+		wantErr          bool
+	}{
+		{input: "dnslink /ipfs ipfs:8080", wantUpstreams: map[string]string{"/ipfs": "ipfs:8080"}, wantReplacements: map[string]string{}},
+		{input: "dnslink /swarm /bzz http://varnish:8080", wantUpstreams: map[string]string{"/swarm": "varnish:8080"}, wantReplacements: map[string]string{"/swarm": "/bzz"}},
+		{
+			input:            "dnslink /ipfs ipfs:8080 {\n proxies {\n /swarm /bzz bee:1633\n }\n on_miss 404\n }",
+			wantUpstreams:    map[string]string{"/ipfs": "ipfs:8080", "/swarm": "bee:1633"},
+			wantReplacements: map[string]string{"/swarm": "/bzz"},
+		},
+		{input: "dnslink /ipfs", wantErr: true},
+		{input: "dnslink /swarm /bzz varnish:8080 extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(tt.input)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			d := handler.(*DNSLink)
+			if !reflect.DeepEqual(d.Upstreams, tt.wantUpstreams) || !reflect.DeepEqual(d.Replacements, tt.wantReplacements) {
+				t.Errorf("parseCaddyfile() = %v, %v, want %v, %v", d.Upstreams, d.Replacements, tt.wantUpstreams, tt.wantReplacements)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileJSON(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs ipfs:8080
+		}
+		dynamic /swarm a bee.internal 1633
+		replace /swarm /bzz
+		failover /ipfs ipfs-b:8080
+		path_mode /ipfs strip /app
+		header_up /ipfs X-Gateway dnslink
+		cache_control /ipfs 1h
+		trust_forwarded_host 10.0.0.0/8
+		on_miss 404
+		cache_ttl /ipns 30s
+	}`
+	var d DNSLink
+	if err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if got := d.Replacements["/swarm"]; got != "/bzz" {
+		t.Errorf("Replacements[/swarm] = %q, want /bzz", got)
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	// Everything set from the Caddyfile survives a JSON round trip.
+	encoded, err := json.Marshal(&d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DNSLink
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if reencoded, _ := json.Marshal(&decoded); string(reencoded) != string(encoded) {
+		t.Errorf("JSON round trip = %s, want %s", reencoded, encoded)
+	}
+	if decoded.Replacements["/swarm"] != "/bzz" || decoded.PrefixCacheTTL["/ipns"] != caddy.Duration(30*time.Second) || decoded.OnMiss != 404 {
+		t.Errorf("decoded handler from %s lost options", encoded)
+	}
+}
+
+func TestFormatLinks(t *testing.T) {
+	links := map[string]dnslinkpkg.NamespaceEntries{
+		"swarm": {{Identifier: "abc123"}},
+		"ipfs":  {{Identifier: "QmB"}, {Identifier: "QmA"}},
+	}
+	want := "/ipfs/QmA, /ipfs/QmB, /swarm/abc123"
+	if got := formatLinks(links); got != want {
+		t.Errorf("formatLinks() = %q, want %q", got, want)
+	}
+	if got := formatLinks(nil); got != "" {
+		t.Errorf("formatLinks(nil) = %q, want empty", got)
+	}
+}
+
+func TestLinksHeaderStripped(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		LinksHeader:    "X-Dnslink-Links",
+		DNSLinkHeaders: true,
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+				return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+			},
+		},
+		logger: zap.NewNop(),
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://nolink.example.com/", nil)
+	req.Header.Set("X-Dnslink-Links", "/ipfs/QmSpoofed")
+	req.Header.Set("X-Dnslink-Identifier", "QmSpoofed")
+
+	var got http.Header
+	next := caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		got = r.Header
+		return nil
+	})
+	if err := d.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Get("X-Dnslink-Links"); v != "" {
+		t.Errorf("X-Dnslink-Links = %q, want client value removed", v)
+	}
+	if v := got.Get("X-Dnslink-Identifier"); v != "" {
+		t.Errorf("X-Dnslink-Identifier = %q, want client value removed", v)
+	}
+}
+
+func TestSetDNSLinkHeaders(t *testing.T) {
+	h := http.Header{"X-Dnslink-Namespace": {"spoofed"}}
+	setDNSLinkHeaders(h, "example.com", "ipfs", "QmXyz/docs")
+	want := http.Header{
+		"X-Dnslink-Host":       {"example.com"},
+		"X-Dnslink-Namespace":  {"ipfs"},
+		"X-Dnslink-Identifier": {"QmXyz/docs"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+	setDNSLinkHeaders(h, "", "", "")
+	if len(h) != 0 {
+		t.Errorf("headers = %v, want none", h)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var resolved []string
+	d := &DNSLink{
+		OnMiss: http.StatusNotFound,
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				resolved = append(resolved, host)
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					"ipfs": {{Identifier: "QmFake"}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	for i := 0; i < 2; i++ {
+		if err := d.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(resolved) != 1 || resolved[0] != "example.com" {
+		t.Errorf("resolver calls = %q, want one for example.com", resolved)
+	}
+	if entry, ok, _ := d.app.cache.Load(context.Background(), "example.com"); !ok || entry.Identifier != "QmFake" {
+		t.Errorf("cache entry = %+v, %v, want the fake's link", entry, ok)
+	}
+}
+
+func TestPrefixFor(t *testing.T) {
+	d := &DNSLink{
+		proxies: map[string]*reverseproxy.Handler{"/ipfs": nil, "/swarm": nil, "/ipns": nil},
+		Aliases: map[string]string{"bzz": "/swarm", "ipns": "/ipfs"},
+	}
+	tests := map[string]string{
+		"ipfs":    "/ipfs",
+		"bzz":     "/swarm",
+		"ipns":    "/ipns", // its own prefix wins over the alias
+		"arweave": "/arweave",
+	}
+	for namespace, expected := range tests {
+		if got := d.prefixFor(namespace); got != expected {
+			t.Errorf("prefixFor(%q) = %q, want %q", namespace, got, expected)
+		}
+	}
+
+	d.proxies[defaultPrefix] = nil
+	for namespace, expected := range map[string]string{"ipfs": "/ipfs", "bzz": "/swarm", "arweave": defaultPrefix} {
+		if got := d.prefixFor(namespace); got != expected {
+			t.Errorf("with a default prefix, prefixFor(%q) = %q, want %q", namespace, got, expected)
+		}
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs ipfs:8080
+		}
+		aliases {
+			ipns /ipfs
+			/bzz swarm
+		}
+	}`
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	aliases := handler.(*DNSLink).Aliases
+	if aliases["ipns"] != "/ipfs" || aliases["bzz"] != "/swarm" {
+		t.Errorf("Aliases = %v, want ipns=/ipfs bzz=/swarm", aliases)
+	}
+}
+
+func TestEscapeIdentifier(t *testing.T) {
+	tests := []struct {
+		identifier string
+		want       string
+		wantErr    bool
+	}{
+		{identifier: "QmXyz789", want: "QmXyz789"},
+		{identifier: "abc123/subdir/", want: "abc123/subdir/"},
+		{identifier: "abc?x=1#frag", want: "abc%3Fx=1%23frag"},
+		{identifier: "a b%2F", want: "a%20b%252F"},
+		{identifier: `abc\..`, want: "abc%5C.."},
+		{identifier: "..", wantErr: true},
+		{identifier: "abc123/../../admin", wantErr: true},
+		{identifier: "abc123/./x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := escapeIdentifier(tt.identifier)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("escapeIdentifier(%q) = %q, want error", tt.identifier, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("escapeIdentifier(%q) error: %v", tt.identifier, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("escapeIdentifier(%q) = %q, want %q", tt.identifier, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/", want: "/"},
+		{path: "", want: "/"},
+		{path: "/index.html", want: "/index.html"},
+		{path: "//index.html", want: "//index.html"},
+		{path: "/a/b/", want: "/a/b/"},
+		{path: "/../../admin", want: "/admin"},
+		{path: "/a/../b", want: "/b"},
+		{path: "/a/./b", want: "/a/b"},
+		{path: "/a/..", want: "/"},
+		{path: "/a/b/.", want: "/a/b/"},
+		{path: "/%2e%2E/admin", want: "/admin"},
+		{path: "/a%2Fb", want: "/a%2Fb"},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePathTemplate(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs kubo:5001
+		}
+		path_template /ipfs /api/v0/cat?arg={identifier}{path}
+	}`
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	want := "/api/v0/cat?arg={identifier}{path}"
+	if got := handler.(*DNSLink).PathTemplates["/ipfs"]; got != want {
+		t.Errorf("PathTemplates[/ipfs] = %q, want %q", got, want)
+	}
+}
+
+func TestHostHeaderOps(t *testing.T) {
+	tests := []struct {
+		host string
+		want string // empty means the Host is kept
+	}{
+		{host: "keep"},
+		{host: ""},
+		{host: "upstream", want: "{http.reverse_proxy.upstream.hostport}"},
+		{host: "gateway.example.com", want: "gateway.example.com"},
+	}
+	for _, tt := range tests {
+		ops := hostHeaderOps(tt.host)
+		if tt.want == "" {
+			if ops != nil {
+				t.Errorf("hostHeaderOps(%q) = %+v, want nil", tt.host, ops)
+			}
+			continue
+		}
+		if ops == nil || ops.Request == nil {
+			t.Errorf("hostHeaderOps(%q) = nil, want Host %q", tt.host, tt.want)
+			continue
+		}
+		if got := ops.Request.Set.Get("Host"); got != tt.want {
+			t.Errorf("hostHeaderOps(%q) sets Host %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs gateway:8080
+		}
+		header_up /ipfs Authorization "Bearer {env.GATEWAY_TOKEN}"
+		header_up /ipfs -X-Debug
+		header_down /ipfs -Server
+		host_header /ipfs upstream
+	}`
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	d := handler.(*DNSLink)
+	ops := d.Headers["/ipfs"]
+	if ops == nil || ops.Request == nil || ops.Response == nil {
+		t.Fatalf("Headers[/ipfs] = %+v, want request and response operations", ops)
+	}
+	if got := ops.Request.Set.Get("Authorization"); got != "Bearer {env.GATEWAY_TOKEN}" {
+		t.Errorf("header_up sets Authorization %q", got)
+	}
+	if got := ops.Request.Delete; len(got) != 1 || got[0] != "X-Debug" {
+		t.Errorf("header_up deletes %q, want X-Debug", got)
+	}
+	if got := ops.Response.Delete; len(got) != 1 || got[0] != "Server" {
+		t.Errorf("header_down deletes %q, want Server", got)
+	}
+
+	merged := proxyHeaders(ops, d.HostHeaders["/ipfs"], nil)
+	if got := merged.Request.Set.Get("Host"); got != "{http.reverse_proxy.upstream.hostport}" {
+		t.Errorf("merged headers set Host %q, want the upstream's", got)
+	}
+	if got := merged.Request.Set.Get("Authorization"); got == "" {
+		t.Error("merged headers lost the Authorization header")
+	}
+	if ops.Request.Set.Get("Host") != "" {
+		t.Error("proxyHeaders() modified the configured operations")
+	}
+}
+
+func TestParseDynamicUpstreams(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/swarm bee:1633
+		}
+		dynamic /ipfs srv _gateway._tcp.ipfs.internal {
+			refresh 30s
+		}
+		dynamic /ipns a ipns.internal 8080
+		aliases {
+			ipld /ipfs
+		}
+	}`
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	d := handler.(*DNSLink)
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if got := d.Upstreams["/swarm"]; got != "bee:1633" {
+		t.Errorf("Upstreams[/swarm] = %q, want bee:1633", got)
+	}
+	for prefix, want := range map[string]string{
+		"/ipfs": `{"name":"_gateway._tcp.ipfs.internal","refresh":30000000000,"source":"srv"}`,
+		"/ipns": `{"name":"ipns.internal","port":"8080","source":"a"}`,
+	} {
+		if got := string(d.DynamicUpstreams[prefix]); got != want {
+			t.Errorf("DynamicUpstreams[%s] = %s, want %s", prefix, got, want)
+		}
+	}
+
+	for _, input := range []string{
+		`dnslink {
+			dynamic /ipfs
+		}`,
+		`dnslink {
+			dynamic /ipfs nonexistent
+		}`,
+		`dnslink {
+			dynamic /ipfs a ipfs.internal 8080
+			dynamic /ipfs a ipfs2.internal 8080
+		}`,
+	} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+		if _, err := parseCaddyfile(h); err == nil {
+			t.Errorf("parseCaddyfile(%q) succeeded, want error", input)
+		}
+	}
+}
+
+func TestFailurePolicies(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		OnMiss:  http.StatusNotFound,
+		OnError: http.StatusServiceUnavailable,
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+				switch name {
+				case "_dnslink.swarm.example.com":
+					return []dnslinkpkg.LookupEntry{{Value: "dnslink=/swarm/abc123"}}, nil
+				case "_dnslink.broken.example.com":
+					return nil, dnslinkpkg.NewDNSRCodeError(2, name)
+				}
+				return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+			},
+		},
+		logger: zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{host: "nolink.example.com", want: http.StatusNotFound},
+		{host: "swarm.example.com", want: http.StatusNotFound}, // no /swarm upstream
+		{host: "broken.example.com", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			if err := d.ServeHTTP(rec, req, next); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	d.OnMiss, d.OnError = 0, 0
+	rec := httptest.NewRecorder()
+	if err := d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://broken.example.com/", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("status without policies = %d, want the next handler's %d", rec.Code, http.StatusTeapot)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *DNSLink
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			d: &DNSLink{
+				Upstreams:    map[string]string{"/ipfs": "ipfs:8080", "/swarm": "varnish:8080", "/arweave": "varnish:8080"},
+				Replacements: map[string]string{"/swarm": "/bzz", "/arweave": "/"},
+				Aliases:      map[string]string{"ipns": "/ipfs"},
+			},
+		},
+		{name: "empty upstream", d: &DNSLink{Upstreams: map[string]string{"/ipfs": " "}}, wantErr: true},
+		{name: "prefix without slash", d: &DNSLink{Upstreams: map[string]string{"ipfs": "ipfs:8080"}}, wantErr: true},
+		{name: "default prefix", d: &DNSLink{Upstreams: map[string]string{"default": "gw:8080"}, PathTemplates: map[string]string{"default": "/{namespace}/{identifier}{path}"}}},
+		{name: "nested prefix", d: &DNSLink{Upstreams: map[string]string{"/ipfs/x": "ipfs:8080"}}, wantErr: true},
+		{name: "bad replacement prefix", d: &DNSLink{Replacements: map[string]string{"swarm": "/bzz"}}, wantErr: true},
+		{
+			name: "colliding replacements",
+			d: &DNSLink{
+				Upstreams:    map[string]string{"/ipfs": "gw:8080", "/ipns": "gw:8080"},
+				Replacements: map[string]string{"/ipfs": "/content", "/ipns": "/content/"},
+			},
+			wantErr: true,
+		},
+		{name: "replacement without upstream", d: &DNSLink{Replacements: map[string]string{"/swarm": "/bzz"}}, wantErr: true},
+		{name: "alias without upstream", d: &DNSLink{Aliases: map[string]string{"ipns": "/ipfs"}}, wantErr: true},
+		{name: "failover without upstream", d: &DNSLink{Failover: map[string]*Failover{"/ipfs": {Upstreams: []string{"b:8080"}}}}, wantErr: true},
+		{name: "transport without upstream", d: &DNSLink{Transports: map[string]*Transport{"/ipfs": {}}}, wantErr: true},
+		{name: "negative transport timeout", d: &DNSLink{Upstreams: map[string]string{"/ipfs": "a:8080"}, Transports: map[string]*Transport{"/ipfs": {ResponseHeaderTimeout: -1}}}, wantErr: true},
+		{
+			name: "static and dynamic upstream",
+			d: &DNSLink{
+				Upstreams:        map[string]string{"/ipfs": "ipfs:8080"},
+				DynamicUpstreams: map[string]json.RawMessage{"/ipfs": json.RawMessage(`{"source":"a"}`)},
+			},
+			wantErr: true,
+		},
+		{name: "negative max age", d: &DNSLink{MaxAge: map[string]caddy.Duration{"/ipfs": -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.d.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCombinedPath(t *testing.T) {
+	tests := []struct {
+		mode, path, want string
+	}{
+		{"", "/docs/index.html", "/docs/index.html"},
+		{pathModeKeep, "/docs/", "/docs/"},
+		{pathModeDrop, "/docs/index.html", "/"},
+		{"/app", "/app/index.html", "/index.html"},
+		{"/app/", "/app", "/"},
+		{"/app", "/application", "/application"},
+		{"/app", "/other/app", "/other/app"},
+		{"/my app", "/my%20app/a%2Fb", "/a%2Fb"},
+	}
+	for _, tt := range tests {
+		if got := combinedPath(tt.mode, tt.path); got != tt.want {
+			t.Errorf("combinedPath(%q, %q) = %q, want %q", tt.mode, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"/", "/"},
+		{"//index.html", "/index.html"},
+		{"/a///b//", "/a/b/"},
+		{"/a%2F%2Fb", "/a%2F%2Fb"},
+	}
+	for _, tt := range tests {
+		if got := collapseSlashes(tt.path); got != tt.want {
+			t.Errorf("collapseSlashes(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePathMode(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs  ipfs:8080
+			/swarm bee:1633
+		}
+		path_mode /ipfs strip /app
+		path_mode /swarm drop
+		normalize_path /ipfs /swarm
+	}`
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := handler.(*DNSLink)
+	if want := map[string]string{"/ipfs": "/app", "/swarm": "drop"}; !reflect.DeepEqual(d.PathModes, want) {
+		t.Errorf("PathModes = %v, want %v", d.PathModes, want)
+	}
+	if want := []string{"/ipfs", "/swarm"}; !reflect.DeepEqual(d.NormalizePaths, want) {
+		t.Errorf("NormalizePaths = %v, want %v", d.NormalizePaths, want)
+	}
+	if err := d.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	for _, input := range []string{
+		"dnslink {\n path_mode /ipfs strip\n}",
+		"dnslink {\n path_mode /ipfs strip app\n}",
+		"dnslink {\n path_mode /ipfs replace\n}",
+		"dnslink {\n path_mode /ipfs drop /app\n}",
+		"dnslink {\n normalize_path\n}",
+	} {
+		if _, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}); err == nil {
+			t.Errorf("parseCaddyfile(%q) succeeded", input)
+		}
+	}
+	if err := (&DNSLink{PathModes: map[string]string{"/ipfs": "append"}}).Validate(); err == nil {
+		t.Error("Validate() accepted an unknown path mode")
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	t.Setenv("DNSLINK_TEST_BEE", "bee:1633")
+	t.Setenv("DNSLINK_TEST_BZZ", "/bzz")
+	d := &DNSLink{
+		Upstreams:    map[string]string{"/swarm": "{env.DNSLINK_TEST_BEE}", "/ipfs": "{http.request.host}:8080"},
+		Failover:     map[string]*Failover{"/swarm": {Upstreams: []string{"{env.DNSLINK_TEST_BEE}", "{env.DNSLINK_TEST_UNSET}"}}},
+		Replacements: map[string]string{"/swarm": "{env.DNSLINK_TEST_BZZ}"},
+	}
+	d.expandPlaceholders()
+
+	if want := map[string]string{"/swarm": "bee:1633", "/ipfs": "{http.request.host}:8080"}; !reflect.DeepEqual(d.Upstreams, want) {
+		t.Errorf("Upstreams = %v, want %v", d.Upstreams, want)
+	}
+	if want := []string{"bee:1633", ""}; !reflect.DeepEqual(d.Failover["/swarm"].Upstreams, want) {
+		t.Errorf("Failover upstreams = %q, want %q", d.Failover["/swarm"].Upstreams, want)
+	}
+	if got := d.Replacements["/swarm"]; got != "/bzz" {
+		t.Errorf("replacement = %q, want /bzz", got)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	input := `dnslink {
+		proxies {
+			/ipfs ipfs:8080
+		}
+		match {
+			not path /admin/* /healthz
+		}
+	}`
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw := handler.(*DNSLink).MatchRaw; len(raw) != 1 || raw[0]["not"] == nil {
+		t.Errorf("MatchRaw = %v, want a not matcher", raw)
+	}
+
+	d := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "localhost:8080"},
+		Trace:     &Trace{Secret: "s3cret"},
+		matchers:  caddyhttp.MatcherSets{{caddyhttp.MatchNot{MatcherSets: []caddyhttp.MatcherSet{{caddyhttp.MatchPath{"/admin/*"}}}}}},
+		proxies:   map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Trace.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for target, wantNext := range map[string]bool{
+		"http://example.com/admin/users": true,
+		"http://example.com/docs/":       false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		r.Header.Set(defaultTraceHeader, "s3cret")
+		w := httptest.NewRecorder()
+		var calledNext bool
+		next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			calledNext = true
+			return nil
+		})
+		if err := d.ServeHTTP(w, r, next); err != nil {
+			t.Fatal(err)
+		}
+		if calledNext != wantNext {
+			t.Errorf("%s: called next = %v, want %v", target, calledNext, wantNext)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"golang.org/x/crypto/sha3"
+)
+
+func init() {
+	caddy.RegisterModule(new(ENSResolver))
+}
+
+// ensRegistry is the address of the ENS registry on Ethereum mainnet.
+const ensRegistry = "0x00000000000C2E074eC69A0bFb2997BA6C7d2e1e"
+
+// Function selectors of the ENS contracts.
+const (
+	selectorResolver    = "0178b8bf" // resolver(bytes32)
+	selectorContenthash = "bc1c58d1" // contenthash(bytes32)
+)
+
+// Multicodecs of EIP-1577 contenthash namespaces.
+var contenthashNamespaces = map[uint64]string{
+	0xe3: "ipfs",
+	0xe4: "swarm",
+	0xe5: "ipns",
+}
+
+// ENSResolver resolves .eth names through the contenthash record of the
+// Ethereum Name Service, queried from an Ethereum JSON-RPC endpoint.
+// Contenthashes are mapped to the ipfs, ipns and swarm namespaces so ENS
+// sites can be served alongside DNSLink ones. Other names are reported as
+// having no link, so the resolver is meant to be used in a chain.
+type ENSResolver struct {
+	// RPC is the URL of the Ethereum JSON-RPC endpoint. It may contain
+	// global placeholders such as {env.INFURA_KEY}.
+	RPC string `json:"rpc"`
+
+	// Registry is the address of the ENS registry. Default is the
+	// mainnet registry.
+	Registry string `json:"registry,omitempty"`
+
+	resolverTimeout
+
+	rpc    string
+	client *http.Client
+}
+
+func (*ENSResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.resolvers.ens",
+		New: func() caddy.Module { return new(ENSResolver) },
+	}
+}
+
+func (r *ENSResolver) Provision(caddy.Context) error {
+	if r.RPC == "" {
+		return fmt.Errorf("ens resolver requires an rpc endpoint")
+	}
+	r.rpc = caddy.NewReplacer().ReplaceAll(r.RPC, "")
+	if r.Registry == "" {
+		r.Registry = ensRegistry
+	}
+	if r.client == nil {
+		r.client = http.DefaultClient
+	}
+	return nil
+}
+
+func (r *ENSResolver) Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasSuffix(name, ".eth") {
+		return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	}
+	node := namehash(name)
+
+	out, err := r.call(ctx, r.Registry, selectorResolver, node)
+	if err != nil {
+		return dnslinkpkg.Result{}, fmt.Errorf("looking up ENS resolver: %v", err)
+	}
+	if len(out) < 32 || isZero(out[:32]) {
+		return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	}
+	resolver := "0x" + hex.EncodeToString(out[12:32])
+
+	out, err = r.call(ctx, resolver, selectorContenthash, node)
+	if err != nil {
+		return dnslinkpkg.Result{}, fmt.Errorf("looking up ENS contenthash: %v", err)
+	}
+	contenthash, err := abiBytes(out)
+	if err != nil {
+		return dnslinkpkg.Result{}, fmt.Errorf("decoding ENS contenthash: %v", err)
+	}
+	if len(contenthash) == 0 {
+		return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	}
+	namespace, identifier, err := decodeContenthash(contenthash)
+	if err != nil {
+		return dnslinkpkg.Result{}, err
+	}
+	return dnslinkpkg.Result{
+		Links: map[string]dnslinkpkg.NamespaceEntries{namespace: {{Identifier: identifier}}},
+	}, nil
+}
+
+// call performs an eth_call of a single-bytes32-argument function.
+func (r *ENSResolver) call(ctx context.Context, to, selector string, arg []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "eth_call",
+		"params": []any{
+			map[string]string{"to": to, "data": "0x" + selector + hex.EncodeToString(arg)},
+			"latest",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.rpc, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	var rpcResp struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return nil, fmt.Errorf("decoding RPC response: %v", err)
+	}
+	if rpcResp.Error != nil {
+		return nil, fmt.Errorf("RPC error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+	}
+	return hex.DecodeString(strings.TrimPrefix(rpcResp.Result, "0x"))
+}
+
+// namehash computes the ENS node of a name as specified in EIP-137.
+func namehash(name string) []byte {
+	node := make([]byte, 32)
+	if name == "" {
+		return node
+	}
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = keccak256(node, keccak256([]byte(labels[i])))
+	}
+	return node
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// abiBytes decodes an ABI-encoded dynamic bytes return value.
+func abiBytes(out []byte) ([]byte, error) {
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if len(out) < 64 {
+		return nil, errors.New("short return value")
+	}
+	offset := new(big.Int).SetBytes(out[:32])
+	if !offset.IsInt64() || offset.Int64()+32 > int64(len(out)) {
+		return nil, errors.New("invalid offset")
+	}
+	start := offset.Int64() + 32
+	length := new(big.Int).SetBytes(out[start-32 : start])
+	if !length.IsInt64() || start+length.Int64() > int64(len(out)) {
+		return nil, errors.New("invalid length")
+	}
+	return out[start : start+length.Int64()], nil
+}
+
+// decodeContenthash maps an EIP-1577 contenthash to a DNSLink namespace
+// and identifier. IPFS and IPNS CIDs are rendered in base32; Swarm
+// references as the hex-encoded hash.
+func decodeContenthash(contenthash []byte) (namespace, identifier string, err error) {
+	codec, n := binary.Uvarint(contenthash)
+	if n <= 0 {
+		return "", "", errors.New("invalid contenthash")
+	}
+	namespace, ok := contenthashNamespaces[codec]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported contenthash codec 0x%x", codec)
+	}
+	cid := contenthash[n:]
+
+	if namespace == "swarm" {
+		digest, err := cidDigest(cid)
+		if err != nil {
+			return "", "", err
+		}
+		return namespace, hex.EncodeToString(digest), nil
+	}
+	if _, err := cidDigest(cid); err != nil {
+		return "", "", err
+	}
+	return namespace, "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(cid)), nil
+}
+
+// cidDigest returns the multihash digest of a binary CIDv1.
+func cidDigest(cid []byte) ([]byte, error) {
+	rest := cid
+	var fields [4]uint64 // version, codec, hash function, digest length
+	for i := range fields {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("invalid CID in contenthash")
+		}
+		fields[i] = v
+		rest = rest[n:]
+	}
+	if fields[0] != 1 || fields[3] != uint64(len(rest)) {
+		return nil, errors.New("invalid CID in contenthash")
+	}
+	return rest, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens.
+// Syntax:
+//
+//	ens <rpc> {
+//	    registry <address>
+//	    timeout  <duration>
+//	}
+func (r *ENSResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		r.RPC = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "registry":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.Registry = d.Val()
+			case "timeout":
+				if err := r.unmarshalTimeout(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*ENSResolver)(nil)
+	_ caddy.Provisioner     = (*ENSResolver)(nil)
+	_ caddyfile.Unmarshaler = (*ENSResolver)(nil)
+	_ Resolver              = (*ENSResolver)(nil)
+)
@@ -0,0 +1,113 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestNamehash(t *testing.T) {
+	tests := map[string]string{
+		"":        "0000000000000000000000000000000000000000000000000000000000000000",
+		"eth":     "93cdeb708b7545dc668eb9280176169d1c33cfd8ed6f04690a0bcc88a93fc4ae",
+		"foo.eth": "de9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f",
+	}
+	for name, expected := range tests {
+		if got := hex.EncodeToString(namehash(name)); got != expected {
+			t.Errorf("namehash(%q) = %s, want %s", name, got, expected)
+		}
+	}
+}
+
+func TestDecodeContenthash(t *testing.T) {
+	tests := []struct {
+		contenthash string
+		namespace   string
+		identifier  string
+		wantErr     bool
+	}{
+		{
+			contenthash: "e3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f",
+			namespace:   "ipfs",
+			identifier:  "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4",
+		},
+		{
+			contenthash: "e40101fa011b20d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162",
+			namespace:   "swarm",
+			identifier:  "d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162",
+		},
+		{contenthash: "aa01", wantErr: true},
+		{contenthash: "e301017012", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contenthash, func(t *testing.T) {
+			raw, _ := hex.DecodeString(tt.contenthash)
+			ns, id, err := decodeContenthash(raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeContenthash() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ns != tt.namespace || id != tt.identifier {
+				t.Errorf("decodeContenthash() = %q, %q, want %q, %q", ns, id, tt.namespace, tt.identifier)
+			}
+		})
+	}
+}
+
+func TestENSResolver(t *testing.T) {
+	const resolverAddr = "0x4976fb03c32e5b8cfe2b6ccb31c09ba78ebaba41"
+	contenthash := "e3010170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f"
+	node := hex.EncodeToString(namehash("foo.eth"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []json.RawMessage `json:"params"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var call struct{ To, Data string }
+		_ = json.Unmarshal(req.Params[0], &call)
+
+		result := "0x"
+		switch {
+		case strings.EqualFold(call.To, ensRegistry) && call.Data == "0x"+selectorResolver+node:
+			result += strings.Repeat("0", 24) + strings.TrimPrefix(resolverAddr, "0x")
+		case strings.EqualFold(call.To, ensRegistry):
+			result += strings.Repeat("0", 64)
+		case call.To == resolverAddr && call.Data == "0x"+selectorContenthash+node:
+			result += encodeABIBytes(contenthash)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "result": result})
+	}))
+	defer srv.Close()
+
+	r := &ENSResolver{RPC: srv.URL}
+	if err := r.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Resolve(context.Background(), "Foo.eth")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if entries := result.Links["ipfs"]; len(entries) != 1 || entries[0].Identifier != "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4" {
+		t.Errorf("Links[ipfs] = %+v", entries)
+	}
+
+	for _, host := range []string{"unregistered.eth", "example.com"} {
+		if _, err := r.Resolve(context.Background(), host); lookupOutcome("", err) != outcomeNoLink {
+			t.Errorf("Resolve(%s) error = %v, want no link", host, err)
+		}
+	}
+}
+
+// encodeABIBytes ABI-encodes hex data as a dynamic bytes return value.
+func encodeABIBytes(data string) string {
+	padded := data + strings.Repeat("0", (64-len(data)%64)%64)
+	return fmt.Sprintf("%064x%064x", 32, len(data)/2) + padded
+}
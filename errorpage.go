@@ -0,0 +1,62 @@
+package dnslink
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// failure describes a request that could not be routed. Its exported
+// fields are available to error page templates.
+type failure struct {
+	Status    int
+	Host      string
+	Namespace string
+	Message   string
+}
+
+// problem is an RFC 9457 problem details object, extended with the host
+// and namespace of the failed request.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Host      string `json:"host"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// writeFailure writes the error response for f: the error page template if
+// one is configured, a problem+json body if ErrorJSON is set, or a plain
+// text message otherwise.
+func (d *DNSLink) writeFailure(w http.ResponseWriter, f failure) error {
+	switch {
+	case d.errorPage != nil:
+		// Render into a buffer so a failing template doesn't leave a
+		// half-written response.
+		var buf bytes.Buffer
+		if err := d.errorPage.Execute(&buf, f); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(f.Status)
+		_, err := w.Write(buf.Bytes())
+		return err
+	case d.ErrorJSON:
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(f.Status)
+		return json.NewEncoder(w).Encode(problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(f.Status),
+			Status:    f.Status,
+			Detail:    f.Message,
+			Host:      f.Host,
+			Namespace: f.Namespace,
+		})
+	default:
+		http.Error(w, f.Message, f.Status)
+		return nil
+	}
+}
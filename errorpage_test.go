@@ -0,0 +1,61 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteFailure(t *testing.T) {
+	f := failure{
+		Status:    http.StatusNotFound,
+		Host:      "<b>example.com</b>",
+		Namespace: "arweave",
+		Message:   "namespace arweave is not served",
+	}
+
+	t.Run("template", func(t *testing.T) {
+		d := &DNSLink{errorPage: template.Must(template.New("page").Parse(`{{.Status}} {{.Host}} {{.Namespace}}`))}
+		rec := httptest.NewRecorder()
+		if err := d.writeFailure(rec, f); err != nil {
+			t.Fatal(err)
+		}
+		want := "404 &lt;b&gt;example.com&lt;/b&gt; arweave"
+		if rec.Code != http.StatusNotFound || rec.Body.String() != want {
+			t.Errorf("response = %d %q, want 404 %q", rec.Code, rec.Body.String(), want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	})
+
+	t.Run("problem json", func(t *testing.T) {
+		d := &DNSLink{ErrorJSON: true}
+		rec := httptest.NewRecorder()
+		if err := d.writeFailure(rec, f); err != nil {
+			t.Fatal(err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("Content-Type = %q, want application/problem+json", ct)
+		}
+		var p problem
+		if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != 404 || p.Title != "Not Found" || p.Host != f.Host || p.Namespace != "arweave" || p.Detail != f.Message {
+			t.Errorf("problem = %+v", p)
+		}
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		if err := new(DNSLink).writeFailure(rec, f); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusNotFound || rec.Body.String() != f.Message+"\n" {
+			t.Errorf("response = %d %q", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package dnslink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// contentAddressed lists the namespaces whose identifiers name immutable
+// content, so a response is fully determined by the identifier and the
+// request path.
+var contentAddressed = map[string]bool{
+	"ipfs":  true,
+	"swarm": true,
+	"bzz":   true,
+}
+
+// immutableLink reports whether a link names immutable content: one of a
+// content-addressed namespace, or an Arweave transaction rather than an
+// ArNS name.
+func immutableLink(namespace, identifier string) bool {
+	root, _, _ := strings.Cut(identifier, "/")
+	arweaveTx := (namespace == "arweave" || namespace == "ar") && isArweaveTxID(root)
+	return contentAddressed[namespace] || arweaveTx
+}
+
+// contentPath returns the content path of a request for a link, as
+// identified by ETags and the content cache. identifier and path must be
+// escaped as for the upstream path; query is the raw query of the request,
+// which may select a different representation.
+func contentPath(namespace, identifier, path, query string) string {
+	return "/" + namespace + "/" + strings.TrimSuffix(identifier, "/") + path + "?" + query
+}
+
+// identifierETag returns a strong ETag for a request served from an
+// immutable link, or "" if the link is mutable.
+func identifierETag(namespace, identifier, path, query string) string {
+	if !immutableLink(namespace, identifier) {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(contentPath(namespace, identifier, path, query)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison of RFC 9110. The "*" wildcard is not honoured, since
+// it is only true if the upstream has the content.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified writes a 304 response for a request whose If-None-Match
+// matched etag. w should set the headers the full response would have,
+// such as Cache-Control, as RFC 9110 requires of a 304.
+func notModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,105 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestIdentifierETag(t *testing.T) {
+	etag := identifierETag("ipfs", "QmXyz789", "/index.html", "")
+	if etag == "" || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("identifierETag() = %q, want a quoted tag", etag)
+	}
+	if got := identifierETag("ipfs", "QmXyz789/", "/index.html", ""); got != etag {
+		t.Errorf("identifierETag() with trailing slash = %q, want %q", got, etag)
+	}
+	for _, other := range []string{
+		identifierETag("ipfs", "QmOther", "/index.html", ""),
+		identifierETag("ipfs", "QmXyz789", "/other.html", ""),
+		identifierETag("ipfs", "QmXyz789", "/index.html", "format=car"),
+		identifierETag("swarm", "QmXyz789", "/index.html", ""),
+	} {
+		if other == etag {
+			t.Errorf("identifierETag() = %q for different content", other)
+		}
+	}
+	if got := identifierETag("ipns", "example.com", "/", ""); got != "" {
+		t.Errorf("identifierETag(ipns) = %q, want empty", got)
+	}
+	if got := identifierETag("arweave", "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U", "/", ""); got == "" {
+		t.Error("identifierETag(arweave transaction) is empty")
+	}
+	if got := identifierETag("ar", "ardrive", "/", ""); got != "" {
+		t.Errorf("identifierETag(ArNS name) = %q, want empty", got)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{ifNoneMatch: `"abc"`, want: true},
+		{ifNoneMatch: `W/"abc"`, want: true},
+		{ifNoneMatch: `"xyz", "abc"`, want: true},
+		{ifNoneMatch: `"xyz"`, want: false},
+		{ifNoneMatch: `*`, want: false},
+		{ifNoneMatch: ``, want: false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	app := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		lookup: func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmXyz789"}}, nil
+		},
+	}
+	d := &DNSLink{
+		Upstreams:    map[string]string{"/ipfs": "ipfs:8080"},
+		ETag:         true,
+		CacheControl: true,
+		CORS:         map[string]*CORSPolicy{"/ipfs": {}},
+		proxies:      map[string]*reverseproxy.Handler{"/ipfs": {}},
+		app:          app,
+		logger:       zap.NewNop(),
+	}
+	etag := identifierETag("ipfs", "QmXyz789", "/index.html", "")
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/index.html", nil)
+	req.Header.Set("If-None-Match", etag)
+	req.Header.Set("Origin", "https://app.example")
+	rec := httptest.NewRecorder()
+	if err := d.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })); err != nil {
+		t.Fatal(err)
+	}
+
+	// The 304 has the headers the full response would.
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", rec.Code)
+	}
+	for name, want := range map[string]string{
+		"ETag":                        etag,
+		"Cache-Control":               cacheControl(d.maxAge("/ipfs", CacheEntry{}, time.Now())),
+		"Access-Control-Allow-Origin": "*",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
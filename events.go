@@ -0,0 +1,49 @@
+package dnslink
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// Event names emitted through Caddy's event system.
+const (
+	eventResolved = "dnslink.resolved"
+	eventMiss     = "dnslink.miss"
+	eventChanged  = "dnslink.changed"
+)
+
+// emit dispatches an event if the events app is available.
+func (a *App) emit(name string, data map[string]any) caddyevents.Event {
+	if a.events == nil {
+		return caddyevents.Event{}
+	}
+	return a.events.Emit(a.ctx, name, data)
+}
+
+// emitResolution fires the events describing the outcome of a live
+// lookup for host. prev is the last entry resolved for host, if any.
+func (a *App) emitResolution(host string, entry CacheEntry, prev CacheEntry, hadPrev bool, err error) {
+	if entry.Namespace == "" {
+		data := map[string]any{"host": host}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		a.emit(eventMiss, data)
+		return
+	}
+
+	a.emit(eventResolved, map[string]any{
+		"host":       host,
+		"namespace":  entry.Namespace,
+		"identifier": entry.Identifier,
+	})
+
+	if hadPrev && (prev.Namespace != entry.Namespace || prev.Identifier != entry.Identifier) {
+		a.emit(eventChanged, map[string]any{
+			"host":                host,
+			"namespace":           entry.Namespace,
+			"identifier":          entry.Identifier,
+			"previous_namespace":  prev.Namespace,
+			"previous_identifier": prev.Identifier,
+		})
+	}
+}
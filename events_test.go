@@ -0,0 +1,106 @@
+package dnslink
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// eventRecorder is an events handler recording the events it handles.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []recordedEvent
+}
+
+type recordedEvent struct {
+	name string
+	data map[string]any
+}
+
+func (r *eventRecorder) Handle(_ context.Context, e caddyevents.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, recordedEvent{name: e.CloudEvent().Type, data: e.Data})
+	return nil
+}
+
+// take returns the events recorded since it was last called.
+func (r *eventRecorder) take() []recordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestEmitResolution(t *testing.T) {
+	mod, _ := loadTestModule(t, "dnslink", &App{})
+	a := mod.(*App)
+
+	// Record the events in an events app of the test's own, rather than
+	// subscribing to the one shared by the config.
+	events := new(caddyevents.App)
+	if err := events.Provision(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	rec := new(eventRecorder)
+	if err := events.Subscribe(&caddyevents.Subscription{
+		Events:   []string{eventResolved, eventChanged, eventMiss},
+		Handlers: []caddyevents.Handler{rec},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.events = events
+
+	var value string
+	a.lookup = func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		if value == "" {
+			return nil, nil
+		}
+		return []dnslinkpkg.LookupEntry{{Value: "dnslink=" + value}}, nil
+	}
+
+	resolved := func(identifier string) recordedEvent {
+		return recordedEvent{name: eventResolved, data: map[string]any{
+			"host":       "example.com",
+			"namespace":  "ipfs",
+			"identifier": identifier,
+		}}
+	}
+	tests := []struct {
+		name  string
+		value string
+		want  []recordedEvent
+	}{
+		{name: "first resolution", value: "/ipfs/QmOld", want: []recordedEvent{resolved("QmOld")}},
+		{name: "same link", value: "/ipfs/QmOld", want: []recordedEvent{resolved("QmOld")}},
+		{name: "changed link", value: "/ipfs/QmNew", want: []recordedEvent{
+			resolved("QmNew"),
+			{name: eventChanged, data: map[string]any{
+				"host":                "example.com",
+				"namespace":           "ipfs",
+				"identifier":          "QmNew",
+				"previous_namespace":  "ipfs",
+				"previous_identifier": "QmOld",
+			}},
+		}},
+		{name: "no link", want: []recordedEvent{
+			{name: eventMiss, data: map[string]any{"host": "example.com"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value = tt.value
+			if _, err := a.resolveLive(context.Background(), "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.take(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
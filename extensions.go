@@ -0,0 +1,209 @@
+package dnslink
+
+import (
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// Extensions of DNSLink records honored by the gateway.
+const (
+	// extensionTTL is a number of seconds the links of the namespace may
+	// be cached for at most.
+	extensionTTL = "ttl"
+	// extensionPriority orders the links of a namespace, lowest first.
+	extensionPriority = "priority"
+	// extensionWeight is the weight of the link for the weighted
+	// selection strategy.
+	extensionWeight = "weight"
+)
+
+// headerDNSLinkExtension prefixes the request headers extensions are sent
+// upstream in, e.g. X-Dnslink-Ext-Priority.
+const headerDNSLinkExtension = "X-Dnslink-Ext-"
+
+// extensionKey matches the keys of extensions.
+var extensionKey = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// splitExtensions splits a DNSLink value such as
+// "/ipfs/bafy... ttl=300 priority=1" into the link and its key=value
+// extensions. Keys are lowercased; fields that are not key=value pairs are
+// ignored, and so are repeated keys after the first.
+func splitExtensions(value string) (string, map[string]string) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	var ext map[string]string
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		key = strings.ToLower(key)
+		if !ok || val == "" || !extensionKey.MatchString(key) {
+			continue
+		}
+		if _, dup := ext[key]; dup {
+			continue
+		}
+		if ext == nil {
+			ext = make(map[string]string)
+		}
+		ext[key] = val
+	}
+	return fields[0], ext
+}
+
+// stripExtensions returns links with the extensions cut off their
+// identifiers. links is returned as is if none has any, and is never
+// modified.
+func stripExtensions(links map[string]dnslinkpkg.NamespaceEntries) map[string]dnslinkpkg.NamespaceEntries {
+	stripped := links
+	copied := false
+	for ns, entries := range links {
+		if !slices.ContainsFunc(entries, func(e dnslinkpkg.NamespaceEntry) bool { return strings.ContainsAny(e.Identifier, " \t") }) {
+			continue
+		}
+		if !copied {
+			stripped, copied = maps.Clone(links), true
+		}
+		cut := make(dnslinkpkg.NamespaceEntries, 0, len(entries))
+		for _, e := range entries {
+			if e.Identifier, _ = splitExtensions(e.Identifier); e.Identifier != "" {
+				cut = append(cut, e)
+			}
+		}
+		stripped[ns] = cut
+	}
+	return stripped
+}
+
+// txtExtensions returns the extensions of the TXT entries of a resolution,
+// by /<namespace>/<identifier> link.
+func txtExtensions(entries []dnslinkpkg.TxtEntry) map[string]map[string]string {
+	var all map[string]map[string]string
+	for _, e := range entries {
+		value, ext := splitExtensions(e.Value)
+		if ext == nil {
+			continue
+		}
+		ns, id, err := parseLink(value)
+		if err != nil {
+			continue
+		}
+		link := "/" + ns + "/" + id
+		if _, dup := all[link]; dup {
+			continue
+		}
+		if all == nil {
+			all = make(map[string]map[string]string)
+		}
+		all[link] = ext
+	}
+	return all
+}
+
+// extensionInt returns the non-negative integer value of the extension
+// key, if it has one.
+func extensionInt(ext map[string]string, key string) (int, bool) {
+	n, err := strconv.Atoi(ext[key])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// prioritizeLinks orders the links of each namespace by their priority
+// extension, lowest first, before those without one, keeping the order of
+// links of the same priority. links is never modified.
+func prioritizeLinks(links map[string]dnslinkpkg.NamespaceEntries, ext map[string]map[string]string) map[string]dnslinkpkg.NamespaceEntries {
+	if len(ext) == 0 {
+		return links
+	}
+	ordered := links
+	copied := false
+	for ns, entries := range links {
+		priority := func(e dnslinkpkg.NamespaceEntry) int {
+			if p, ok := extensionInt(ext["/"+ns+"/"+e.Identifier], extensionPriority); ok {
+				return p
+			}
+			return -1
+		}
+		compare := func(a, b dnslinkpkg.NamespaceEntry) int {
+			pa, pb := priority(a), priority(b)
+			switch {
+			case pa == pb:
+				return 0
+			case pa < 0:
+				return 1
+			case pb < 0:
+				return -1
+			}
+			return pa - pb
+		}
+		if slices.IsSortedFunc(entries, compare) {
+			continue
+		}
+		if !copied {
+			ordered, copied = maps.Clone(links), true
+		}
+		sorted := slices.Clone(entries)
+		slices.SortStableFunc(sorted, compare)
+		ordered[ns] = sorted
+	}
+	return ordered
+}
+
+// linkExtensions returns the extensions of the links of a resolution, if
+// TXTExtensions is set.
+func (a *App) linkExtensions(result dnslinkpkg.Result) map[string]map[string]string {
+	if !a.TXTExtensions {
+		return nil
+	}
+	ext := txtExtensions(result.TxtEntries)
+	for link := range ext {
+		ns, id, _ := parseLink(link)
+		if !slices.ContainsFunc(result.Links[ns], func(e dnslinkpkg.NamespaceEntry) bool { return e.Identifier == id }) {
+			delete(ext, link)
+		}
+	}
+	if len(ext) == 0 {
+		return nil
+	}
+	return ext
+}
+
+// hintedTTL returns ttl, lowered to the ttl extension of the links of
+// namespace if any is lower, but no lower than MinTTL.
+func (a *App) hintedTTL(ttl time.Duration, entry CacheEntry, namespace string) time.Duration {
+	for _, e := range entry.Links[namespace] {
+		secs, ok := extensionInt(entry.extensions(namespace, e.Identifier), extensionTTL)
+		if hint := time.Duration(secs) * time.Second; ok && hint < ttl {
+			ttl = max(hint, min(time.Duration(a.MinTTL), ttl))
+		}
+	}
+	return ttl
+}
+
+// extensions returns the extensions of the link /<namespace>/<identifier>
+// of the entry.
+func (e CacheEntry) extensions(namespace, identifier string) map[string]string {
+	return e.Extensions["/"+namespace+"/"+identifier]
+}
+
+// setExtensionHeaders replaces the extension headers of a request with
+// ext.
+func setExtensionHeaders(h http.Header, ext map[string]string) {
+	for name := range h {
+		if strings.HasPrefix(name, headerDNSLinkExtension) {
+			h.Del(name)
+		}
+	}
+	for key, value := range ext {
+		h.Set(headerDNSLinkExtension+key, value)
+	}
+}
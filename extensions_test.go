@@ -0,0 +1,146 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestSplitExtensions(t *testing.T) {
+	tests := []struct {
+		value, link string
+		ext         map[string]string
+	}{
+		{value: "/ipfs/QmXyz", link: "/ipfs/QmXyz"},
+		{value: "/ipfs/QmXyz ttl=300 Priority=1", link: "/ipfs/QmXyz", ext: map[string]string{"ttl": "300", "priority": "1"}},
+		{value: "/ipfs/QmXyz  ttl=300 ttl=10", link: "/ipfs/QmXyz", ext: map[string]string{"ttl": "300"}},
+		{value: "/ipfs/QmXyz note ttl= =1 x_y=2 region=eu-west", link: "/ipfs/QmXyz", ext: map[string]string{"region": "eu-west"}},
+		{value: "", link: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			link, ext := splitExtensions(tt.value)
+			if link != tt.link || !reflect.DeepEqual(ext, tt.ext) {
+				t.Errorf("splitExtensions() = %q, %v, want %q, %v", link, ext, tt.link, tt.ext)
+			}
+		})
+	}
+}
+
+func TestTXTExtensions(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	records := []string{
+		"dnslink=/ipfs/QmA weight=1",
+		"dnslink=/ipfs/QmB priority=2 ttl=30",
+		"dnslink=/ipfs/QmC priority=1 weight=3",
+	}
+	newApp := func(extensions bool) *App {
+		return &App{
+			CacheTTL:      caddy.Duration(time.Hour),
+			LookupTimeout: caddy.Duration(time.Second),
+			TXTExtensions: extensions,
+			cache:         new(MemoryCache),
+			logger:        zap.NewNop(),
+			lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+				if name != "_dnslink.example.com" {
+					return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+				}
+				var entries []dnslinkpkg.LookupEntry
+				for _, v := range records {
+					entries = append(entries, dnslinkpkg.LookupEntry{Value: v, Ttl: 60})
+				}
+				return entries, nil
+			},
+		}
+	}
+
+	entry, _, err := newApp(true).resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Identifier != "QmC" {
+		t.Errorf("identifier = %q, want the lowest priority QmC", entry.Identifier)
+	}
+	var ids []string
+	for _, e := range entry.Links["ipfs"] {
+		ids = append(ids, e.Identifier)
+	}
+	if want := []string{"QmC", "QmB", "QmA"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("links = %v, want %v", ids, want)
+	}
+	want := map[string]map[string]string{
+		"/ipfs/QmA": {"weight": "1"},
+		"/ipfs/QmB": {"priority": "2", "ttl": "30"},
+		"/ipfs/QmC": {"priority": "1", "weight": "3"},
+	}
+	if !reflect.DeepEqual(entry.Extensions, want) {
+		t.Errorf("extensions = %v, want %v", entry.Extensions, want)
+	}
+	if ttl := time.Until(entry.ExpiresAt); ttl > 30*time.Second {
+		t.Errorf("cached for %v, want at most the ttl extension of 30s", ttl)
+	}
+
+	// Without txt_extensions, extensions are part of the identifier.
+	entry, _, err = newApp(false).resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Identifier != "QmA weight=1" || entry.Extensions != nil {
+		t.Errorf("entry = %q, %v, want extensions left in the identifier", entry.Identifier, entry.Extensions)
+	}
+}
+
+func TestWeightExtension(t *testing.T) {
+	d := &DNSLink{Selection: map[string]*LinkSelection{"/ipfs": {Strategy: selectWeighted, Weights: map[string]int{"QmB": 0}}}}
+	entry := CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmA",
+		Links:      map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmA"}, {Identifier: "QmB"}, {Identifier: "QmC"}}},
+		Extensions: map[string]map[string]string{
+			"/ipfs/QmA": {"weight": "0"},
+			"/ipfs/QmB": {"weight": "5"},
+		},
+	}
+	// QmA has a published weight of 0, and the configured weight of QmB
+	// wins over its published one.
+	for i := 0; i < 50; i++ {
+		if got := d.selectIdentifier("/ipfs", entry); got != "QmC" {
+			t.Fatalf("selectIdentifier() = %s, want QmC", got)
+		}
+	}
+}
+
+func TestSetExtensionHeaders(t *testing.T) {
+	h := http.Header{"X-Dnslink-Ext-Priority": {"spoofed"}, "Accept": {"*/*"}}
+	setExtensionHeaders(h, map[string]string{"ttl": "30", "region": "eu"})
+	want := http.Header{"X-Dnslink-Ext-Ttl": {"30"}, "X-Dnslink-Ext-Region": {"eu"}, "Accept": {"*/*"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+	setExtensionHeaders(h, nil)
+	if want := (http.Header{"Accept": {"*/*"}}); !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+}
+
+func TestParseTXTExtensions(t *testing.T) {
+	var a App
+	if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dnslink {
+		txt_extensions
+	}`)); err != nil || !a.TXTExtensions {
+		t.Errorf("UnmarshalCaddyfile() = %v, TXTExtensions %v", err, a.TXTExtensions)
+	}
+	if err := new(App).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dnslink {
+		txt_extensions on
+	}`)); err == nil {
+		t.Error("UnmarshalCaddyfile() accepted an argument to txt_extensions")
+	}
+}
@@ -0,0 +1,209 @@
+package dnslink
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// Failover retries the requests of a prefix against alternate upstreams
+// when its upstream cannot be reached or answers with a retryable status.
+// Only requests without a body whose method is listed in Methods are
+// retried, so requests with side effects are never sent twice.
+type Failover struct {
+	// Upstreams are the alternate upstreams, tried in order after the
+	// prefix's own.
+	Upstreams []string `json:"upstreams,omitempty"`
+
+	// RetryCount is how many times a request is retried, moving to the
+	// next upstream each time and wrapping around to the prefix's own.
+	// Default is one retry per alternate upstream.
+	RetryCount int `json:"retry_count,omitempty"`
+
+	// Statuses are the upstream response statuses that are retried, in
+	// addition to connection errors. Default is 502, 503 and 504.
+	Statuses []int `json:"statuses,omitempty"`
+
+	// Methods are the request methods that are retried. Default is GET,
+	// HEAD and OPTIONS.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// retries returns the number of retries of a request.
+func (f *Failover) retries() int {
+	if f.RetryCount == 0 {
+		return len(f.Upstreams)
+	}
+	return f.RetryCount
+}
+
+// retryable reports whether r may be sent more than once. Upgrades such as
+// websockets are never retried, since their connection is handed over to
+// the upstream.
+func (f *Failover) retryable(r *http.Request) bool {
+	if r.ContentLength != 0 || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if len(f.Methods) == 0 {
+		return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	}
+	return slices.Contains(f.Methods, r.Method)
+}
+
+// retryStatus reports whether an upstream response with status is retried.
+func (f *Failover) retryStatus(status int) bool {
+	if len(f.Statuses) == 0 {
+		return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+	}
+	return slices.Contains(f.Statuses, status)
+}
+
+// validate checks the failover configuration.
+func (f *Failover) validate() error {
+	for _, upstream := range f.Upstreams {
+		if strings.TrimSpace(upstream) == "" {
+			return fmt.Errorf("empty upstream address")
+		}
+	}
+	if f.RetryCount < 0 {
+		return fmt.Errorf("negative retry_count %d", f.RetryCount)
+	}
+	if f.retries() == 0 {
+		return fmt.Errorf("no alternate upstreams or retry_count")
+	}
+	for _, status := range f.Statuses {
+		if status < 500 || status > 599 {
+			return fmt.Errorf("invalid retry status %d", status)
+		}
+	}
+	return nil
+}
+
+// serveFailover proxies r with proxy, the reverse proxy of prefix, and
+// with the prefix's alternate upstreams if it fails.
+func (d *DNSLink) serveFailover(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, prefix string, proxy *reverseproxy.Handler) error {
+	f, ok := d.Failover[prefix]
+	if !ok || !f.retryable(r) {
+		return proxy.ServeHTTP(w, r, next)
+	}
+	pool := make([]caddyhttp.MiddlewareHandler, 0, 1+len(d.alternates[prefix]))
+	pool = append(pool, proxy)
+	for _, rp := range d.alternates[prefix] {
+		pool = append(pool, rp)
+	}
+	return d.retry(w, r, next, prefix, f, pool)
+}
+
+// retry serves r with each handler of pool in turn until one succeeds or
+// the retries of f are exhausted. Responses with a retryable status are
+// buffered and discarded unless they come from the last attempt, so the
+// client only sees the response that is kept.
+func (d *DNSLink) retry(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, prefix string, f *Failover, pool []caddyhttp.MiddlewareHandler) error {
+	header := w.Header().Clone()
+	retries := f.retries()
+	for attempt := 0; ; attempt++ {
+		h := pool[attempt%len(pool)]
+		if attempt == retries {
+			return h.ServeHTTP(w, r, next)
+		}
+
+		var buf bytes.Buffer
+		rec := caddyhttp.NewResponseRecorder(w, &buf, func(status int, _ http.Header) bool {
+			return f.retryStatus(status)
+		})
+		err := h.ServeHTTP(rec, r, next)
+		if r.Context().Err() != nil {
+			return err
+		}
+		switch {
+		case err != nil && rec.Status() == 0:
+			d.logger.Debug("retrying failed upstream", zap.String("prefix", prefix), zap.Int("attempt", attempt+1), zap.Error(err))
+		case err == nil && rec.Status() != 0 && rec.Buffered():
+			d.logger.Debug("retrying upstream response", zap.String("prefix", prefix), zap.Int("attempt", attempt+1), zap.Int("status", rec.Status()))
+		default:
+			return err
+		}
+		dnslinkMetrics.upstreamRetries.WithLabelValues(prefix).Inc()
+
+		// Drop the headers of the discarded response.
+		clear(w.Header())
+		maps.Copy(w.Header(), header.Clone())
+	}
+}
+
+// unmarshalFailover parses the failover subdirective:
+//
+//	failover <prefix> [<upstream>...] {
+//	    upstreams <upstream>...
+//	    retry_count <n>
+//	    status <code>...
+//	    methods <method>...
+//	}
+func unmarshalFailover(d *caddyfile.Dispenser) (string, *Failover, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	f := &Failover{Upstreams: trimSchemes(d.RemainingArgs())}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "upstreams":
+			upstreams := d.RemainingArgs()
+			if len(upstreams) == 0 {
+				return "", nil, d.ArgErr()
+			}
+			f.Upstreams = append(f.Upstreams, trimSchemes(upstreams)...)
+		case "retry_count":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 1 {
+				return "", nil, d.Errf("invalid retry_count '%s'", d.Val())
+			}
+			f.RetryCount = n
+		case "status":
+			codes := d.RemainingArgs()
+			if len(codes) == 0 {
+				return "", nil, d.ArgErr()
+			}
+			for _, code := range codes {
+				status, err := strconv.Atoi(code)
+				if err != nil {
+					return "", nil, d.Errf("invalid status '%s'", code)
+				}
+				f.Statuses = append(f.Statuses, status)
+			}
+		case "methods":
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				return "", nil, d.ArgErr()
+			}
+			for _, method := range methods {
+				f.Methods = append(f.Methods, strings.ToUpper(method))
+			}
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return prefix, f, nil
+}
+
+// trimSchemes removes the http:// or https:// scheme of upstreams, as in
+// the proxies block.
+func trimSchemes(upstreams []string) []string {
+	for i, upstream := range upstreams {
+		upstream = strings.TrimPrefix(upstream, "http://")
+		upstreams[i] = strings.TrimPrefix(upstream, "https://")
+	}
+	return upstreams
+}
@@ -0,0 +1,251 @@
+package dnslink
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// upstreamFunc is a fake upstream handler.
+type upstreamFunc func(http.ResponseWriter, *http.Request) error
+
+func (f upstreamFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	return f(w, r)
+}
+
+func TestFailoverRetry(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var primaryHits int
+	unavailable := upstreamFunc(func(w http.ResponseWriter, r *http.Request) error {
+		primaryHits++
+		w.Header().Set("X-Upstream", "primary")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable"))
+		return nil
+	})
+	unreachable := upstreamFunc(func(w http.ResponseWriter, r *http.Request) error {
+		primaryHits++
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("connection refused"))
+	})
+	alternate := upstreamFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Write([]byte("alternate"))
+		return nil
+	})
+
+	tests := []struct {
+		name       string
+		primary    upstreamFunc
+		failover   *Failover
+		method     string
+		wantStatus int
+		wantBody   string
+		wantHits   int
+	}{
+		{
+			name:       "retryable status",
+			primary:    unavailable,
+			failover:   &Failover{Upstreams: []string{"b:8080"}},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "alternate",
+			wantHits:   1,
+		},
+		{
+			name:       "connection error",
+			primary:    unreachable,
+			failover:   &Failover{Upstreams: []string{"b:8080"}},
+			method:     http.MethodHead,
+			wantStatus: http.StatusOK,
+			wantBody:   "alternate",
+			wantHits:   1,
+		},
+		{
+			name:       "status not retried",
+			primary:    unavailable,
+			failover:   &Failover{Upstreams: []string{"b:8080"}, Statuses: []int{http.StatusBadGateway}},
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "unavailable",
+			wantHits:   1,
+		},
+		{
+			name:       "method not retried",
+			primary:    unreachable,
+			failover:   &Failover{Upstreams: []string{"b:8080"}},
+			method:     http.MethodDelete,
+			wantStatus: http.StatusBadGateway,
+			wantHits:   1,
+		},
+		{
+			name:       "last attempt kept",
+			primary:    unavailable,
+			failover:   &Failover{RetryCount: 2},
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "unavailable",
+			wantHits:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primaryHits = 0
+			d := &DNSLink{Failover: map[string]*Failover{"/ipfs": tt.failover}, logger: zap.NewNop()}
+			pool := []caddyhttp.MiddlewareHandler{tt.primary}
+			for range tt.failover.Upstreams {
+				pool = append(pool, alternate)
+			}
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "http://example.com/", nil)
+			var err error
+			if tt.failover.retryable(r) {
+				err = d.retry(rec, r, nil, "/ipfs", tt.failover, pool)
+			} else {
+				err = tt.primary.ServeHTTP(rec, r, nil)
+			}
+			status := rec.Code
+			if herr, ok := err.(caddyhttp.HandlerError); ok {
+				status = herr.StatusCode
+			} else if err != nil {
+				t.Fatalf("retry() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if primaryHits != tt.wantHits {
+				t.Errorf("primary upstream hits = %d, want %d", primaryHits, tt.wantHits)
+			}
+			if tt.wantBody == "alternate" && rec.Header().Get("X-Upstream") != "" {
+				t.Error("headers of the discarded response were kept")
+			}
+		})
+	}
+}
+
+func TestServeFailover(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	// Both upstreams answer 502 until they are told otherwise.
+	var primaryHits, alternateHits atomic.Int32
+	var alternateUp atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		primaryHits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		alternateHits.Add(1)
+		if !alternateUp.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = io.WriteString(w, "alternate")
+	}))
+	defer alternate.Close()
+
+	tests := []struct {
+		name                       string
+		method                     string
+		retryCount                 int
+		alternateUp                bool
+		wantStatus                 int
+		wantPrimary, wantAlternate int32
+	}{
+		{name: "GET retried", method: http.MethodGet, alternateUp: true, wantStatus: http.StatusOK, wantPrimary: 1, wantAlternate: 1},
+		{name: "POST not retried", method: http.MethodPost, alternateUp: true, wantStatus: http.StatusBadGateway, wantPrimary: 1},
+		{name: "retry_count", method: http.MethodGet, retryCount: 3, wantStatus: http.StatusBadGateway, wantPrimary: 2, wantAlternate: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := loadTestHandler(t, &DNSLink{
+				Upstreams: map[string]string{"/ipfs": primary.Listener.Addr().String()},
+				Failover:  map[string]*Failover{"/ipfs": {Upstreams: []string{alternate.Listener.Addr().String()}, RetryCount: tt.retryCount}},
+			}, map[string]string{"example.com": "/ipfs/QmFake"})
+			primaryHits.Store(0)
+			alternateHits.Store(0)
+			alternateUp.Store(tt.alternateUp)
+
+			var body io.Reader
+			if tt.method == http.MethodPost {
+				body = strings.NewReader("data")
+			}
+			req := caddyhttp.PrepareRequest(httptest.NewRequest(tt.method, "http://example.com/", body), caddy.NewReplacer(), nil, &caddyhttp.Server{})
+			rec := httptest.NewRecorder()
+			if err := d.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got, want := [2]int32{primaryHits.Load(), alternateHits.Load()}, [2]int32{tt.wantPrimary, tt.wantAlternate}; got != want {
+				t.Errorf("upstream hits = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFailoverRetryable(t *testing.T) {
+	f := new(Failover)
+	if !f.retryable(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("GET is not retryable")
+	}
+	if f.retryable(httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body"))) {
+		t.Error("request with a body is retryable")
+	}
+	upgrade := httptest.NewRequest(http.MethodGet, "/", nil)
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	if f.retryable(upgrade) {
+		t.Error("websocket upgrade is retryable")
+	}
+	if f.retryable(httptest.NewRequest(http.MethodPost, "/", nil)) {
+		t.Error("POST is retryable by default")
+	}
+	f.Methods = []string{http.MethodPut}
+	if !f.retryable(httptest.NewRequest(http.MethodPut, "/", nil)) {
+		t.Error("listed PUT is not retryable")
+	}
+}
+
+func TestParseFailover(t *testing.T) {
+	input := `failover /ipfs http://ipfs-b:8080 {
+		upstreams ipfs-c:8080
+		retry_count 3
+		status 502 503
+		methods get head
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	d.Next()
+	prefix, f, err := unmarshalFailover(d)
+	if err != nil {
+		t.Fatalf("unmarshalFailover() error = %v", err)
+	}
+	if prefix != "/ipfs" {
+		t.Errorf("prefix = %q, want /ipfs", prefix)
+	}
+	if got := strings.Join(f.Upstreams, " "); got != "ipfs-b:8080 ipfs-c:8080" {
+		t.Errorf("Upstreams = %q", got)
+	}
+	if f.RetryCount != 3 || len(f.Statuses) != 2 || strings.Join(f.Methods, " ") != "GET HEAD" {
+		t.Errorf("Failover = %+v", f)
+	}
+	if err := (&Failover{Statuses: []int{404}, Upstreams: []string{"b:8080"}}).validate(); err == nil {
+		t.Error("validate() accepted a 404 retry status")
+	}
+	if err := new(Failover).validate(); err == nil {
+		t.Error("validate() accepted a failover without retries")
+	}
+}
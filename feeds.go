@@ -0,0 +1,220 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Defaults of SwarmFeeds.
+const (
+	defaultFeedTTL     = time.Minute
+	defaultFeedTimeout = 10 * time.Second
+)
+
+// maxFeedEntries bounds the feed resolutions kept in memory.
+const maxFeedEntries = 1024
+
+// SwarmFeeds resolves Swarm feed links to the feed's current reference
+// through the Bee API before proxying, so mutable Swarm sites stay current
+// without a DNS change per update. A feed link has an identifier made of
+// the feed owner's address and the topic, both hex, e.g.
+// /swarm/<owner>/<topic>/<path>; static references are proxied as they
+// are.
+type SwarmFeeds struct {
+	// API is the URL of the Bee API, e.g. http://bee:1633.
+	API string `json:"api"`
+
+	// TTL is how long a feed's reference is cached. Default is 1m,
+	// independently of the DNSLink record's TTL, since feeds change
+	// without DNS updates.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Timeout bounds a feed lookup. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	api    *url.URL
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]feedEntry
+}
+
+// feedEntry is a cached feed resolution.
+type feedEntry struct {
+	reference string
+	expiresAt time.Time
+}
+
+// provision validates the configuration and sets the defaults.
+func (f *SwarmFeeds) provision() error {
+	u, err := url.Parse(f.API)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid api '%s'", f.API)
+	}
+	f.api = u
+	if f.TTL < 0 || f.Timeout < 0 {
+		return fmt.Errorf("negative ttl or timeout")
+	}
+	if f.TTL == 0 {
+		f.TTL = caddy.Duration(defaultFeedTTL)
+	}
+	if f.Timeout == 0 {
+		f.Timeout = caddy.Duration(defaultFeedTimeout)
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	f.entries = make(map[string]feedEntry)
+	return nil
+}
+
+// parseFeed splits a swarm identifier of the form <owner>/<topic>[/<path>],
+// with a 20 byte hex owner address, optionally 0x-prefixed, and a 32 byte
+// hex topic. ok is false for other identifiers, such as static references.
+func parseFeed(identifier string) (owner, topic, rest string, ok bool) {
+	owner, after, found := strings.Cut(identifier, "/")
+	if !found {
+		return "", "", "", false
+	}
+	owner = strings.ToLower(strings.TrimPrefix(owner, "0x"))
+	topic, rest, _ = strings.Cut(after, "/")
+	topic = strings.ToLower(topic)
+	if !isHexOfLength(owner, 20) || !isHexOfLength(topic, 32) {
+		return "", "", "", false
+	}
+	if rest != "" {
+		rest = "/" + rest
+	}
+	return owner, topic, rest, true
+}
+
+// isHexOfLength reports whether s is the hex encoding of n bytes.
+func isHexOfLength(s string, n int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == n
+}
+
+// resolve returns the current reference of the feed of owner and topic,
+// and when it expires from the cache.
+func (f *SwarmFeeds) resolve(ctx context.Context, owner, topic string) (string, time.Time, error) {
+	key := owner + "/" + topic
+	now := time.Now()
+	f.mu.Lock()
+	entry, ok := f.entries[key]
+	f.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.reference, entry.expiresAt, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(f.Timeout))
+	defer cancel()
+	ref, err := f.lookup(ctx, owner, topic)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	entry = feedEntry{reference: ref, expiresAt: now.Add(time.Duration(f.TTL))}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.entries) >= maxFeedEntries {
+		for k, e := range f.entries {
+			if !now.Before(e.expiresAt) {
+				delete(f.entries, k)
+			}
+		}
+		if len(f.entries) >= maxFeedEntries {
+			clear(f.entries)
+		}
+	}
+	f.entries[key] = entry
+	return entry.reference, entry.expiresAt, nil
+}
+
+// lookup asks the Bee API for the latest update of a feed. The update is
+// read as a JSON object with a reference, or as the raw payload of a
+// feed update: an 8 byte timestamp followed by a 32 or 64 byte reference.
+func (f *SwarmFeeds) lookup(ctx context.Context, owner, topic string) (string, error) {
+	u := f.api.JoinPath("feeds", owner, topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("swarm feed: unexpected HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("swarm feed: reading response: %v", err)
+	}
+
+	var ref string
+	var update struct {
+		Reference string `json:"reference"`
+	}
+	switch {
+	case json.Unmarshal(body, &update) == nil:
+		ref = strings.ToLower(update.Reference)
+	case len(body) == 8+32 || len(body) == 8+64:
+		ref = hex.EncodeToString(body[8:])
+	}
+	if !isHexOfLength(ref, 32) && !isHexOfLength(ref, 64) {
+		return "", fmt.Errorf("swarm feed: no reference in the update of %s/%s", owner, topic)
+	}
+	return ref, nil
+}
+
+// unmarshalSwarmFeeds parses the swarm_feeds subdirective:
+//
+//	swarm_feeds <api> {
+//	    ttl <duration>
+//	    timeout <duration>
+//	}
+func unmarshalSwarmFeeds(d *caddyfile.Dispenser) (*SwarmFeeds, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	f := &SwarmFeeds{API: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "ttl", "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "ttl" {
+				f.TTL = caddy.Duration(dur)
+			} else {
+				f.Timeout = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,156 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+const (
+	testFeedOwner = "8d3766440f0d7b949a5e32995d09619a7f86e632"
+	testFeedTopic = "c1b6a5e2b8e0a4c1e3f1d5d4a9e7b8c6d2f0a1b3c5d7e9f1a3b5c7d9e1f3a5b7"
+	testFeedRef   = "d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162"
+)
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		identifier string
+		wantRest   string
+		wantOK     bool
+	}{
+		{identifier: testFeedOwner + "/" + testFeedTopic, wantOK: true},
+		{identifier: "0x" + strings.ToUpper(testFeedOwner) + "/" + testFeedTopic + "/docs/index.html", wantRest: "/docs/index.html", wantOK: true},
+		{identifier: testFeedRef},
+		{identifier: testFeedRef + "/index.html"},
+		{identifier: testFeedOwner + "/" + testFeedTopic[:62]},
+		{identifier: testFeedOwner},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			owner, topic, rest, ok := parseFeed(tt.identifier)
+			if ok != tt.wantOK || rest != tt.wantRest {
+				t.Fatalf("parseFeed() = %q, %q, %q, %v, want rest %q, %v", owner, topic, rest, ok, tt.wantRest, tt.wantOK)
+			}
+			if ok && (owner != testFeedOwner || topic != testFeedTopic) {
+				t.Errorf("parseFeed() = %q, %q", owner, topic)
+			}
+		})
+	}
+}
+
+func TestSwarmFeedsResolve(t *testing.T) {
+	var lookups int
+	binary := false
+	bee := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/feeds/"+testFeedOwner+"/"+testFeedTopic {
+			http.NotFound(w, r)
+			return
+		}
+		if binary {
+			ref, _ := hex.DecodeString(testFeedRef)
+			w.Write(append(make([]byte, 8), ref...))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"reference": testFeedRef})
+	}))
+	defer bee.Close()
+
+	f := &SwarmFeeds{API: bee.URL}
+	if err := f.provision(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		ref, expiresAt, err := f.resolve(ctx, testFeedOwner, testFeedTopic)
+		if err != nil || ref != testFeedRef || time.Until(expiresAt) > defaultFeedTTL {
+			t.Fatalf("resolve() = %q, %v, %v", ref, expiresAt, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("lookups = %d, want 1 with the cache", lookups)
+	}
+
+	clear(f.entries)
+	binary = true
+	if ref, _, err := f.resolve(ctx, testFeedOwner, testFeedTopic); err != nil || ref != testFeedRef {
+		t.Errorf("resolve() of a binary update = %q, %v", ref, err)
+	}
+	if _, _, err := f.resolve(ctx, testFeedOwner, strings.Repeat("0", 64)); err == nil {
+		t.Error("resolve() of a missing feed succeeded")
+	}
+	if err := (&SwarmFeeds{API: "bee:1633"}).provision(); err == nil {
+		t.Error("provision() accepted an API without a scheme")
+	}
+}
+
+func TestSwarmFeedLink(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	bee := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"reference": testFeedRef})
+	}))
+	defer bee.Close()
+
+	d := &DNSLink{
+		SwarmFeeds: &SwarmFeeds{API: bee.URL},
+		Trace:      &Trace{Secret: "s3cret"},
+		proxies:    map[string]*reverseproxy.Handler{"/swarm": nil},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					"swarm": {{Identifier: testFeedOwner + "/" + testFeedTopic}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.SwarmFeeds.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Trace.provision(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://feed.example.com/app.js", nil)
+	r.Header.Set(defaultTraceHeader, "s3cret")
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	if err := d.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	var tr requestTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Identifier != testFeedRef || tr.UpstreamPath != "/swarm/"+testFeedRef+"/app.js" {
+		t.Errorf("trace = %+v, want the feed's reference", tr)
+	}
+}
+
+func TestParseSwarmFeeds(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`swarm_feeds http://bee:1633 {
+		ttl 30s
+		timeout 5s
+	}`)
+	d.Next()
+	f, err := unmarshalSwarmFeeds(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.API != "http://bee:1633" || time.Duration(f.TTL) != 30*time.Second || time.Duration(f.Timeout) != 5*time.Second {
+		t.Errorf("SwarmFeeds = %+v", f)
+	}
+}
@@ -0,0 +1,142 @@
+package dnslink
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parseTrustedProxies parses TrustedProxies into prefixes. The
+// "private_ranges" shortcut expands to the private IP ranges.
+func parseTrustedProxies(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, expr := range ranges {
+		exprs := []string{expr}
+		if expr == "private_ranges" {
+			exprs = caddyhttp.PrivateRangesCIDR()
+		}
+		for _, e := range exprs {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(e)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// fromTrustedProxy reports whether r was sent by a trusted proxy: one in
+// the handler's TrustedProxies, or one the server's trusted_proxies already
+// vouched for.
+func (d *DNSLink) fromTrustedProxy(r *http.Request) bool {
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); trusted {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range d.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the host to resolve for r, without a port: the last
+// X-Forwarded-Host value if TrustForwardedHost is set and r came from a
+// trusted proxy, and r.Host otherwise. If SNIFallback is set and that host
+// is not usable, the TLS server name of the connection is used instead.
+// The longest matching HostSuffixes entry is then stripped.
+func (d *DNSLink) requestHost(r *http.Request) string {
+	host := r.Host
+	if d.TrustForwardedHost && d.fromTrustedProxy(r) {
+		if values := r.Header.Values("X-Forwarded-Host"); len(values) > 0 {
+			last := values[len(values)-1]
+			if i := strings.LastIndex(last, ","); i >= 0 {
+				last = last[i+1:]
+			}
+			if last = strings.TrimSpace(last); last != "" {
+				host = last
+			}
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if d.SNIFallback && r.TLS != nil && r.TLS.ServerName != "" && !usableHost(host) {
+		host = r.TLS.ServerName
+	}
+	return d.stripHostSuffix(host)
+}
+
+// provisionHostSuffixes normalizes HostSuffixes to lowercase with a
+// leading dot, longest first.
+func (d *DNSLink) provisionHostSuffixes() error {
+	for i, suffix := range d.HostSuffixes {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix == "" {
+			return fmt.Errorf("empty host suffix")
+		}
+		d.HostSuffixes[i] = "." + suffix
+	}
+	sort.SliceStable(d.HostSuffixes, func(i, j int) bool { return len(d.HostSuffixes[i]) > len(d.HostSuffixes[j]) })
+	return nil
+}
+
+// stripHostSuffix returns host without the first of HostSuffixes it ends
+// with, unless it is a host of SubdomainGateways. A host equal to a suffix
+// is returned as is.
+func (d *DNSLink) stripHostSuffix(host string) string {
+	if len(d.HostSuffixes) == 0 {
+		return host
+	}
+	if _, _, ok := subdomainHost(host, d.SubdomainGateways); ok {
+		return host
+	}
+	lower := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, suffix := range d.HostSuffixes {
+		if rest, ok := strings.CutSuffix(lower, suffix); ok && rest != "" {
+			return rest
+		}
+	}
+	return host
+}
+
+// usableHost reports whether host may name a DNSLink domain: it is not
+// empty or an IP literal, and is made of dot-separated labels of letters,
+// digits, hyphens and underscores.
+func usableHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return false
+	}
+	if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			// Internationalized labels are checked when resolved.
+			if c < utf8.RuneSelf && c != '-' && c != '_' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
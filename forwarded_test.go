@@ -0,0 +1,110 @@
+package dnslink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestHost(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		trust     bool
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "disabled", remote: "10.0.0.1:1234", forwarded: []string{"user.example"}, want: "gateway.example"},
+		{name: "trusted range", trust: true, remote: "10.1.2.3:1234", forwarded: []string{"user.example:443"}, want: "user.example"},
+		{name: "trusted address", trust: true, remote: "192.0.2.1:1234", forwarded: []string{"user.example"}, want: "user.example"},
+		{name: "untrusted client", trust: true, remote: "203.0.113.9:1234", forwarded: []string{"spoofed.example"}, want: "gateway.example"},
+		{name: "last value wins", trust: true, remote: "10.0.0.1:1234", forwarded: []string{"spoofed.example", "a.example, user.example"}, want: "user.example"},
+		{name: "no header", trust: true, remote: "10.0.0.1:1234", want: "gateway.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DNSLink{TrustForwardedHost: tt.trust, trustedProxies: trusted}
+			r := httptest.NewRequest(http.MethodGet, "http://gateway.example:8080/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-Host", v)
+			}
+			if got := d.requestHost(r); got != tt.want {
+				t.Errorf("requestHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestHostSNIFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback bool
+		host     string
+		sni      string
+		want     string
+	}{
+		{name: "usable host", fallback: true, host: "user.example", sni: "sni.example", want: "user.example"},
+		{name: "missing host", fallback: true, sni: "sni.example", want: "sni.example"},
+		{name: "ipv4 literal", fallback: true, host: "192.0.2.1:443", sni: "sni.example", want: "sni.example"},
+		{name: "ipv6 literal", fallback: true, host: "[2001:db8::1]", sni: "sni.example", want: "sni.example"},
+		{name: "bogus host", fallback: true, host: "user.example/evil", sni: "sni.example", want: "sni.example"},
+		{name: "empty label", fallback: true, host: "user..example", sni: "sni.example", want: "sni.example"},
+		{name: "no sni", fallback: true, host: "192.0.2.1", want: "192.0.2.1"},
+		{name: "disabled", host: "192.0.2.1", sni: "sni.example", want: "192.0.2.1"},
+		{name: "internationalized host", fallback: true, host: "bücher.example", sni: "sni.example", want: "bücher.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DNSLink{SNIFallback: tt.fallback}
+			r := httptest.NewRequest(http.MethodGet, "https://gateway.example/", nil)
+			r.Host = tt.host
+			r.TLS.ServerName = tt.sni
+			if got := d.requestHost(r); got != tt.want {
+				t.Errorf("requestHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripHostSuffix(t *testing.T) {
+	d := &DNSLink{HostSuffixes: []string{".DWEB.example.com.", "example.com"}, SubdomainGateways: []string{"gw.example.com"}}
+	if err := d.provisionHostSuffixes(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "mysite.org.dweb.example.com", want: "mysite.org"},
+		{host: "MySite.org.Dweb.Example.com.", want: "mysite.org"},
+		{host: "mysite.org.example.com", want: "mysite.org"},
+		{host: "dweb.example.com", want: "dweb"},
+		{host: "example.com", want: "example.com"},
+		{host: ".example.com", want: ".example.com"},
+		{host: "mysite.org", want: "mysite.org"},
+		{host: "bafyroot.ipfs.gw.example.com", want: "bafyroot.ipfs.gw.example.com"},
+	}
+	for _, tt := range tests {
+		if got := d.stripHostSuffix(tt.host); got != tt.want {
+			t.Errorf("stripHostSuffix(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+	if err := (&DNSLink{HostSuffixes: []string{"."}}).provisionHostSuffixes(); err == nil {
+		t.Error("provisionHostSuffixes() accepted an empty suffix")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"private_ranges"})
+	if err != nil || len(prefixes) == 0 {
+		t.Errorf("parseTrustedProxies(private_ranges) = %v, %v", prefixes, err)
+	}
+	if _, err := parseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("parseTrustedProxies() accepted an invalid range")
+	}
+}
@@ -0,0 +1,54 @@
+package dnslink
+
+import (
+	"net/http"
+	"strings"
+)
+
+// gatewayHeaders returns the IPFS gateway response headers for a request
+// served from an ipfs or ipns link, or nil for other namespaces. identifier
+// and path must be escaped as for the upstream path. X-Ipfs-Roots is only
+// known for ipfs links, whose identifier starts with the root CID.
+func gatewayHeaders(namespace, identifier, path string) http.Header {
+	if namespace != "ipfs" && namespace != "ipns" {
+		return nil
+	}
+	h := make(http.Header)
+	h.Set("X-Ipfs-Path", "/"+namespace+"/"+strings.TrimSuffix(identifier, "/")+path)
+	if namespace == "ipfs" {
+		root, _, _ := strings.Cut(identifier, "/")
+		h.Set("X-Ipfs-Roots", root)
+	}
+	return h
+}
+
+// protocolSchemes maps the namespaces with a protocol-native URI scheme to
+// it.
+var protocolSchemes = map[string]string{
+	"ipfs":    "ipfs",
+	"ipns":    "ipns",
+	"swarm":   "bzz",
+	"bzz":     "bzz",
+	"arweave": "ar",
+}
+
+// protocolLinks returns the Link header values pointing native clients at
+// the protocol address of a response: the link's content as alternate and,
+// for the ipfs and ipns links of a DNSLink host, the host's IPNS name as
+// canonical. identifier and path must be escaped as for the upstream path.
+// It returns nil for namespaces without a URI scheme.
+func protocolLinks(namespace, identifier, path, host string) []string {
+	scheme, ok := protocolSchemes[namespace]
+	if !ok {
+		return nil
+	}
+	root, rest, _ := strings.Cut(identifier, "/")
+	if rest != "" {
+		rest = "/" + strings.TrimSuffix(rest, "/")
+	}
+	links := []string{"<" + scheme + "://" + normalizeRoot(namespace, root) + rest + path + `>; rel="alternate"`}
+	if host != "" && (namespace == "ipfs" || namespace == "ipns") {
+		links = append(links, "<ipns://"+normalizeRoot("ipns", host)+path+`>; rel="canonical"`)
+	}
+	return links
+}
@@ -0,0 +1,61 @@
+package dnslink
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGatewayHeaders(t *testing.T) {
+	tests := []struct {
+		namespace  string
+		identifier string
+		path       string
+		wantPath   string
+		wantRoots  string
+	}{
+		{namespace: "ipfs", identifier: "QmXyz789", path: "/index.html", wantPath: "/ipfs/QmXyz789/index.html", wantRoots: "QmXyz789"},
+		{namespace: "ipfs", identifier: "QmXyz789/docs/", path: "/", wantPath: "/ipfs/QmXyz789/docs/", wantRoots: "QmXyz789"},
+		{namespace: "ipns", identifier: "example.com", path: "/a%20b", wantPath: "/ipns/example.com/a%20b"},
+	}
+	for _, tt := range tests {
+		h := gatewayHeaders(tt.namespace, tt.identifier, tt.path)
+		if got := h.Get("X-Ipfs-Path"); got != tt.wantPath {
+			t.Errorf("gatewayHeaders(%q, %q, %q) X-Ipfs-Path = %q, want %q", tt.namespace, tt.identifier, tt.path, got, tt.wantPath)
+		}
+		if got := h.Get("X-Ipfs-Roots"); got != tt.wantRoots {
+			t.Errorf("gatewayHeaders(%q, %q, %q) X-Ipfs-Roots = %q, want %q", tt.namespace, tt.identifier, tt.path, got, tt.wantRoots)
+		}
+	}
+	if h := gatewayHeaders("swarm", "abc123", "/"); h != nil {
+		t.Errorf("gatewayHeaders(swarm) = %v, want nil", h)
+	}
+}
+
+func TestProtocolLinks(t *testing.T) {
+	tests := []struct {
+		namespace, identifier, path, host string
+		want                              []string
+	}{
+		{
+			namespace: "ipfs", identifier: "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR", path: "/index.html", host: "Example.com",
+			want: []string{
+				`<ipfs://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/index.html>; rel="alternate"`,
+				`<ipns://example.com/index.html>; rel="canonical"`,
+			},
+		},
+		{
+			namespace: "ipns", identifier: "docs.ipfs.tech/guide/", path: "/a%20b",
+			want: []string{`<ipns://docs.ipfs.tech/guide/a%20b>; rel="alternate"`},
+		},
+		{
+			namespace: "swarm", identifier: "abc123", path: "/", host: "example.com",
+			want: []string{`<bzz://abc123/>; rel="alternate"`},
+		},
+		{namespace: "git", identifier: "abc123", path: "/", host: "example.com"},
+	}
+	for _, tt := range tests {
+		if got := protocolLinks(tt.namespace, tt.identifier, tt.path, tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("protocolLinks(%q, %q, %q, %q) = %q, want %q", tt.namespace, tt.identifier, tt.path, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// healthProbeHost is resolved to check that an app's resolvers answer. The
+// .invalid TLD never has a link, so an NXDOMAIN proves reachability
+// without depending on any published record.
+const healthProbeHost = "dnslink-health.invalid"
+
+// handlers tracks the provisioned dnslink handlers, so the health endpoint
+// can summarize their upstreams.
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[*DNSLink]struct{})
+)
+
+func registerHandler(d *DNSLink) {
+	handlersMu.Lock()
+	handlers[d] = struct{}{}
+	handlersMu.Unlock()
+}
+
+func unregisterHandler(d *DNSLink) {
+	handlersMu.Lock()
+	delete(handlers, d)
+	handlersMu.Unlock()
+}
+
+// activeHandlers returns all provisioned handlers.
+func activeHandlers() []*DNSLink {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	active := make([]*DNSLink, 0, len(handlers))
+	for d := range handlers {
+		active = append(active, d)
+	}
+	return active
+}
+
+// Health statuses.
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// healthReport is the readiness of the gateway tier: whether every app's
+// resolvers answer, the cache statistics, and the health of every static
+// upstream as seen by the reverse proxies' health checks.
+type healthReport struct {
+	Status    string           `json:"status"`
+	Resolvers []resolverHealth `json:"resolvers"`
+	Cache     cacheStats       `json:"cache"`
+	Upstreams []upstreamHealth `json:"upstreams"`
+}
+
+// resolverHealth is the result of probing the resolvers of an app.
+type resolverHealth struct {
+	Resolvers []string `json:"resolvers"`
+	Reachable bool     `json:"reachable"`
+	LatencyMS float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// upstreamHealth summarizes an upstream of a prefix.
+type upstreamHealth struct {
+	Prefix   string `json:"prefix"`
+	Address  string `json:"address"`
+	Healthy  bool   `json:"healthy"`
+	Requests int    `json:"requests"`
+	Fails    int    `json:"fails"`
+}
+
+// probe resolves healthProbeHost through the app's resolvers. They are
+// reachable if they answer, whether or not with a link.
+func (a *App) probe(ctx context.Context) resolverHealth {
+	h := resolverHealth{Resolvers: a.Resolvers}
+	switch {
+	case a.chain != nil:
+		h.Resolvers = []string{"chain"}
+	case len(a.Resolvers) == 0:
+		h.Resolvers = []string{"system"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.LookupTimeout))
+	defer cancel()
+	start := time.Now()
+	_, err := a.resolveLinks(ctx, healthProbeHost)
+	h.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	h.Reachable = err == nil || lookupOutcome("", err) == outcomeNoLink
+	if !h.Reachable {
+		h.Error = err.Error()
+	}
+	return h
+}
+
+// upstreamHealth summarizes the static upstreams of the handler, primary
+// and failover alike. Dynamic upstreams are only known per request and
+// are not included.
+func (d *DNSLink) upstreamHealth() []upstreamHealth {
+	var summary []upstreamHealth
+	add := func(prefix string, rp *reverseproxy.Handler) {
+		for _, u := range rp.Upstreams {
+			h := upstreamHealth{Prefix: prefix, Address: u.Dial, Healthy: u.Healthy()}
+			if u.Host != nil {
+				h.Requests, h.Fails = u.Host.NumRequests(), u.Host.Fails()
+			}
+			summary = append(summary, h)
+		}
+	}
+	d.upstreamsMu.RLock()
+	proxies := d.proxies
+	d.upstreamsMu.RUnlock()
+	for prefix, rp := range proxies {
+		add(prefix, rp)
+	}
+	for prefix, alternates := range d.alternates {
+		for _, rp := range alternates {
+			add(prefix, rp)
+		}
+	}
+	return summary
+}
+
+// checkHealth builds the health report of all active apps and handlers.
+// The status is unavailable if an app's resolvers don't answer, or if a
+// prefix has static upstreams and none of them is healthy.
+func checkHealth(ctx context.Context) healthReport {
+	upstreams, healthy := activeUpstreamHealth()
+	report := healthReport{
+		Status:    healthOK,
+		Resolvers: []resolverHealth{},
+		Cache:     collectStats(),
+		Upstreams: upstreams,
+	}
+	if !healthy {
+		report.Status = healthUnavailable
+	}
+	for _, a := range activeApps() {
+		h := a.probe(ctx)
+		if !h.Reachable {
+			report.Status = healthUnavailable
+		}
+		report.Resolvers = append(report.Resolvers, h)
+	}
+	return report
+}
+
+// activeUpstreamHealth summarizes the static upstreams of all active
+// handlers, sorted by prefix and address, and reports whether every
+// prefix of every handler has a healthy one.
+func activeUpstreamHealth() ([]upstreamHealth, bool) {
+	summary := []upstreamHealth{}
+	allHealthy := true
+	for _, d := range activeHandlers() {
+		healthy := make(map[string]bool)
+		for _, h := range d.upstreamHealth() {
+			healthy[h.Prefix] = healthy[h.Prefix] || h.Healthy
+			summary = append(summary, h)
+		}
+		for _, ok := range healthy {
+			allHealthy = allHealthy && ok
+		}
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		ui, uj := summary[i], summary[j]
+		if ui.Prefix != uj.Prefix {
+			return ui.Prefix < uj.Prefix
+		}
+		return ui.Address < uj.Address
+	})
+	return summary, allHealthy
+}
+
+// handleHealth writes the health report as JSON, with status 503 if the
+// gateway is not ready, for load balancer readiness probes.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	report := checkHealth(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,78 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestAdminHealth(t *testing.T) {
+	var lookupErr error
+	a := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+			if host != healthProbeHost {
+				t.Errorf("probed %s, want %s", host, healthProbeHost)
+			}
+			if lookupErr != nil {
+				return dnslinkpkg.Result{}, lookupErr
+			}
+			return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+		})},
+	}
+	registerApp(a)
+	defer unregisterApp(a)
+	d := &DNSLink{proxies: map[string]*reverseproxy.Handler{
+		"/ipfs": {Upstreams: reverseproxy.UpstreamPool{{Dial: "ipfs:8080"}}},
+	}}
+	registerHandler(d)
+	defer unregisterHandler(d)
+
+	check := func() (int, healthReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleHealth(rec, httptest.NewRequest(http.MethodGet, "/dnslink/health", nil)); err != nil {
+			t.Fatalf("GET /dnslink/health error = %v", err)
+		}
+		var report healthReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := check()
+	if code != http.StatusOK || report.Status != healthOK {
+		t.Fatalf("status = %d %q, want 200 ok: %+v", code, report.Status, report)
+	}
+	if len(report.Resolvers) != 1 || !report.Resolvers[0].Reachable || report.Resolvers[0].Resolvers[0] != "chain" {
+		t.Errorf("resolvers = %+v, want a reachable chain", report.Resolvers)
+	}
+	if len(report.Upstreams) != 1 || report.Upstreams[0] != (upstreamHealth{Prefix: "/ipfs", Address: "ipfs:8080", Healthy: true}) {
+		t.Errorf("upstreams = %+v, want a healthy ipfs:8080", report.Upstreams)
+	}
+
+	lookupErr = errors.New("connection refused")
+	code, report = check()
+	if code != http.StatusServiceUnavailable || report.Status != healthUnavailable {
+		t.Errorf("status with an unreachable resolver = %d %q, want 503 unavailable", code, report.Status)
+	}
+	if report.Resolvers[0].Error != "connection refused" {
+		t.Errorf("resolver error = %q", report.Resolvers[0].Error)
+	}
+
+	err := (adminAPI{}).handleHealth(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/dnslink/health", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("POST /dnslink/health error = %v, want 405", err)
+	}
+}
@@ -0,0 +1,304 @@
+package dnslink
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// historyPrefix is the storage key prefix under which histories are
+// persisted.
+const historyPrefix = "dnslink/history"
+
+// Default History bounds.
+const (
+	defaultHistoryMaxEntries = 20
+	defaultHistoryMaxHosts   = 10000
+)
+
+// History keeps the links each host has resolved to over time, so it can
+// be told when a host switched identifiers. Only changes are recorded.
+type History struct {
+	// MaxEntries is how many links are kept per host, oldest dropped
+	// first. Default is 20.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// MaxHosts is how many hosts histories are kept for. When full, the
+	// host that changed least recently is dropped, from storage too if
+	// persisted. Default is 10000.
+	MaxHosts int `json:"max_hosts,omitempty"`
+
+	// Persist writes the histories to the configured Caddy storage, so
+	// they survive restarts.
+	Persist bool `json:"persist,omitempty"`
+
+	// lru holds the *hostHistory of each host, the one that changed
+	// most recently first.
+	mu    sync.Mutex
+	lru   *list.List
+	hosts map[string]*list.Element
+
+	storage certmagic.Storage
+	// storing serializes writes to storage, each of the history of a host
+	// as it is by then, so an earlier change can't overwrite a later one.
+	storing    sync.Mutex
+	persisting sync.WaitGroup
+	logger     *zap.Logger
+}
+
+// historyRecord is a link a host resolved to, from the time it was first
+// seen.
+type historyRecord struct {
+	Namespace  string    `json:"namespace"`
+	Identifier string    `json:"identifier"`
+	Since      time.Time `json:"since"`
+}
+
+// hostHistory is the storage and admin API representation of a host's
+// history, oldest record first.
+type hostHistory struct {
+	Host    string          `json:"host"`
+	Records []historyRecord `json:"records"`
+}
+
+// provision sets the defaults and loads persisted histories.
+func (h *History) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if h.MaxEntries == 0 {
+		h.MaxEntries = defaultHistoryMaxEntries
+	}
+	if h.MaxHosts == 0 {
+		h.MaxHosts = defaultHistoryMaxHosts
+	}
+	h.lru = list.New()
+	h.hosts = make(map[string]*list.Element)
+	h.logger = logger
+	if !h.Persist {
+		return nil
+	}
+	h.storage = ctx.Storage()
+	return h.load(ctx)
+}
+
+// record appends entry to the history of host if it differs from the
+// link last recorded.
+func (h *History) record(host string, entry CacheEntry, now time.Time) {
+	h.mu.Lock()
+	var records []historyRecord
+	e, ok := h.hosts[host]
+	if ok {
+		records = e.Value.(*hostHistory).Records
+	}
+	if n := len(records); n > 0 && records[n-1].Namespace == entry.Namespace && records[n-1].Identifier == entry.Identifier {
+		h.mu.Unlock()
+		return
+	}
+	var evicted string
+	if ok {
+		h.lru.Remove(e)
+		delete(h.hosts, host)
+	} else if len(h.hosts) >= h.MaxHosts {
+		evicted = h.evictOldest()
+	}
+	records = append(records, historyRecord{Namespace: entry.Namespace, Identifier: entry.Identifier, Since: now})
+	if len(records) > h.MaxEntries {
+		records = append([]historyRecord(nil), records[len(records)-h.MaxEntries:]...)
+	}
+	h.insert(&hostHistory{Host: host, Records: records})
+	h.mu.Unlock()
+
+	if h.storage != nil {
+		h.persisting.Add(1)
+		go func() {
+			defer h.persisting.Done()
+			if evicted != "" {
+				h.persist(evicted)
+			}
+			h.persist(host)
+		}()
+	}
+}
+
+// insert adds history to the LRU list by the time of its last record.
+// Records are usually the most recent, so the list is walked from its
+// front. h.mu must be held.
+func (h *History) insert(history *hostHistory) {
+	at := history.Records[len(history.Records)-1].Since
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		if records := e.Value.(*hostHistory).Records; !records[len(records)-1].Since.After(at) {
+			h.hosts[history.Host] = h.lru.InsertBefore(history, e)
+			return
+		}
+	}
+	h.hosts[history.Host] = h.lru.PushBack(history)
+}
+
+// evictOldest drops the history of the host that changed least recently,
+// returning that host. h.mu must be held.
+func (h *History) evictOldest() string {
+	e := h.lru.Back()
+	if e == nil {
+		return ""
+	}
+	host := h.lru.Remove(e).(*hostHistory).Host
+	delete(h.hosts, host)
+	return host
+}
+
+// get returns the history of host, oldest record first.
+func (h *History) get(host string) []historyRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.hosts[host]
+	if !ok {
+		return nil
+	}
+	return append([]historyRecord(nil), e.Value.(*hostHistory).Records...)
+}
+
+// all returns the histories of every host.
+func (h *History) all() []hostHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histories := make([]hostHistory, 0, len(h.hosts))
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		history := e.Value.(*hostHistory)
+		histories = append(histories, hostHistory{Host: history.Host, Records: append([]historyRecord(nil), history.Records...)})
+	}
+	return histories
+}
+
+// historyKey returns the storage key for the history of host.
+func historyKey(host string) string {
+	return path.Join(historyPrefix, certmagic.StorageKeys.Safe(host)+".json")
+}
+
+// persist writes the history of host to storage, or deletes it from
+// storage if host was evicted. Failures are logged but otherwise ignored.
+func (h *History) persist(host string) {
+	h.storing.Lock()
+	defer h.storing.Unlock()
+	h.mu.Lock()
+	e, ok := h.hosts[host]
+	var data []byte
+	var err error
+	if ok {
+		data, err = json.Marshal(e.Value.(*hostHistory))
+	}
+	h.mu.Unlock()
+	if err != nil {
+		h.logger.Error("encoding history", zap.String("host", host), zap.Error(err))
+		return
+	}
+
+	if !ok {
+		err := h.storage.Delete(context.Background(), historyKey(host))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Error("deleting evicted history", zap.String("host", host), zap.Error(err))
+		}
+		return
+	}
+	if err := h.storage.Store(context.Background(), historyKey(host), data); err != nil {
+		h.logger.Error("persisting history", zap.String("host", host), zap.Error(err))
+	}
+}
+
+// load restores the histories previously written to storage.
+func (h *History) load(ctx context.Context) error {
+	keys, err := h.storage.List(ctx, historyPrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var histories []*hostHistory
+	for _, key := range keys {
+		data, err := h.storage.Load(ctx, key)
+		if err != nil {
+			h.logger.Warn("loading persisted history", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		var history hostHistory
+		if err := json.Unmarshal(data, &history); err != nil || len(history.Records) == 0 {
+			h.logger.Warn("decoding persisted history", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if len(history.Records) > h.MaxEntries {
+			history.Records = history.Records[len(history.Records)-h.MaxEntries:]
+		}
+		histories = append(histories, &history)
+	}
+
+	// The histories are listed from the one that changed least recently, so
+	// each is the most recent so far.
+	sort.Slice(histories, func(i, j int) bool {
+		a, b := histories[i].Records, histories[j].Records
+		return a[len(a)-1].Since.Before(b[len(b)-1].Since)
+	})
+	for _, history := range histories {
+		if e, ok := h.hosts[history.Host]; ok {
+			h.lru.Remove(e)
+		}
+		h.hosts[history.Host] = h.lru.PushFront(history)
+	}
+	// Histories persisted beyond max_hosts, e.g. before it was lowered, are
+	// dropped for good.
+	for len(h.hosts) > h.MaxHosts {
+		host := h.evictOldest()
+		if err := h.storage.Delete(ctx, historyKey(host)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Warn("deleting persisted history", zap.String("host", host), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// unmarshalHistory parses the history option:
+//
+//	history {
+//	    max_entries <n>
+//	    max_hosts <n>
+//	    persist
+//	}
+func unmarshalHistory(d *caddyfile.Dispenser) (*History, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	h := new(History)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "max_entries", "max_hosts":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 1 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "max_entries" {
+				h.MaxEntries = n
+			} else {
+				h.MaxHosts = n
+			}
+		case "persist":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			h.Persist = true
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return h, nil
+}
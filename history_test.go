@@ -0,0 +1,102 @@
+package dnslink
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestHistory(t *testing.T) {
+	h := &History{MaxEntries: 2, MaxHosts: 2}
+	if err := h.provision(caddy.Context{}, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(0))
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(1))
+	if got := h.get("a.example.com"); len(got) != 1 || !got[0].Since.Equal(at(0)) {
+		t.Fatalf("history after an unchanged resolution = %+v, want only the first", got)
+	}
+
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmTwo"}, at(2))
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmThree"}, at(3))
+	got := h.get("a.example.com")
+	if len(got) != 2 || got[0].Identifier != "QmTwo" || got[1].Identifier != "QmThree" {
+		t.Fatalf("history beyond max_entries = %+v, want QmTwo and QmThree", got)
+	}
+
+	h.record("b.example.com", CacheEntry{Namespace: "swarm", Identifier: "abc"}, at(1))
+	h.record("c.example.com", CacheEntry{Namespace: "swarm", Identifier: "def"}, at(4))
+	if len(h.get("b.example.com")) != 0 {
+		t.Error("history beyond max_hosts kept the host that changed least recently")
+	}
+	if len(h.get("a.example.com")) == 0 || len(h.get("c.example.com")) == 0 {
+		t.Error("history beyond max_hosts dropped a recently changed host")
+	}
+}
+
+func TestHistoryPersist(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	start := time.Now()
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	newHistory := func(maxHosts int) *History {
+		h := &History{MaxEntries: 2, MaxHosts: maxHosts, lru: list.New(), hosts: make(map[string]*list.Element), storage: storage, logger: zap.NewNop()}
+		if err := h.load(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	hosts := func(h *History) []string {
+		var hosts []string
+		for _, history := range h.all() {
+			hosts = append(hosts, history.Host)
+		}
+		return hosts
+	}
+	persisted := func(host string) bool {
+		_, err := storage.Load(context.Background(), historyKey(host))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	h := newHistory(3)
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(0))
+	h.record("b.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(1))
+	h.record("c.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(2))
+	h.record("a.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmTwo"}, at(3))
+	h.persisting.Wait()
+	if got, want := hosts(h), []string{"a.example.com", "c.example.com", "b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts = %v, want %v, the most recently changed first", got, want)
+	}
+
+	// Loaded histories keep their order, and those beyond max_hosts are
+	// deleted from storage.
+	h = newHistory(2)
+	if got, want := hosts(h), []string{"a.example.com", "c.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded hosts = %v, want %v", got, want)
+	}
+	if persisted("b.example.com") {
+		t.Error("history beyond max_hosts is still persisted after loading")
+	}
+
+	h.record("d.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOne"}, at(4))
+	h.persisting.Wait()
+	if persisted("c.example.com") {
+		t.Error("evicted history is still persisted")
+	}
+	if !persisted("a.example.com") || !persisted("d.example.com") {
+		t.Error("kept histories are not persisted")
+	}
+}
@@ -0,0 +1,108 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func init() {
+	caddy.RegisterModule(new(HNSResolver))
+}
+
+// HNSResolver looks up DNSLink records of Handshake names through an
+// HNS-aware resolver, such as hnsd or a Handshake DNS-over-HTTPS
+// endpoint. Unless TLDs is set, every host is looked up, so the resolver
+// is usually placed after the regular DNS resolver in a chain.
+type HNSResolver struct {
+	// Resolvers are the HNS resolvers to query, in the format of
+	// Resolvers on App. Required.
+	Resolvers []string `json:"resolvers"`
+
+	// TLDs limits the resolver to hosts under these Handshake top-level
+	// domains. Other hosts are reported as having no link.
+	TLDs []string `json:"tlds,omitempty"`
+
+	resolverTimeout
+
+	lookup txtLookup
+	tlds   map[string]bool
+}
+
+func (*HNSResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.resolvers.hns",
+		New: func() caddy.Module { return new(HNSResolver) },
+	}
+}
+
+func (r *HNSResolver) Provision(caddy.Context) error {
+	if len(r.Resolvers) == 0 {
+		return fmt.Errorf("hns resolver requires at least one resolver")
+	}
+	var err error
+	r.lookup, err = newTransportLookup(r.Resolvers, nil, false)
+	if err != nil {
+		return err
+	}
+	r.tlds = make(map[string]bool, len(r.TLDs))
+	for _, tld := range r.TLDs {
+		r.tlds[strings.ToLower(strings.Trim(tld, "."))] = true
+	}
+	return nil
+}
+
+func (r *HNSResolver) Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	if len(r.tlds) > 0 {
+		name := mappingKey(host)
+		if !r.tlds[name[strings.LastIndexByte(name, '.')+1:]] {
+			return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+		}
+	}
+	return libraryResolver(ctx, r.lookup).Resolve(host)
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens.
+// Syntax:
+//
+//	hns <resolvers...> {
+//	    tlds    <tlds...>
+//	    timeout <duration>
+//	}
+func (r *HNSResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		r.Resolvers = append(r.Resolvers, d.RemainingArgs()...)
+		if len(r.Resolvers) == 0 {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "tlds":
+				tlds := d.RemainingArgs()
+				if len(tlds) == 0 {
+					return d.ArgErr()
+				}
+				r.TLDs = append(r.TLDs, tlds...)
+			case "timeout":
+				if err := r.unmarshalTimeout(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*HNSResolver)(nil)
+	_ caddy.Provisioner     = (*HNSResolver)(nil)
+	_ caddyfile.Unmarshaler = (*HNSResolver)(nil)
+	_ Resolver              = (*HNSResolver)(nil)
+)
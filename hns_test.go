@@ -0,0 +1,36 @@
+package dnslink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHNSResolver(t *testing.T) {
+	addr := startTestNameserver(t, map[string][]string{
+		"_dnslink.welcome.nb.":  {"dnslink=/ipfs/QmHandshake"},
+		"_dnslink.example.com.": {"dnslink=/ipfs/QmNotHandshake"},
+	})
+	r := &HNSResolver{Resolvers: []string{addr}, TLDs: []string{"nb", ".hns."}}
+	if err := r.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Resolve(context.Background(), "welcome.nb")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if entries := result.Links["ipfs"]; len(entries) != 1 || entries[0].Identifier != "QmHandshake" {
+		t.Errorf("Links[ipfs] = %+v, want QmHandshake", entries)
+	}
+
+	// Hosts outside the configured TLDs are left to other resolvers.
+	if _, err := r.Resolve(context.Background(), "example.com"); lookupOutcome("", err) != outcomeNoLink {
+		t.Errorf("Resolve(example.com) error = %v, want no link", err)
+	}
+
+	if err := (&HNSResolver{}).Provision(caddy.Context{}); err == nil {
+		t.Error("Provision() without resolvers succeeded, want error")
+	}
+}
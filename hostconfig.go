@@ -0,0 +1,217 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+)
+
+// HostConfig overrides part of the configuration of a handler for the
+// hosts matching one of its patterns, so a gateway serving many tenants
+// can tune some of them without a site block each. Matching hosts are
+// served by a copy of the handler with the overrides applied, sharing
+// the denylist, content cache and mirrors of the handler.
+type HostConfig struct {
+	// Hosts are the patterns of the hosts overridden, as in allow_hosts:
+	// "example.com", "*.example.com" or ".example.com".
+	Hosts []string `json:"hosts"`
+
+	// Upstreams replaces the upstreams of prefixes, or adds prefixes. A
+	// replaced prefix keeps its other settings, such as its replacement
+	// and failover, but loses its dynamic upstreams if it had any.
+	Upstreams map[string]string `json:"upstreams,omitempty"`
+
+	// Headers replaces the header manipulations of prefixes.
+	Headers map[string]*headers.Handler `json:"headers,omitempty"`
+
+	// OnMiss, OnError, ErrorPage and ErrorJSON replace those of the
+	// handler. ErrorPage and ErrorJSON replace each other.
+	OnMiss    int    `json:"on_miss,omitempty"`
+	OnError   int    `json:"on_error,omitempty"`
+	ErrorPage string `json:"error_page,omitempty"`
+	ErrorJSON bool   `json:"error_json,omitempty"`
+
+	// CacheTTL and PrefixCacheTTL, if set, give matching hosts a cache
+	// private to them, as they do to a handler.
+	CacheTTL       caddy.Duration            `json:"cache_ttl,omitempty"`
+	PrefixCacheTTL map[string]caddy.Duration `json:"prefix_cache_ttl,omitempty"`
+
+	// handler serves the matching hosts.
+	handler *DNSLink
+}
+
+// provision sets up the handler of hc as a copy of base, the JSON of the
+// handler being provisioned, with the overrides of hc applied.
+func (hc *HostConfig) provision(ctx caddy.Context, base []byte, parent *DNSLink) error {
+	if len(hc.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	d := new(DNSLink)
+	if err := json.Unmarshal(base, d); err != nil {
+		return err
+	}
+	// The copy shares the resolver of its parent rather than loading its
+	// own, and its denylist, content cache, mirrors and multiaddr proxies
+	// rather than running another denylist loader, caching responses
+	// apart and provisioning proxies of its own.
+	d.HostConfigs, d.MatchRaw, d.ResolverRaw, d.Resolver = nil, nil, nil, parent.Resolver
+	d.Denylist, d.ContentCache, d.Mirrors, d.DialMultiaddrs = nil, nil, nil, false
+	hc.apply(d)
+	if err := d.Provision(ctx); err != nil {
+		return err
+	}
+	d.Denylist, d.ContentCache, d.DialMultiaddrs = parent.Denylist, parent.ContentCache, parent.DialMultiaddrs
+	d.multiaddrProxies, d.parent = parent.multiaddrProxies, parent
+	// The copy stands in for its parent, which is the one the admin API
+	// checks and later handlers of the site defer to.
+	unregisterHandler(d)
+	d.site, d.order = parent.site, parent.order
+	// Prefixes keeping the upstream of the parent share its limits.
+	for prefix, l := range parent.limiters {
+		if _, ok := hc.Upstreams[prefix]; !ok {
+			d.limiters[prefix] = l
+		}
+	}
+	hc.handler = d
+	return d.Validate()
+}
+
+// apply sets the overrides of hc on d.
+func (hc *HostConfig) apply(d *DNSLink) {
+	for prefix, upstream := range hc.Upstreams {
+		if d.Upstreams == nil {
+			d.Upstreams = make(map[string]string)
+		}
+		d.Upstreams[prefix] = upstream
+		delete(d.DynamicUpstreams, prefix)
+		delete(d.Routes, prefix)
+	}
+	for prefix, hdr := range hc.Headers {
+		if d.Headers == nil {
+			d.Headers = make(map[string]*headers.Handler)
+		}
+		d.Headers[prefix] = hdr
+	}
+	if hc.OnMiss != 0 {
+		d.OnMiss = hc.OnMiss
+	}
+	if hc.OnError != 0 {
+		d.OnError = hc.OnError
+	}
+	if hc.ErrorPage != "" {
+		d.ErrorPage, d.ErrorJSON = hc.ErrorPage, false
+	}
+	if hc.ErrorJSON {
+		d.ErrorPage, d.ErrorJSON = "", true
+	}
+	if hc.CacheTTL != 0 {
+		d.CacheTTL = hc.CacheTTL
+	}
+	for prefix, ttl := range hc.PrefixCacheTTL {
+		if d.PrefixCacheTTL == nil {
+			d.PrefixCacheTTL = make(map[string]caddy.Duration)
+		}
+		d.PrefixCacheTTL[prefix] = ttl
+	}
+}
+
+// matches reports whether host is one of the hosts of hc.
+func (hc *HostConfig) matches(host string) bool {
+	host = mappingKey(host)
+	for _, pattern := range hc.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionHostConfigs sets up the handlers of HostConfigs from base, the
+// JSON of d before it was provisioned.
+func (d *DNSLink) provisionHostConfigs(ctx caddy.Context, base []byte) error {
+	for i, hc := range d.HostConfigs {
+		if err := hc.provision(ctx, base, d); err != nil {
+			return fmt.Errorf("host config %d (%v): %v", i, hc.Hosts, err)
+		}
+	}
+	return nil
+}
+
+// hostHandler returns the handler serving host: that of the first of
+// HostConfigs matching it, or else d itself.
+func (d *DNSLink) hostHandler(host string) *DNSLink {
+	for _, hc := range d.HostConfigs {
+		if hc.matches(host) {
+			return hc.handler
+		}
+	}
+	return d
+}
+
+// unmarshalHostConfig parses the host subdirective:
+//
+//	host <pattern>... {
+//	    proxies {
+//	        <prefix> <upstream>
+//	    }
+//	    header_up <prefix> [+|-]<field> [<value|regexp> [<replacement>]]
+//	    header_down <prefix> [+|-]<field> [<value|regexp> [<replacement>]]
+//	    on_miss <status>
+//	    on_error <status>
+//	    error_page <file> | error_json
+//	    cache_ttl [<prefix>] <duration>
+//	}
+//
+// The block is parsed as that of a dnslink directive limited to these
+// subdirectives.
+func unmarshalHostConfig(h *caddyfile.Dispenser) (*HostConfig, error) {
+	directive := h.Token()
+	hosts := h.RemainingArgs()
+	if len(hosts) == 0 {
+		return nil, h.ArgErr()
+	}
+
+	open, end := directive, directive
+	directive.Text, open.Text, end.Text = "dnslink", "{", "}"
+	tokens := []caddyfile.Token{directive, open}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch opt := h.Val(); opt {
+		case "proxies", "header_up", "header_down", "on_miss", "on_error", "error_page", "error_json", "cache_ttl":
+		default:
+			return nil, h.Errf("unknown subdirective '%s'", opt)
+		}
+		segment := h.NextSegment()
+		tokens = append(tokens, segment...)
+		end.Line = segment[len(segment)-1].Line + 1
+	}
+	if len(tokens) == 2 {
+		return nil, h.Err("host block without overrides")
+	}
+	tokens = append(tokens, end)
+
+	var d DNSLink
+	if err := d.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens)); err != nil {
+		return nil, err
+	}
+	if len(d.Replacements) > 0 {
+		return nil, h.Err("host blocks cannot set replacements")
+	}
+	hc := &HostConfig{
+		Hosts:          hosts,
+		Upstreams:      d.Upstreams,
+		Headers:        d.Headers,
+		OnMiss:         d.OnMiss,
+		OnError:        d.OnError,
+		ErrorPage:      d.ErrorPage,
+		ErrorJSON:      d.ErrorJSON,
+		CacheTTL:       d.CacheTTL,
+		PrefixCacheTTL: d.PrefixCacheTTL,
+	}
+	if len(hc.Upstreams) == 0 {
+		hc.Upstreams = nil
+	}
+	return hc, nil
+}
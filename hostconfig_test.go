@@ -0,0 +1,219 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestHostConfigs(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	app := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	tenant := &DNSLink{OnMiss: http.StatusGone, app: app, logger: zap.NewNop()}
+	other := &DNSLink{OnMiss: http.StatusForbidden, app: app, logger: zap.NewNop()}
+	d := &DNSLink{
+		OnMiss: http.StatusNotFound,
+		HostConfigs: []*HostConfig{
+			{Hosts: []string{"*.customer-a.com", "customer-a.com"}, handler: tenant},
+			{Hosts: []string{".com"}, handler: other},
+		},
+		app:    app,
+		logger: zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	for _, tt := range []struct {
+		host string
+		want int
+	}{
+		{host: "www.customer-a.com", want: http.StatusGone},
+		{host: "Customer-A.com.", want: http.StatusGone},
+		{host: "a.b.customer-a.com", want: http.StatusForbidden},
+		{host: "example.com", want: http.StatusForbidden},
+		{host: "example.org", want: http.StatusNotFound},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if err := d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil), next); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostConfigProvision(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+	}
+	shared, tenant := upstream("shared"), upstream("tenant")
+	defer shared.Close()
+	defer tenant.Close()
+
+	d, _ := loadTestHandler(t, &DNSLink{
+		Upstreams:    map[string]string{"/ipfs": shared.Listener.Addr().String()},
+		Mirrors:      map[string]*Mirror{"/ipfs": {Upstream: shared.Listener.Addr().String(), Percent: 1}},
+		Denylist:     &Denylist{Entries: []string{"/ipfs/" + testDeniedCIDv1}},
+		ContentCache: new(ContentCache),
+		OnMiss:       http.StatusNotFound,
+		CacheTTL:     caddy.Duration(time.Minute),
+		HostConfigs: []*HostConfig{{
+			Hosts:     []string{"*.tenant.com", "tenant.com"},
+			Upstreams: map[string]string{"/ipfs": tenant.Listener.Addr().String()},
+			OnMiss:    http.StatusGone,
+			CacheTTL:  caddy.Duration(10 * time.Second),
+		}},
+	}, map[string]string{
+		"example.com":       "/ipfs/QmFake",
+		"tenant.com":        "/ipfs/QmTenant",
+		"denied.tenant.com": "/ipfs/" + testDeniedCIDv1,
+	})
+
+	// The copy has overrides of its own, and shares the rest with d.
+	copied := d.hostHandler("www.tenant.com")
+	if copied == d || d.hostHandler("example.com") != d {
+		t.Fatal("hostHandler() did not pick the host config of tenant hosts only")
+	}
+	if copied.app == d.app || copied.app.CacheTTL != caddy.Duration(10*time.Second) || d.app.CacheTTL != caddy.Duration(time.Minute) {
+		t.Errorf("cache ttl = %v, want 10s for tenants and 1m for others", copied.app.CacheTTL)
+	}
+	if copied.Denylist != d.Denylist || copied.ContentCache != d.ContentCache || len(copied.mirrorProxies) != 0 || copied.parent != d {
+		t.Error("host config copy doesn't share the denylist, content cache and mirrors of its parent")
+	}
+
+	server := &caddyhttp.Server{}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	for _, tt := range []struct {
+		host     string
+		wantCode int
+		wantBody string
+	}{
+		{host: "example.com", wantCode: http.StatusOK, wantBody: "shared"},
+		{host: "tenant.com", wantCode: http.StatusOK, wantBody: "tenant"},
+		{host: "denied.tenant.com", wantCode: http.StatusGone},
+		{host: "missing.tenant.com", wantCode: http.StatusGone},
+		{host: "missing.example.com", wantCode: http.StatusNotFound},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			req := caddyhttp.PrepareRequest(httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil), caddy.NewReplacer(), nil, server)
+			rec := httptest.NewRecorder()
+			if err := d.ServeHTTP(rec, req, next); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode || (tt.wantBody != "" && rec.Body.String() != tt.wantBody) {
+				t.Errorf("response = %d %q, want %d %q", rec.Code, rec.Body, tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHostConfigApply(t *testing.T) {
+	hdr := &headers.Handler{Request: &headers.HeaderOps{Set: http.Header{"Authorization": {"Bearer tenant"}}}}
+	d := &DNSLink{
+		Upstreams:        map[string]string{"/swarm": "bee:1633"},
+		DynamicUpstreams: map[string]json.RawMessage{"/ipfs": json.RawMessage(`{"source":"srv"}`)},
+		Headers:          map[string]*headers.Handler{"/swarm": new(headers.Handler)},
+		ErrorJSON:        true,
+		OnMiss:           http.StatusNotFound,
+		CacheTTL:         caddy.Duration(time.Minute),
+	}
+	hc := &HostConfig{
+		Upstreams: map[string]string{"/ipfs": "tenant-ipfs:8080"},
+		Headers:   map[string]*headers.Handler{"/ipfs": hdr},
+		OnError:   http.StatusServiceUnavailable,
+		ErrorPage: "tenant.html",
+		CacheTTL:  caddy.Duration(10 * time.Second),
+	}
+	hc.apply(d)
+	if d.Upstreams["/ipfs"] != "tenant-ipfs:8080" || d.Upstreams["/swarm"] != "bee:1633" || len(d.DynamicUpstreams) != 0 {
+		t.Errorf("upstreams = %v, dynamic %v", d.Upstreams, d.DynamicUpstreams)
+	}
+	if d.Headers["/ipfs"] != hdr || d.Headers["/swarm"] == nil {
+		t.Errorf("headers = %v", d.Headers)
+	}
+	if d.OnMiss != http.StatusNotFound || d.OnError != http.StatusServiceUnavailable || d.ErrorPage != "tenant.html" || d.ErrorJSON {
+		t.Errorf("error policy = %d %d %q %v", d.OnMiss, d.OnError, d.ErrorPage, d.ErrorJSON)
+	}
+	if d.CacheTTL != caddy.Duration(10*time.Second) {
+		t.Errorf("cache ttl = %v", d.CacheTTL)
+	}
+}
+
+func TestParseHostConfig(t *testing.T) {
+	d := new(DNSLink)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dnslink /ipfs ipfs:8080 {
+		host *.customer-a.com customer-a.com {
+			proxies {
+				/ipfs customer-a-gateway:8080
+			}
+			header_up /ipfs Authorization "Bearer a"
+			on_miss 410
+			error_json
+			cache_ttl 10s
+			cache_ttl /ipns 5s
+		}
+		host .customer-b.com {
+			on_error 503
+		}
+		on_miss 404
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.HostConfigs) != 2 || d.OnMiss != http.StatusNotFound || d.Upstreams["/ipfs"] != "ipfs:8080" {
+		t.Fatalf("parsed %+v", d)
+	}
+	a, b := d.HostConfigs[0], d.HostConfigs[1]
+	if len(a.Hosts) != 2 || a.Upstreams["/ipfs"] != "customer-a-gateway:8080" || a.OnMiss != http.StatusGone || !a.ErrorJSON ||
+		a.CacheTTL != caddy.Duration(10*time.Second) || a.PrefixCacheTTL["/ipns"] != caddy.Duration(5*time.Second) {
+		t.Errorf("first host config = %+v", a)
+	}
+	if got := a.Headers["/ipfs"].Request.Set.Get("Authorization"); got != "Bearer a" {
+		t.Errorf("header_up Authorization = %q", got)
+	}
+	if b.Hosts[0] != ".customer-b.com" || b.OnError != http.StatusServiceUnavailable || b.Upstreams != nil {
+		t.Errorf("second host config = %+v", b)
+	}
+
+	for _, input := range []string{
+		"dnslink {\n host {\n on_miss 404\n }\n}",
+		"dnslink {\n host example.com\n}",
+		"dnslink {\n host example.com {\n etag\n }\n}",
+		"dnslink {\n host example.com {\n proxies {\n /ipfs /content ipfs:8080\n }\n }\n}",
+		"dnslink {\n host example.com {\n on_miss teapot\n }\n}",
+	} {
+		if err := new(DNSLink).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("UnmarshalCaddyfile(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package dnslink
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Default HostOverride headers.
+const (
+	defaultOverrideHeader      = "X-Dnslink-Host"
+	defaultOverrideTokenHeader = "X-Dnslink-Token"
+)
+
+// HostOverride lets authorized requests choose the domain that is
+// resolved instead of their host, so QA can exercise the production
+// routing of a domain before its public DNS points at the gateway.
+type HostOverride struct {
+	// Header is the request header naming the domain to resolve. Default
+	// is X-Dnslink-Host.
+	Header string `json:"header,omitempty"`
+
+	// TokenHeader is the request header carrying Secret. Default is
+	// X-Dnslink-Token.
+	TokenHeader string `json:"token_header,omitempty"`
+
+	// Secret, if set, must be the value of TokenHeader. It may be a global
+	// placeholder such as {env.DNSLINK_OVERRIDE_SECRET}.
+	Secret string `json:"secret,omitempty"`
+
+	// TrustedIPs, if set, lists the IP ranges (CIDR or single addresses,
+	// or "private_ranges") of the clients allowed to override the host.
+	// At least one of Secret and TrustedIPs is required.
+	TrustedIPs []string `json:"trusted_ips,omitempty"`
+
+	auth requestAuth
+}
+
+// provision validates the configuration and sets the defaults.
+func (o *HostOverride) provision() error {
+	if o.Header == "" {
+		o.Header = defaultOverrideHeader
+	}
+	if o.TokenHeader == "" {
+		o.TokenHeader = defaultOverrideTokenHeader
+	}
+	auth, err := newRequestAuth(o.Secret, o.TrustedIPs)
+	if err != nil {
+		return err
+	}
+	o.auth = auth
+	return nil
+}
+
+// host returns the domain r asks to resolve, if it asks for one and is
+// allowed to. The override headers are removed from r either way.
+func (o *HostOverride) host(r *http.Request) (string, bool) {
+	host := strings.TrimSpace(r.Header.Get(o.Header))
+	token := r.Header.Get(o.TokenHeader)
+	r.Header.Del(o.Header)
+	r.Header.Del(o.TokenHeader)
+	if host == "" {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if o.auth.secret == "" {
+		// Without a secret, any value passes and the client's IP decides.
+		token = host
+	}
+	return host, o.auth.allowed(r, token)
+}
+
+// unmarshalHostOverride parses the host_override subdirective:
+//
+//	host_override {
+//	    header <name>
+//	    token_header <name>
+//	    secret <secret>
+//	    trusted_ips <ranges>...
+//	}
+func unmarshalHostOverride(d *caddyfile.Dispenser) (*HostOverride, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	o := new(HostOverride)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "header", "token_header", "secret":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			switch opt {
+			case "header":
+				o.Header = d.Val()
+			case "token_header":
+				o.TokenHeader = d.Val()
+			default:
+				o.Secret = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "trusted_ips":
+			ranges := d.RemainingArgs()
+			if len(ranges) == 0 {
+				return nil, d.ArgErr()
+			}
+			o.TrustedIPs = append(o.TrustedIPs, ranges...)
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return o, nil
+}
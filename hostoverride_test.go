@@ -0,0 +1,113 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestHostOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		override   HostOverride
+		remoteAddr string
+		host       string
+		token      string
+		want       string
+		wantOK     bool
+	}{
+		{name: "secret", override: HostOverride{Secret: "s3cret"}, host: "example.org", token: "s3cret", want: "example.org", wantOK: true},
+		{name: "wrong secret", override: HostOverride{Secret: "s3cret"}, host: "example.org", token: "guess"},
+		{name: "no header", override: HostOverride{Secret: "s3cret"}, token: "s3cret"},
+		{name: "port", override: HostOverride{Secret: "s3cret"}, host: "example.org:443", token: "s3cret", want: "example.org", wantOK: true},
+		{name: "trusted ip", override: HostOverride{TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "10.1.2.3:1234", host: "example.org", want: "example.org", wantOK: true},
+		{name: "untrusted ip", override: HostOverride{TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "192.0.2.1:1234", host: "example.org"},
+		{name: "secret from untrusted ip", override: HostOverride{Secret: "s3cret", TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "192.0.2.1:1234", host: "example.org", token: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := tt.override
+			if err := o.provision(); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://gateway.example.com/", nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			if tt.host != "" {
+				r.Header.Set(defaultOverrideHeader, tt.host)
+			}
+			if tt.token != "" {
+				r.Header.Set(defaultOverrideTokenHeader, tt.token)
+			}
+			host, ok := o.host(r)
+			if ok != tt.wantOK || (ok && host != tt.want) {
+				t.Errorf("host() = %q, %v, want %q, %v", host, ok, tt.want, tt.wantOK)
+			}
+			if r.Header.Get(defaultOverrideHeader) != "" || r.Header.Get(defaultOverrideTokenHeader) != "" {
+				t.Error("override headers were not removed")
+			}
+		})
+	}
+
+	if err := new(HostOverride).provision(); err == nil {
+		t.Error("provision() without a secret or trusted IPs succeeded")
+	}
+}
+
+func TestHostOverrideServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		Upstreams:      map[string]string{"/ipfs": "localhost:8080"},
+		HostOverride:   &HostOverride{Secret: "s3cret"},
+		Trace:          &Trace{Secret: "s3cret"},
+		DNSLinkHeaders: true,
+		proxies:        map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				if host != "mysite.example.org" {
+					return dnslinkpkg.Result{}, nil
+				}
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	for _, err := range []error{d.HostOverride.provision(), d.Trace.provision()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://gateway.example.com/", nil)
+	r.Header.Set(defaultTraceHeader, "s3cret")
+	r.Header.Set(defaultOverrideHeader, "mysite.example.org")
+	r.Header.Set(defaultOverrideTokenHeader, "s3cret")
+	if err := d.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })); err != nil {
+		t.Fatal(err)
+	}
+	var got requestTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding trace %q: %v", w.Body.String(), err)
+	}
+	if got.Host != "mysite.example.org" || got.Identifier != "QmSite" || got.Outcome != traceProxy {
+		t.Errorf("trace = %+v, want the routing of mysite.example.org", got)
+	}
+	if got := r.Header.Get(headerDNSLinkHost); got != "mysite.example.org" {
+		t.Errorf("%s = %q, want mysite.example.org", headerDNSLinkHost, got)
+	}
+	if r.Header.Get(defaultOverrideTokenHeader) != "" {
+		t.Error("override token was sent upstream")
+	}
+}
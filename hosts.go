@@ -0,0 +1,40 @@
+package dnslink
+
+import "strings"
+
+// matchHost reports whether host matches pattern, which is either an exact
+// name ("example.com"), a wildcard matching a single label
+// ("*.example.com"), or a suffix matching a domain and every name under it
+// (".example.com"). host must be normalized with mappingKey.
+func matchHost(pattern, host string) bool {
+	pattern = mappingKey(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		label, rest, ok := strings.Cut(host, ".")
+		return ok && label != "" && rest == pattern[2:]
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+// hostAllowed reports whether host may be resolved under AllowHosts and
+// DenyHosts. Denials take precedence.
+func (a *App) hostAllowed(host string) bool {
+	host = mappingKey(host)
+	for _, pattern := range a.DenyHosts {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(a.AllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range a.AllowHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package dnslink
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "Example.com.", host: "example.com", want: true},
+		{pattern: "example.com", host: "www.example.com", want: false},
+		{pattern: "*.example.com", host: "www.example.com", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com", want: false},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: ".example.com", host: "example.com", want: true},
+		{pattern: ".example.com", host: "a.b.example.com", want: true},
+		{pattern: ".example.com", host: "badexample.com", want: false},
+	}
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	a := &App{
+		AllowHosts: []string{".example.com", "site.test"},
+		DenyHosts:  []string{"internal.example.com"},
+	}
+	tests := map[string]bool{
+		"www.example.com":      true,
+		"SITE.test":            true,
+		"internal.example.com": false,
+		"scanner.invalid":      false,
+	}
+	for host, want := range tests {
+		if got := a.hostAllowed(host); got != want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if !new(App).hostAllowed("anything.invalid") {
+		t.Error("hostAllowed() = false without patterns, want true")
+	}
+}
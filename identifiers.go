@@ -0,0 +1,219 @@
+package dnslink
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// validateIdentifier checks that identifier is well-formed for namespace:
+// a CID for ipfs, a CID or domain name for ipns, a 64 or 128 character hex
+// reference for swarm, and a transaction ID or ArNS name for arweave and
+// ar. Only the part before the first "/" is checked; other namespaces are
+// not validated.
+func validateIdentifier(namespace, identifier string) error {
+	root, _, _ := strings.Cut(identifier, "/")
+	var err error
+	switch namespace {
+	case "ipfs":
+		err = validateCID(root)
+	case "ipns":
+		if err = validateCID(root); err != nil && isDomainName(root) {
+			err = nil
+		}
+	case "swarm", "bzz":
+		if _, hexErr := hex.DecodeString(root); hexErr != nil || (len(root) != 64 && len(root) != 128) {
+			err = errors.New("not a 64 or 128 character hex reference")
+		}
+	case "arweave", "ar":
+		if !isArweaveTxID(root) && !isArNSName(root) {
+			err = errors.New("not a transaction ID or ArNS name")
+		}
+	}
+	if link, ok := multiaddrLink(namespace, identifier); ok {
+		if _, err := parseMultiaddr(link); err != nil {
+			return fmt.Errorf("invalid %s link '%s': %v", namespace, link, err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s identifier '%s': %v", namespace, root, err)
+	}
+	return nil
+}
+
+// arweaveTxIDLength is the length of a base64url-encoded Arweave
+// transaction ID.
+const arweaveTxIDLength = 43
+
+// isArweaveTxID reports whether s is an Arweave transaction ID: 32 bytes
+// in unpadded base64url.
+func isArweaveTxID(s string) bool {
+	if len(s) != arweaveTxIDLength {
+		return false
+	}
+	b, err := base64.RawURLEncoding.Strict().DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+// isArNSName reports whether s is an ArNS name, 1 to 51 lowercase letters,
+// digits and inner dashes, optionally preceded by an undername and "_".
+func isArNSName(s string) bool {
+	if under, name, found := strings.Cut(s, "_"); found {
+		if !isArNSLabel(under) {
+			return false
+		}
+		s = name
+	}
+	return isArNSLabel(s) && len(s) <= 51
+}
+
+// isArNSLabel reports whether s is a non-empty run of lowercase letters,
+// digits and dashes that does not start or end with a dash.
+func isArNSLabel(s string) bool {
+	if s == "" || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRoot returns the canonical form of the root of a link: CIDs as
+// base32 CIDv1, IPNS keys as base36 CIDv1 and domains in lowercase. Roots
+// of other namespaces, and those that don't decode, are returned as is.
+func normalizeRoot(namespace, root string) string {
+	switch {
+	case namespace == "ipns" && isDomainName(root):
+		return strings.ToLower(strings.TrimSuffix(root, "."))
+	case namespace == "ipns":
+		if key, err := decodeIPNSKey(root); err == nil {
+			return "k" + encodeBase(key, base36Alphabet)
+		}
+	case namespace == "ipfs":
+		if cid, err := decodeCID(root); err == nil {
+			return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(cid))
+		}
+	}
+	return root
+}
+
+// validateCID checks that s is a CIDv0 or a multibase-encoded CIDv1.
+func validateCID(s string) error {
+	_, err := decodeCID(s)
+	return err
+}
+
+// decodeCID returns the binary form of s, a CIDv0 or a multibase-encoded
+// CIDv1. CIDv0s are returned as the equivalent dag-pb CIDv1.
+func decodeCID(s string) ([]byte, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		b, err := decodeBase(s, base58Alphabet)
+		if err != nil || len(b) != 34 || b[0] != 0x12 || b[1] != 0x20 {
+			return nil, errors.New("not a valid CIDv0")
+		}
+		return append([]byte{0x01, 0x70}, b...), nil
+	}
+	if len(s) < 2 {
+		return nil, errors.New("too short for a CID")
+	}
+
+	var b []byte
+	var err error
+	switch prefix, rest := s[0], s[1:]; prefix {
+	case 'b':
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(rest))
+	case 'B':
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(rest)
+	case 'f':
+		b, err = hex.DecodeString(rest)
+	case 'k':
+		b, err = decodeBase(rest, base36Alphabet)
+	case 'z':
+		b, err = decodeBase(rest, base58Alphabet)
+	default:
+		return nil, fmt.Errorf("unsupported multibase prefix '%c'", prefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibase encoding: %v", err)
+	}
+	if _, err := cidDigest(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+const (
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	base36Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+)
+
+// decodeBase decodes s in the positional base given by alphabet, keeping
+// leading zero digits as zero bytes like base58btc does.
+func decodeBase(s, alphabet string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty input")
+	}
+	base := big.NewInt(int64(len(alphabet)))
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		digit := strings.IndexByte(alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character '%c'", c)
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	var zeros int
+	for zeros < len(s) && s[zeros] == alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// encodeBase encodes b in the positional base given by alphabet, the
+// inverse of decodeBase.
+func encodeBase(b []byte, alphabet string) string {
+	base := big.NewInt(int64(len(alphabet)))
+	n := new(big.Int).SetBytes(b)
+	var digits []byte
+	for mod := new(big.Int); n.Sign() > 0; {
+		n.DivMod(n, base, mod)
+		digits = append(digits, alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		digits = append(digits, alphabet[0])
+	}
+	slices.Reverse(digits)
+	return string(digits)
+}
+
+// isDomainName reports whether s looks like a fully qualified domain name
+// with at least two labels.
+func isDomainName(s string) bool {
+	labels := strings.Split(strings.TrimSuffix(s, "."), ".")
+	if len(labels) < 2 || len(s) > 253 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package dnslink
+
+import "testing"
+
+func TestValidateIdentifier(t *testing.T) {
+	tests := []struct {
+		namespace  string
+		identifier string
+		wantErr    bool
+	}{
+		{namespace: "ipfs", identifier: "QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD4"},
+		{namespace: "ipfs", identifier: "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4/index.html"},
+		{namespace: "ipfs", identifier: "f0170122029f2d17be6139079dc48696d1f582a8530eb9805b561eda517e22a892c7e3f1f"},
+		{namespace: "ipfs", identifier: "QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD0", wantErr: true},
+		{namespace: "ipfs", identifier: "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnv", wantErr: true},
+		{namespace: "ipfs", identifier: "../../etc/passwd", wantErr: true},
+		{namespace: "ipfs", identifier: "", wantErr: true},
+		{namespace: "ipns", identifier: "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8"},
+		{namespace: "ipns", identifier: "docs.ipfs.tech/install"},
+		{namespace: "ipns", identifier: "localhost", wantErr: true},
+		{namespace: "ipns", identifier: "bad_$chars.example", wantErr: true},
+		{namespace: "swarm", identifier: "d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162"},
+		{namespace: "swarm", identifier: "d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162/"},
+		{namespace: "swarm", identifier: "abc123", wantErr: true},
+		{namespace: "swarm", identifier: "zz" + "de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162", wantErr: true},
+		{namespace: "arweave", identifier: "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U/index.html"},
+		{namespace: "ar", identifier: "ardrive"},
+		{namespace: "ar", identifier: "docs_ar-io"},
+		{namespace: "arweave", identifier: "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_", wantErr: true},
+		{namespace: "ar", identifier: "-ardrive", wantErr: true},
+		{namespace: "ar", identifier: "ArDrive", wantErr: true},
+		{namespace: "hyper", identifier: "anything goes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.identifier, func(t *testing.T) {
+			err := validateIdentifier(tt.namespace, tt.identifier)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateIdentifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// intercept is an intercept block of the Caddyfile, kept as reverse_proxy
+// tokens until its handle_response routes can be parsed.
+type intercept struct {
+	prefix string
+	tokens []caddyfile.Token
+}
+
+// unmarshalIntercept stashes the intercept subdirective:
+//
+//	intercept <prefix> {
+//	    @name <response matcher>
+//	    replace_status [@name] <status>
+//	    handle_response [@name] {
+//	        <directives...>
+//	    }
+//	}
+//
+// Its body is the response handling of reverse_proxy, which needs the
+// Caddyfile helper to parse, so it is finished by finalizeUnmarshalCaddyfile.
+func (d *DNSLink) unmarshalIntercept(h *caddyfile.Dispenser) error {
+	directive := h.Token()
+	if !h.NextArg() {
+		return h.ArgErr()
+	}
+	prefix := h.Val()
+	if h.NextArg() {
+		return h.ArgErr()
+	}
+
+	open, end := directive, directive
+	directive.Text, open.Text, end.Text = "reverse_proxy", "{", "}"
+	tokens := []caddyfile.Token{directive, open}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		if opt := h.Val(); !strings.HasPrefix(opt, "@") && opt != "replace_status" && opt != "handle_response" {
+			return h.Errf("unknown subdirective '%s'", opt)
+		}
+		segment := h.NextSegment()
+		tokens = append(tokens, segment...)
+		end.Line = segment[len(segment)-1].Line + 1
+	}
+	if len(tokens) == 2 {
+		return h.Err("intercept needs replace_status or handle_response")
+	}
+	d.intercepts = append(d.intercepts, intercept{prefix: prefix, tokens: append(tokens, end)})
+	return nil
+}
+
+// finalizeUnmarshalCaddyfile parses the intercept blocks stashed by
+// UnmarshalCaddyfile into HandleResponse.
+func (d *DNSLink) finalizeUnmarshalCaddyfile(helper httpcaddyfile.Helper) error {
+	for _, ic := range d.intercepts {
+		rp := new(reverseproxy.Handler)
+		if err := rp.UnmarshalCaddyfile(caddyfile.NewDispenser(ic.tokens)); err != nil {
+			return err
+		}
+		if err := rp.FinalizeUnmarshalCaddyfile(helper); err != nil {
+			return err
+		}
+		if d.HandleResponse == nil {
+			d.HandleResponse = make(map[string][]caddyhttp.ResponseHandler)
+		}
+		d.HandleResponse[ic.prefix] = append(d.HandleResponse[ic.prefix], rp.HandleResponse...)
+	}
+	d.intercepts = nil
+	return nil
+}
+
+// responseHandlers returns a copy of the HandleResponse of prefix for one
+// of its reverse proxies, since provisioning a route modifies it.
+func (d *DNSLink) responseHandlers(prefix string) ([]caddyhttp.ResponseHandler, error) {
+	handlers, ok := d.HandleResponse[prefix]
+	if !ok {
+		return nil, nil
+	}
+	raw, err := json.Marshal(handlers)
+	if err != nil {
+		return nil, err
+	}
+	var copied []caddyhttp.ResponseHandler
+	err = json.Unmarshal(raw, &copied)
+	return copied, err
+}
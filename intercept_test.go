@@ -0,0 +1,99 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestParseIntercept(t *testing.T) {
+	// Parsing the routes of handle_response takes a full Caddyfile.
+	input := `{
+		order dnslink before reverse_proxy
+	}
+
+	:80 {
+		dnslink {
+			proxies {
+				/ipfs ipfs:8080
+			}
+			intercept /ipfs {
+				@notfound status 404
+				@accel header X-Accel-Redirect *
+				handle_response @notfound {
+					respond "Not on this gateway" 404
+				}
+				replace_status @accel 200
+			}
+		}
+	}`
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt() error = %v", err)
+	}
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []struct {
+						Handle []json.RawMessage `json:"handle"`
+					} `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatalf("decoding adapted config: %v", err)
+	}
+	d := new(DNSLink)
+	if srv := cfg.Apps.HTTP.Servers["srv0"]; len(srv.Routes) != 1 || len(srv.Routes[0].Handle) != 1 {
+		t.Fatalf("adapted config has no dnslink handler: %s", out)
+	} else if err := json.Unmarshal(srv.Routes[0].Handle[0], d); err != nil {
+		t.Fatal(err)
+	}
+	handlers := d.HandleResponse["/ipfs"]
+	if len(handlers) != 2 {
+		t.Fatalf("HandleResponse[/ipfs] = %+v, want 2 handlers", handlers)
+	}
+	// As in reverse_proxy, status replacements come before routes.
+	if m := handlers[0].Match; m == nil || m.Headers.Get("X-Accel-Redirect") != "*" || handlers[0].StatusCode != "200" {
+		t.Errorf("first handler = %+v, want a 200 for accel responses", handlers[0])
+	}
+	if m := handlers[1].Match; m == nil || len(m.StatusCode) != 1 || m.StatusCode[0] != 404 || len(handlers[1].Routes) != 1 {
+		t.Errorf("second handler = %+v, want the routes of 404 responses", handlers[1])
+	}
+	if err := d.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	copied, err := d.responseHandlers("/ipfs")
+	if err != nil || len(copied) != 2 || &copied[0] == &handlers[0] {
+		t.Errorf("responseHandlers() = %+v, %v, want a copy", copied, err)
+	}
+	if copied, err := d.responseHandlers("/swarm"); copied != nil || err != nil {
+		t.Errorf("responseHandlers(/swarm) = %+v, %v", copied, err)
+	}
+
+	for _, input := range []string{
+		"dnslink {\n intercept {\n replace_status 200\n }\n}",
+		"dnslink {\n intercept /ipfs\n}",
+		"dnslink {\n intercept /ipfs {\n to other:8080\n }\n}",
+		"dnslink {\n intercept /ipfs {\n handle_response @missing {\n respond 404\n }\n }\n}",
+	} {
+		if _, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}); err == nil {
+			t.Errorf("parseCaddyfile(%q) succeeded", input)
+		}
+	}
+
+	orphan := "dnslink {\n intercept /swarm {\n replace_status 200\n }\n}"
+	handler, err := parseCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(orphan)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.(*DNSLink).Validate(); err == nil {
+		t.Error("Validate() accepted response handlers for a prefix without an upstream")
+	}
+}
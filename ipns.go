@@ -0,0 +1,117 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// IPNS resolves /ipns links further to immutable /ipfs paths through the
+// RPC API of a Kubo node, for upstreams that only understand CIDs.
+type IPNS struct {
+	// API is the base URL of the Kubo RPC API. Default is
+	// http://127.0.0.1:5001.
+	API string `json:"api,omitempty"`
+
+	// CacheTTL is how long an IPNS resolution is reused. Cached DNSLink
+	// entries that went through IPNS expire no later than this. Default
+	// is 1m.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	cache  sync.Map // name -> ipnsCacheEntry
+	client *http.Client
+}
+
+type ipnsCacheEntry struct {
+	path      string
+	expiresAt time.Time
+}
+
+// provision applies the defaults and expands placeholders in the API.
+func (i *IPNS) provision() error {
+	i.API = caddy.NewReplacer().ReplaceAll(i.API, "")
+	if i.API == "" {
+		i.API = "http://127.0.0.1:5001"
+	}
+	if _, err := url.Parse(i.API); err != nil {
+		return fmt.Errorf("invalid api '%s': %v", i.API, err)
+	}
+	if i.CacheTTL == 0 {
+		i.CacheTTL = caddy.Duration(time.Minute)
+	}
+	if i.client == nil {
+		i.client = http.DefaultClient
+	}
+	return nil
+}
+
+// resolve returns the /ipfs path that the IPNS name (with an optional
+// subpath) currently points to, and until when the answer may be reused.
+func (i *IPNS) resolve(ctx context.Context, name string) (string, time.Time, error) {
+	now := time.Now()
+	if val, ok := i.cache.Load(name); ok {
+		if cached := val.(ipnsCacheEntry); now.Before(cached.expiresAt) {
+			return cached.path, cached.expiresAt, nil
+		}
+		i.cache.Delete(name)
+	}
+
+	query := url.Values{"arg": {"/ipns/" + name}, "recursive": {"true"}}
+	endpoint := strings.TrimSuffix(i.API, "/") + "/api/v0/name/resolve?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Path    string
+		Message string
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding Kubo response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("kubo: %s (HTTP %d)", body.Message, resp.StatusCode)
+	}
+	if !strings.HasPrefix(body.Path, "/ipfs/") {
+		return "", time.Time{}, fmt.Errorf("kubo: unexpected path '%s'", body.Path)
+	}
+
+	expiresAt := now.Add(time.Duration(i.CacheTTL))
+	i.cache.Store(name, ipnsCacheEntry{path: body.Path, expiresAt: expiresAt})
+	return body.Path, expiresAt, nil
+}
+
+// resolveIPNS replaces an /ipns link selected for routing with the /ipfs
+// path it points to. The entry's links are left as published.
+func (a *App) resolveIPNS(ctx context.Context, entry *CacheEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.LookupTimeout))
+	defer cancel()
+
+	path, expiresAt, err := a.IPNS.resolve(ctx, entry.Identifier)
+	if err != nil {
+		return err
+	}
+	namespace, identifier, err := parseLink(path)
+	if err != nil {
+		return err
+	}
+	entry.Namespace, entry.Identifier = namespace, identifier
+	if expiresAt.Before(entry.ExpiresAt) {
+		entry.ExpiresAt = expiresAt
+	}
+	return nil
+}
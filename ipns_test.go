@@ -0,0 +1,93 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestIPNSResolution(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var calls atomic.Int32
+	kubo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/name/resolve" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("arg") {
+		case "/ipns/k51key/docs":
+			_ = json.NewEncoder(w).Encode(map[string]string{"Path": "/ipfs/bafyresolved/docs"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]any{"Message": "could not resolve name", "Code": 0, "Type": "error"})
+		}
+	}))
+	defer kubo.Close()
+
+	records := map[string]string{
+		"_dnslink.site.example.com":   "dnslink=/ipns/k51key/docs",
+		"_dnslink.broken.example.com": "dnslink=/ipns/k51unknown",
+	}
+	a := &App{
+		CacheTTL:      caddy.Duration(time.Hour),
+		LookupTimeout: caddy.Duration(time.Second),
+		IPNS:          &IPNS{API: kubo.URL, CacheTTL: caddy.Duration(time.Minute)},
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if txt, ok := records[name]; ok {
+				return []dnslinkpkg.LookupEntry{{Value: txt}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	if err := a.IPNS.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, _, err := a.resolve(context.Background(), "site.example.com")
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if entry.Namespace != "ipfs" || entry.Identifier != "bafyresolved/docs" {
+		t.Errorf("resolve() = /%s/%s, want /ipfs/bafyresolved/docs", entry.Namespace, entry.Identifier)
+	}
+	if links := entry.Links["ipns"]; len(links) != 1 || links[0].Identifier != "k51key/docs" {
+		t.Errorf("Links[ipns] = %+v, want the published link", links)
+	}
+	if time.Until(entry.ExpiresAt) > time.Minute {
+		t.Errorf("ExpiresAt = %v, want within the IPNS cache TTL", entry.ExpiresAt)
+	}
+
+	// A second host pointing at the same name reuses the IPNS cache.
+	records["_dnslink.other.example.com"] = "dnslink=/ipns/k51key/docs"
+	before := calls.Load()
+	if _, _, err := a.resolve(context.Background(), "other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != before {
+		t.Errorf("Kubo called %d more times, want IPNS cache hit", calls.Load()-before)
+	}
+
+	// A failed IPNS resolution routes on the published link, uncached.
+	entry, _, err = a.resolve(context.Background(), "broken.example.com")
+	if err != nil {
+		t.Fatalf("resolve(broken) error = %v", err)
+	}
+	if entry.Namespace != "ipns" || entry.Identifier != "k51unknown" {
+		t.Errorf("resolve(broken) = /%s/%s, want /ipns/k51unknown", entry.Namespace, entry.Identifier)
+	}
+	if _, ok, _ := a.cache.Load(context.Background(), "broken.example.com"); ok {
+		t.Error("failed IPNS resolution was cached")
+	}
+}
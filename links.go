@@ -0,0 +1,196 @@
+package dnslink
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// contentNamespaces are the namespaces recognized when embedded in an
+// identifier without a leading slash, e.g. /ipfs/ipns/example.com.
+var contentNamespaces = map[string]bool{
+	"ipfs": true, "ipns": true,
+	"swarm": true, "bzz": true,
+	"arweave": true, "ar": true,
+}
+
+// maxEmbeddedLinks bounds the namespaces unwrapped from one identifier.
+const maxEmbeddedLinks = 4
+
+// unwrapLink returns the link an identifier embeds its own namespace path
+// in, as published by some records and resolvers: /ipfs//ipns/k51... is
+// routed as /ipns/k51..., and /ipfs/ipfs/bafy.../subdir as
+// /ipfs/bafy.../subdir. An embedded namespace is recognized when it
+// follows a slash, equals namespace, or both are content namespaces, so
+// identifiers such as IPNS domain names are left alone. Leading slashes
+// are dropped from identifiers that embed none.
+func unwrapLink(namespace, identifier string) (string, string) {
+	for i := 0; i < maxEmbeddedLinks; i++ {
+		rest := strings.TrimLeft(identifier, "/")
+		ns, id, _ := strings.Cut(rest, "/")
+		slashed := rest != identifier
+		embedded := ns == namespace || contentNamespaces[ns] && (slashed || contentNamespaces[namespace])
+		if !embedded || strings.Trim(id, "/") == "" {
+			if rest == "" {
+				return namespace, identifier
+			}
+			return namespace, rest
+		}
+		namespace, identifier = ns, id
+	}
+	return namespace, identifier
+}
+
+// normalizeLinks moves the links embedding their own namespace path to the
+// namespace they embed, so routing and selection see them where they
+// belong. links is returned as is if no link embeds one.
+func normalizeLinks(links map[string]dnslinkpkg.NamespaceEntries) map[string]dnslinkpkg.NamespaceEntries {
+	changed := false
+	for ns, entries := range links {
+		for _, e := range entries {
+			if n, id := unwrapLink(ns, e.Identifier); n != ns || id != e.Identifier {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return links
+	}
+	// Visit the namespaces in order, so the links merged into one keep a
+	// stable order for selection.
+	namespaces := make([]string, 0, len(links))
+	for ns := range links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	normalized := make(map[string]dnslinkpkg.NamespaceEntries, len(links))
+	for _, ns := range namespaces {
+		for _, e := range links[ns] {
+			n, id := unwrapLink(ns, e.Identifier)
+			normalized[n] = append(normalized[n], dnslinkpkg.NamespaceEntry{Identifier: id, Ttl: e.Ttl})
+		}
+	}
+	return normalized
+}
+
+// orderLinks sorts the links of each namespace deterministically, so every
+// instance routes a host with several links in a namespace the same way,
+// whatever order its resolver returned them in: well-formed identifiers
+// first, then alphabetically, without duplicates. links is returned as is
+// if already in order, and is never modified, since resolvers may share
+// it.
+func orderLinks(links map[string]dnslinkpkg.NamespaceEntries) map[string]dnslinkpkg.NamespaceEntries {
+	ordered := links
+	copied := false
+	for ns, entries := range links {
+		if linksOrdered(ns, entries) {
+			continue
+		}
+		if !copied {
+			ordered, copied = maps.Clone(links), true
+		}
+		sorted := slices.Clone(entries)
+		slices.SortStableFunc(sorted, func(a, b dnslinkpkg.NamespaceEntry) int {
+			return compareLinks(ns, a, b)
+		})
+		// Keep the lowest TTL of duplicates, so they are not cached longer
+		// than any of their records allows.
+		deduped := sorted[:1]
+		for _, e := range sorted[1:] {
+			if last := &deduped[len(deduped)-1]; e.Identifier == last.Identifier {
+				last.Ttl = min(last.Ttl, e.Ttl)
+				continue
+			}
+			deduped = append(deduped, e)
+		}
+		ordered[ns] = deduped
+	}
+	return ordered
+}
+
+// compareLinks orders two links of namespace: well-formed identifiers
+// first, then by identifier.
+func compareLinks(namespace string, a, b dnslinkpkg.NamespaceEntry) int {
+	aValid := validateIdentifier(namespace, a.Identifier) == nil
+	bValid := validateIdentifier(namespace, b.Identifier) == nil
+	switch {
+	case aValid && !bValid:
+		return -1
+	case !aValid && bValid:
+		return 1
+	}
+	return strings.Compare(a.Identifier, b.Identifier)
+}
+
+// linksOrdered reports whether entries are in the order of orderLinks.
+func linksOrdered(namespace string, entries dnslinkpkg.NamespaceEntries) bool {
+	for i := 1; i < len(entries); i++ {
+		if compareLinks(namespace, entries[i-1], entries[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// boundLinks drops the links whose identifier is longer than
+// maxIdentifier, then keeps at most maxLinks links, taking namespaces in
+// alphabetical order and the links of each in order. links is returned as
+// is if it is within bounds.
+func boundLinks(links map[string]dnslinkpkg.NamespaceEntries, maxIdentifier, maxLinks int) map[string]dnslinkpkg.NamespaceEntries {
+	total, within := 0, true
+	for _, entries := range links {
+		total += len(entries)
+		for _, e := range entries {
+			if len(e.Identifier) > maxIdentifier {
+				within = false
+			}
+		}
+	}
+	if within && total <= maxLinks {
+		return links
+	}
+
+	namespaces := make([]string, 0, len(links))
+	for ns := range links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	bounded := make(map[string]dnslinkpkg.NamespaceEntries, len(links))
+	kept := 0
+	for _, ns := range namespaces {
+		for _, e := range links[ns] {
+			if kept == maxLinks {
+				return bounded
+			}
+			if len(e.Identifier) <= maxIdentifier {
+				bounded[ns] = append(bounded[ns], e)
+				kept++
+			}
+		}
+	}
+	return bounded
+}
+
+// allowLinks keeps the links of namespaces, along with the /dnslink links
+// redirecting to other domains. links is returned as is if namespaces is
+// empty or every link is in one of them, and is never modified.
+func allowLinks(links map[string]dnslinkpkg.NamespaceEntries, namespaces []string) map[string]dnslinkpkg.NamespaceEntries {
+	if len(namespaces) == 0 {
+		return links
+	}
+	kept := links
+	copied := false
+	for ns := range links {
+		if ns == "dnslink" || slices.Contains(namespaces, ns) {
+			continue
+		}
+		if !copied {
+			kept, copied = maps.Clone(links), true
+		}
+		delete(kept, ns)
+	}
+	return kept
+}
@@ -0,0 +1,200 @@
+package dnslink
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestUnwrapLink(t *testing.T) {
+	tests := []struct {
+		namespace, identifier         string
+		wantNamespace, wantIdentifier string
+	}{
+		{"ipfs", "/ipns/k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8", "ipns", "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8"},
+		{"ipfs", "ipfs/bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4/subdir", "ipfs", "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4/subdir"},
+		{"ipfs", "ipns/example.com", "ipns", "example.com"},
+		{"ipfs", "//ipfs/ipfs/QmXyz", "ipfs", "QmXyz"},
+		{"dnslink", "/swarm/d1de9994", "swarm", "d1de9994"},
+		{"ipfs", "/QmXyz/index.html", "ipfs", "QmXyz/index.html"},
+		{"ipns", "ipfs.tech/install", "ipns", "ipfs.tech/install"},
+		{"dnslink", "ipfs/docs", "dnslink", "ipfs/docs"},
+		{"ipfs", "/ipns/", "ipfs", "ipns/"},
+		{"ipfs", "QmXyz", "ipfs", "QmXyz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.identifier, func(t *testing.T) {
+			ns, id := unwrapLink(tt.namespace, tt.identifier)
+			if ns != tt.wantNamespace || id != tt.wantIdentifier {
+				t.Errorf("unwrapLink() = %q, %q, want %q, %q", ns, id, tt.wantNamespace, tt.wantIdentifier)
+			}
+		})
+	}
+}
+
+func TestEmbeddedNamespaceResolve(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	a := &App{
+		NamespacePriority: []string{"ipns", "ipfs"},
+		cache:             new(MemoryCache),
+		logger:            zap.NewNop(),
+		lookup: func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{
+				{Value: "dnslink=/ipfs//ipns/example.org/docs", Ttl: 60},
+				{Value: "dnslink=/ipfs/QmXyz", Ttl: 60},
+			}, nil
+		},
+	}
+	entry, _, err := a.resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Namespace != "ipns" || entry.Identifier != "example.org/docs" {
+		t.Errorf("resolve() = /%s/%s, want /ipns/example.org/docs", entry.Namespace, entry.Identifier)
+	}
+	if ipfs := entry.Links["ipfs"]; len(ipfs) != 1 || ipfs[0].Identifier != "QmXyz" {
+		t.Errorf("ipfs links = %+v, want only QmXyz", ipfs)
+	}
+}
+
+func TestOrderLinks(t *testing.T) {
+	const cidB = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	const cidQ = "QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD4"
+	links := map[string]dnslinkpkg.NamespaceEntries{
+		"ipfs": {{Identifier: cidQ, Ttl: 300}, {Identifier: "Qm-malformed"}, {Identifier: cidB, Ttl: 60}, {Identifier: cidQ, Ttl: 30}},
+		"ipns": {{Identifier: "example.com"}},
+	}
+	ordered := orderLinks(links)
+	want := dnslinkpkg.NamespaceEntries{{Identifier: cidQ, Ttl: 30}, {Identifier: cidB, Ttl: 60}, {Identifier: "Qm-malformed"}}
+	if got := ordered["ipfs"]; !slices.Equal(got, want) {
+		t.Errorf("ordered ipfs links = %+v, want %+v", got, want)
+	}
+	if links["ipfs"][0].Ttl != 300 || len(links["ipfs"]) != 4 {
+		t.Error("orderLinks() modified its argument")
+	}
+	if len(ordered["ipns"]) != 1 {
+		t.Errorf("ordered ipns links = %+v", ordered["ipns"])
+	}
+
+	// Reordering the records of a resolution never changes the result.
+	reversed := map[string]dnslinkpkg.NamespaceEntries{"ipfs": slices.Clone(links["ipfs"])}
+	slices.Reverse(reversed["ipfs"])
+	if got := orderLinks(reversed)["ipfs"]; !slices.Equal(got, want) {
+		t.Errorf("ordered reversed links = %+v, want %+v", got, want)
+	}
+}
+
+func TestBoundLinks(t *testing.T) {
+	links := map[string]dnslinkpkg.NamespaceEntries{
+		"ipfs":  {{Identifier: "QmA"}, {Identifier: "Qm" + strings.Repeat("x", 20)}, {Identifier: "QmB"}},
+		"swarm": {{Identifier: "abc"}, {Identifier: "def"}},
+	}
+	tests := []struct {
+		name                    string
+		maxIdentifier, maxLinks int
+		want                    map[string]dnslinkpkg.NamespaceEntries
+	}{
+		{name: "within bounds", maxIdentifier: 64, maxLinks: 5, want: links},
+		{
+			name: "long identifier", maxIdentifier: 10, maxLinks: 5,
+			want: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmA"}, {Identifier: "QmB"}}, "swarm": links["swarm"]},
+		},
+		{
+			name: "too many links", maxIdentifier: 10, maxLinks: 3,
+			want: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmA"}, {Identifier: "QmB"}}, "swarm": {{Identifier: "abc"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := boundLinks(links, tt.maxIdentifier, tt.maxLinks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("boundLinks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveBounds(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	a := &App{
+		MaxRecordSize: 64,
+		MaxLinks:      2,
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{
+				{Value: "dnslink=/ipfs/Qm" + strings.Repeat("x", 64), Ttl: 60},
+				{Value: "dnslink=/ipfs/QmA", Ttl: 60},
+				{Value: "dnslink=/ipfs/QmB", Ttl: 60},
+				{Value: "dnslink=/ipfs/QmC", Ttl: 60},
+			}, nil
+		},
+	}
+	entry, _, err := a.resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dnslinkpkg.NamespaceEntries{{Identifier: "QmA", Ttl: 60}, {Identifier: "QmB", Ttl: 60}}
+	if got := entry.Links["ipfs"]; !slices.Equal(got, want) {
+		t.Errorf("ipfs links = %+v, want %+v", got, want)
+	}
+}
+
+func TestAllowLinks(t *testing.T) {
+	links := map[string]dnslinkpkg.NamespaceEntries{
+		"ipfs":    {{Identifier: "QmA"}},
+		"arweave": {{Identifier: "tx"}},
+		"dnslink": {{Identifier: "other.example.com"}},
+	}
+	if got := allowLinks(links, nil); !reflect.DeepEqual(got, links) {
+		t.Errorf("allowLinks(nil) = %+v, want every link", got)
+	}
+	want := map[string]dnslinkpkg.NamespaceEntries{"ipfs": links["ipfs"], "dnslink": links["dnslink"]}
+	if got := allowLinks(links, []string{"ipfs", "swarm"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("allowLinks() = %+v, want %+v", got, want)
+	}
+	if len(links) != 3 {
+		t.Error("allowLinks() modified its argument")
+	}
+}
+
+func TestResolveNamespaces(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	lookups := 0
+	a := &App{
+		Namespaces: []string{"ipfs", "swarm"},
+		CacheTTL:   caddy.Duration(time.Minute),
+		cache:      new(MemoryCache),
+		logger:     zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			lookups++
+			if name == "_dnslink.both.example.com" {
+				return []dnslinkpkg.LookupEntry{{Value: "dnslink=/arweave/tx"}, {Value: "dnslink=/swarm/abc"}}, nil
+			}
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=/arweave/tx"}}, nil
+		},
+	}
+	entry, _, err := a.resolve(context.Background(), "both.example.com")
+	if err != nil || entry.Namespace != "swarm" || len(entry.Links) != 1 {
+		t.Errorf("resolve(both) = %+v, %v, want the swarm link only", entry, err)
+	}
+	// The other host is cached without a link.
+	for i := 0; i < 2; i++ {
+		entry, _, err = a.resolve(context.Background(), "arweave.example.com")
+		if lookupOutcome(entry.Namespace, err) != outcomeNoLink {
+			t.Errorf("resolve(arweave) = %+v, %v, want no link", entry, err)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("lookups = %d, want 2", lookups)
+	}
+}
@@ -0,0 +1,109 @@
+package dnslink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultMappingsPollInterval is how often the mappings file is checked
+// for changes.
+const defaultMappingsPollInterval = time.Second
+
+// readMappingsFile reads host mappings from a file. The file is either a
+// JSON object of host to DNSLink value, or hosts-style lines of
+// "<host> <value>" where blank lines and lines starting with # are
+// ignored.
+func readMappingsFile(path string) (map[string]CacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]string)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &mappings); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: want '<host> <value>'", path, line)
+			}
+			mappings[fields[0]] = fields[1]
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := parseMappings(mappings)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// loadMappingsFile reads the mappings file and makes its entries active.
+func (a *App) loadMappingsFile() error {
+	info, err := os.Stat(a.MappingsFile)
+	if err != nil {
+		return err
+	}
+	entries, err := readMappingsFile(a.MappingsFile)
+	if err != nil {
+		return err
+	}
+	a.fileMappings.Store(&entries)
+	a.mappingsModTime = info.ModTime()
+	return nil
+}
+
+// watchMappingsFile reloads the mappings file whenever its modification
+// time changes, until stop is closed. A file that fails to load leaves
+// the previous mappings in place.
+func (a *App) watchMappingsFile(stop <-chan struct{}) {
+	interval := time.Duration(a.MappingsPollInterval)
+	if interval == 0 {
+		interval = defaultMappingsPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(a.MappingsFile)
+		if err != nil {
+			a.logger.Warn("checking mappings file", zap.String("file", a.MappingsFile), zap.Error(err))
+			continue
+		}
+		if info.ModTime().Equal(a.mappingsModTime) {
+			continue
+		}
+
+		if err := a.loadMappingsFile(); err != nil {
+			// Don't retry the same broken file on every tick.
+			a.mappingsModTime = info.ModTime()
+			a.logger.Error("reloading mappings file", zap.String("file", a.MappingsFile), zap.Error(err))
+			continue
+		}
+		a.logger.Info("reloaded mappings file", zap.String("file", a.MappingsFile))
+	}
+}
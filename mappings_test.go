@@ -0,0 +1,112 @@
+package dnslink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestReadMappingsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "json",
+			content: `{"a.example.com": "/ipfs/QmA", "B.example.com": "/swarm/abc"}`,
+			want:    map[string]string{"a.example.com": "/ipfs/QmA", "b.example.com": "/swarm/abc"},
+		},
+		{
+			name:    "hosts",
+			content: "# vanity domains\na.example.com /ipfs/QmA\n\n  b.example.com   /swarm/abc\n",
+			want:    map[string]string{"a.example.com": "/ipfs/QmA", "b.example.com": "/swarm/abc"},
+		},
+		{name: "hosts missing value", content: "a.example.com\n", wantErr: true},
+		{name: "invalid value", content: "a.example.com QmA\n", wantErr: true},
+		{name: "invalid json", content: `{"a.example.com": 1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mappings")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readMappingsFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMappingsFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("readMappingsFile() = %d entries, want %d", len(entries), len(tt.want))
+			}
+			for host, value := range tt.want {
+				entry := entries[host]
+				if got := "/" + entry.Namespace + "/" + entry.Identifier; got != value {
+					t.Errorf("entries[%s] = %s, want %s", host, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchMappingsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mappings")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("a.example.com /ipfs/QmOld\n", now.Add(-time.Minute))
+
+	a := &App{
+		MappingsFile:         path,
+		MappingsPollInterval: caddy.Duration(5 * time.Millisecond),
+		logger:               zap.NewNop(),
+	}
+	if err := a.loadMappingsFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Stop() }()
+
+	identifier := func() string {
+		entry, _ := a.lookupStatic("a.example.com")
+		return entry.Identifier
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for identifier() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("identifier = %q, want %q", identifier(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor("QmOld")
+	write("a.example.com /ipfs/QmNew\n", now)
+	waitFor("QmNew")
+
+	// A broken file keeps the last good mappings.
+	write("a.example.com\n", now.Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got := identifier(); got != "QmNew" {
+		t.Errorf("identifier after invalid reload = %q, want QmNew", got)
+	}
+}
@@ -0,0 +1,175 @@
+package dnslink
+
+import (
+	"errors"
+	"sync"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Resolution outcomes used as the "outcome" metric label.
+const (
+	outcomeHit         = "hit"
+	outcomeMiss        = "miss"
+	outcomeError       = "error"
+	outcomeNoLink      = "no_link"
+	outcomeStatic      = "static"
+	outcomeFallback    = "fallback"
+	outcomeStale       = "stale"
+	outcomeDenied      = "denied"
+	outcomeRateLimited = "rate_limited"
+	outcomePending     = "pending"
+)
+
+// Pin outcomes used as the "outcome" metric label.
+const (
+	outcomePinned = "pinned"
+)
+
+// Cache purge outcomes used as the "outcome" metric label.
+const (
+	outcomePurged = "purged"
+)
+
+// Mirrored request outcomes used as the "outcome" metric label.
+const (
+	outcomeMirrored = "mirrored"
+	outcomeDropped  = "dropped"
+)
+
+// Upstream limits used as the "limit" metric label.
+const (
+	limitRate        = "rate"
+	limitConcurrency = "concurrency"
+)
+
+var dnslinkMetrics = struct {
+	init                sync.Once
+	resolutions         *prometheus.CounterVec
+	resolutionDuration  prometheus.Histogram
+	proxiedRequests     *prometheus.CounterVec
+	notModified         *prometheus.CounterVec
+	deniedContent       *prometheus.CounterVec
+	upstreamRetries     *prometheus.CounterVec
+	contentCache        *prometheus.CounterVec
+	pins                *prometheus.CounterVec
+	purges              *prometheus.CounterVec
+	unverifiedResponses *prometheus.CounterVec
+	mirroredRequests    *prometheus.CounterVec
+	limitedRequests     *prometheus.CounterVec
+}{
+	init: sync.Once{},
+}
+
+func initMetrics() {
+	const ns, sub = "caddy", "dnslink"
+
+	dnslinkMetrics.resolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "resolutions_total",
+		Help:      "Counter of DNSLink resolutions by outcome (hit, miss, error, no_link, static, fallback, denied, rate_limited).",
+	}, []string{"outcome"})
+	dnslinkMetrics.resolutionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "resolution_duration_seconds",
+		Help:      "Histogram of DNSLink lookup durations, excluding cache hits.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	dnslinkMetrics.proxiedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "proxied_requests_total",
+		Help:      "Counter of requests proxied to an upstream, by namespace.",
+	}, []string{"namespace"})
+	dnslinkMetrics.notModified = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "not_modified_total",
+		Help:      "Counter of requests answered with 304 Not Modified without contacting the upstream, by namespace.",
+	}, []string{"namespace"})
+	dnslinkMetrics.deniedContent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "denied_requests_total",
+		Help:      "Counter of requests for content on the denylist, by namespace.",
+	}, []string{"namespace"})
+	dnslinkMetrics.upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "upstream_retries_total",
+		Help:      "Counter of proxied requests retried against an alternate upstream, by prefix.",
+	}, []string{"prefix"})
+	dnslinkMetrics.contentCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "content_cache_requests_total",
+		Help:      "Counter of requests for immutable content looked up in the content cache, by outcome (hit, miss).",
+	}, []string{"outcome"})
+	dnslinkMetrics.pins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "pins_total",
+		Help:      "Counter of requests to pin newly resolved identifiers, by outcome (pinned, error).",
+	}, []string{"outcome"})
+	dnslinkMetrics.purges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_purges_total",
+		Help:      "Counter of purge requests sent to HTTP caches for hosts whose link changed, by outcome (purged, error).",
+	}, []string{"outcome"})
+	dnslinkMetrics.unverifiedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "unverified_responses_total",
+		Help:      "Counter of trustless gateway responses that failed verification, by prefix.",
+	}, []string{"prefix"})
+	dnslinkMetrics.mirroredRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "mirrored_requests_total",
+		Help:      "Counter of requests copied to a shadow upstream, by prefix and outcome (mirrored, error, dropped).",
+	}, []string{"prefix", "outcome"})
+	dnslinkMetrics.limitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "upstream_limited_requests_total",
+		Help:      "Counter of requests rejected by the upstream limits of their prefix, by prefix and limit (rate, concurrency).",
+	}, []string{"prefix", "limit"})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_entries",
+		Help:      "Number of entries in the in-memory resolution caches.",
+	}, cacheSize)
+}
+
+// cacheSize counts the unexpired entries of all active caches. Only
+// in-memory caches are counted, since enumerating a shared backend on
+// every scrape would be too expensive.
+func cacheSize() float64 {
+	return float64(collectStats().Entries)
+}
+
+// rcodeNXDomain is the DNS NXDOMAIN response code. The dnslink library's
+// own NXDomain constant is off by one, so compare against the raw value
+// like the library does internally.
+const rcodeNXDomain = 3
+
+// lookupOutcome classifies the result of a live DNSLink lookup.
+func lookupOutcome(namespace string, err error) string {
+	var rcodeErr dnslinkpkg.DNSRCodeError
+	switch {
+	case errors.As(err, &rcodeErr) && rcodeErr.DNSRCode == rcodeNXDomain:
+		return outcomeNoLink
+	case err != nil:
+		return outcomeError
+	case namespace == "":
+		return outcomeNoLink
+	default:
+		return outcomeMiss
+	}
+}
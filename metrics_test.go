@@ -0,0 +1,31 @@
+package dnslink
+
+import (
+	"errors"
+	"testing"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func TestLookupOutcome(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		err       error
+		expected  string
+	}{
+		{name: "link found", namespace: "ipfs", expected: outcomeMiss},
+		{name: "no link in records", namespace: "", expected: outcomeNoLink},
+		{name: "nxdomain", err: dnslinkpkg.NewDNSRCodeError(3, "example.com"), expected: outcomeNoLink},
+		{name: "servfail", err: dnslinkpkg.NewDNSRCodeError(2, "example.com"), expected: outcomeError},
+		{name: "other error", err: errors.New("i/o timeout"), expected: outcomeError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lookupOutcome(tt.namespace, tt.err); got != tt.expected {
+				t.Errorf("lookupOutcome() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Defaults of Mirror.
+const (
+	defaultMirrorTimeout = 30 * time.Second
+	// maxMirrorsInFlight bounds the mirrored requests of a handler in
+	// progress, so a slow shadow upstream cannot pile them up. Requests
+	// are not mirrored while it is reached.
+	maxMirrorsInFlight = 100
+)
+
+// Mirror sends copies of a share of the requests of a prefix to a shadow
+// upstream in the background, discarding its responses, so a new gateway
+// cluster can be tried against production traffic before it becomes the
+// prefix's upstream. Copies have the upstream path, headers, credentials
+// and transport of the prefix's own requests. Only requests without a
+// body are mirrored, and upgrades such as websockets never are.
+type Mirror struct {
+	// Upstream is the address of the shadow upstream.
+	Upstream string `json:"upstream"`
+
+	// Percent is the share of the requests mirrored, from 0 (exclusive)
+	// to 100. Default is 100.
+	Percent float64 `json:"percent,omitempty"`
+
+	// Timeout bounds a mirrored request. Default is 30s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// validate checks the mirror configuration.
+func (m *Mirror) validate() error {
+	if strings.TrimSpace(m.Upstream) == "" {
+		return fmt.Errorf("empty upstream address")
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("percent %g out of range", m.Percent)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	return nil
+}
+
+// sampled reports whether a request is picked to be mirrored.
+func (m *Mirror) sampled() bool {
+	return m.Percent == 0 || m.Percent == 100 || rand.Float64()*100 < m.Percent
+}
+
+// mirrorable reports whether r can be mirrored.
+func mirrorable(r *http.Request) bool {
+	return r.ContentLength == 0 && (r.Body == nil || r.Body == http.NoBody) && r.Header.Get("Upgrade") == ""
+}
+
+// mirror sends a copy of r, a request of prefix on its way to the
+// upstream, to the shadow upstream of the prefix, if it has one and r is
+// picked. The copy of a handler serving a host config mirrors through
+// its parent.
+func (d *DNSLink) mirror(r *http.Request, prefix string) {
+	if d.parent != nil {
+		d.parent.mirror(r, prefix)
+		return
+	}
+	m, ok := d.Mirrors[prefix]
+	if !ok || !mirrorable(r) || !m.sampled() {
+		return
+	}
+	rp := d.mirrorProxies[prefix]
+	if d.mirrorsInFlight.Add(1) > maxMirrorsInFlight {
+		d.mirrorsInFlight.Add(-1)
+		dnslinkMetrics.mirroredRequests.WithLabelValues(prefix, outcomeDropped).Inc()
+		return
+	}
+	timeout := time.Duration(m.Timeout)
+	if timeout == 0 {
+		timeout = defaultMirrorTimeout
+	}
+	// The copy outlives r, and gets a replacer and variables of its own
+	// since the reverse proxy sets them. It is aborted by Cleanup, so a
+	// slow shadow upstream can't hold up a config reload.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	stop := context.AfterFunc(d.mirrorsCtx, cancel)
+	server, _ := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	shadow := caddyhttp.PrepareRequest(r.Clone(ctx), caddy.NewReplacer(), nil, server)
+	shadow.Body = http.NoBody
+
+	d.mirroring.Add(1)
+	go func() {
+		defer d.mirroring.Done()
+		defer d.mirrorsInFlight.Add(-1)
+		defer cancel()
+		defer stop()
+		w := &discardWriter{header: make(http.Header)}
+		err := rp.ServeHTTP(w, shadow, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		if err != nil {
+			dnslinkMetrics.mirroredRequests.WithLabelValues(prefix, outcomeError).Inc()
+			d.logger.Debug("mirrored request failed", zap.String("prefix", prefix), zap.String("upstream", m.Upstream), zap.String("uri", shadow.URL.RequestURI()), zap.Error(err))
+			return
+		}
+		dnslinkMetrics.mirroredRequests.WithLabelValues(prefix, outcomeMirrored).Inc()
+	}()
+}
+
+// discardWriter is a response writer discarding the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (*discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (*discardWriter) WriteHeader(int) {}
+
+// unmarshalMirror parses the mirror subdirective:
+//
+//	mirror <prefix> <upstream> {
+//	    percent <percent>
+//	    timeout <duration>
+//	}
+func unmarshalMirror(d *caddyfile.Dispenser) (string, *Mirror, error) {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return "", nil, d.ArgErr()
+	}
+	prefix := args[0]
+	m := &Mirror{Upstream: trimSchemes(args[1:])[0]}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "percent":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil || percent <= 0 || percent > 100 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			m.Percent = percent
+		case "timeout":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			m.Timeout = caddy.Duration(dur)
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	return prefix, m, nil
+}
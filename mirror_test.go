@@ -0,0 +1,183 @@
+package dnslink
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMirror(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+	type mirrored struct {
+		method, path, test string
+	}
+	copies := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copies <- mirrored{r.Method, r.URL.Path, r.Header.Get("X-Test")}
+		if r.Header.Get("X-Test") == "slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Shadow", "1")
+		_, _ = io.WriteString(w, "shadow")
+	}))
+	defer shadow.Close()
+
+	d, unload := loadTestHandler(t, &DNSLink{
+		Upstreams: map[string]string{"/ipfs": primary.Listener.Addr().String()},
+		Mirrors:   map[string]*Mirror{"/ipfs": {Upstream: shadow.Listener.Addr().String(), Timeout: caddy.Duration(time.Minute)}},
+	}, map[string]string{"example.com": "/ipfs/QmFake"})
+
+	server := &caddyhttp.Server{}
+	serve := func(test string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/index.html", nil)
+		req.Header.Set("X-Test", test)
+		req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), nil, server)
+		rec := httptest.NewRecorder()
+		if err := d.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+		return rec
+	}
+	next := func() mirrored {
+		t.Helper()
+		select {
+		case c := <-copies:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not mirrored")
+			return mirrored{}
+		}
+	}
+
+	// The copy has the upstream method, path and headers, and its response
+	// never reaches the client.
+	rec := serve("copied")
+	if rec.Body.String() != "primary" || rec.Header().Get("X-Shadow") != "" {
+		t.Errorf("response = %q with headers %v, want the primary's", rec.Body, rec.Header())
+	}
+	if c := next(); c != (mirrored{http.MethodGet, "/ipfs/QmFake/index.html", "copied"}) {
+		t.Errorf("mirrored %+v", c)
+	}
+
+	// Copies over the in-flight limit are dropped.
+	d.mirrorsInFlight.Add(maxMirrorsInFlight)
+	serve("dropped")
+	d.mirrorsInFlight.Add(-maxMirrorsInFlight)
+
+	// Unloading the config aborts copies in flight instead of waiting for
+	// the shadow.
+	serve("slow")
+	if c := next(); c.test != "slow" {
+		t.Fatalf("mirrored %+v, want the slow request; dropped copies must not be sent", c)
+	}
+	done := make(chan struct{})
+	go func() {
+		unload()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cleanup() waited for a slow shadow upstream")
+	}
+	if d.mirrorsInFlight.Load() != 0 {
+		t.Errorf("%d mirrored requests in flight after Cleanup", d.mirrorsInFlight.Load())
+	}
+}
+
+func TestMirrorable(t *testing.T) {
+	get := httptest.NewRequest(http.MethodGet, "/ipfs/bafy/", nil)
+	post := httptest.NewRequest(http.MethodPost, "/api/v0/add", strings.NewReader("data"))
+	upgrade := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	upgrade.Header.Set("Upgrade", "websocket")
+	for r, want := range map[*http.Request]bool{get: true, post: false, upgrade: false} {
+		if got := mirrorable(r); got != want {
+			t.Errorf("mirrorable(%s %s) = %v, want %v", r.Method, r.URL, got, want)
+		}
+	}
+}
+
+func TestMirrorSampled(t *testing.T) {
+	sampled := 0
+	m := &Mirror{Upstream: "ipfs-next:8080", Percent: 25}
+	for i := 0; i < 10000; i++ {
+		if m.sampled() {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Errorf("sampled %d of 10000 requests at 25%%", sampled)
+	}
+	if m := (&Mirror{Upstream: "ipfs-next:8080"}); !m.sampled() {
+		t.Error("sampled() skipped a request without a percent")
+	}
+}
+
+func TestValidateMirrors(t *testing.T) {
+	for _, m := range []*Mirror{
+		{Upstream: " "},
+		{Upstream: "ipfs-next:8080", Percent: 101},
+		{Upstream: "ipfs-next:8080", Percent: -1},
+		{Upstream: "ipfs-next:8080", Timeout: -1},
+	} {
+		if err := m.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", m)
+		}
+	}
+
+	d := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "ipfs:8080"},
+		Mirrors:   map[string]*Mirror{"/ipns": {Upstream: "ipfs-next:8080"}},
+	}
+	if err := d.Validate(); err == nil {
+		t.Error("Validate() accepted a mirror for a prefix without an upstream")
+	}
+	d.Mirrors = map[string]*Mirror{"/ipfs": {Upstream: "ipfs-next:8080", Percent: 10}}
+	if err := d.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestUnmarshalMirror(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`mirror /ipfs http://ipfs-next:8080 {
+		percent 12.5%
+		timeout 5s
+	}`)
+	d.Next()
+	prefix, m, err := unmarshalMirror(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "/ipfs" || m.Upstream != "ipfs-next:8080" || m.Percent != 12.5 || m.Timeout != caddy.Duration(5*time.Second) {
+		t.Errorf("unmarshalMirror() = %s, %+v", prefix, m)
+	}
+
+	for _, input := range []string{
+		"mirror /ipfs",
+		"mirror /ipfs a:80 b:80",
+		"mirror /ipfs a:80 {\n percent 0\n}",
+		"mirror /ipfs a:80 {\n percent half\n}",
+		"mirror /ipfs a:80 {\n timeout soon\n}",
+		"mirror /ipfs a:80 {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, _, err := unmarshalMirror(d); err == nil {
+			t.Errorf("unmarshalMirror(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// maxDNSAddrDepth bounds the chains of dnsaddr records followed to find a
+// dialable address.
+const maxDNSAddrDepth = 4
+
+// Variables holding the endpoint of a dialed multiaddr link, read by the
+// multiaddr reverse proxies.
+const (
+	varMultiaddrDial = "dnslink_multiaddr_dial"
+	varMultiaddrHost = "dnslink_multiaddr_host"
+)
+
+// Placeholders of multiaddr links available in path templates.
+const (
+	placeholderMultiaddrHost   = "{multiaddr.host}"
+	placeholderMultiaddrPort   = "{multiaddr.port}"
+	placeholderMultiaddrScheme = "{multiaddr.scheme}"
+	placeholderMultiaddrPeer   = "{multiaddr.peer}"
+)
+
+// multiaddr is a parsed multiaddr describing an HTTP endpoint, such as
+// /dns4/example.com/tcp/443/https or /ip4/192.0.2.1/tcp/8080/http.
+type multiaddr struct {
+	// Host is an IP address or a domain name.
+	Host string
+
+	// DNSAddr is set if Host is a dnsaddr name, whose TXT records list
+	// the addresses to dial.
+	DNSAddr bool
+
+	Port   string
+	Scheme string
+	Peer   string
+
+	// Path is the escaped HTTP path of an http-path component.
+	Path string
+}
+
+// dialAddress returns the host:port to dial.
+func (m multiaddr) dialAddress() string {
+	return net.JoinHostPort(m.Host, m.Port)
+}
+
+// multiaddrLink returns the multiaddr of a link: the link itself if its
+// namespace is a multiaddr address protocol, e.g. /dns4/example.com/...,
+// or its identifier in the multiaddr namespace, e.g.
+// /multiaddr/dns4/example.com/....
+func multiaddrLink(namespace, identifier string) (string, bool) {
+	switch {
+	case isMultiaddrAddress(namespace):
+		return "/" + namespace + "/" + identifier, true
+	case namespace == "multiaddr":
+		return "/" + strings.TrimPrefix(identifier, "/"), true
+	}
+	return "", false
+}
+
+// dialsMultiaddr reports whether the links of namespace are dialed: they
+// are multiaddrs, DialMultiaddrs is set, and namespace has no prefix or
+// alias of its own.
+func (d *DNSLink) dialsMultiaddr(namespace string) bool {
+	if _, ok := multiaddrLink(namespace, ""); !ok || !d.DialMultiaddrs {
+		return false
+	}
+	_, hasAlias := d.Aliases[namespace]
+	return !d.handles("/"+namespace) && !hasAlias
+}
+
+// parseMultiaddr parses a multiaddr made of an address (ip4, ip6, dns,
+// dns4, dns6 or dnsaddr), an optional tcp port, and optional tls, http,
+// https, http-path and p2p components. The port and scheme are left empty
+// if the multiaddr does not give them; see withDefaults.
+func parseMultiaddr(s string) (multiaddr, error) {
+	var m multiaddr
+	parts := strings.Split(strings.TrimPrefix(s, "/"), "/")
+	arg := func(i int) (string, error) {
+		if i+1 >= len(parts) || parts[i+1] == "" {
+			return "", fmt.Errorf("missing value of %s", parts[i])
+		}
+		return parts[i+1], nil
+	}
+	tls := false
+	for i := 0; i < len(parts); i++ {
+		proto := parts[i]
+		if (i == 0) != isMultiaddrAddress(proto) {
+			if i == 0 {
+				return multiaddr{}, fmt.Errorf("multiaddr %q does not start with an address", s)
+			}
+			return multiaddr{}, fmt.Errorf("multiaddr %q has more than one address", s)
+		}
+		switch proto {
+		case "ip4", "ip6":
+			v, err := arg(i)
+			if err != nil {
+				return multiaddr{}, err
+			}
+			ip, err := netip.ParseAddr(v)
+			if err != nil || ip.Is4() != (proto == "ip4") || ip.Zone() != "" {
+				return multiaddr{}, fmt.Errorf("invalid %s address '%s'", proto, v)
+			}
+			m.Host = ip.String()
+		case "dns", "dns4", "dns6", "dnsaddr":
+			v, err := arg(i)
+			if err != nil {
+				return multiaddr{}, err
+			}
+			if !isDomainName(v) {
+				return multiaddr{}, fmt.Errorf("invalid %s name '%s'", proto, v)
+			}
+			m.Host, m.DNSAddr = strings.ToLower(strings.TrimSuffix(v, ".")), proto == "dnsaddr"
+		case "tcp":
+			v, err := arg(i)
+			if err != nil {
+				return multiaddr{}, err
+			}
+			if port, err := strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+				return multiaddr{}, fmt.Errorf("invalid tcp port '%s'", v)
+			}
+			m.Port = v
+		case "p2p", "ipfs":
+			v, err := arg(i)
+			if err != nil {
+				return multiaddr{}, err
+			}
+			if _, err := decodeIPNSKey(v); err != nil {
+				return multiaddr{}, fmt.Errorf("invalid peer ID '%s': %v", v, err)
+			}
+			m.Peer = v
+		case "http-path":
+			v, err := arg(i)
+			if err != nil {
+				return multiaddr{}, err
+			}
+			p, err := url.PathUnescape(v)
+			if err != nil {
+				return multiaddr{}, fmt.Errorf("invalid http-path '%s'", v)
+			}
+			m.Path = strings.TrimSuffix(cleanPath("/"+strings.TrimPrefix(p, "/")), "/")
+		case "tls":
+			tls = true
+			m.Scheme = "https"
+			continue
+		case "http":
+			if !tls {
+				m.Scheme = "http"
+			}
+			continue
+		case "https":
+			m.Scheme = "https"
+			continue
+		default:
+			return multiaddr{}, fmt.Errorf("unsupported multiaddr protocol '%s'", proto)
+		}
+		i++
+	}
+	return m, nil
+}
+
+// withDefaults returns m with its port defaulting to that of its scheme,
+// and its scheme to https for port 443 and http otherwise.
+func (m multiaddr) withDefaults() multiaddr {
+	if m.Scheme == "" {
+		m.Scheme = "http"
+		if m.Port == "443" {
+			m.Scheme = "https"
+		}
+	}
+	if m.Port == "" {
+		m.Port = "80"
+		if m.Scheme == "https" {
+			m.Port = "443"
+		}
+	}
+	return m
+}
+
+// isMultiaddrAddress reports whether proto is a multiaddr address protocol.
+func isMultiaddrAddress(proto string) bool {
+	switch proto {
+	case "ip4", "ip6", "dns", "dns4", "dns6", "dnsaddr":
+		return true
+	}
+	return false
+}
+
+// resolveDNSAddr follows the dnsaddr records of m to the first multiaddr
+// with a dialable address and, if m names a peer, the same peer. The
+// port, scheme and path of m apply unless the record gives its own.
+func resolveDNSAddr(ctx context.Context, lookup txtLookup, m multiaddr) (multiaddr, error) {
+	for depth := 0; m.DNSAddr; depth++ {
+		if depth == maxDNSAddrDepth {
+			return multiaddr{}, fmt.Errorf("dnsaddr records of %s nest too deeply", m.Host)
+		}
+		entries, err := lookup(ctx, "_dnsaddr."+m.Host)
+		if err != nil {
+			return multiaddr{}, err
+		}
+		next, found := multiaddr{}, false
+		for _, entry := range entries {
+			value, ok := strings.CutPrefix(entry.Value, "dnsaddr=")
+			if !ok {
+				continue
+			}
+			candidate, err := parseMultiaddr(value)
+			if err != nil || (m.Peer != "" && candidate.Peer != "" && candidate.Peer != m.Peer) {
+				continue
+			}
+			if candidate.Port == "" {
+				candidate.Port = m.Port
+			}
+			if candidate.Scheme == "" {
+				candidate.Scheme = m.Scheme
+			}
+			if candidate.Path == "" {
+				candidate.Path = m.Path
+			}
+			if candidate.Peer == "" {
+				candidate.Peer = m.Peer
+			}
+			next, found = candidate, true
+			break
+		}
+		if !found {
+			return multiaddr{}, fmt.Errorf("no usable dnsaddr record for %s", m.Host)
+		}
+		m = next
+	}
+	return m, nil
+}
+
+// expandMultiaddr fills in the multiaddr placeholders of a path template.
+func expandMultiaddr(tmpl string, m multiaddr) string {
+	return strings.NewReplacer(
+		placeholderMultiaddrHost, url.PathEscape(m.Host),
+		placeholderMultiaddrPort, m.Port,
+		placeholderMultiaddrScheme, m.Scheme,
+		placeholderMultiaddrPeer, url.PathEscape(m.Peer),
+	).Replace(tmpl)
+}
+
+// hasMultiaddrPlaceholders reports whether a path template uses the
+// placeholders of multiaddr links.
+func hasMultiaddrPlaceholders(tmpl string) bool {
+	return strings.Contains(tmpl, "{multiaddr.")
+}
+
+// newMultiaddrProxies sets up the reverse proxies dialing multiaddr links
+// over HTTP and HTTPS. Their upstream and Host header are set per request
+// from the variables set by serveMultiaddr.
+func newMultiaddrProxies() (plain, secure *reverseproxy.Handler) {
+	hostVar := "{http.vars." + varMultiaddrHost + "}"
+	newProxy := func() *reverseproxy.Handler {
+		return &reverseproxy.Handler{
+			Upstreams: staticPool("{http.vars." + varMultiaddrDial + "}"),
+			Headers:   hostHeaderOps(hostVar),
+		}
+	}
+	plain, secure = newProxy(), newProxy()
+	secure.TransportRaw = caddyconfig.JSONModuleObject(&reverseproxy.HTTPTransport{
+		TLS: &reverseproxy.TLSConfig{ServerName: hostVar},
+	}, "protocol", "http", nil)
+	return plain, secure
+}
+
+// serveMultiaddr proxies r to the endpoint described by the multiaddr
+// link of entry, resolving dnsaddr names first. The upstream path is the
+// link's http-path, if any, followed by the request path.
+func (d *DNSLink) serveMultiaddr(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, host, link string, al *accessLog) error {
+	invalid := failure{
+		Status:    d.OnMiss,
+		Host:      host,
+		Namespace: al.namespace,
+		Message:   "invalid DNSLink record for " + host,
+	}
+	m, err := parseMultiaddr(link)
+	if err != nil {
+		d.logger.Warn("ignoring dnslink", zap.String("host", host), zap.Error(err))
+		return d.fail(w, r, next, invalid)
+	}
+	if m.DNSAddr {
+		lookup := d.app.lookup
+		if lookup == nil {
+			lookup = systemLookup
+		}
+		if m, err = resolveDNSAddr(withClient(r.Context(), r), lookup, m); err != nil {
+			d.logger.Debug("dnsaddr lookup failed", zap.String("host", host), zap.Error(err))
+			if r.Context().Err() != nil {
+				return next.ServeHTTP(w, r)
+			}
+			if errors.Is(err, errRateLimited) {
+				return d.fail(w, r, next, failure{Status: http.StatusTooManyRequests, Host: host, Message: "too many DNSLink resolutions, try again later"})
+			}
+			return d.fail(w, r, next, failure{Status: d.OnError, Host: host, Message: "dnsaddr resolution failed for " + host})
+		}
+	}
+	m = m.withDefaults()
+	proxy := d.multiaddrProxies[0]
+	if m.Scheme == "https" {
+		proxy = d.multiaddrProxies[1]
+	}
+	al.upstream = m.dialAddress()
+
+	rawPath := escapePath(m.Path) + cleanPath(r.URL.EscapedPath())
+	upstreamPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("building upstream path: %v", err))
+	}
+	r.URL.Path, r.URL.RawPath = upstreamPath, rawPath
+
+	if tr := traceFrom(r); tr != nil {
+		tr.Upstream, tr.UpstreamPath, tr.Outcome = m.Scheme+"://"+m.dialAddress(), r.URL.RequestURI(), traceProxy
+		return tr.write(w)
+	}
+	d.logger.Debug("dialing multiaddr", zap.String("host", host), zap.String("upstream", m.dialAddress()), zap.String("scheme", m.Scheme))
+	caddyhttp.SetVar(r.Context(), varMultiaddrDial, m.dialAddress())
+	caddyhttp.SetVar(r.Context(), varMultiaddrHost, m.Host)
+	dnslinkMetrics.proxiedRequests.WithLabelValues(al.namespace).Inc()
+	return proxy.ServeHTTP(w, r, next)
+}
@@ -0,0 +1,142 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestParseMultiaddr(t *testing.T) {
+	const peer = "12D3KooWRBy97UB99e3J6hiPesre1MZeuNQvfan4gBziswrRJsNK"
+	tests := []struct {
+		addr    string
+		want    multiaddr
+		wantErr bool
+	}{
+		{addr: "/dns4/Example.com/tcp/443/https", want: multiaddr{Host: "example.com", Port: "443", Scheme: "https"}},
+		{addr: "/ip4/192.0.2.1/tcp/8080/http", want: multiaddr{Host: "192.0.2.1", Port: "8080", Scheme: "http"}},
+		{addr: "/ip6/2001:db8::1/tcp/8443/tls/http", want: multiaddr{Host: "2001:db8::1", Port: "8443", Scheme: "https"}},
+		{addr: "/dns/example.com", want: multiaddr{Host: "example.com"}},
+		{addr: "/dnsaddr/example.com/p2p/" + peer, want: multiaddr{Host: "example.com", DNSAddr: true, Peer: peer}},
+		{addr: "/dns/example.com/https/http-path/api%2Fv0", want: multiaddr{Host: "example.com", Scheme: "https", Path: "/api/v0"}},
+		{addr: "/ip4/2001:db8::1/tcp/80", wantErr: true},
+		{addr: "/dns/example.com/tcp/99999", wantErr: true},
+		{addr: "/dns/example.com/udp/53", wantErr: true},
+		{addr: "/dns/example.com/dns/example.org", wantErr: true},
+		{addr: "/tcp/80/dns/example.com", wantErr: true},
+		{addr: "/dns4", wantErr: true},
+		{addr: "/dns/example.com/p2p/notapeer", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := parseMultiaddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMultiaddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMultiaddr() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if m := (multiaddr{Host: "example.com", Port: "443"}).withDefaults(); m.Scheme != "https" {
+		t.Errorf("scheme of port 443 = %q, want https", m.Scheme)
+	}
+	if m := (multiaddr{Host: "example.com", Scheme: "https"}).withDefaults(); m.Port != "443" {
+		t.Errorf("port of https = %q, want 443", m.Port)
+	}
+	if got := expandMultiaddr("/{multiaddr.scheme}/{multiaddr.host}/{multiaddr.port}{path}", multiaddr{Host: "example.com", Port: "80", Scheme: "http"}); got != "/http/example.com/80{path}" {
+		t.Errorf("expandMultiaddr() = %q", got)
+	}
+}
+
+func TestResolveDNSAddr(t *testing.T) {
+	const peer = "12D3KooWRBy97UB99e3J6hiPesre1MZeuNQvfan4gBziswrRJsNK"
+	records := map[string][]string{
+		"_dnsaddr.example.com": {
+			"dnsaddr=/ip4/192.0.2.1/udp/4001/quic",
+			"dnsaddr=/dnsaddr/gw.example.com",
+		},
+		"_dnsaddr.gw.example.com": {
+			"other=value",
+			"dnsaddr=/ip4/192.0.2.2/tcp/4001/p2p/12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA",
+			"dnsaddr=/ip4/192.0.2.3/tcp/8080/p2p/" + peer,
+		},
+		"_dnsaddr.loop.example.com": {"dnsaddr=/dnsaddr/loop.example.com"},
+	}
+	lookup := func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		var entries []dnslinkpkg.LookupEntry
+		for _, value := range records[name] {
+			entries = append(entries, dnslinkpkg.LookupEntry{Value: value})
+		}
+		return entries, nil
+	}
+
+	m, err := resolveDNSAddr(context.Background(), lookup, multiaddr{Host: "example.com", DNSAddr: true, Peer: peer, Scheme: "https"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (multiaddr{Host: "192.0.2.3", Port: "8080", Scheme: "https", Peer: peer}); m != want {
+		t.Errorf("resolveDNSAddr() = %+v, want %+v", m, want)
+	}
+	if _, err := resolveDNSAddr(context.Background(), lookup, multiaddr{Host: "loop.example.com", DNSAddr: true}); err == nil {
+		t.Error("resolveDNSAddr() followed a dnsaddr loop")
+	}
+	if _, err := resolveDNSAddr(context.Background(), lookup, multiaddr{Host: "none.example.com", DNSAddr: true}); err == nil {
+		t.Error("resolveDNSAddr() succeeded without records")
+	}
+}
+
+func TestServeMultiaddr(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	links := map[string]dnslinkpkg.Result{
+		"dial.example.com":    {Links: map[string]dnslinkpkg.NamespaceEntries{"dns4": {{Identifier: "origin.example.net/tcp/8443/https/http-path/site"}}}},
+		"invalid.example.com": {Links: map[string]dnslinkpkg.NamespaceEntries{"dns4": {{Identifier: "origin.example.net/udp/53"}}}},
+	}
+	d := &DNSLink{
+		DialMultiaddrs: true,
+		Trace:          &Trace{Secret: "s3cret"},
+		OnMiss:         http.StatusNotFound,
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				return links[host], nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Trace.provision(); err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	r := httptest.NewRequest(http.MethodGet, "http://dial.example.com/docs/?q=1", nil)
+	r.Header.Set(defaultTraceHeader, "s3cret")
+	w := httptest.NewRecorder()
+	if err := d.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	var tr requestTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Upstream != "https://origin.example.net:8443" || tr.UpstreamPath != "/site/docs/?q=1" || tr.Outcome != traceProxy {
+		t.Errorf("trace = %+v, want a proxy to https://origin.example.net:8443/site/docs/?q=1", tr)
+	}
+
+	w = httptest.NewRecorder()
+	if err := d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://invalid.example.com/", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("invalid multiaddr status = %d, want 404", w.Code)
+	}
+}
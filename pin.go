@@ -0,0 +1,258 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Pinning APIs.
+const (
+	pinAPIKubo           = "kubo"
+	pinAPIPinningService = "pinning_service"
+)
+
+// Bounds of the pinning of new identifiers.
+const (
+	defaultPinTimeout = 10 * time.Minute
+	maxConcurrentPins = 4
+	maxPinnedCIDs     = 10000
+)
+
+// Pin asks a pinning endpoint to pin the ipfs links of matching hosts the
+// first time they are resolved, so the content of hosted domains stays
+// pinned as their publishers roll out new roots. Unpinning previous roots
+// is left to the pinning endpoint's own garbage collection policy.
+type Pin struct {
+	// API is the pinning API spoken by URL: "kubo" for the RPC API of a
+	// Kubo node, or "pinning_service" for the IPFS Pinning Service API.
+	API string `json:"api"`
+
+	// URL is the base URL of the API, e.g. http://ipfs:5001 for Kubo or
+	// https://api.pinata.cloud/psa for a pinning service.
+	URL string `json:"url"`
+
+	// Hosts are the patterns of the hosts whose links are pinned, as in
+	// allow_hosts: "example.com", "*.example.com" or ".example.com".
+	Hosts []string `json:"hosts"`
+
+	// Token, if set, is sent as a bearer token. It may be a global
+	// placeholder such as {env.PINNING_TOKEN}.
+	Token string `json:"token,omitempty"`
+
+	// Timeout bounds a pin request. Kubo only answers once the content is
+	// pinned, so this should cover fetching it. Default is 10m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	token  string
+	client *http.Client
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	pinned map[string]struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slots   chan struct{}
+	pinning sync.WaitGroup
+}
+
+// provision validates the configuration and sets the defaults.
+func (p *Pin) provision(logger *zap.Logger) error {
+	if p.API != pinAPIKubo && p.API != pinAPIPinningService {
+		return fmt.Errorf("unknown api '%s'", p.API)
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url '%s'", p.URL)
+	}
+	if len(p.Hosts) == 0 {
+		return fmt.Errorf("no hosts to pin")
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = caddy.Duration(defaultPinTimeout)
+	}
+	p.token = caddy.NewReplacer().ReplaceAll(p.Token, "")
+	if p.client == nil {
+		p.client = new(http.Client)
+	}
+	p.logger = logger
+	p.pinned = make(map[string]struct{})
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.slots = make(chan struct{}, maxConcurrentPins)
+	return nil
+}
+
+// stop cancels the pin requests in progress and waits for them.
+func (p *Pin) stop() {
+	p.cancel()
+	p.pinning.Wait()
+}
+
+// pinNew pins, in the background, the ipfs links of entry not pinned yet
+// if host matches Hosts. Failed pins are retried on the host's next live
+// resolution.
+func (p *Pin) pinNew(host string, entry CacheEntry) {
+	host = mappingKey(host)
+	matched := false
+	for _, pattern := range p.Hosts {
+		if matchHost(pattern, host) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+	for _, link := range entry.Links["ipfs"] {
+		cid, _, _ := strings.Cut(link.Identifier, "/")
+		if validateCID(cid) != nil || !p.claim(cid) {
+			continue
+		}
+		p.pinning.Add(1)
+		go func() {
+			defer p.pinning.Done()
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.ctx.Done():
+				return
+			}
+			defer func() { <-p.slots }()
+
+			if err := p.pin(host, cid); err != nil {
+				p.release(cid)
+				dnslinkMetrics.pins.WithLabelValues(outcomeError).Inc()
+				if p.ctx.Err() == nil {
+					p.logger.Warn("pinning dnslink", zap.String("host", host), zap.String("cid", cid), zap.Error(err))
+				}
+				return
+			}
+			dnslinkMetrics.pins.WithLabelValues(outcomePinned).Inc()
+			p.logger.Info("pinned dnslink", zap.String("host", host), zap.String("cid", cid))
+		}()
+	}
+}
+
+// claim marks cid as pinned, reporting false if it already was. The set is
+// reset when full, since pinning again is harmless.
+func (p *Pin) claim(cid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pinned[cid]; ok {
+		return false
+	}
+	if len(p.pinned) >= maxPinnedCIDs {
+		clear(p.pinned)
+	}
+	p.pinned[cid] = struct{}{}
+	return true
+}
+
+// release forgets cid, so it is pinned again when next resolved.
+func (p *Pin) release(cid string) {
+	p.mu.Lock()
+	delete(p.pinned, cid)
+	p.mu.Unlock()
+}
+
+// pin asks the pinning endpoint to pin cid, naming it after host where the
+// API supports it.
+func (p *Pin) pin(host, cid string) error {
+	ctx, cancel := context.WithTimeout(p.ctx, time.Duration(p.Timeout))
+	defer cancel()
+
+	endpoint := strings.TrimSuffix(p.URL, "/")
+	var body []byte
+	if p.API == pinAPIKubo {
+		query := url.Values{"arg": {cid}, "recursive": {"true"}, "progress": {"false"}}
+		endpoint += "/api/v0/pin/add?" + query.Encode()
+	} else {
+		endpoint += "/pins"
+		body, _ = json.Marshal(map[string]string{"cid": cid, "name": host})
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// unmarshalPin parses the pin option:
+//
+//	pin kubo|pinning_service <url> {
+//	    hosts <pattern>...
+//	    token <token>
+//	    timeout <duration>
+//	}
+func unmarshalPin(d *caddyfile.Dispenser) (*Pin, error) {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return nil, d.ArgErr()
+	}
+	p := &Pin{API: args[0], URL: args[1]}
+	if p.API != pinAPIKubo && p.API != pinAPIPinningService {
+		return nil, d.Errf("unknown pinning api '%s'", p.API)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return nil, d.ArgErr()
+			}
+			p.Hosts = append(p.Hosts, hosts...)
+		case "token":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			p.Token = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid timeout '%s'", d.Val())
+			}
+			p.Timeout = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return p, nil
+}
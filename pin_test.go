@@ -0,0 +1,107 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestPin(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	const cidA = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	const cidB = "QmRAQB6YaCyidP37UdDnjFY5vQuiBrcqdyoW1CuDgwxkD4"
+	var mu sync.Mutex
+	var pinned []string
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the bearer token", got)
+		}
+		var cid string
+		switch r.URL.Path {
+		case "/api/v0/pin/add":
+			cid = r.URL.Query().Get("arg")
+		case "/pins":
+			var pin struct{ CID, Name string }
+			if err := json.NewDecoder(r.Body).Decode(&pin); err != nil || pin.Name != "www.example.com" {
+				t.Errorf("pin request = %+v, %v", pin, err)
+			}
+			cid = pin.CID
+		default:
+			t.Errorf("unexpected request for %s", r.URL)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if cid == cidB && fail {
+			fail = false
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		pinned = append(pinned, cid)
+	}))
+	defer srv.Close()
+
+	entry := CacheEntry{Links: map[string]dnslinkpkg.NamespaceEntries{
+		"ipfs": {{Identifier: cidA + "/docs"}, {Identifier: cidB}, {Identifier: "not-a-cid"}},
+		"ipns": {{Identifier: "example.org"}},
+	}}
+	for _, api := range []string{pinAPIKubo, pinAPIPinningService} {
+		t.Run(api, func(t *testing.T) {
+			pinned, fail = nil, true
+			p := &Pin{API: api, URL: srv.URL, Hosts: []string{".example.com"}, Token: "secret"}
+			if err := p.provision(zap.NewNop()); err != nil {
+				t.Fatal(err)
+			}
+			p.pinNew("other.example.org", entry)
+			p.pinNew("www.example.com", entry)
+			p.pinning.Wait()
+			// The identifiers already pinned are skipped, the failed one is
+			// retried.
+			p.pinNew("WWW.example.com.", entry)
+			p.pinning.Wait()
+			p.stop()
+			if len(pinned) != 2 || pinned[0] == pinned[1] {
+				t.Errorf("pinned = %v, want %s and %s once", pinned, cidA, cidB)
+			}
+		})
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`pin pinning_service https://pins.example/psa {
+		hosts .example.com example.org
+		token {env.PINNING_TOKEN}
+		timeout 1m
+	}`)
+	d.Next()
+	p, err := unmarshalPin(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.API != pinAPIPinningService || p.URL != "https://pins.example/psa" || len(p.Hosts) != 2 || p.Token != "{env.PINNING_TOKEN}" {
+		t.Errorf("Pin = %+v", p)
+	}
+
+	for _, input := range []string{
+		"pin ipfs-cluster http://cluster:9094 {\n hosts example.com\n}",
+		"pin kubo",
+		"pin kubo http://ipfs:5001 {\n timeout soon\n}",
+		"pin kubo http://ipfs:5001 {\n recursive\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalPin(d); err == nil {
+			t.Errorf("unmarshalPin(%q) succeeded", input)
+		}
+	}
+	if err := (&Pin{API: pinAPIKubo, URL: "http://ipfs:5001"}).provision(zap.NewNop()); err == nil {
+		t.Error("provision() accepted a pin without hosts")
+	}
+}
@@ -0,0 +1,141 @@
+package dnslink
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultProbeTimeout bounds a probe by default.
+const defaultProbeTimeout = 5 * time.Second
+
+// probeRetryInterval bounds how long the previous link of a host is kept
+// after a failed probe before the new one is probed again.
+const probeRetryInterval = 30 * time.Second
+
+// Probe checks that a gateway can serve the content root of a host's new
+// link before the link replaces the previous one, so a publisher updating
+// DNS before the content has propagated doesn't break their site: while
+// the gateway answers a HEAD request for the new root with an error, or
+// not at all, the previous link keeps being served and the new one is
+// probed again on the next resolution. Hosts resolved for the first time
+// are not probed, as there is nothing to fall back to.
+type Probe struct {
+	// URL is the base URL of the gateway probed, e.g. http://ipfs:8080,
+	// usually the upstream of the probed namespaces.
+	URL string `json:"url"`
+
+	// Namespaces are the namespaces whose links are probed. Default is
+	// ipfs.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Timeout bounds a probe. Default is 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	url    string
+	client *http.Client
+}
+
+// provision validates the configuration and sets the defaults.
+func (p *Probe) provision() error {
+	p.url = strings.TrimSuffix(caddy.NewReplacer().ReplaceAll(p.URL, ""), "/")
+	u, err := url.Parse(p.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url '%s'", p.URL)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = caddy.Duration(defaultProbeTimeout)
+	}
+	if len(p.Namespaces) == 0 {
+		p.Namespaces = []string{"ipfs"}
+	}
+	if p.client == nil {
+		p.client = new(http.Client)
+	}
+	return nil
+}
+
+// probes reports whether the change of a host's link from prev to entry
+// must be probed.
+func (p *Probe) probes(prev, entry CacheEntry) bool {
+	if prev.Namespace == "" || (prev.Namespace == entry.Namespace && prev.Identifier == entry.Identifier) {
+		return false
+	}
+	return slices.Contains(p.Namespaces, entry.Namespace)
+}
+
+// check asks the gateway for the content root of entry, returning why it
+// is unavailable if it is.
+func (p *Probe) check(ctx context.Context, entry CacheEntry) error {
+	escaped, err := escapeIdentifier(entry.Identifier)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+	defer cancel()
+	endpoint := p.url + "/" + entry.Namespace + "/" + strings.TrimSuffix(escaped, "/") + "/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("gateway answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// unmarshalProbe parses the probe option:
+//
+//	probe <url> {
+//	    namespaces <namespace>...
+//	    timeout <duration>
+//	}
+func unmarshalProbe(d *caddyfile.Dispenser) (*Probe, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	p := &Probe{URL: d.Val()}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "namespaces":
+			namespaces := d.RemainingArgs()
+			if len(namespaces) == 0 {
+				return nil, d.ArgErr()
+			}
+			p.Namespaces = append(p.Namespaces, namespaces...)
+		case "timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return nil, d.Errf("invalid timeout '%s'", d.Val())
+			}
+			p.Timeout = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return p, nil
+}
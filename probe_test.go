@@ -0,0 +1,120 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestProbe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var available atomic.Bool
+	var probed atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed.Add(1)
+		if r.Method != http.MethodHead || r.URL.Path != "/ipfs/QmNew/" {
+			t.Errorf("unexpected probe %s %s", r.Method, r.URL.Path)
+		}
+		if !available.Load() {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var value atomic.Value
+	value.Store("dnslink=/ipfs/QmOld")
+	a := &App{
+		CacheTTL:      caddy.Duration(time.Hour),
+		LookupTimeout: caddy.Duration(time.Second),
+		Probe:         &Probe{URL: srv.URL},
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if name == "_dnslink.example.com" {
+				return []dnslinkpkg.LookupEntry{{Value: value.Load().(string)}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	if err := a.Probe.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(want string) {
+		t.Helper()
+		entry, err := a.resolveLive(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Identifier != want {
+			t.Errorf("identifier = %s, want %s", entry.Identifier, want)
+		}
+	}
+
+	// The first resolution of a host isn't probed.
+	resolve("QmOld")
+	if n := probed.Load(); n != 0 {
+		t.Errorf("probed %d times on the first resolution", n)
+	}
+
+	value.Store("dnslink=/ipfs/QmNew")
+	resolve("QmOld")
+	cached, ok, _ := a.cache.Load(context.Background(), "example.com")
+	if !ok || cached.Identifier != "QmOld" || time.Until(cached.ExpiresAt) > probeRetryInterval {
+		t.Errorf("cached %+v, want the previous link for at most %s", cached, probeRetryInterval)
+	}
+
+	available.Store(true)
+	resolve("QmNew")
+	if n := probed.Load(); n != 2 {
+		t.Errorf("probed %d times, want 2", n)
+	}
+
+	// Links not in the probed namespaces are adopted as they are.
+	value.Store("dnslink=/ipns/example.org")
+	resolve("example.org")
+	if n := probed.Load(); n != 2 {
+		t.Errorf("probed %d times, want 2", n)
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	d := caddyfile.NewTestDispenser("probe http://ipfs:8080 {\n namespaces ipfs ipns\n timeout 2s\n}")
+	d.Next()
+	p, err := unmarshalProbe(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.URL != "http://ipfs:8080" || len(p.Namespaces) != 2 || p.Timeout != caddy.Duration(2*time.Second) {
+		t.Errorf("unmarshalProbe() = %+v", p)
+	}
+
+	for _, input := range []string{
+		"probe",
+		"probe http://a http://b",
+		"probe http://ipfs:8080 {\n namespaces\n}",
+		"probe http://ipfs:8080 {\n timeout never\n}",
+		"probe http://ipfs:8080 {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalProbe(d); err == nil {
+			t.Errorf("unmarshalProbe(%q) succeeded", input)
+		}
+	}
+
+	for _, p := range []*Probe{{URL: "ipfs:8080"}, {URL: "ftp://ipfs"}, {URL: "http://ipfs:8080", Timeout: -1}} {
+		if err := p.provision(); err == nil {
+			t.Errorf("provision(%+v) succeeded", p)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// proxyPool holds the reverse proxies of every handler by their config, so
+// those of upstreams a reload leaves unchanged are kept, along with their
+// connections and health checks, instead of being set up again each time
+// an unrelated site changes.
+var proxyPool = caddy.NewUsagePool()
+
+// proxyKeys maps the pooled reverse proxies to their key in proxyPool.
+var proxyKeys sync.Map
+
+// pooledProxy is a reverse proxy of proxyPool. It is provisioned in a
+// context of its own, which outlives the config that first loaded it and
+// is canceled once the last config using it is unloaded.
+type pooledProxy struct {
+	rp     *reverseproxy.Handler
+	cancel context.CancelFunc
+}
+
+// Destruct cleans up the reverse proxy and the modules it loaded.
+func (p *pooledProxy) Destruct() error {
+	proxyKeys.Delete(p.rp)
+	defer p.cancel()
+	return p.rp.Cleanup()
+}
+
+// proxyKey returns the key of the config of rp in proxyPool.
+func proxyKey(rp *reverseproxy.Handler) (string, error) {
+	raw, err := json.Marshal(rp)
+	return string(raw), err
+}
+
+// loadProxy returns the pooled reverse proxy of the config of rp,
+// provisioning rp if the pool has none. Proxies loaded must be released
+// with releaseProxy rather than cleaned up.
+func loadProxy(ctx caddy.Context, rp *reverseproxy.Handler) (*reverseproxy.Handler, error) {
+	key, err := proxyKey(rp)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := proxyPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		// Modules loaded in a context are cleaned up with it, so the
+		// proxy gets a context detached from that of the config. Its
+		// parent is a fresh child of the config's, whose own cleanups
+		// are not run along.
+		parent, _ := caddy.NewContext(ctx)
+		pctx, cancel := caddy.NewContext(parent)
+		base, stop := context.WithCancel(context.WithoutCancel(ctx.Context))
+		pctx.Context = base
+		if err := rp.Provision(pctx); err != nil {
+			stop()
+			cancel()
+			return nil, err
+		}
+		p := &pooledProxy{rp: rp, cancel: func() { stop(); cancel() }}
+		proxyKeys.Store(rp, key)
+		return p, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*pooledProxy).rp, nil
+}
+
+// releaseProxy releases a reverse proxy from loadProxy, cleaning it up if
+// no other handler uses it. Proxies that are not pooled are cleaned up
+// right away.
+func releaseProxy(rp *reverseproxy.Handler) error {
+	key, ok := proxyKeys.Load(rp)
+	if !ok {
+		return rp.Cleanup()
+	}
+	_, err := proxyPool.Delete(key)
+	return err
+}
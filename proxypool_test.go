@@ -0,0 +1,115 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+var (
+	testConfigOnce sync.Once
+	testConfigErr  error
+)
+
+// testContext returns a context of a running, empty Caddy config, to
+// provision handlers and their reverse proxies in. Caddy can't load
+// modules when json.RawMessage isn't defined in encoding/json, as with the
+// JSON v2 experiment, so the test is skipped then.
+func testContext(t *testing.T) caddy.Context {
+	t.Helper()
+	if typ := reflect.TypeOf(json.RawMessage(nil)); typ.PkgPath() != "encoding/json" {
+		t.Skipf("Caddy cannot load modules with json.RawMessage defined in %s; run with GOEXPERIMENT=nojsonv2", typ.PkgPath())
+	}
+	testConfigOnce.Do(func() {
+		persist := false
+		testConfigErr = caddy.Run(&caddy.Config{
+			Admin: &caddy.AdminConfig{Disabled: true, Config: &caddy.ConfigSettings{Persist: &persist}},
+		})
+	})
+	if testConfigErr != nil {
+		t.Fatalf("running Caddy: %v", testConfigErr)
+	}
+	ctx, cancel := caddy.NewContext(caddy.ActiveContext())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testMappings returns the config of a resolver serving the links of hosts
+// from mappings, e.g. "example.com": "/ipfs/QmFake".
+func testMappings(t *testing.T, mappings map[string]string) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "mappings.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return caddyconfig.JSONModuleObject(&FileResolver{Path: path}, "resolver", "file", nil)
+}
+
+// loadTestModule loads and provisions the module id from its JSON config
+// in a config of its own, as Caddy would, and returns it along with the
+// function unloading that config. The config is also unloaded at the end
+// of the test.
+func loadTestModule(t *testing.T, id string, config any) (any, func()) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(testContext(t))
+	var once sync.Once
+	unload := func() { once.Do(cancel) }
+	t.Cleanup(unload)
+
+	raw, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := ctx.LoadModuleByID(id, raw)
+	if err != nil {
+		t.Fatalf("loading %s: %v", id, err)
+	}
+	return mod, unload
+}
+
+// loadTestHandler loads d as loadTestModule does, with the links of hosts
+// served from mappings.
+func loadTestHandler(t *testing.T, d *DNSLink, mappings map[string]string) (*DNSLink, func()) {
+	t.Helper()
+	d.ResolverRaw = testMappings(t, mappings)
+	mod, unload := loadTestModule(t, "http.handlers.dnslink", d)
+	return mod.(*DNSLink), unload
+}
+
+func TestProxyKey(t *testing.T) {
+	key := func(rp *reverseproxy.Handler) string {
+		t.Helper()
+		k, err := proxyKey(rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	base := key(&reverseproxy.Handler{Upstreams: staticPool("ipfs:8080")})
+	if got := key(&reverseproxy.Handler{Upstreams: staticPool("ipfs:8080")}); got != base {
+		t.Errorf("same config keyed %s and %s", base, got)
+	}
+	for name, rp := range map[string]*reverseproxy.Handler{
+		"upstream": {Upstreams: staticPool("ipfs:8081")},
+		"headers":  {Upstreams: staticPool("ipfs:8080"), Headers: hostHeaderOps("example.com")},
+		"transport": {
+			Upstreams:    staticPool("ipfs:8080"),
+			TransportRaw: []byte(`{"protocol":"http","versions":["3"]}`),
+		},
+	} {
+		if key(rp) == base {
+			t.Errorf("%s change keeps the key %s", name, base)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+// defaultPublishTTL is the TTL of published records by default.
+const defaultPublishTTL = time.Minute
+
+// Publish sets the DNSLink TXT records of hosts in managed zones through a
+// libdns provider, from the PUT /dnslink/records/<host> admin endpoint, so
+// the instance serving a site can also publish its new roots after a
+// deployment.
+type Publish struct {
+	// ProviderRaw is the DNS provider managing Zones, a dns.providers
+	// module as used for ACME DNS challenges. It must be able to get and
+	// set records.
+	ProviderRaw json.RawMessage `json:"provider,omitempty" caddy:"namespace=dns.providers inline_key=name"`
+
+	// Zones are the zones whose records may be published, e.g.
+	// example.com. A host is published in the longest zone it is in.
+	Zones []string `json:"zones"`
+
+	// TTL is the TTL of published records. Default is 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	provider publishProvider
+}
+
+// publishProvider is what Publish needs of a DNS provider.
+type publishProvider interface {
+	libdns.RecordGetter
+	libdns.RecordSetter
+}
+
+// publishedRecord describes a published DNSLink record.
+type publishedRecord struct {
+	Host  string `json:"host"`
+	Zone  string `json:"zone"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+// provision loads the provider and validates the configuration.
+func (p *Publish) provision(ctx caddy.Context) error {
+	if len(p.Zones) == 0 {
+		return fmt.Errorf("no zones to publish in")
+	}
+	for i, zone := range p.Zones {
+		zone = mappingKey(zone)
+		if !isDomainName(zone) {
+			return fmt.Errorf("invalid zone '%s'", p.Zones[i])
+		}
+		p.Zones[i] = zone
+	}
+	if p.TTL < 0 {
+		return fmt.Errorf("negative ttl")
+	}
+	if p.TTL == 0 {
+		p.TTL = caddy.Duration(defaultPublishTTL)
+	}
+	if p.provider != nil {
+		return nil
+	}
+	if p.ProviderRaw == nil {
+		return fmt.Errorf("no provider")
+	}
+	mod, err := ctx.LoadModule(p, "ProviderRaw")
+	if err != nil {
+		return fmt.Errorf("loading provider: %v", err)
+	}
+	provider, ok := mod.(publishProvider)
+	if !ok {
+		return fmt.Errorf("provider %T cannot get and set records", mod)
+	}
+	p.provider = provider
+	return nil
+}
+
+// zone returns the longest managed zone fqdn is in.
+func (p *Publish) zone(fqdn string) (string, bool) {
+	var longest string
+	for _, zone := range p.Zones {
+		if (fqdn == zone || strings.HasSuffix(fqdn, "."+zone)) && len(zone) > len(longest) {
+			longest = zone
+		}
+	}
+	return longest, longest != ""
+}
+
+// set publishes value as the only DNSLink record at the relative name of
+// zone, updating an existing record in place and deleting the other ones
+// if the provider can. Other TXT records at the name are left alone.
+func (p *Publish) set(ctx context.Context, zone, name, value string) error {
+	absZone := zone + "."
+	existing, err := p.provider.GetRecords(ctx, absZone)
+	if err != nil {
+		return fmt.Errorf("getting records of %s: %v", zone, err)
+	}
+	record := libdns.Record{Type: "TXT", Name: name, Value: "dnslink=" + value, TTL: time.Duration(p.TTL)}
+	var stale []libdns.Record
+	for _, rec := range existing {
+		if rec.Type != "TXT" || !strings.EqualFold(libdns.RelativeName(rec.Name, absZone), name) || !strings.HasPrefix(rec.Value, "dnslink=") {
+			continue
+		}
+		if record.ID == "" && rec.ID != "" {
+			record.ID = rec.ID
+			continue
+		}
+		stale = append(stale, rec)
+	}
+	if _, err := p.provider.SetRecords(ctx, absZone, []libdns.Record{record}); err != nil {
+		return fmt.Errorf("setting record in %s: %v", zone, err)
+	}
+	if deleter, ok := p.provider.(libdns.RecordDeleter); ok && len(stale) > 0 {
+		if _, err := deleter.DeleteRecords(ctx, absZone, stale); err != nil {
+			return fmt.Errorf("deleting previous records in %s: %v", zone, err)
+		}
+	}
+	return nil
+}
+
+// publish sets the DNSLink record host is served from to value, and
+// evicts host from every active cache so the new link is picked up. The
+// record is that of the host's lookup domain, if it has one, under
+// txt_label.
+func (a *App) publish(ctx context.Context, host, value string) (publishedRecord, error) {
+	ns, id, err := parseLink(value)
+	if err == nil {
+		err = validateIdentifier(ns, id)
+	}
+	if err != nil {
+		return publishedRecord{}, &invalidValueError{err}
+	}
+	label := a.TXTLabel
+	if label == "" {
+		label = "_dnslink"
+	}
+	fqdn := label + "." + a.lookupDomain(host)
+	zone, ok := a.Publish.zone(fqdn)
+	if !ok {
+		return publishedRecord{}, errNotManaged
+	}
+	name := libdns.RelativeName(fqdn, zone)
+	if err := a.Publish.set(ctx, zone, name, value); err != nil {
+		return publishedRecord{}, err
+	}
+	a.logger.Info("published DNSLink record", zap.String("host", host), zap.String("record", fqdn), zap.String("value", value))
+	for _, app := range activeApps() {
+		if err := app.evict(ctx, host); err != nil {
+			a.logger.Warn("evicting published host", zap.String("host", host), zap.Error(err))
+		}
+	}
+	return publishedRecord{
+		Host:  mappingKey(host),
+		Zone:  zone,
+		Name:  name,
+		Value: "dnslink=" + value,
+		TTL:   time.Duration(a.Publish.TTL).String(),
+	}, nil
+}
+
+// errNotManaged is returned when publishing a host outside the managed
+// zones.
+var errNotManaged = errors.New("not in a managed zone")
+
+// invalidValueError reports a DNSLink value that can't be published.
+type invalidValueError struct {
+	err error
+}
+
+func (e *invalidValueError) Error() string { return e.err.Error() }
+
+func (e *invalidValueError) Unwrap() error { return e.err }
+
+// unmarshalPublish parses the publish option:
+//
+//	publish {
+//	    dns <provider> [<args...>]
+//	    zones <zone>...
+//	    ttl <duration>
+//	}
+func unmarshalPublish(d *caddyfile.Dispenser) (*Publish, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	p := new(Publish)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "dns":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "dns.providers."+name)
+			if err != nil {
+				return nil, err
+			}
+			p.ProviderRaw = caddyconfig.JSONModuleObject(unm, "name", name, nil)
+		case "zones":
+			zones := d.RemainingArgs()
+			if len(zones) == 0 {
+				return nil, d.ArgErr()
+			}
+			p.Zones = append(p.Zones, zones...)
+		case "ttl":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return nil, d.Errf("invalid ttl '%s'", d.Val())
+			}
+			p.TTL = caddy.Duration(dur)
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	if p.ProviderRaw == nil {
+		return nil, d.Err("publish needs a dns provider")
+	}
+	return p, nil
+}
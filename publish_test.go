@@ -0,0 +1,163 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+// memZones is a libdns provider keeping records in memory.
+type memZones struct {
+	mu      sync.Mutex
+	records map[string][]libdns.Record
+	nextID  int
+}
+
+func (m *memZones) GetRecords(_ context.Context, zone string) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]libdns.Record(nil), m.records[zone]...), nil
+}
+
+func (m *memZones) SetRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range recs {
+		i := -1
+		for j, existing := range m.records[zone] {
+			if rec.ID != "" && existing.ID == rec.ID {
+				i = j
+			}
+		}
+		if i < 0 {
+			m.nextID++
+			rec.ID = strconv.Itoa(m.nextID)
+			m.records[zone] = append(m.records[zone], rec)
+		} else {
+			m.records[zone][i] = rec
+		}
+	}
+	return recs, nil
+}
+
+func (m *memZones) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range recs {
+		kept := m.records[zone][:0]
+		for _, existing := range m.records[zone] {
+			if existing.ID != rec.ID {
+				kept = append(kept, existing)
+			}
+		}
+		m.records[zone] = kept
+	}
+	return recs, nil
+}
+
+func TestAdminRecords(t *testing.T) {
+	zones := &memZones{records: map[string][]libdns.Record{
+		"example.com.": {
+			{ID: "a", Type: "TXT", Name: "_dnslink.www", Value: "dnslink=/ipfs/QmOld"},
+			{ID: "b", Type: "TXT", Name: "_dnslink.www", Value: "dnslink=/ipns/example.org"},
+			{ID: "c", Type: "TXT", Name: "_dnslink.www", Value: "google-site-verification=abc"},
+		},
+	}}
+	a := &App{
+		Publish: &Publish{Zones: []string{"Example.com", "sub.example.com"}, provider: zones},
+		cache:   new(MemoryCache),
+		logger:  zap.NewNop(),
+	}
+	if err := a.Publish.provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	registerApp(a)
+	defer unregisterApp(a)
+	_ = a.cache.Store(context.Background(), "www.example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmOld", ExpiresAt: time.Now().Add(time.Hour)})
+
+	const cid = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	put := func(host, body string) (publishedRecord, error) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		err := adminAPI{}.handleRecords(rec, httptest.NewRequest(http.MethodPut, "/dnslink/records/"+host, strings.NewReader(body)))
+		var record publishedRecord
+		if err == nil {
+			if err := json.NewDecoder(rec.Body).Decode(&record); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+		}
+		return record, err
+	}
+
+	record, err := put("WWW.example.com", `{"value": "/ipfs/`+cid+`"}`)
+	if err != nil {
+		t.Fatalf("PUT error = %v", err)
+	}
+	want := publishedRecord{Host: "www.example.com", Zone: "example.com", Name: "_dnslink.www", Value: "dnslink=/ipfs/" + cid, TTL: "1m0s"}
+	if record != want {
+		t.Errorf("published %+v, want %+v", record, want)
+	}
+	got, _ := zones.GetRecords(context.Background(), "example.com.")
+	if len(got) != 2 || got[0].ID != "a" || got[0].Value != want.Value || got[0].TTL != time.Minute || got[1].ID != "c" {
+		t.Errorf("records = %+v, want the DNSLink record updated in place and the other one deleted", got)
+	}
+	if _, ok, _ := a.cache.Load(context.Background(), "www.example.com"); ok {
+		t.Error("published host is still cached")
+	}
+
+	// Hosts are published in their longest managed zone.
+	if record, err := put("app.sub.example.com", `{"value": "/ipfs/`+cid+`"}`); err != nil || record.Zone != "sub.example.com" || record.Name != "_dnslink.app" {
+		t.Errorf("published %+v, %v in the parent zone", record, err)
+	}
+
+	for _, tt := range []struct {
+		host, body string
+		wantStatus int
+	}{
+		{"www.example.org", `{"value": "/ipfs/` + cid + `"}`, http.StatusNotFound},
+		{"www.example.com", `{"value": "/ipfs/not-a-cid"}`, http.StatusBadRequest},
+		{"www.example.com", `{"value": "ipfs"}`, http.StatusBadRequest},
+		{"www.example.com", `not json`, http.StatusBadRequest},
+		{"", `{"value": "/ipfs/` + cid + `"}`, http.StatusBadRequest},
+	} {
+		var apiErr caddy.APIError
+		if _, err := put(tt.host, tt.body); !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+			t.Errorf("PUT %s %s error = %v, want status %d", tt.host, tt.body, err, tt.wantStatus)
+		}
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	for _, input := range []string{
+		"publish",
+		"publish {\n zones example.com\n}",
+		"publish {\n dns\n zones example.com\n}",
+		"publish {\n dns unknown-provider\n}",
+		"publish {\n ttl soon\n}",
+		"publish {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalPublish(d); err == nil {
+			t.Errorf("unmarshalPublish(%q) succeeded", input)
+		}
+	}
+
+	for _, p := range []*Publish{{provider: new(memZones)}, {Zones: []string{"not a zone"}, provider: new(memZones)}, {Zones: []string{"example.com"}}} {
+		if err := p.provision(caddy.Context{}); err == nil {
+			t.Errorf("provision(%+v) succeeded", p)
+		}
+	}
+}
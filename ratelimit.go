@@ -0,0 +1,177 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// errRateLimited is returned for resolutions rejected by the rate limit.
+var errRateLimited = errors.New("resolution rate limit exceeded")
+
+// defaultRateLimitWindow is the default RateLimit window.
+const defaultRateLimitWindow = time.Minute
+
+// RateLimit bounds how often uncached resolutions may be triggered, so the
+// resolvers cannot be used for DNS amplification through Host header spam.
+// Over-limit requests are served the host's last resolution, even if it
+// has expired from the cache, or rejected if there is none.
+type RateLimit struct {
+	// PerClient is the number of uncached resolutions a client IP may
+	// trigger per window. 0 means unlimited.
+	PerClient int `json:"per_client,omitempty"`
+
+	// PerHost is the number of uncached resolutions of a single host per
+	// window. 0 means unlimited.
+	PerHost int `json:"per_host,omitempty"`
+
+	// Window is the period the limits apply to. Default is 1m.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	clients *windowCounter
+	hosts   *windowCounter
+}
+
+// provision sets the defaults and creates the counters.
+func (l *RateLimit) provision() {
+	if l.Window == 0 {
+		l.Window = caddy.Duration(defaultRateLimitWindow)
+	}
+	l.clients = &windowCounter{limit: l.PerClient, window: time.Duration(l.Window)}
+	l.hosts = &windowCounter{limit: l.PerHost, window: time.Duration(l.Window)}
+}
+
+// allow records an uncached resolution of host for client, which may be
+// empty if unknown, and reports whether it is within the limits. Both
+// limits are checked before either is counted, so a resolution refused by
+// one limit doesn't use up the other.
+func (l *RateLimit) allow(client, host string, now time.Time) bool {
+	key := mappingKey(host)
+	l.clients.lock(now)
+	defer l.clients.mu.Unlock()
+	l.hosts.lock(now)
+	defer l.hosts.mu.Unlock()
+	if (client != "" && l.clients.full(client)) || l.hosts.full(key) {
+		return false
+	}
+	if client != "" {
+		l.clients.count(client)
+	}
+	l.hosts.count(key)
+	return true
+}
+
+// windowCounter counts events per key in fixed windows. All counts are
+// dropped when a window ends, which keeps memory bounded by the number of
+// keys seen in one window.
+type windowCounter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// allow counts an event for key and reports whether it is within the
+// limit.
+func (c *windowCounter) allow(key string, now time.Time) bool {
+	c.lock(now)
+	defer c.mu.Unlock()
+	if c.full(key) {
+		return false
+	}
+	c.count(key)
+	return true
+}
+
+// lock locks c, starting a new window if the current one has ended at now.
+func (c *windowCounter) lock(now time.Time) {
+	c.mu.Lock()
+	if c.counts == nil || now.Sub(c.start) >= c.window {
+		c.start = now
+		c.counts = make(map[string]int)
+	}
+}
+
+// full reports whether key has reached the limit in the current window.
+// c must be locked.
+func (c *windowCounter) full(key string) bool {
+	return c.limit > 0 && c.counts[key] >= c.limit
+}
+
+// count counts an event for key, unless there is no limit to keep to. c
+// must be locked.
+func (c *windowCounter) count(key string) {
+	if c.limit > 0 {
+		c.counts[key]++
+	}
+}
+
+// clientKey is the context key of the client a resolution is made for.
+type clientKey struct{}
+
+// withClient returns ctx annotated with the IP of the client of r, as
+// determined by Caddy's trusted proxy handling.
+func withClient(ctx context.Context, r *http.Request) context.Context {
+	ip, _ := caddyhttp.GetVar(ctx, caddyhttp.ClientIPVarKey).(string)
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	return context.WithValue(ctx, clientKey{}, ip)
+}
+
+// clientFrom returns the client IP stored by withClient, or "".
+func clientFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientKey{}).(string)
+	return ip
+}
+
+// unmarshalRateLimit parses the rate_limit option:
+//
+//	rate_limit {
+//	    per_client <n>
+//	    per_host <n>
+//	    window <duration>
+//	}
+func unmarshalRateLimit(d *caddyfile.Dispenser) (*RateLimit, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	l := new(RateLimit)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		opt := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch opt {
+		case "per_client", "per_host":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "per_client" {
+				l.PerClient = n
+			} else {
+				l.PerHost = n
+			}
+		case "window":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, err
+			}
+			l.Window = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return l, nil
+}
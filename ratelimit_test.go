@@ -0,0 +1,113 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestWindowCounter(t *testing.T) {
+	c := &windowCounter{limit: 2, window: time.Minute}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := c.allow("a", now); got != want {
+			t.Errorf("allow #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !c.allow("b", now) {
+		t.Error("allow(b) = false, want keys counted separately")
+	}
+	if !c.allow("a", now.Add(time.Minute)) {
+		t.Error("allow(a) = false in the next window, want true")
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	l := &RateLimit{PerClient: 2, PerHost: 1}
+	l.provision()
+	now := time.Now()
+	tests := []struct {
+		client, host string
+		want         bool
+	}{
+		{client: "192.0.2.1", host: "a.example.com", want: true},
+		// Refused by the host limit, so the client's count is left alone.
+		{client: "192.0.2.1", host: "a.example.com", want: false},
+		{client: "192.0.2.1", host: "b.example.com", want: true},
+		// Refused by the client limit, so the host's count is left alone.
+		{client: "192.0.2.1", host: "c.example.com", want: false},
+		{client: "192.0.2.2", host: "c.example.com", want: true},
+		{client: "", host: "d.example.com", want: true},
+		{client: "", host: "d.example.com", want: false},
+	}
+	for i, tt := range tests {
+		if got := l.allow(tt.client, tt.host, now); got != tt.want {
+			t.Errorf("allow #%d (%s, %s) = %v, want %v", i+1, tt.client, tt.host, got, tt.want)
+		}
+	}
+	if !l.allow("192.0.2.1", "a.example.com", now.Add(time.Minute)) {
+		t.Error("allow() = false in the next window, want true")
+	}
+}
+
+func TestRateLimitedResolve(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var lookups int
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Second),
+		RateLimit:     &RateLimit{PerClient: 1},
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			lookups++
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmXyz789"}}, nil
+		},
+	}
+	a.RateLimit.provision()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	ctx := withClient(context.Background(), req)
+
+	if _, _, err := a.resolveEntry(ctx, "a.example.com"); err != nil {
+		t.Fatalf("first resolveEntry() error = %v", err)
+	}
+	if _, _, err := a.resolveEntry(ctx, "b.example.com"); !errors.Is(err, errRateLimited) {
+		t.Errorf("over-limit resolveEntry() error = %v, want %v", err, errRateLimited)
+	}
+
+	// An expired host is served its last resolution instead.
+	_ = a.cache.Purge(context.Background())
+	entry, _, err := a.resolveEntry(ctx, "a.example.com")
+	if err != nil || entry.Identifier != "QmXyz789" {
+		t.Errorf("stale resolveEntry() = %+v, %v, want last resolution", entry, err)
+	}
+	if lookups != 1 {
+		t.Errorf("lookups = %d, want 1", lookups)
+	}
+}
+
+func TestUnmarshalRateLimit(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`rate_limit {
+		per_client 30
+		per_host 10
+		window 10s
+	}`)
+	d.Next()
+	l, err := unmarshalRateLimit(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.PerClient != 30 || l.PerHost != 10 || l.Window != caddy.Duration(10*time.Second) {
+		t.Errorf("unmarshalRateLimit() = %+v", l)
+	}
+}
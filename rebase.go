@@ -0,0 +1,211 @@
+package dnslink
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxRebaseSize bounds the responses buffered for link rebasing. Larger
+// ones are passed through unchanged.
+const maxRebaseSize = 10 << 20
+
+// rebaseRoots returns the gateway-rooted paths at which an upstream may
+// link to the content of identifier: the canonical /<namespace>/<identifier>
+// and, if it differs, the one built with the prefix's replacement.
+func rebaseRoots(namespace, identifier, replacement string) []string {
+	roots := []string{"/" + namespace + "/" + identifier}
+	if replacement != "" {
+		root := buildPath(namespace, identifier, replacement, "")
+		if root = root[:len(root)-1]; root != roots[0] && root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// rebaseLinks rewrites the links in body that start with one of roots to
+// site-relative ones, e.g. "/ipfs/<cid>/style.css" to "/style.css". A
+// root only matches at the start of a link, after a quote, parenthesis or
+// similar delimiter, and must be followed by a slash or the end of the
+// link.
+func rebaseLinks(body []byte, roots []string) []byte {
+	for _, root := range roots {
+		body = rebaseRoot(body, []byte(root))
+	}
+	return body
+}
+
+// rebaseRoot rebases the links in body that start with root.
+func rebaseRoot(body, root []byte) []byte {
+	var out bytes.Buffer
+	changed := false
+	rest := body
+	for {
+		i := bytes.Index(rest, root)
+		if i < 0 {
+			break
+		}
+		end := i + len(root)
+		pos := len(body) - len(rest) + i
+		startsLink := pos == 0 || isLinkStart(body[pos-1])
+		out.Write(rest[:i])
+		switch {
+		case startsLink && end < len(rest) && rest[end] == '/':
+			changed = true
+		case startsLink && (end == len(rest) || isLinkEnd(rest[end])):
+			out.WriteByte('/')
+			changed = true
+		default:
+			out.Write(rest[i:end])
+		}
+		rest = rest[end:]
+	}
+	if !changed {
+		return body
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
+
+// isLinkStart reports whether c may precede a link.
+func isLinkStart(c byte) bool {
+	switch c {
+	case '"', '\'', '(', '=', ',', ' ', '\t', '\n', '\r':
+		return true
+	}
+	return false
+}
+
+// isLinkEnd reports whether c ends a link.
+func isLinkEnd(c byte) bool {
+	switch c {
+	case '"', '\'', ')', '?', '#', ',', ' ', '\t', '\n', '\r', '<', '>':
+		return true
+	}
+	return false
+}
+
+// rebaseable reports whether a response with header can have its links
+// rebased: an uncompressed HTML or CSS document.
+func rebaseable(header http.Header) bool {
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil && n > maxRebaseSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "text/css" || mediaType == "application/xhtml+xml"
+}
+
+// rebaseWriter buffers the successful HTML and CSS responses written to it
+// and rebases their links when finished. Other responses are passed
+// through as they are written.
+type rebaseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	roots []string
+
+	// status is the status of the buffered response, and buf its body,
+	// while it is being buffered.
+	status int
+	buf    *bytes.Buffer
+
+	wroteHeader bool
+}
+
+// newRebaseWriter returns w wrapped in a rebaseWriter rebasing links
+// rooted at roots.
+func newRebaseWriter(w http.ResponseWriter, roots []string) *rebaseWriter {
+	return &rebaseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		roots:                 roots,
+	}
+}
+
+func (w *rebaseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	// Informational responses are followed by the final one.
+	if status < 200 {
+		w.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	if status < 300 && rebaseable(w.Header()) {
+		w.status = status
+		w.buf = new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *rebaseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf == nil {
+		return w.ResponseWriterWrapper.Write(b)
+	}
+	if w.buf.Len()+len(b) > maxRebaseSize {
+		// Too large to rebase: send what was buffered unchanged and
+		// stream the rest.
+		if err := w.passThrough(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriterWrapper.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *rebaseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.wroteHeader && w.buf == nil {
+		return w.ResponseWriterWrapper.ReadFrom(r)
+	}
+	// Hide ReadFrom so io.Copy goes through Write.
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// FlushError flushes the response unless it is being buffered.
+func (w *rebaseWriter) FlushError() error {
+	if w.buf != nil {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriterWrapper).Flush()
+}
+
+// passThrough writes the buffered response unchanged and stops buffering.
+func (w *rebaseWriter) passThrough() error {
+	buf := w.buf
+	w.buf = nil
+	w.ResponseWriterWrapper.WriteHeader(w.status)
+	_, err := w.ResponseWriterWrapper.Write(buf.Bytes())
+	return err
+}
+
+// finish writes the buffered response, if any, with its links rebased.
+func (w *rebaseWriter) finish() error {
+	if w.buf == nil {
+		return nil
+	}
+	body := rebaseLinks(w.buf.Bytes(), w.roots)
+	w.buf = nil
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriterWrapper.WriteHeader(w.status)
+	_, err := w.ResponseWriterWrapper.Write(body)
+	return err
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*rebaseWriter)(nil)
+	_ io.ReaderFrom       = (*rebaseWriter)(nil)
+)
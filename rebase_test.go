@@ -0,0 +1,87 @@
+package dnslink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRebaseLinks(t *testing.T) {
+	roots := rebaseRoots("swarm", "abc123", "/bzz")
+	if got := strings.Join(roots, " "); got != "/swarm/abc123 /bzz/abc123" {
+		t.Fatalf("rebaseRoots() = %q", got)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "html attributes",
+			body: `<a href="/bzz/abc123/docs/">docs</a><img src='/swarm/abc123/logo.png'>`,
+			want: `<a href="/docs/">docs</a><img src='/logo.png'>`,
+		},
+		{
+			name: "css url",
+			body: `body { background: url(/bzz/abc123/bg.png) }`,
+			want: `body { background: url(/bg.png) }`,
+		},
+		{name: "root itself", body: `<a href="/bzz/abc123">home</a>`, want: `<a href="/">home</a>`},
+		{name: "root with query", body: `<a href="/bzz/abc123?x=1">`, want: `<a href="/?x=1">`},
+		{name: "srcset", body: `srcset="/bzz/abc123/a.png 1x,/bzz/abc123/b.png 2x"`, want: `srcset="/a.png 1x,/b.png 2x"`},
+		{name: "other identifier", body: `<a href="/bzz/abc1234/">`, want: `<a href="/bzz/abc1234/">`},
+		{name: "absolute url", body: `<a href="https://gw.example/bzz/abc123/">`, want: `<a href="https://gw.example/bzz/abc123/">`},
+		{name: "text", body: `see /bzz/abc123/`, want: `see /`},
+		{name: "no links", body: `<p>hello</p>`, want: `<p>hello</p>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(rebaseLinks([]byte(tt.body), roots)); got != tt.want {
+				t.Errorf("rebaseLinks() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebaseWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		status      int
+		want        string
+	}{
+		{name: "html", contentType: "text/html; charset=utf-8", status: http.StatusOK, want: `<a href="/x">`},
+		{name: "css", contentType: "text/css", status: http.StatusOK, want: `<a href="/x">`},
+		{name: "javascript", contentType: "text/javascript", status: http.StatusOK, want: `<a href="/ipfs/QmA/x">`},
+		{name: "compressed", contentType: "text/html", encoding: "gzip", status: http.StatusOK, want: `<a href="/ipfs/QmA/x">`},
+		{name: "error", contentType: "text/html", status: http.StatusNotFound, want: `<a href="/ipfs/QmA/x">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := newRebaseWriter(rec, rebaseRoots("ipfs", "QmA", ""))
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Header().Set("Content-Length", "20")
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", tt.encoding)
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(`<a href="/ipfs/QmA/x">`))
+			if err := w.finish(); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if tt.want == `<a href="/x">` && rec.Header().Get("Content-Length") != "13" {
+				t.Errorf("Content-Length = %q, want 13", rec.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package dnslink
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Bounds of the redirects files.
+const (
+	defaultRedirectsEntries = 1024
+	maxRedirectsFileSize    = 64 << 10
+)
+
+// redirectsPath is the path of the redirects file in a content root.
+const redirectsPath = "/_redirects"
+
+// Redirects applies the _redirects file of the content root to requests
+// for paths that don't exist, as IPFS gateways do: once the upstream
+// answers 404, the rules of the file are matched against the request path
+// and the first match redirects the client, rewrites the request to another
+// path of the root, or serves a custom 404, 410 or 451 page. This is how
+// single-page apps and custom error pages work on a DNSLink host. The
+// rules of immutable links are kept in memory, least recently used first
+// out; those of mutable links are fetched again on every miss.
+type Redirects struct {
+	// MaxEntries bounds the redirects files kept in memory. Default is
+	// 1024.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	logger  *zap.Logger
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// redirectsEntry holds the rules of a content root in the LRU.
+type redirectsEntry struct {
+	key   string
+	rules []redirectRule
+}
+
+// redirectRule is a rule of a redirects file.
+type redirectRule struct {
+	// from holds the segments matched, where ":name" matches any segment
+	// and a final "*" any number of them.
+	from   []string
+	to     string
+	status int
+}
+
+// provision validates the configuration and sets the defaults.
+func (rd *Redirects) provision(logger *zap.Logger) error {
+	if rd.MaxEntries < 0 {
+		return fmt.Errorf("negative max_entries %d", rd.MaxEntries)
+	}
+	if rd.MaxEntries == 0 {
+		rd.MaxEntries = defaultRedirectsEntries
+	}
+	rd.logger = logger
+	rd.lru = list.New()
+	rd.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// serve proxies r with proxy, applying the rules of the redirects file of
+// the content root key if the upstream answers 404. requestPath is the
+// escaped path r asked for, and setPath points a request at an escaped path
+// of the content root.
+func (rd *Redirects) serve(w http.ResponseWriter, r *http.Request, key, requestPath string, immutable bool, setPath func(*http.Request, string) error, proxy func(http.ResponseWriter, *http.Request) error) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return proxy(w, r)
+	}
+	header := w.Header().Clone()
+	var buf bytes.Buffer
+	rec := caddyhttp.NewResponseRecorder(w, &buf, func(status int, _ http.Header) bool {
+		return status == http.StatusNotFound
+	})
+	if err := proxy(rec, r); err != nil || !rec.Buffered() {
+		return err
+	}
+
+	p, err := url.PathUnescape(requestPath)
+	if err != nil {
+		p = requestPath
+	}
+	rule, to, ok := matchRedirects(rd.rules(r, key, immutable, setPath, proxy), p)
+	if !ok {
+		return rec.WriteResponse()
+	}
+	rd.logger.Debug("applying redirects file rule", zap.String("key", key), zap.String("path", p), zap.String("to", to), zap.Int("status", rule.status))
+
+	// Drop the headers of the discarded response.
+	clear(w.Header())
+	maps.Copy(w.Header(), header)
+	switch rule.status {
+	case http.StatusOK, http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons:
+		page := r.Clone(r.Context())
+		to, _, _ = strings.Cut(to, "?")
+		if err := setPath(page, escapePath(to)); err != nil {
+			return err
+		}
+		if rule.status == http.StatusOK {
+			return proxy(w, page)
+		}
+		return proxy(&statusWriter{ResponseWriter: w, status: rule.status}, page)
+	default:
+		http.Redirect(w, r, to, rule.status)
+		return nil
+	}
+}
+
+// rules returns the rules of the redirects file of the content root key,
+// or nil if it has none or it can't be fetched or parsed.
+func (rd *Redirects) rules(r *http.Request, key string, immutable bool, setPath func(*http.Request, string) error, proxy func(http.ResponseWriter, *http.Request) error) []redirectRule {
+	if immutable {
+		if rules, ok := rd.load(key); ok {
+			return rules
+		}
+	}
+	fetch := r.Clone(r.Context())
+	fetch.Method, fetch.Body, fetch.ContentLength = http.MethodGet, http.NoBody, 0
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		fetch.Header.Del(name)
+	}
+	if err := setPath(fetch, redirectsPath); err != nil {
+		return nil
+	}
+	rec := &limitedRecorder{header: make(http.Header), limit: maxRedirectsFileSize}
+	err := proxy(rec, fetch)
+
+	var rules []redirectRule
+	switch {
+	case rec.overflow:
+		rd.logger.Warn("ignoring redirects file", zap.String("key", key), zap.String("reason", fmt.Sprintf("larger than %d bytes", maxRedirectsFileSize)))
+	case err != nil:
+		rd.logger.Debug("fetching redirects file failed", zap.String("key", key), zap.Error(err))
+		return nil
+	case rec.status == http.StatusNotFound:
+	case rec.status != http.StatusOK:
+		rd.logger.Debug("fetching redirects file failed", zap.String("key", key), zap.Int("status", rec.status))
+		return nil
+	default:
+		if rules, err = parseRedirects(rec.body.String()); err != nil {
+			rd.logger.Warn("ignoring redirects file", zap.String("key", key), zap.Error(err))
+		}
+	}
+	if immutable {
+		rd.store(key, rules)
+	}
+	return rules
+}
+
+// load returns the cached rules of key.
+func (rd *Redirects) load(key string) ([]redirectRule, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	e, ok := rd.entries[key]
+	if !ok {
+		return nil, false
+	}
+	rd.lru.MoveToFront(e)
+	return e.Value.(*redirectsEntry).rules, true
+}
+
+// store caches the rules of key, evicting the least recently used entries
+// beyond MaxEntries.
+func (rd *Redirects) store(key string, rules []redirectRule) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if e, ok := rd.entries[key]; ok {
+		e.Value.(*redirectsEntry).rules = rules
+		rd.lru.MoveToFront(e)
+		return
+	}
+	rd.entries[key] = rd.lru.PushFront(&redirectsEntry{key: key, rules: rules})
+	for rd.lru.Len() > rd.MaxEntries {
+		e := rd.lru.Back()
+		rd.lru.Remove(e)
+		delete(rd.entries, e.Value.(*redirectsEntry).key)
+	}
+}
+
+// parseRedirects parses a redirects file. A file with an invalid rule is
+// rejected as a whole.
+func parseRedirects(file string) ([]redirectRule, error) {
+	var rules []redirectRule
+	for i, line := range strings.Split(file, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: want a path, a target and an optional status", i+1)
+		}
+		rule := redirectRule{from: pathSegments(fields[0]), to: fields[1], status: http.StatusMovedPermanently}
+		if !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("line %d: '%s' is not a path", i+1, fields[0])
+		}
+		if star := slices.IndexFunc(rule.from, func(s string) bool { return strings.Contains(s, "*") }); star >= 0 && (star != len(rule.from)-1 || rule.from[star] != "*") {
+			return nil, fmt.Errorf("line %d: '*' must be the last segment", i+1)
+		}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid status '%s'", i+1, fields[2])
+			}
+			rule.status = status
+		}
+		switch rule.status {
+		case http.StatusOK, http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons:
+			if !strings.HasPrefix(rule.to, "/") {
+				return nil, fmt.Errorf("line %d: status %d needs a path of the content root, not '%s'", i+1, rule.status, rule.to)
+			}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("line %d: unsupported status %d", i+1, rule.status)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// pathSegments splits p into its non-empty segments.
+func pathSegments(p string) []string {
+	return strings.FieldsFunc(p, func(c rune) bool { return c == '/' })
+}
+
+// matchRedirects returns the first rule matching p and its target with
+// the placeholders of the rule filled in.
+func matchRedirects(rules []redirectRule, p string) (redirectRule, string, bool) {
+	segments := pathSegments(p)
+	for _, rule := range rules {
+		if params, ok := rule.match(segments); ok {
+			// Longer names first, so :id doesn't replace part of :identifier.
+			names := make([]string, 0, len(params))
+			for name := range params {
+				names = append(names, name)
+			}
+			slices.SortFunc(names, func(a, b string) int { return len(b) - len(a) })
+			to := rule.to
+			for _, name := range names {
+				to = strings.ReplaceAll(to, ":"+name, params[name])
+			}
+			return rule, to, true
+		}
+	}
+	return redirectRule{}, "", false
+}
+
+// match reports whether segments match the rule, and the values of its
+// placeholders if so. The segments matched by a splat are its "splat".
+func (rule redirectRule) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, s := range rule.from {
+		if s == "*" {
+			params["splat"] = strings.Join(segments[min(i, len(segments)):], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(s, ":"); ok && name != "" {
+			params[name] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(rule.from)
+}
+
+// statusWriter replaces the success status of a response, for custom
+// error pages.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if !w.wrote && status >= 200 {
+		w.wrote = true
+		if status == http.StatusOK {
+			status = w.status
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for flushing and hijacking.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// unmarshalRedirects parses the redirects_file subdirective:
+//
+//	redirects_file {
+//	    max_entries <n>
+//	}
+func unmarshalRedirects(d *caddyfile.Dispenser) (*Redirects, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	rd := new(Redirects)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "max_entries":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			rd.MaxEntries = n
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return rd, nil
+}
+
+// Interface guards
+var _ http.ResponseWriter = (*statusWriter)(nil)
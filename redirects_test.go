@@ -0,0 +1,172 @@
+package dnslink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestParseRedirects(t *testing.T) {
+	rules, err := parseRedirects(`# comment
+/old /new
+/blog/:year/:slug /posts/:year/:slug.html 302
+
+/app/*   /app/index.html 200
+/* /404.html 404
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 || rules[0].status != http.StatusMovedPermanently || rules[1].status != http.StatusFound || rules[3].status != http.StatusNotFound {
+		t.Errorf("parseRedirects() = %+v", rules)
+	}
+
+	for _, file := range []string{
+		"/only-a-path",
+		"/a /b 301 extra",
+		"old /new",
+		"/a/*/b /c",
+		"/a* /c",
+		"/a /b moved",
+		"/a /b 500",
+		"/a https://example.com/ 200",
+	} {
+		if _, err := parseRedirects(file); err == nil {
+			t.Errorf("parseRedirects(%q) succeeded", file)
+		}
+	}
+}
+
+func TestMatchRedirects(t *testing.T) {
+	rules, err := parseRedirects(`/blog/:year/:slug /posts/:year/:slug.html
+/docs/* https://docs.example.com/:splat 308
+/id/:id/:identifier /item?id=:id&name=:identifier 302
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, to string
+		ok       bool
+	}{
+		{"/blog/2024/hello", "/posts/2024/hello.html", true},
+		{"/blog/2024/hello/", "/posts/2024/hello.html", true},
+		{"/blog/2024", "", false},
+		{"/blog/2024/hello/more", "", false},
+		{"/docs/a/b", "https://docs.example.com/a/b", true},
+		{"/docs", "https://docs.example.com/", true},
+		{"/id/1/one", "/item?id=1&name=one", true},
+		{"/other", "", false},
+	}
+	for _, tt := range tests {
+		_, to, ok := matchRedirects(rules, tt.path)
+		if ok != tt.ok || to != tt.to {
+			t.Errorf("matchRedirects(%s) = %q, %v, want %q, %v", tt.path, to, ok, tt.to, tt.ok)
+		}
+	}
+}
+
+func TestRedirectsServe(t *testing.T) {
+	files := map[string]string{
+		"/index.html":     "home",
+		"/app/index.html": "app",
+		"/404.html":       "not found page",
+		redirectsPath:     "/old /new 301\n/app/* /app/index.html 200\n/* /404.html 404\n",
+	}
+	var redirectsFetches int
+	setPath := func(r *http.Request, p string) error {
+		r.URL.Path, r.URL.RawPath = "/ipfs/bafyroot"+p, ""
+		return nil
+	}
+	proxy := func(w http.ResponseWriter, r *http.Request) error {
+		p := strings.TrimPrefix(r.URL.Path, "/ipfs/bafyroot")
+		if p == redirectsPath {
+			redirectsFetches++
+		}
+		body, ok := files[p]
+		if !ok {
+			w.Header().Set("X-Upstream-404", "1")
+			w.WriteHeader(http.StatusNotFound)
+			_, err := w.Write([]byte("upstream 404"))
+			return err
+		}
+		_, err := w.Write([]byte(body))
+		return err
+	}
+
+	rd := new(Redirects)
+	if err := rd.provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, method string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{path: "/index.html", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "home"},
+		{path: "/old", method: http.MethodGet, wantStatus: http.StatusMovedPermanently, wantLocation: "/new"},
+		{path: "/app/settings/profile", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "app"},
+		{path: "/missing", method: http.MethodGet, wantStatus: http.StatusNotFound, wantBody: "not found page"},
+		{path: "/missing", method: http.MethodPost, wantStatus: http.StatusNotFound, wantBody: "upstream 404"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+		_ = setPath(r, tt.path)
+		if err := rd.serve(w, r, "/ipfs/bafyroot", tt.path, true, setPath, proxy); err != nil {
+			t.Fatalf("serve(%s %s) error = %v", tt.method, tt.path, err)
+		}
+		if w.Code != tt.wantStatus || (tt.wantBody != "" && w.Body.String() != tt.wantBody) {
+			t.Errorf("serve(%s %s) = %d %q, want %d %q", tt.method, tt.path, w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+		}
+		if loc := w.Header().Get("Location"); loc != tt.wantLocation {
+			t.Errorf("serve(%s %s) Location = %q, want %q", tt.method, tt.path, loc, tt.wantLocation)
+		}
+		if tt.method == http.MethodGet && w.Header().Get("X-Upstream-404") != "" {
+			t.Errorf("serve(%s %s) kept the headers of the upstream 404", tt.method, tt.path)
+		}
+	}
+	if redirectsFetches != 1 {
+		t.Errorf("fetched the redirects file %d times, want once for an immutable root", redirectsFetches)
+	}
+
+	// Roots without a redirects file keep their 404.
+	delete(files, redirectsPath)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/missing", nil)
+	if err := rd.serve(w, r, "/ipns/example.com", "/missing", false, setPath, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || w.Body.String() != "upstream 404" {
+		t.Errorf("serve() without a redirects file = %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUnmarshalRedirects(t *testing.T) {
+	d := caddyfile.NewTestDispenser("redirects_file {\n max_entries 10\n}")
+	d.Next()
+	rd, err := unmarshalRedirects(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.MaxEntries != 10 {
+		t.Errorf("MaxEntries = %d, want 10", rd.MaxEntries)
+	}
+
+	for _, input := range []string{
+		"redirects_file extra",
+		"redirects_file {\n max_entries 0\n}",
+		"redirects_file {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, err := unmarshalRedirects(d); err == nil {
+			t.Errorf("unmarshalRedirects(%q) succeeded", input)
+		}
+	}
+}
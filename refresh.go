@@ -0,0 +1,238 @@
+package dnslink
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultRefreshHeader is the default Refresh header.
+const defaultRefreshHeader = "X-Dnslink-Refresh"
+
+// Refresh lets authorized requests bypass the cache, so publishers can
+// check an update right after changing their DNS records. A refreshed
+// request is resolved live and its result replaces the cached entry.
+type Refresh struct {
+	// Header is the request header asking for a refresh. Default is
+	// X-Dnslink-Refresh.
+	Header string `json:"header,omitempty"`
+
+	// Query, if set, is a query parameter that also asks for a refresh.
+	// It is removed from the request before it is proxied.
+	Query string `json:"query,omitempty"`
+
+	// Secret, if set, must be the value of the header or query parameter.
+	// It may be a global placeholder such as {env.DNSLINK_REFRESH_SECRET}.
+	Secret string `json:"secret,omitempty"`
+
+	// TrustedIPs, if set, lists the IP ranges (CIDR or single addresses,
+	// or "private_ranges") of the clients allowed to refresh. At least one
+	// of Secret and TrustedIPs is required.
+	TrustedIPs []string `json:"trusted_ips,omitempty"`
+
+	auth requestAuth
+}
+
+// provision validates the configuration and sets the defaults.
+func (f *Refresh) provision() error {
+	if f.Header == "" {
+		f.Header = defaultRefreshHeader
+	}
+	auth, err := newRequestAuth(f.Secret, f.TrustedIPs)
+	if err != nil {
+		return err
+	}
+	f.auth = auth
+	return nil
+}
+
+// requested reports whether r asks for a refresh and is allowed to. The
+// refresh header and query parameter are removed from r either way, so
+// they never reach the upstream.
+func (f *Refresh) requested(r *http.Request) bool {
+	value := r.Header.Get(f.Header)
+	r.Header.Del(f.Header)
+	if f.Query != "" {
+		if v, ok := removeQueryParam(r, f.Query); ok && value == "" {
+			value = v
+		}
+	}
+	return f.auth.allowed(r, value)
+}
+
+// requestAuth authorizes debugging and maintenance requests by a shared
+// secret, the client's IP, or both.
+type requestAuth struct {
+	secret  string
+	trusted []netip.Prefix
+}
+
+// newRequestAuth returns the requestAuth of secret, which may contain
+// global placeholders, and the IP ranges trustedIPs. At least one of them
+// is required, and a secret must not be empty once its placeholders are
+// replaced, as with an unset environment variable, which would otherwise
+// leave the requests unauthenticated.
+func newRequestAuth(secret string, trustedIPs []string) (requestAuth, error) {
+	raw := secret
+	secret = caddy.NewReplacer().ReplaceAll(secret, "")
+	if raw != "" && secret == "" {
+		return requestAuth{}, fmt.Errorf("secret '%s' is empty", raw)
+	}
+	if secret == "" && len(trustedIPs) == 0 {
+		return requestAuth{}, fmt.Errorf("no secret or trusted IPs")
+	}
+	trusted, err := parseTrustedProxies(trustedIPs)
+	if err != nil {
+		return requestAuth{}, fmt.Errorf("trusted IPs: %v", err)
+	}
+	return requestAuth{secret: secret, trusted: trusted}, nil
+}
+
+// allowed reports whether r, whose flag header or parameter has value,
+// is authorized: value must be the secret, if any, and the client must
+// be trusted, if trusted IPs are configured.
+func (a requestAuth) allowed(r *http.Request, value string) bool {
+	if value == "" {
+		return false
+	}
+	if a.secret != "" && subtle.ConstantTimeCompare([]byte(value), []byte(a.secret)) != 1 {
+		return false
+	}
+	if len(a.trusted) > 0 {
+		ip, err := netip.ParseAddr(clientFrom(withClient(r.Context(), r)))
+		if err != nil {
+			return false
+		}
+		ip = ip.Unmap()
+		for _, prefix := range a.trusted {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// removeQueryParam removes the query parameter name from r, returning its
+// first value.
+func removeQueryParam(r *http.Request, name string) (value string, found bool) {
+	if r.URL.RawQuery == "" {
+		return "", false
+	}
+	params := strings.Split(r.URL.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if queryParamName(param) != name {
+			kept = append(kept, param)
+			continue
+		}
+		if !found {
+			_, raw, _ := strings.Cut(param, "=")
+			value, found = raw, true
+			if unescaped, err := url.QueryUnescape(raw); err == nil {
+				value = unescaped
+			}
+		}
+	}
+	if found {
+		r.URL.RawQuery = strings.Join(kept, "&")
+	}
+	return value, found
+}
+
+// refreshEntry resolves host like resolveEntry, but without consulting
+// the cache or the rate limit.
+func (a *App) refreshEntry(ctx context.Context, host string) (CacheEntry, error) {
+	host = a.lookupDomain(host)
+	if !a.hostAllowed(host) {
+		return CacheEntry{}, nil
+	}
+	if entry, ok := a.lookupStatic(host); ok {
+		return entry, nil
+	}
+	ctx, span := startSpan(ctx, "dnslink.refresh", attrHost.String(host))
+	defer span.End()
+	entry, err := a.resolveLive(ctx, host)
+	// Async requests get the refreshed entry from the cache rather than
+	// an earlier background result.
+	a.pending.Delete(host)
+	return entry, err
+}
+
+// Cache statuses of a request's resolution.
+const (
+	cacheStatusHit     = "hit"
+	cacheStatusMiss    = "miss"
+	cacheStatusRefresh = "refresh"
+)
+
+// resolveRequest resolves host for r, refreshing it if r asks for it, and
+// reports how the cache was used.
+func (d *DNSLink) resolveRequest(r *http.Request, host string) (CacheEntry, string, error) {
+	ctx := withClient(r.Context(), r)
+	if d.Refresh != nil && d.Refresh.requested(r) {
+		d.logger.Info("refreshing dnslink", zap.String("host", host), zap.String("client", clientFrom(ctx)))
+		entry, err := d.app.refreshEntry(ctx, host)
+		return entry, cacheStatusRefresh, err
+	}
+	if d.Async != nil {
+		ctx = withAsync(ctx)
+	}
+	entry, cached, err := d.app.resolveEntry(ctx, host)
+	if cached {
+		return entry, cacheStatusHit, err
+	}
+	return entry, cacheStatusMiss, err
+}
+
+// unmarshalRefresh parses the refresh subdirective:
+//
+//	refresh {
+//	    header <name>
+//	    query <name>
+//	    secret <secret>
+//	    trusted_ips <ranges>...
+//	}
+func unmarshalRefresh(d *caddyfile.Dispenser) (*Refresh, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	f := new(Refresh)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "header", "query", "secret":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			switch opt {
+			case "header":
+				f.Header = d.Val()
+			case "query":
+				f.Query = d.Val()
+			default:
+				f.Secret = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "trusted_ips":
+			ranges := d.RemainingArgs()
+			if len(ranges) == 0 {
+				return nil, d.ArgErr()
+			}
+			f.TrustedIPs = append(f.TrustedIPs, ranges...)
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return f, nil
+}
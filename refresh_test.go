@@ -0,0 +1,139 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestRefreshRequested(t *testing.T) {
+	t.Setenv("TEST_REFRESH_SECRET", "s3cret")
+
+	tests := []struct {
+		name       string
+		refresh    Refresh
+		remoteAddr string
+		header     string
+		target     string
+		want       bool
+		wantQuery  string
+	}{
+		{name: "secret header", refresh: Refresh{Secret: "{env.TEST_REFRESH_SECRET}"}, header: "s3cret", want: true},
+		{name: "wrong secret", refresh: Refresh{Secret: "s3cret"}, header: "guess"},
+		{name: "no flag", refresh: Refresh{Secret: "s3cret"}},
+		{name: "secret query", refresh: Refresh{Secret: "s3cret", Query: "refresh"}, target: "/?a=1&refresh=s3cret&b=2", want: true, wantQuery: "a=1&b=2"},
+		{name: "trusted ip", refresh: Refresh{TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "10.1.2.3:1234", header: "1", want: true},
+		{name: "untrusted ip", refresh: Refresh{TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "192.0.2.1:1234", header: "1"},
+		{name: "secret from untrusted ip", refresh: Refresh{Secret: "s3cret", TrustedIPs: []string{"10.0.0.0/8"}}, remoteAddr: "192.0.2.1:1234", header: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.refresh
+			if err := f.provision(); err != nil {
+				t.Fatal(err)
+			}
+			target := tt.target
+			if target == "" {
+				target = "/"
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			if tt.header != "" {
+				r.Header.Set(defaultRefreshHeader, tt.header)
+			}
+			if got := f.requested(r); got != tt.want {
+				t.Errorf("requested() = %v, want %v", got, tt.want)
+			}
+			if r.Header.Get(defaultRefreshHeader) != "" {
+				t.Error("refresh header was not removed")
+			}
+			if r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", r.URL.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+
+	if err := new(Refresh).provision(); err == nil {
+		t.Error("provision() without a secret or trusted IPs succeeded")
+	}
+}
+
+func TestNewRequestAuth(t *testing.T) {
+	t.Setenv("DNSLINK_TEST_SECRET", "s3cret")
+	auth, err := newRequestAuth("{env.DNSLINK_TEST_SECRET}", nil)
+	if err != nil || auth.secret != "s3cret" {
+		t.Errorf("newRequestAuth() = %+v, %v, want the secret of the environment", auth, err)
+	}
+
+	// An unset variable must not turn the secret off, not even when the
+	// client must be trusted as well.
+	const unset = "{env.DNSLINK_TEST_UNSET}"
+	for name, provision := range map[string]func() error{
+		"refresh":       (&Refresh{Secret: unset, TrustedIPs: []string{"10.0.0.0/8"}}).provision,
+		"trace":         (&Trace{Secret: unset}).provision,
+		"host_override": (&HostOverride{Secret: unset, TrustedIPs: []string{"10.0.0.0/8"}}).provision,
+	} {
+		if err := provision(); err == nil {
+			t.Errorf("%s: provision() with an empty secret succeeded", name)
+		}
+	}
+}
+
+func TestRefreshEntry(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	identifier := "QmOld"
+	var lookups int
+	d := &DNSLink{
+		Refresh: &Refresh{Secret: "s3cret"},
+		app: &App{
+			CacheTTL: caddy.Duration(time.Hour),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+				lookups++
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					"ipfs": {{Identifier: identifier}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Refresh.provision(); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(secret string) CacheEntry {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if secret != "" {
+			r.Header.Set(defaultRefreshHeader, secret)
+		}
+		entry, _, err := d.resolveRequest(r, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	resolve("")
+	identifier = "QmNew"
+	if entry := resolve(""); entry.Identifier != "QmOld" || lookups != 1 {
+		t.Errorf("cached resolution = %q after %d lookups, want QmOld after 1", entry.Identifier, lookups)
+	}
+	if entry := resolve("wrong"); entry.Identifier != "QmOld" || lookups != 1 {
+		t.Errorf("unauthorized refresh = %q after %d lookups, want the cached QmOld", entry.Identifier, lookups)
+	}
+	if entry := resolve("s3cret"); entry.Identifier != "QmNew" || lookups != 2 {
+		t.Errorf("refresh = %q after %d lookups, want QmNew after 2", entry.Identifier, lookups)
+	}
+	if entry := resolve(""); entry.Identifier != "QmNew" || lookups != 2 {
+		t.Errorf("resolution after refresh = %q after %d lookups, want the cached QmNew", entry.Identifier, lookups)
+	}
+}
@@ -0,0 +1,156 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func init() {
+	caddy.RegisterModule(new(RemoteResolver))
+}
+
+// RemoteResolver delegates resolution to an external HTTP service instead
+// of querying DNS locally. The service is called as GET <endpoint>?host=
+// and must answer like the dnslink_api handler: a JSON object with the
+// host's links, or 404 if the host has no DNSLink record. This lets edge
+// nodes delegate to a central resolver, such as a Caddy instance running
+// dnslink_api.
+type RemoteResolver struct {
+	// Endpoint is the URL of the resolution service.
+	Endpoint string `json:"endpoint"`
+
+	// Headers are added to every request, e.g. for authentication.
+	// Values may contain global placeholders such as {env.DNSLINK_TOKEN}.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	resolverTimeout
+
+	endpoint *url.URL
+	headers  http.Header
+	client   *http.Client
+}
+
+func (*RemoteResolver) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dnslink.resolvers.remote",
+		New: func() caddy.Module { return new(RemoteResolver) },
+	}
+}
+
+func (rr *RemoteResolver) Provision(caddy.Context) error {
+	return rr.provision()
+}
+
+// provision parses the endpoint and expands placeholders in it and in the
+// headers.
+func (rr *RemoteResolver) provision() error {
+	repl := caddy.NewReplacer()
+	endpoint := repl.ReplaceAll(rr.Endpoint, "")
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint '%s'", endpoint)
+	}
+	rr.endpoint = u
+
+	rr.headers = make(http.Header, len(rr.Headers))
+	for name, value := range rr.Headers {
+		rr.headers.Set(name, repl.ReplaceAll(value, ""))
+	}
+	if rr.client == nil {
+		rr.client = http.DefaultClient
+	}
+	return nil
+}
+
+// Resolve asks the remote service for the links of host. A host without
+// a DNSLink record yields an NXDOMAIN error, like a local lookup would.
+func (rr *RemoteResolver) Resolve(ctx context.Context, host string) (dnslinkpkg.Result, error) {
+	u := *rr.endpoint
+	query := u.Query()
+	query.Set("host", host)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return dnslinkpkg.Result{}, err
+	}
+	for name, values := range rr.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := rr.client.Do(req)
+	if err != nil {
+		return dnslinkpkg.Result{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return dnslinkpkg.Result{}, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, host)
+	default:
+		return dnslinkpkg.Result{}, fmt.Errorf("remote resolver: unexpected HTTP status %s", resp.Status)
+	}
+
+	var body apiResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return dnslinkpkg.Result{}, fmt.Errorf("remote resolver: decoding response: %v", err)
+	}
+	return dnslinkpkg.Result{Links: body.Links}, nil
+}
+
+// UnmarshalCaddyfile sets up the resolver from Caddyfile tokens.
+// Syntax:
+//
+//	remote <endpoint> {
+//	    header <name> <value>
+//	    timeout <duration>
+//	}
+func (rr *RemoteResolver) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		rr.Endpoint = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "header":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if rr.Headers == nil {
+					rr.Headers = make(map[string]string)
+				}
+				rr.Headers[args[0]] = args[1]
+			case "timeout":
+				if err := rr.unmarshalTimeout(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unknown subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*RemoteResolver)(nil)
+	_ caddy.Provisioner     = (*RemoteResolver)(nil)
+	_ caddyfile.Unmarshaler = (*RemoteResolver)(nil)
+	_ Resolver              = (*RemoteResolver)(nil)
+)
@@ -0,0 +1,80 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func TestRemoteResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("host") {
+		case "example.com":
+			_ = json.NewEncoder(w).Encode(apiResponse{
+				Host:  "example.com",
+				Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmRemote", Ttl: 60}}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(apiResponse{Error: "no DNSLink record found"})
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("DNSLINK_TEST_TOKEN", "secret")
+	rr := &RemoteResolver{
+		Endpoint: srv.URL + "/resolve",
+		Headers:  map[string]string{"Authorization": "Bearer {env.DNSLINK_TEST_TOKEN}"},
+	}
+	if err := rr.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rr.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if entries := result.Links["ipfs"]; len(entries) != 1 || entries[0].Identifier != "QmRemote" {
+		t.Errorf("Links[ipfs] = %+v, want QmRemote", entries)
+	}
+
+	_, err = rr.Resolve(context.Background(), "missing.example.com")
+	var rcodeErr dnslinkpkg.DNSRCodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.DNSRCode != rcodeNXDomain {
+		t.Errorf("resolve(missing) error = %v, want NXDOMAIN", err)
+	}
+
+	unauthorized := &RemoteResolver{Endpoint: srv.URL}
+	if err := unauthorized.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthorized.Resolve(context.Background(), "example.com"); err == nil {
+		t.Error("resolve() without credentials succeeded, want error")
+	}
+}
+
+func TestRemoteResolverEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "resolver.internal", "ftp://resolver.internal"} {
+		if err := (&RemoteResolver{Endpoint: endpoint}).provision(); err == nil {
+			t.Errorf("provision() with endpoint %q succeeded, want error", endpoint)
+		}
+	}
+
+	t.Setenv("DNSLINK_TEST_RESOLVER", "https://resolver.internal")
+	rr := &RemoteResolver{Endpoint: "{env.DNSLINK_TEST_RESOLVER}/resolve"}
+	if err := rr.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rr.endpoint.String(); got != "https://resolver.internal/resolve" {
+		t.Errorf("endpoint = %s, want https://resolver.internal/resolve", got)
+	}
+}
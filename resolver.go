@@ -0,0 +1,430 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"github.com/miekg/dns"
+)
+
+// txtLookup looks up the TXT records of a name. Unlike the dnslink
+// library's LookupTXTFunc it takes a context, so lookups can be bound to
+// the lifetime of a request.
+type txtLookup func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error)
+
+// exchangeFunc sends a DNS query and returns the response.
+type exchangeFunc func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+// libraryResolver adapts lookup to the dnslink library for a single
+// resolution under ctx.
+func libraryResolver(ctx context.Context, lookup txtLookup) *dnslinkpkg.Resolver {
+	return &dnslinkpkg.Resolver{
+		LookupTXT: func(name string) ([]dnslinkpkg.LookupEntry, error) {
+			return lookup(ctx, name)
+		},
+	}
+}
+
+// systemLookup looks up TXT records with the system resolver. Like the
+// library's default it cannot report record TTLs.
+func systemLookup(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		}
+		return nil, err
+	}
+	entries := make([]dnslinkpkg.LookupEntry, len(txts))
+	for i, txt := range txts {
+		entries[i] = dnslinkpkg.LookupEntry{Value: txt}
+	}
+	return entries, nil
+}
+
+// defaultRetryBackoff is the delay before the first retry of a transient
+// lookup failure.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// retryLookup retries lookup up to retries times on transient failures,
+// with exponential backoff starting at backoff.
+func retryLookup(lookup txtLookup, retries int, backoff time.Duration) txtLookup {
+	return func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		entries, err := lookup(ctx, name)
+		for attempt := 0; attempt < retries && isTransient(err); attempt++ {
+			timer := time.NewTimer(backoff << attempt)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			entries, err = lookup(ctx, name)
+		}
+		return entries, err
+	}
+}
+
+// defaultTXTLabel is the label DNSLink records are published under, as
+// queried by the dnslink library.
+const defaultTXTLabel = "_dnslink"
+
+// labelLookup queries the DNSLink records of a host under label instead
+// of _dnslink, e.g. _links.example.com for _dnslink.example.com. Other
+// names, such as _dnsaddr records, are looked up as they are, except that
+// with labelOnly the bare host the library falls back to is not looked up
+// at all and found empty.
+func labelLookup(lookup txtLookup, label string, labelOnly bool) txtLookup {
+	if (label == "" || label == defaultTXTLabel) && !labelOnly {
+		return lookup
+	}
+	if label == "" {
+		label = defaultTXTLabel
+	}
+	return func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		host, ok := strings.CutPrefix(name, defaultTXTLabel+".")
+		switch {
+		case ok:
+			name = label + "." + host
+		case labelOnly && !strings.HasPrefix(name, "_"):
+			return nil, nil
+		}
+		return lookup(ctx, name)
+	}
+}
+
+// validateTXTLabel checks that label is one or more non-empty DNS labels.
+func validateTXTLabel(label string) error {
+	for _, l := range strings.Split(label, ".") {
+		if l == "" || len(l) > 63 || strings.ContainsAny(l, " /\\") {
+			return fmt.Errorf("invalid txt_label '%s'", label)
+		}
+	}
+	return nil
+}
+
+// limitLookup allows at most n concurrent calls to lookup. Callers wait
+// for a slot until their context is done.
+func limitLookup(lookup txtLookup, n int) txtLookup {
+	sem := make(chan struct{}, n)
+	return func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lookup slot: %w", ctx.Err())
+		}
+		defer func() { <-sem }()
+		return lookup(ctx, name)
+	}
+}
+
+// recordSizeLookup drops the TXT records of lookup longer than max bytes,
+// before they are parsed.
+func recordSizeLookup(lookup txtLookup, max int) txtLookup {
+	return func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		entries, err := lookup(ctx, name)
+		kept := entries[:0]
+		for _, e := range entries {
+			if len(e.Value) <= max {
+				kept = append(kept, e)
+			}
+		}
+		return kept, err
+	}
+}
+
+// isTransient reports whether a lookup error may succeed when retried, as
+// opposed to an authoritative answer such as NXDOMAIN.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rcodeErr dnslinkpkg.DNSRCodeError
+	if errors.As(err, &rcodeErr) {
+		return rcodeErr.DNSRCode == dns.RcodeServerFailure
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// newExchange returns the transport for a resolver address. Addresses
+// starting with https:// are DNS-over-HTTPS endpoints, addresses starting
+// with tls:// are DNS-over-TLS servers, and anything else is a plain
+// nameserver (host or host:port) queried over UDP. tlsConfig is used as a
+// template for DNS-over-TLS connections and may be nil.
+func newExchange(addr string, tlsConfig *tls.Config) (exchangeFunc, error) {
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		if _, err := url.Parse(addr); err != nil {
+			return nil, fmt.Errorf("invalid DoH endpoint %s: %v", addr, err)
+		}
+		return dohExchange(addr, http.DefaultClient), nil
+	case strings.HasPrefix(addr, "tls://"):
+		server := strings.TrimPrefix(addr, "tls://")
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "853")
+		}
+		return dotExchange(server, tlsConfig), nil
+	default:
+		return udpExchange(normalizeNameserver(addr)), nil
+	}
+}
+
+// fallbackExchange tries each transport in order, moving on to the next
+// one on network errors.
+func fallbackExchange(addrs []string, exchanges []exchangeFunc) exchangeFunc {
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		var lastErr error
+		for i, exchange := range exchanges {
+			resp, err := exchange(ctx, msg)
+			if err != nil {
+				lastErr = fmt.Errorf("querying %s: %w", addrs[i], err)
+				if ctx.Err() != nil {
+					break
+				}
+				continue
+			}
+			return resp, nil
+		}
+		return nil, lastErr
+	}
+}
+
+// udpExchange queries a nameserver over UDP, retrying over TCP when the
+// response is truncated.
+func udpExchange(server string) exchangeFunc {
+	udp := &dns.Client{UDPSize: 4096}
+	tcp := &dns.Client{Net: "tcp"}
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		resp, _, err := udp.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = tcp.ExchangeContext(ctx, msg, server)
+		}
+		return resp, err
+	}
+}
+
+// dotExchange queries a DNS-over-TLS server as described in RFC 7858.
+// Unless tlsConfig sets a server name, the certificate is verified
+// against the host part of server.
+func dotExchange(server string, tlsConfig *tls.Config) exchangeFunc {
+	cfg := new(tls.Config)
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(server)
+		cfg.ServerName = host
+	}
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: cfg}
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		return resp, err
+	}
+}
+
+// dohExchange sends queries to a DNS-over-HTTPS endpoint as described in
+// RFC 8484, using POST with the wire-format message as the body.
+func dohExchange(endpoint string, client *http.Client) exchangeFunc {
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		// RFC 8484 recommends an ID of 0 for HTTP cache friendliness.
+		query := msg.Copy()
+		query.Id = 0
+		packed, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", dohMediaType)
+		req.Header.Set("Accept", dohMediaType)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+		if err != nil {
+			return nil, err
+		}
+		answer := new(dns.Msg)
+		if err := answer.Unpack(body); err != nil {
+			return nil, fmt.Errorf("decoding DoH response: %v", err)
+		}
+		answer.Id = msg.Id
+		return answer, nil
+	}
+}
+
+// dohMediaType is the content type of wire-format DNS messages over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// errUnauthenticatedAnswer is returned for answers the resolver did not
+// mark as DNSSEC-validated when authenticated data is required.
+var errUnauthenticatedAnswer = errors.New("answer not marked DNSSEC-validated by the resolver")
+
+// errRenamedRequireDNSSEC is the Caddyfile error of the former name of
+// require_authenticated_data, which promised a validation this module
+// leaves to the resolver.
+const errRenamedRequireDNSSEC = "require_dnssec was renamed to require_authenticated_data, which trusts the AD flag of validating resolvers reached over DNS-over-TLS or DNS-over-HTTPS"
+
+// checkAuthenticatedData rejects resolvers whose AD flag can't be trusted
+// for require_authenticated_data: the system resolver, which doesn't report
+// it, and nameservers queried over plain UDP, whose answers anyone on the
+// path can forge. Global placeholders in the addresses are expanded.
+func checkAuthenticatedData(resolvers []string) error {
+	if len(resolvers) == 0 {
+		return fmt.Errorf("require_authenticated_data needs explicit resolvers; the system resolver does not report DNSSEC validation")
+	}
+	repl := caddy.NewReplacer()
+	for _, addr := range resolvers {
+		addr = repl.ReplaceAll(addr, "")
+		if !strings.HasPrefix(addr, "https://") && !strings.HasPrefix(addr, "tls://") {
+			return fmt.Errorf("require_authenticated_data cannot trust the AD flag of %s, which is queried over plain UDP; use DNS-over-TLS or DNS-over-HTTPS", addr)
+		}
+	}
+	return nil
+}
+
+// exchangeLookup builds a txtLookup on top of a DNS transport. If
+// requireAD is set, records are only returned from answers carrying
+// the AD flag.
+//
+// CNAME records are followed explicitly: the TXT records of a name with a
+// CNAME are those of the end of its chain, which is queried in turn if the
+// resolver answered with the chain alone. Their TTLs are lowered to those
+// of the CNAME records, and the canonical name is recorded for the
+// resolution.
+func exchangeLookup(exchange exchangeFunc, requireAD bool) txtLookup {
+	return func(ctx context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		qname := dns.Fqdn(name)
+		seen := map[string]bool{strings.ToLower(qname): true}
+		var chainTTL uint32
+		aliased := false
+		for hops := 1; ; hops++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion(qname, dns.TypeTXT)
+			msg.SetEdns0(4096, requireAD)
+			msg.AuthenticatedData = requireAD
+
+			resp, err := exchange(ctx, msg)
+			if err != nil {
+				return nil, err
+			}
+			target, ttl, followed := cnameTarget(resp, qname)
+			if followed {
+				if !aliased || ttl < chainTTL {
+					chainTTL = ttl
+				}
+				aliased = true
+			}
+			owner := ""
+			if aliased {
+				owner = target
+			}
+			entries, err := txtEntries(resp, name, owner)
+			if err == nil && requireAD && !resp.AuthenticatedData {
+				return nil, fmt.Errorf("%s: %w", name, errUnauthenticatedAnswer)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) > 0 || !followed {
+				if aliased {
+					for i := range entries {
+						entries[i].Ttl = min(entries[i].Ttl, chainTTL)
+					}
+				}
+				if len(entries) > 0 {
+					cname := ""
+					if aliased {
+						cname = strings.TrimSuffix(target, ".")
+					}
+					recordCanonicalName(ctx, cname)
+				}
+				return entries, nil
+			}
+			// The resolver answered with the chain alone.
+			if hops == maxCNAMEHops || seen[strings.ToLower(target)] {
+				return nil, fmt.Errorf("%s: %w", name, errCNAMEChain)
+			}
+			seen[strings.ToLower(target)] = true
+			qname = target
+		}
+	}
+}
+
+// txtEntries extracts the TXT answers from a DNS response, only those of
+// owner if it is set.
+func txtEntries(resp *dns.Msg, name, owner string) ([]dnslinkpkg.LookupEntry, error) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, dnslinkpkg.NewDNSRCodeError(resp.Rcode, name)
+	}
+	var entries []dnslinkpkg.LookupEntry
+	for _, answer := range resp.Answer {
+		txt, ok := answer.(*dns.TXT)
+		if !ok || owner != "" && !strings.EqualFold(txt.Hdr.Name, owner) {
+			continue
+		}
+		entries = append(entries, dnslinkpkg.LookupEntry{
+			Value: unescapeTXT(strings.Join(txt.Txt, "")),
+			Ttl:   txt.Hdr.Ttl,
+		})
+	}
+	return entries, nil
+}
+
+// unescapeTXT decodes the presentation-format escapes (\DDD and \X) that
+// the dns package uses for TXT strings.
+func unescapeTXT(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// normalizeNameserver adds the default DNS port to a nameserver address
+// that does not specify one.
+func normalizeNameserver(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+}
@@ -0,0 +1,414 @@
+package dnslink
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"github.com/miekg/dns"
+)
+
+// startTestNameserver serves the given TXT records over UDP on localhost
+// and returns its address. Names without records get NXDOMAIN.
+func startTestNameserver(t *testing.T, records map[string][]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: testDNSHandler(records)}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func testDNSHandler(records map[string][]string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		name := req.Question[0].Name
+		txts, ok := records[name]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+		for _, txt := range txts {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{txt},
+			})
+		}
+		_ = w.WriteMsg(resp)
+	}
+}
+
+// validatingHandler wraps a handler and sets the AD flag on answers for
+// names in signed, mimicking a validating resolver.
+func validatingHandler(next dns.HandlerFunc, signed map[string]bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		rec := &recordingResponseWriter{}
+		next(rec, req)
+		opt := req.IsEdns0()
+		rec.msg.AuthenticatedData = signed[req.Question[0].Name] && opt != nil && opt.Do()
+		_ = w.WriteMsg(rec.msg)
+	}
+}
+
+func TestNameserverLookup(t *testing.T) {
+	addr := startTestNameserver(t, map[string][]string{
+		"_dnslink.example.com.": {"dnslink=/ipfs/QmXyz789", "unrelated"},
+	})
+	// The first nameserver is unreachable, so the lookup must fall back.
+	app := &App{Resolvers: []string{"127.0.0.1:1", addr}}
+	lookup, err := app.newLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := libraryResolver(context.Background(), lookup).Resolve("example.com")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	entries := result.Links["ipfs"]
+	if len(entries) != 1 || entries[0].Identifier != "QmXyz789" || entries[0].Ttl != 300 {
+		t.Errorf("Links[ipfs] = %+v, want QmXyz789 with ttl 300", entries)
+	}
+
+	_, err = lookup(context.Background(), "missing.example.com")
+	rcodeErr, ok := err.(dnslinkpkg.DNSRCodeError)
+	if !ok || rcodeErr.DNSRCode != rcodeNXDomain {
+		t.Errorf("lookup(missing) error = %v, want NXDOMAIN", err)
+	}
+}
+
+func TestTXTLabel(t *testing.T) {
+	addr := startTestNameserver(t, map[string][]string{
+		"_links.example.com.":   {"dnslink=/ipfs/QmPrivate"},
+		"_dnslink.example.com.": {"dnslink=/ipfs/QmPublic"},
+		"_links.internal.corp.": {"dnslink=/ipns/docs.internal.corp"},
+		"_dnsaddr.example.com.": {"dnsaddr=/dns/example.com/tcp/443/https"},
+	})
+	app := &App{Resolvers: []string{addr}, TXTLabel: "_links"}
+	lookup, err := app.newLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{"example.com": "ipfs", "internal.corp": "ipns"} {
+		result, err := libraryResolver(context.Background(), lookup).Resolve(host)
+		if err != nil {
+			t.Fatalf("Resolve(%s) error = %v", host, err)
+		}
+		if ns, id := selectLink(result, nil); ns != want || id == "QmPublic" {
+			t.Errorf("Resolve(%s) = /%s/%s, want the %s link under _links", host, ns, id, want)
+		}
+	}
+	if entries, err := lookup(context.Background(), "_dnsaddr.example.com"); err != nil || len(entries) != 1 {
+		t.Errorf("lookup(_dnsaddr.example.com) = %+v, %v, want it unchanged", entries, err)
+	}
+
+	for label, wantErr := range map[string]bool{"_links": false, "_links._meta": false, "": true, "a..b": true, "a/b": true} {
+		if err := validateTXTLabel(label); (err != nil) != wantErr {
+			t.Errorf("validateTXTLabel(%q) error = %v, wantErr %v", label, err, wantErr)
+		}
+	}
+}
+
+func TestTXTLabelOnly(t *testing.T) {
+	addr := startTestNameserver(t, map[string][]string{
+		"apex.example.":              {"dnslink=/ipfs/QmApex"},
+		"_dnslink.labelled.example.": {"dnslink=/ipfs/QmLabelled"},
+		"_dnsaddr.apex.example.":     {"dnsaddr=/dns/apex.example/tcp/443/https"},
+	})
+	for _, labelOnly := range []bool{false, true} {
+		app := &App{Resolvers: []string{addr}, TXTLabelOnly: labelOnly}
+		lookup, err := app.newLookup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"labelled.example": "QmLabelled", "apex.example": "QmApex"}
+		if labelOnly {
+			want["apex.example"] = ""
+		}
+		for host, wantID := range want {
+			result, err := libraryResolver(context.Background(), lookup).Resolve(host)
+			if err != nil {
+				t.Fatalf("Resolve(%s) error = %v", host, err)
+			}
+			if _, id := selectLink(result, nil); id != wantID {
+				t.Errorf("txt_label_only %v: Resolve(%s) identifier = %q, want %q", labelOnly, host, id, wantID)
+			}
+		}
+		if entries, err := lookup(context.Background(), "_dnsaddr.apex.example"); err != nil || len(entries) != 1 {
+			t.Errorf("txt_label_only %v: lookup(_dnsaddr.apex.example) = %+v, %v, want it unchanged", labelOnly, entries, err)
+		}
+	}
+}
+
+func TestDoHLookup(t *testing.T) {
+	handler := testDNSHandler(map[string][]string{
+		"_dnslink.example.com.": {"dnslink=/swarm/abc123"},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec := &recordingResponseWriter{}
+		handler.ServeDNS(rec, req)
+		packed, _ := rec.msg.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(packed)
+	}))
+	defer srv.Close()
+
+	lookup := exchangeLookup(dohExchange(srv.URL, srv.Client()), false)
+	result, err := libraryResolver(context.Background(), lookup).Resolve("example.com")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if entries := result.Links["swarm"]; len(entries) != 1 || entries[0].Identifier != "abc123" {
+		t.Errorf("Links[swarm] = %+v, want abc123", entries)
+	}
+}
+
+func TestDoTLookup(t *testing.T) {
+	// Borrow the test certificate of an httptest TLS server, which is
+	// valid for 127.0.0.1.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSrv.Close()
+	roots := certSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certSrv.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: testDNSHandler(map[string][]string{
+		"_dnslink.example.com.": {"dnslink=/ipns/example.net"},
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	exchange, err := newExchange("tls://"+ln.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := libraryResolver(context.Background(), exchangeLookup(exchange, false)).Resolve("example.com")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if entries := result.Links["ipns"]; len(entries) != 1 || entries[0].Identifier != "example.net" {
+		t.Errorf("Links[ipns] = %+v, want example.net", entries)
+	}
+
+	// Without the test root the server certificate must be rejected.
+	exchange, _ = newExchange("tls://"+ln.Addr().String(), nil)
+	if _, err := exchangeLookup(exchange, false)(context.Background(), "_dnslink.example.com"); err == nil {
+		t.Error("lookup with untrusted certificate succeeded, want error")
+	}
+}
+
+func TestRequireAuthenticatedData(t *testing.T) {
+	records := map[string][]string{
+		"_dnslink.signed.example.":   {"dnslink=/ipfs/QmSigned"},
+		"_dnslink.unsigned.example.": {"dnslink=/ipfs/QmSpoofed"},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: validatingHandler(testDNSHandler(records), map[string]bool{
+		"_dnslink.signed.example.": true,
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	app := &App{Resolvers: []string{pc.LocalAddr().String()}, RequireAuthenticatedData: true}
+	lookup, err := app.newLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := libraryResolver(context.Background(), lookup).Resolve("signed.example")
+	if err != nil {
+		t.Fatalf("Resolve(signed) error = %v", err)
+	}
+	if entries := result.Links["ipfs"]; len(entries) != 1 || entries[0].Identifier != "QmSigned" {
+		t.Errorf("Links[ipfs] = %+v, want QmSigned", entries)
+	}
+
+	if _, err := lookup(context.Background(), "_dnslink.unsigned.example"); !errors.Is(err, errUnauthenticatedAnswer) {
+		t.Errorf("lookup(unsigned) error = %v, want %v", err, errUnauthenticatedAnswer)
+	}
+
+	if _, err := (&App{RequireAuthenticatedData: true}).newLookup(); err == nil {
+		t.Error("newLookup() with system resolver succeeded, want error")
+	}
+
+	// The AD flag is only trusted from resolvers reached over TLS.
+	t.Setenv("DNSLINK_TEST_RESOLVER", "https://dns.example/dns-query")
+	for resolvers, ok := range map[string]bool{
+		"":                                  false,
+		"10.0.0.53:53":                      false,
+		"tls://9.9.9.9 10.0.0.53":           false,
+		"tls://9.9.9.9 https://dns.example": true,
+		"{env.DNSLINK_TEST_RESOLVER}":       true,
+	} {
+		a := &App{Resolvers: strings.Fields(resolvers), RequireAuthenticatedData: true}
+		if err := a.Validate(); (err == nil) != ok {
+			t.Errorf("Validate() with resolvers %q error = %v, want ok %v", resolvers, err, ok)
+		}
+		r := &DNSResolver{Resolvers: strings.Fields(resolvers), RequireAuthenticatedData: true}
+		if err := r.Validate(); (err == nil) != ok {
+			t.Errorf("DNSResolver.Validate() with resolvers %q error = %v, want ok %v", resolvers, err, ok)
+		}
+	}
+
+	// The former name of the option is rejected with a pointer to the new
+	// one, rather than silently trusting the resolver.
+	d := caddyfile.NewTestDispenser("dnslink {\n require_dnssec\n}")
+	if err := new(App).UnmarshalCaddyfile(d); err == nil || !strings.Contains(err.Error(), "require_authenticated_data") {
+		t.Errorf("UnmarshalCaddyfile(require_dnssec) error = %v, want the new name", err)
+	}
+}
+
+func TestRetryLookup(t *testing.T) {
+	servfail := dnslinkpkg.NewDNSRCodeError(dns.RcodeServerFailure, "example.com")
+	nxdomain := dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, "example.com")
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "servfail then success", errs: []error{servfail, nil}, wantCalls: 2},
+		{name: "timeout then success", errs: []error{timeout, timeout, nil}, wantCalls: 3},
+		{name: "nxdomain is not retried", errs: []error{nxdomain}, wantCalls: 1, wantErr: true},
+		{name: "gives up after retries", errs: []error{servfail, servfail, servfail, servfail}, wantCalls: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			lookup := retryLookup(func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+				err := tt.errs[calls]
+				calls++
+				return nil, err
+			}, 2, time.Millisecond)
+
+			_, err := lookup(context.Background(), "_dnslink.example.com")
+			if calls != tt.wantCalls {
+				t.Errorf("lookup called %d times, want %d", calls, tt.wantCalls)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLimitLookup(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak int
+	release := make(chan struct{})
+	lookup := limitLookup(func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil, nil
+	}, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = lookup(context.Background(), "_dnslink.example.com")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("peak concurrent lookups = %d, want 2", peak)
+	}
+
+	// A caller that cannot get a slot gives up with its context.
+	blocked := limitLookup(func(ctx context.Context, _ string) ([]dnslinkpkg.LookupEntry, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() { _, _ = blocked(ctx, "first") }()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := blocked(ctx, "second"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked lookup error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// recordingResponseWriter captures the message written by a dns.Handler.
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestUnescapeTXT(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "dnslink=/ipfs/Qm", expected: "dnslink=/ipfs/Qm"},
+		{input: `dnslink=/ipfs/Qm\;x`, expected: "dnslink=/ipfs/Qm;x"},
+		{input: `dnslink=/ipns/caf\195\169.example`, expected: "dnslink=/ipns/café.example"},
+		{input: `trailing\`, expected: `trailing\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeTXT(tt.input); got != tt.expected {
+			t.Errorf("unescapeTXT(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestNormalizeNameserver(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":        "1.1.1.1:53",
+		"10.0.0.53:5353": "10.0.0.53:5353",
+		"2606:4700::1":   "[2606:4700::1]:53",
+		"[::1]:53":       "[::1]:53",
+		"dns.internal":   "dns.internal:53",
+	}
+	for input, expected := range tests {
+		if got := normalizeNameserver(input); got != expected {
+			t.Errorf("normalizeNameserver(%q) = %q, want %q", input, got, expected)
+		}
+	}
+}
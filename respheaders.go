@@ -0,0 +1,64 @@
+package dnslink
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// overrideHeadersWriter sets response headers just before the response is
+// written, replacing any of the same name the upstream sent. headers apply
+// to every final response, successHeaders only to 2xx and 304 ones, since a
+// 304 carries the headers of the response it stands for.
+type overrideHeadersWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	headers        http.Header
+	successHeaders http.Header
+	wroteHeader    bool
+}
+
+// newOverrideHeadersWriter returns w wrapped in an overrideHeadersWriter.
+func newOverrideHeadersWriter(w http.ResponseWriter) *overrideHeadersWriter {
+	return &overrideHeadersWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		headers:               make(http.Header),
+		successHeaders:        make(http.Header),
+	}
+}
+
+func (w *overrideHeadersWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		for name, values := range w.headers {
+			w.Header()[name] = values
+		}
+		if status < 300 || status == http.StatusNotModified {
+			for name, values := range w.successHeaders {
+				w.Header()[name] = values
+			}
+		}
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (w *overrideHeadersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.Write(b)
+}
+
+func (w *overrideHeadersWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriterWrapper.ReadFrom(r)
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*overrideHeadersWriter)(nil)
+	_ io.ReaderFrom       = (*overrideHeadersWriter)(nil)
+)
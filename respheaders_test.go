@@ -0,0 +1,40 @@
+package dnslink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOverrideHeadersWriter(t *testing.T) {
+	tests := []struct {
+		status   int
+		wantPath string
+		wantETag string
+	}{
+		{status: http.StatusOK, wantPath: "/ipfs/QmXyz789/", wantETag: `"abc"`},
+		{status: http.StatusNotModified, wantPath: "/ipfs/QmXyz789/", wantETag: `"abc"`},
+		{status: http.StatusNotFound, wantPath: "/ipfs/QmXyz789/", wantETag: `"upstream"`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w := newOverrideHeadersWriter(rec)
+		w.headers.Set("X-Ipfs-Path", "/ipfs/QmXyz789/")
+		w.successHeaders.Set("ETag", `"abc"`)
+
+		// The upstream reports its own, rewritten path.
+		w.Header().Set("X-Ipfs-Path", "/bzz/other")
+		w.Header().Add("X-Ipfs-Path", "/bzz/other/")
+		w.Header().Set("ETag", `"upstream"`)
+		w.WriteHeader(tt.status)
+		w.Write([]byte("hello"))
+
+		res := rec.Result()
+		if got := res.Header.Values("X-Ipfs-Path"); len(got) != 1 || got[0] != tt.wantPath {
+			t.Errorf("status %d: X-Ipfs-Path = %q, want [%s]", tt.status, got, tt.wantPath)
+		}
+		if got := res.Header.Get("ETag"); got != tt.wantETag {
+			t.Errorf("status %d: ETag = %q, want %q", tt.status, got, tt.wantETag)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package dnslink
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// namedRouteKey is the key of the Caddyfile adapter's state under which
+// the invoke directive records the named routes it uses, so the adapter
+// adds them to the server of the site.
+const namedRouteKey = "named_route"
+
+// handles reports whether prefix has an upstream or a named route.
+func (d *DNSLink) handles(prefix string) bool {
+	if _, ok := d.proxy(prefix); ok {
+		return true
+	}
+	_, ok := d.Routes[prefix]
+	return ok
+}
+
+// invokeRoute serves r, already rewritten, with the named route name of
+// the server handling r, as the invoke handler does.
+func invokeRoute(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, name string) error {
+	server, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("invoking route '%s' outside of a server", name))
+	}
+	route, ok := server.NamedRoutes[name]
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("route '%s' not found", name))
+	}
+	return route.Compile(next).ServeHTTP(w, r)
+}
+
+// registerRoutes records the named routes of the handler for the
+// Caddyfile adapter, as the invoke directive does.
+func (d *DNSLink) registerRoutes(h httpcaddyfile.Helper) {
+	if len(d.Routes) == 0 {
+		return
+	}
+	if h.State[namedRouteKey] == nil {
+		h.State[namedRouteKey] = map[string]struct{}{}
+	}
+	for _, name := range d.Routes {
+		h.State[namedRouteKey].(map[string]struct{})[name] = struct{}{}
+	}
+}
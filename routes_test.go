@@ -0,0 +1,108 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestRoutes(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	// The route has no handlers, so it passes requests on to next.
+	server := &caddyhttp.Server{NamedRoutes: map[string]*caddyhttp.Route{"ipfs-route": {}}}
+	d := &DNSLink{
+		Routes:  map[string]string{"/ipfs": "ipfs-route", "/ipns": "missing"},
+		Aliases: map[string]string{"bzz": "/ipfs"},
+		OnMiss:  http.StatusNotFound,
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				ns := map[string]string{"a.example.com": "ipfs", "b.example.com": "bzz", "c.example.com": "ipns", "d.example.com": "swarm"}[host]
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					ns: {{Identifier: "QmFake"}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{host: "a.example.com", path: "/ipfs/QmFake/index.html", status: http.StatusTeapot},
+		{host: "b.example.com", path: "/bzz/QmFake/index.html", status: http.StatusTeapot},
+		{host: "c.example.com", status: http.StatusInternalServerError},
+		{host: "d.example.com", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			var routed string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				routed = r.URL.Path
+				w.WriteHeader(http.StatusTeapot)
+				return nil
+			})
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/index.html", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ServerCtxKey, server))
+			rec := httptest.NewRecorder()
+			err := d.ServeHTTP(rec, req, next)
+			status := rec.Code
+			if handlerErr, ok := err.(caddyhttp.HandlerError); ok {
+				status = handlerErr.StatusCode
+			}
+			if status != tt.status || routed != tt.path {
+				t.Errorf("status = %d, routed path = %q, want %d and %q", status, routed, tt.status, tt.path)
+			}
+		})
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	for _, d := range []*DNSLink{
+		{Routes: map[string]string{"/ipfs": "ipfs-route"}, Upstreams: map[string]string{"/ipfs": "ipfs:8080"}},
+		{Routes: map[string]string{"/ipfs": " "}},
+		{Routes: map[string]string{"ipfs": "ipfs-route"}},
+	} {
+		if err := d.Validate(); err == nil {
+			t.Errorf("Validate(%v) succeeded", d.Routes)
+		}
+	}
+	d := &DNSLink{Routes: map[string]string{"/swarm": "swarm-route"}, Replacements: map[string]string{"/swarm": "/bzz"}}
+	if err := d.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want a replacement of a route accepted", err)
+	}
+	if err := d.setUpstream("/swarm", "bee:1633"); err == nil {
+		t.Error("setUpstream() replaced a route")
+	}
+}
+
+func TestUnmarshalRoutes(t *testing.T) {
+	d := new(DNSLink)
+	if err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dnslink {
+		proxies {
+			/ipfs ipfs:8080
+			/ipns invoke ipns-route
+		}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	if d.Routes["/ipns"] != "ipns-route" || d.Upstreams["/ipfs"] != "ipfs:8080" || len(d.Upstreams) != 1 {
+		t.Errorf("Routes = %v, Upstreams = %v", d.Routes, d.Upstreams)
+	}
+}
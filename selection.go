@@ -0,0 +1,143 @@
+package dnslink
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Link selection strategies.
+const (
+	selectFirst      = "first"
+	selectRandom     = "random"
+	selectRoundRobin = "round_robin"
+	selectWeighted   = "weighted"
+)
+
+// LinkSelection chooses among several entries published in the same
+// namespace.
+type LinkSelection struct {
+	// Strategy is one of first, random, round_robin or weighted. Default
+	// is first, the first identifier in the deterministic order of
+	// resolution: well-formed identifiers first, then alphabetically.
+	Strategy string `json:"strategy,omitempty"`
+
+	// Weights are the relative weights of identifiers for the weighted
+	// strategy, e.g. to roll out new content gradually. Identifiers
+	// without a weight have the weight of their weight extension, with
+	// txt_extensions, or else a weight of 1.
+	Weights map[string]int `json:"weights,omitempty"`
+
+	next atomic.Uint64
+}
+
+// validate checks the strategy and weights.
+func (s *LinkSelection) validate() error {
+	switch s.Strategy {
+	case "", selectFirst, selectRandom, selectRoundRobin, selectWeighted:
+	default:
+		return fmt.Errorf("unknown selection strategy '%s'", s.Strategy)
+	}
+	for id, weight := range s.Weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight for %s", id)
+		}
+	}
+	return nil
+}
+
+// choose picks one of identifiers, which must not be empty. hints are the
+// weights published for identifiers without a configured one.
+func (s *LinkSelection) choose(identifiers []string, hints map[string]int) string {
+	switch s.Strategy {
+	case selectRandom:
+		return identifiers[rand.Intn(len(identifiers))]
+	case selectRoundRobin:
+		return identifiers[(s.next.Add(1)-1)%uint64(len(identifiers))]
+	case selectWeighted:
+		var total int
+		for _, id := range identifiers {
+			total += s.weight(id, hints)
+		}
+		if total == 0 {
+			return identifiers[0]
+		}
+		n := rand.Intn(total)
+		for _, id := range identifiers {
+			if n -= s.weight(id, hints); n < 0 {
+				return id
+			}
+		}
+	}
+	return identifiers[0]
+}
+
+func (s *LinkSelection) weight(id string, hints map[string]int) int {
+	if w, ok := s.Weights[id]; ok {
+		return w
+	}
+	if w, ok := hints[id]; ok {
+		return w
+	}
+	return 1
+}
+
+// selectIdentifier picks the identifier to proxy to for a link matching
+// prefix. Without a selection for prefix, or when the namespace has a
+// single entry, the identifier chosen during resolution is used.
+func (d *DNSLink) selectIdentifier(prefix string, entry CacheEntry) string {
+	sel, ok := d.Selection[prefix]
+	if !ok {
+		return entry.Identifier
+	}
+	entries := entry.Links[entry.Namespace]
+	if len(entries) < 2 {
+		return entry.Identifier
+	}
+	identifiers := make([]string, len(entries))
+	var hints map[string]int
+	for i, e := range entries {
+		identifiers[i] = e.Identifier
+		if w, ok := extensionInt(entry.extensions(entry.Namespace, e.Identifier), extensionWeight); ok {
+			if hints == nil {
+				hints = make(map[string]int)
+			}
+			hints[e.Identifier] = w
+		}
+	}
+	return sel.choose(identifiers, hints)
+}
+
+// unmarshalSelection parses a select subdirective of the dnslink
+// directive at the dispenser's current token.
+func unmarshalSelection(d *caddyfile.Dispenser) (string, *LinkSelection, error) {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return "", nil, d.ArgErr()
+	}
+	sel := &LinkSelection{Strategy: args[1]}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if sel.Strategy != selectWeighted {
+			return "", nil, d.Errf("weights require the weighted strategy")
+		}
+		id := d.Val()
+		if !d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+		weight, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return "", nil, d.Errf("invalid weight '%s'", d.Val())
+		}
+		if sel.Weights == nil {
+			sel.Weights = make(map[string]int)
+		}
+		sel.Weights[id] = weight
+	}
+	if err := sel.validate(); err != nil {
+		return "", nil, d.Err(err.Error())
+	}
+	return args[0], sel, nil
+}
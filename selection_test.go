@@ -0,0 +1,101 @@
+package dnslink
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func TestLinkSelection(t *testing.T) {
+	identifiers := []string{"QmA", "QmB", "QmC"}
+
+	first := &LinkSelection{}
+	if got := first.choose(identifiers, nil); got != "QmA" {
+		t.Errorf("first: choose() = %s, want QmA", got)
+	}
+
+	rr := &LinkSelection{Strategy: selectRoundRobin}
+	for i, want := range []string{"QmA", "QmB", "QmC", "QmA"} {
+		if got := rr.choose(identifiers, nil); got != want {
+			t.Errorf("round_robin: choose() #%d = %s, want %s", i, got, want)
+		}
+	}
+
+	random := &LinkSelection{Strategy: selectRandom}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[random.choose(identifiers, nil)] = true
+	}
+	if len(seen) != len(identifiers) {
+		t.Errorf("random: chose %v, want all identifiers", seen)
+	}
+
+	weighted := &LinkSelection{Strategy: selectWeighted, Weights: map[string]int{"QmA": 0, "QmB": 3}}
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[weighted.choose(identifiers, nil)]++
+	}
+	if counts["QmA"] != 0 {
+		t.Errorf("weighted: chose zero-weight identifier %d times", counts["QmA"])
+	}
+	if ratio := float64(counts["QmB"]) / float64(counts["QmC"]); ratio < 2 || ratio > 4 {
+		t.Errorf("weighted: QmB/QmC ratio = %.2f, want about 3", ratio)
+	}
+}
+
+func TestSelectIdentifier(t *testing.T) {
+	d := &DNSLink{Selection: map[string]*LinkSelection{"/ipfs": {Strategy: selectRoundRobin}}}
+	entry := CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmA",
+		Links:      map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmA"}, {Identifier: "QmB"}}},
+	}
+	if got := d.selectIdentifier("/ipfs", entry); got != "QmA" {
+		t.Errorf("selectIdentifier() #1 = %s, want QmA", got)
+	}
+	if got := d.selectIdentifier("/ipfs", entry); got != "QmB" {
+		t.Errorf("selectIdentifier() #2 = %s, want QmB", got)
+	}
+	if got := d.selectIdentifier("/swarm", entry); got != "QmA" {
+		t.Errorf("selectIdentifier() without selection = %s, want QmA", got)
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	input := `dnslink {
+		proxies {
+			/ipfs ipfs:8080
+		}
+		select /ipfs weighted {
+			QmNew 10
+			QmOld 90
+		}
+	}`
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parseCaddyfile() error = %v", err)
+	}
+	sel := handler.(*DNSLink).Selection["/ipfs"]
+	if sel == nil || sel.Strategy != selectWeighted || sel.Weights["QmNew"] != 10 || sel.Weights["QmOld"] != 90 {
+		t.Errorf("Selection[/ipfs] = %+v, want weighted QmNew=10 QmOld=90", sel)
+	}
+
+	for _, bad := range []string{
+		`dnslink {
+			select /ipfs fastest
+		}`,
+		`dnslink {
+			select /ipfs random {
+				QmA 1
+			}
+		}`,
+	} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(bad)}
+		if _, err := parseCaddyfile(h); err == nil {
+			t.Errorf("parseCaddyfile(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package dnslink
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// resolutionTiming returns the Server-Timing metrics of a resolution that
+// took d and used the cache as cacheStatus.
+func resolutionTiming(cacheStatus string, d time.Duration) string {
+	return fmt.Sprintf("dns;dur=%s, cache;desc=%s", timingDuration(d), cacheStatus)
+}
+
+// timingDuration formats d in milliseconds, as Server-Timing expects.
+func timingDuration(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+}
+
+// serverTimingWriter adds the time the upstream took to answer, up to its
+// response headers, to the Server-Timing header of the response.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	start time.Time
+	wrote bool
+}
+
+func newServerTimingWriter(w http.ResponseWriter) *serverTimingWriter {
+	return &serverTimingWriter{ResponseWriter: w, start: time.Now()}
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if !w.wrote && status >= 200 {
+		w.wrote = true
+		w.Header().Add("Server-Timing", "proxy;dur="+timingDuration(time.Since(w.start)))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying writer, for flushing and hijacking.
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Interface guards
+var _ http.ResponseWriter = (*serverTimingWriter)(nil)
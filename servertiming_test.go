@@ -0,0 +1,63 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestResolutionTiming(t *testing.T) {
+	if got, want := resolutionTiming(cacheStatusHit, 1250*time.Microsecond), "dns;dur=1.2, cache;desc=hit"; got != want {
+		t.Errorf("resolutionTiming() = %q, want %q", got, want)
+	}
+}
+
+func TestServerTimingWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Server-Timing", "dns;dur=0.1, cache;desc=miss")
+	w := newServerTimingWriter(rec)
+	w.Header().Add("Server-Timing", "app;dur=3")
+	if _, err := w.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	values := rec.Header().Values("Server-Timing")
+	if len(values) != 3 || !regexp.MustCompile(`^proxy;dur=\d+\.\d$`).MatchString(values[2]) {
+		t.Errorf("Server-Timing = %q, want the resolution, upstream and proxy metrics", values)
+	}
+}
+
+func TestServerTimingFailure(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		ServerTiming: true,
+		OnMiss:       http.StatusNotFound,
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	err := d.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Server-Timing"); !strings.HasPrefix(got, "dns;dur=") || !strings.HasSuffix(got, "cache;desc=miss") {
+		t.Errorf("Server-Timing = %q, want the resolution metrics", got)
+	}
+}
@@ -0,0 +1,82 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// handlerOrder numbers handlers in the order they are provisioned, which
+// is their order in the routes of a site.
+var handlerOrder atomic.Uint64
+
+// siteOf returns the module the handler being provisioned with ctx was
+// loaded by: the subroute of its Caddyfile site, which all dnslink
+// directives of the site share, or of the handle or route block holding
+// them. Modules are loaded anew by each config, so the handlers of two
+// configs never share a site.
+func siteOf(ctx caddy.Context, d *DNSLink) caddy.Module {
+	modules := ctx.Modules()
+	for i := len(modules) - 1; i >= 0; i-- {
+		if m, ok := modules[i].(*DNSLink); !ok || m != d {
+			return modules[i]
+		}
+	}
+	return nil
+}
+
+// serves reports whether d proxies links of namespace.
+func (d *DNSLink) serves(namespace string) bool {
+	return d.handles(d.prefixFor(namespace)) || d.dialsMultiaddr(namespace)
+}
+
+// defers reports whether requests for links of namespace, which d doesn't
+// serve, are left to a later dnslink handler of the same site that does,
+// so several dnslink directives in a site act as one.
+//
+// The directives are not merged when the Caddyfile is adapted, so each
+// keeps its own options and matchers, and the passing happens at request
+// time. Handlers are only of the same site if they were loaded by the same
+// module of the same config, so while a reload runs the old and the new
+// config side by side, neither passes requests on to the other's. Only
+// later handlers are deferred to, since the request goes down the routes
+// of the site, and a handler whose matchers skip the request passes it on
+// to the rest of the routes rather than back to the earlier handler's
+// on_miss.
+func (d *DNSLink) defers(namespace string) bool {
+	if d.site == nil {
+		return false
+	}
+	for _, other := range activeHandlers() {
+		if other.site == d.site && other.order > d.order && other.serves(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedResolution is the resolution of a request handed over to a later
+// dnslink handler, which reuses it if it resolves through the same app
+// instead of resolving the host again.
+type sharedResolution struct {
+	app         *App
+	host        string
+	entry       CacheEntry
+	cacheStatus string
+}
+
+type sharedResolutionKey struct{}
+
+// withResolution returns r carrying its resolution for later handlers.
+func withResolution(r *http.Request, s sharedResolution) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sharedResolutionKey{}, s))
+}
+
+// resolution returns the resolution of host handed over with r by an
+// earlier handler using app, if any.
+func resolution(r *http.Request, app *App, host string) (sharedResolution, bool) {
+	s, ok := r.Context().Value(sharedResolutionKey{}).(sharedResolution)
+	return s, ok && s.app == app && s.host == host
+}
@@ -0,0 +1,239 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestSiteHandlersMerge(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	links := map[string]dnslinkpkg.Result{
+		"ipfs.example.com":  {Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}},
+		"swarm.example.com": {Links: map[string]dnslinkpkg.NamespaceEntries{"swarm": {{Identifier: "abc"}}}},
+		"hyper.example.com": {Links: map[string]dnslinkpkg.NamespaceEntries{"hyper": {{Identifier: "def"}}}},
+	}
+	lookups := 0
+	app := &App{
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+			lookups++
+			return links[host], nil
+		})},
+	}
+	site, otherSite := new(caddyhttp.Subroute), new(caddyhttp.Subroute)
+	first := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "localhost:8080"},
+		Trace:     &Trace{Secret: "s3cret"},
+		OnMiss:    http.StatusNotFound,
+		proxies:   map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app:       app,
+		site:      site,
+		order:     1,
+		logger:    zap.NewNop(),
+	}
+	second := &DNSLink{
+		Upstreams: map[string]string{"/swarm": "localhost:1633"},
+		proxies:   map[string]*reverseproxy.Handler{"/swarm": nil},
+		app:       app,
+		site:      site,
+		order:     2,
+		logger:    zap.NewNop(),
+	}
+	elsewhere := &DNSLink{
+		Upstreams: map[string]string{"/hyper": "localhost:9000"},
+		proxies:   map[string]*reverseproxy.Handler{"/hyper": nil},
+		app:       app,
+		site:      otherSite,
+		order:     3,
+		logger:    zap.NewNop(),
+	}
+	if err := first.Trace.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*DNSLink{first, second, elsewhere} {
+		registerHandler(d)
+		defer unregisterHandler(d)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return second.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		}))
+	})
+
+	tests := []struct {
+		name        string
+		target      string
+		wantPrefix  string
+		wantStatus  int
+		wantOutcome string
+	}{
+		{"served by the first handler", "http://ipfs.example.com/", "/ipfs", 0, traceProxy},
+		{"passed on to the second handler", "http://swarm.example.com/", "/swarm", 0, traceProxy},
+		{"not served in the site", "http://hyper.example.com/", "", http.StatusNotFound, traceFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups = 0
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set(defaultTraceHeader, "s3cret")
+			if err := first.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+			var got requestTrace
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding trace %q: %v", w.Body.String(), err)
+			}
+			if got.Prefix != tt.wantPrefix || got.Status != tt.wantStatus || got.Outcome != tt.wantOutcome {
+				t.Errorf("trace = %+v, want prefix %q, status %d and outcome %s", got, tt.wantPrefix, tt.wantStatus, tt.wantOutcome)
+			}
+			if lookups != 1 {
+				t.Errorf("%d lookups, want 1", lookups)
+			}
+		})
+	}
+}
+
+func TestSiteHandlersReload(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+	}
+	ipfs, swarm := upstream("ipfs"), upstream("swarm")
+	defer ipfs.Close()
+	defer swarm.Close()
+	resolver := testMappings(t, map[string]string{
+		"ipfs.example.com":  "/ipfs/QmSite",
+		"swarm.example.com": "/swarm/abc",
+	})
+
+	// loadSite loads a config whose site routes to the handlers of
+	// upstreams, in order.
+	loadSite := func(upstreams ...map[string]string) (*caddyhttp.Subroute, func()) {
+		t.Helper()
+		var handlers []json.RawMessage
+		for _, u := range upstreams {
+			d := &DNSLink{Upstreams: u, OnMiss: http.StatusNotFound, ResolverRaw: resolver}
+			handlers = append(handlers, caddyconfig.JSONModuleObject(d, "handler", "dnslink", nil))
+		}
+		mod, unload := loadTestModule(t, "http.handlers.subroute", &caddyhttp.Subroute{
+			Routes: caddyhttp.RouteList{{HandlersRaw: handlers}},
+		})
+		return mod.(*caddyhttp.Subroute), unload
+	}
+	serve := func(site *caddyhttp.Subroute, host string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := caddyhttp.PrepareRequest(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil), caddy.NewReplacer(), nil, &caddyhttp.Server{})
+		rec := httptest.NewRecorder()
+		if err := site.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		})); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+		return rec
+	}
+	check := func(name string, rec *httptest.ResponseRecorder, wantStatus int, wantBody string) {
+		t.Helper()
+		if rec.Code != wantStatus || (wantBody != "" && rec.Body.String() != wantBody) {
+			t.Errorf("%s: response = %d %q, want %d %q", name, rec.Code, rec.Body, wantStatus, wantBody)
+		}
+	}
+
+	ipfsOnly := map[string]string{"/ipfs": ipfs.Listener.Addr().String()}
+	swarmOnly := map[string]string{"/swarm": swarm.Listener.Addr().String()}
+	first, unloadFirst := loadSite(ipfsOnly)
+	check("first config", serve(first, "swarm.example.com"), http.StatusNotFound, "")
+
+	// While a reload adds a handler, both configs run, and the handlers of
+	// the old one don't pass requests on to those of the new, which would
+	// skip their on_miss.
+	second, unloadSecond := loadSite(ipfsOnly, swarmOnly)
+	check("first config during reload", serve(first, "swarm.example.com"), http.StatusNotFound, "")
+	check("second config during reload", serve(second, "swarm.example.com"), http.StatusOK, "swarm")
+	unloadFirst()
+	check("second config", serve(second, "swarm.example.com"), http.StatusOK, "swarm")
+	check("second config", serve(second, "ipfs.example.com"), http.StatusOK, "ipfs")
+
+	// Nor do those of the new config pass requests on to the old one's
+	// when a reload drops a handler.
+	third, _ := loadSite(ipfsOnly)
+	check("third config during reload", serve(third, "swarm.example.com"), http.StatusNotFound, "")
+	unloadSecond()
+	check("third config", serve(third, "swarm.example.com"), http.StatusNotFound, "")
+}
+
+func TestInheritDefaults(t *testing.T) {
+	app := &App{OnMiss: http.StatusNotFound, OnError: http.StatusBadGateway, ErrorJSON: true}
+	tests := []struct {
+		name    string
+		handler *DNSLink
+		want    *DNSLink
+	}{
+		{
+			name:    "unset",
+			handler: &DNSLink{},
+			want:    &DNSLink{OnMiss: http.StatusNotFound, OnError: http.StatusBadGateway, ErrorJSON: true},
+		},
+		{
+			name:    "own status",
+			handler: &DNSLink{OnError: http.StatusServiceUnavailable},
+			want:    &DNSLink{OnMiss: http.StatusNotFound, OnError: http.StatusServiceUnavailable, ErrorJSON: true},
+		},
+		{
+			name:    "own error page",
+			handler: &DNSLink{ErrorPage: "error.html"},
+			want:    &DNSLink{OnMiss: http.StatusNotFound, OnError: http.StatusBadGateway, ErrorPage: "error.html"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.handler
+			d.inheritDefaults(app)
+			if d.OnMiss != tt.want.OnMiss || d.OnError != tt.want.OnError || d.ErrorPage != tt.want.ErrorPage || d.ErrorJSON != tt.want.ErrorJSON {
+				t.Errorf("inheritDefaults() = %d, %d, %q, %v, want %d, %d, %q, %v",
+					d.OnMiss, d.OnError, d.ErrorPage, d.ErrorJSON, tt.want.OnMiss, tt.want.OnError, tt.want.ErrorPage, tt.want.ErrorJSON)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrorDefaults(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`dnslink {
+		on_miss 404
+		on_error 502
+		error_json
+	}`)
+	var a App
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if a.OnMiss != http.StatusNotFound || a.OnError != http.StatusBadGateway || !a.ErrorJSON {
+		t.Errorf("UnmarshalCaddyfile() = %d, %d, %v", a.OnMiss, a.OnError, a.ErrorJSON)
+	}
+
+	for _, input := range []string{"dnslink {\n on_miss\n}", "dnslink {\n on_error bad\n}", "dnslink {\n error_json yes\n}"} {
+		var a App
+		if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("UnmarshalCaddyfile(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func init() {
+	caddy.RegisterModule(new(SNIRouter))
+}
+
+// Default timeouts of SNIRouter.
+const (
+	defaultHelloTimeout = 5 * time.Second
+	defaultDialTimeout  = 10 * time.Second
+)
+
+// SNIRouter is a listener wrapper that routes TLS connections on the DNSLink
+// of their server name, before Caddy terminates them, so protocols other
+// than HTTP can be served from the same listener: a connection for a host
+// whose link is in one of the namespaces of Backends is relayed as is to the
+// backend of the namespace, which terminates TLS itself. Other connections,
+// including those without TLS or a server name, are served by Caddy. It
+// must come before the tls listener wrapper.
+//
+// It stands in for a caddy-l4 matcher and handler, so it needs no layer4
+// app, but it only routes connections in front of a Caddy HTTP server and
+// can't be combined with layer4 routes.
+type SNIRouter struct {
+	// Backends maps namespaces to the network addresses connections for
+	// their hosts are relayed to, e.g. "swarm": "bee:1634".
+	Backends map[string]string `json:"backends"`
+
+	// HelloTimeout bounds the wait for the TLS ClientHello of a
+	// connection. Default is 5s.
+	HelloTimeout caddy.Duration `json:"hello_timeout,omitempty"`
+
+	// DialTimeout bounds connecting to a backend. Default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	ctx    context.Context
+	app    *App
+	logger *zap.Logger
+}
+
+func (*SNIRouter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.dnslink",
+		New: func() caddy.Module { return new(SNIRouter) },
+	}
+}
+
+func (s *SNIRouter) Provision(ctx caddy.Context) error {
+	if len(s.Backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	repl := caddy.NewReplacer()
+	backends := make(map[string]string, len(s.Backends))
+	for ns, addr := range s.Backends {
+		addr = repl.ReplaceKnown(addr, "")
+		if strings.TrimSpace(addr) == "" {
+			return fmt.Errorf("namespace %s has an empty backend address", ns)
+		}
+		backends[strings.Trim(ns, "/")] = addr
+	}
+	s.Backends = backends
+	if s.HelloTimeout < 0 || s.DialTimeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if s.HelloTimeout == 0 {
+		s.HelloTimeout = caddy.Duration(defaultHelloTimeout)
+	}
+	if s.DialTimeout == 0 {
+		s.DialTimeout = caddy.Duration(defaultDialTimeout)
+	}
+
+	appIface, err := ctx.App("dnslink")
+	if err != nil {
+		return fmt.Errorf("getting dnslink app: %v", err)
+	}
+	s.ctx, s.app, s.logger = ctx, appIface.(*App), ctx.Logger(s)
+	return nil
+}
+
+// WrapListener returns ln routing the TLS connections it accepts.
+func (s *SNIRouter) WrapListener(ln net.Listener) net.Listener {
+	l := &sniListener{
+		Listener: ln,
+		router:   s,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// backend returns the backend of the namespace the link of host is in, if
+// it has one.
+func (s *SNIRouter) backend(host string) (string, string, bool) {
+	entry, _, err := s.app.resolve(s.ctx, host)
+	if err != nil || entry.Namespace == "" {
+		return "", "", false
+	}
+	addr, ok := s.Backends[entry.Namespace]
+	return entry.Namespace, addr, ok
+}
+
+// relay copies conn to and from the backend at addr until either side is
+// done, then closes both.
+func (s *SNIRouter) relay(conn net.Conn, host, namespace, addr string) {
+	defer conn.Close()
+	backend, err := net.DialTimeout("tcp", addr, time.Duration(s.DialTimeout))
+	if err != nil {
+		s.logger.Warn("dialing backend", zap.String("host", host), zap.String("namespace", namespace), zap.String("backend", addr), zap.Error(err))
+		return
+	}
+	defer backend.Close()
+	s.logger.Debug("relaying connection", zap.String("host", host), zap.String("namespace", namespace), zap.String("backend", addr), zap.String("remote", conn.RemoteAddr().String()))
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(backend, conn)
+	go pipe(conn, backend)
+	<-done
+	<-done
+}
+
+// sniListener routes the connections of a listener, handing those Caddy
+// serves to Accept.
+type sniListener struct {
+	net.Listener
+	router *SNIRouter
+
+	closeOnce sync.Once
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// acceptLoop accepts connections and routes each on its own, since reading
+// a ClientHello must not hold up the others.
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// route relays conn to a backend if its server name has a link in one of
+// the routed namespaces, and hands it to Accept otherwise.
+func (l *sniListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Duration(l.router.HelloTimeout)))
+	host, peeked := readServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	conn = &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+
+	if host != "" {
+		if namespace, addr, ok := l.router.backend(host); ok {
+			l.router.relay(conn, host, namespace, addr)
+			return
+		}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// TLS record and handshake constants used to read a ClientHello.
+const (
+	recordHeaderLen          = 5
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x0000
+	serverNameTypeHostName   = 0x00
+	// maxHelloSize bounds the ClientHello read from a connection.
+	maxHelloSize = 64 << 10
+)
+
+// errNoClientHello is returned for connections that don't start with a
+// TLS ClientHello.
+var errNoClientHello = errors.New("not a TLS client hello")
+
+// readServerName reads the TLS ClientHello of conn and returns its server
+// name, with the bytes read from conn to replay them. The name is empty if
+// the connection is not TLS or names no server.
+func readServerName(conn net.Conn) (string, []byte) {
+	var peeked bytes.Buffer
+	hello, err := readClientHello(io.TeeReader(conn, &peeked))
+	if err != nil {
+		return "", peeked.Bytes()
+	}
+	return helloServerName(hello), peeked.Bytes()
+}
+
+// readClientHello reads the handshake records of r up to the end of the
+// ClientHello they carry, which may span several records, and returns the
+// handshake message.
+func readClientHello(r io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderLen)
+	var msg []byte
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0] != recordTypeHandshake {
+			return nil, errNoClientHello
+		}
+		n := int(binary.BigEndian.Uint16(header[3:]))
+		if len(msg)+n > maxHelloSize {
+			return nil, fmt.Errorf("client hello over %d bytes", maxHelloSize)
+		}
+		msg = append(msg, make([]byte, n)...)
+		if _, err := io.ReadFull(r, msg[len(msg)-n:]); err != nil {
+			return nil, err
+		}
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return nil, errNoClientHello
+		}
+		size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if size > maxHelloSize {
+			return nil, fmt.Errorf("client hello over %d bytes", maxHelloSize)
+		}
+		if len(msg) >= size {
+			return msg[:size], nil
+		}
+	}
+}
+
+// helloServerName returns the host name of the server_name extension of a
+// ClientHello handshake message, or an empty string if it has none or is
+// malformed.
+func helloServerName(msg []byte) string {
+	s := cryptobyte.String(msg[4:])
+	var sessionID, suites, compression, exts cryptobyte.String
+	if !s.Skip(2+32) || // version and random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) ||
+		!s.ReadUint16LengthPrefixed(&exts) {
+		return ""
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return ""
+		}
+		if typ != extensionServerName {
+			continue
+		}
+		var names cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == serverNameTypeHostName {
+				return strings.TrimSuffix(string(name), ".")
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// replayConn is a connection whose first reads return bytes already read
+// from it.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// CloseWrite closes the writing side of the connection, if it can be.
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the listener wrapper from Caddyfile tokens.
+// Syntax:
+//
+//	dnslink {
+//	    backend <namespace> <address>
+//	    hello_timeout <duration>
+//	    dial_timeout <duration>
+//	}
+func (s *SNIRouter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "backend":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if s.Backends == nil {
+				s.Backends = make(map[string]string)
+			}
+			s.Backends[strings.Trim(args[0], "/")] = args[1]
+		case "hello_timeout", "dial_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "hello_timeout" {
+				s.HelloTimeout = caddy.Duration(dur)
+			} else {
+				s.DialTimeout = caddy.Duration(dur)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	if len(s.Backends) == 0 {
+		return d.Err("dnslink listener wrapper needs a backend")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*SNIRouter)(nil)
+	_ caddy.Provisioner     = (*SNIRouter)(nil)
+	_ caddy.ListenerWrapper = (*SNIRouter)(nil)
+	_ caddyfile.Unmarshaler = (*SNIRouter)(nil)
+	_ net.Listener          = (*sniListener)(nil)
+)
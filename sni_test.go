@@ -0,0 +1,253 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestSNIRouter(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	relayed := make(chan []byte, 1)
+	go func() {
+		conn, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(conn, buf)
+		relayed <- buf
+	}()
+
+	s := newTestSNIRouter(t, backendLn.Addr().String())
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := s.WrapListener(inner)
+	defer ln.Close()
+
+	hello := func(serverName string) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			_ = tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		}()
+	}
+	accept := func(want byte) {
+		t.Helper()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+		defer conn.Close()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != want {
+			t.Errorf("first byte = %q, %v, want %q replayed", buf, err, want)
+		}
+	}
+
+	// A host linking into a routed namespace is relayed to its backend.
+	hello("swarm.example.com")
+	select {
+	case buf := <-relayed:
+		if buf[0] != 0x16 {
+			t.Errorf("relayed %x, want a TLS handshake record", buf)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not relayed")
+	}
+
+	// Other hosts and other protocols are served by Caddy.
+	hello("ipfs.example.com")
+	accept(0x16)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	accept('G')
+
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Accept() after Close succeeded")
+	}
+}
+
+// newTestSNIRouter returns a router relaying swarm.example.com to the
+// backend at addr, with ipfs.example.com linking to /ipfs.
+func newTestSNIRouter(t *testing.T, addr string) *SNIRouter {
+	t.Helper()
+	a := &App{
+		Static:        map[string]string{"swarm.example.com": "/swarm/abc", "ipfs.example.com": "/ipfs/QmXyz"},
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+	return &SNIRouter{
+		Backends:     map[string]string{"swarm": addr},
+		HelloTimeout: caddy.Duration(time.Second),
+		DialTimeout:  caddy.Duration(time.Second),
+		ctx:          context.Background(),
+		app:          a,
+		logger:       zap.NewNop(),
+	}
+}
+
+// TestSNIRouterTLS completes TLS handshakes and HTTPS requests through the
+// router, with the relayed connections terminated by the backend and the
+// others by the server behind the listener.
+func TestSNIRouterTLS(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.Host)
+	}))
+	defer backend.Close()
+	s := newTestSNIRouter(t, backend.Listener.Addr().String())
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := s.WrapListener(inner)
+	defer ln.Close()
+	tlsLn := tls.NewListener(ln, &tls.Config{Certificates: backend.TLS.Certificates})
+	go func() {
+		_ = http.Serve(tlsLn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "caddy %s", r.Host)
+		}))
+	}()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for host, want := range map[string]string{
+		"swarm.example.com": "backend swarm.example.com",
+		"ipfs.example.com":  "caddy ipfs.example.com",
+		"none.example.com":  "caddy none.example.com",
+	} {
+		resp, err := client.Get("https://" + host + "/")
+		if err != nil {
+			t.Errorf("GET https://%s/ error = %v", host, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("GET https://%s/ = %q, want %q", host, body, want)
+		}
+	}
+}
+
+func TestReadServerName(t *testing.T) {
+	// Capture the ClientHello a real client sends.
+	client, server := net.Pipe()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "swarm.example.com.", InsecureSkipVerify: true}).Handshake()
+	}()
+	hello, err := readClientHello(server)
+	client.Close()
+	server.Close()
+	if err != nil {
+		t.Fatalf("readClientHello() error = %v", err)
+	}
+
+	// Split the message over two records, as clients may.
+	record := func(fragment []byte) []byte {
+		return append([]byte{recordTypeHandshake, 3, 1, byte(len(fragment) >> 8), byte(len(fragment))}, fragment...)
+	}
+	split := append(record(hello[:10]), record(hello[10:])...)
+	split = append(split, "trailing"...)
+	tests := []struct {
+		input []byte
+		name  string
+		read  int
+	}{
+		{input: record(hello), name: "swarm.example.com", read: len(hello) + recordHeaderLen},
+		{input: split, name: "swarm.example.com", read: len(split) - len("trailing")},
+		{input: []byte("GET / HTTP/1.1\r\n\r\n"), read: recordHeaderLen},
+		{input: record(hello[:len(hello)-1]), read: len(hello) + recordHeaderLen - 1},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		go func() {
+			_, _ = c1.Write(tt.input)
+			c1.Close()
+		}()
+		name, peeked := readServerName(c2)
+		c2.Close()
+		if name != tt.name || len(peeked) != tt.read || !bytes.Equal(peeked, tt.input[:len(peeked)]) {
+			t.Errorf("readServerName(%d bytes) = %q after %d bytes, want %q after %d", len(tt.input), name, len(peeked), tt.name, tt.read)
+		}
+	}
+}
+
+func TestParseSNIRouter(t *testing.T) {
+	var s SNIRouter
+	err := s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dnslink {
+		backend /swarm bee:1634
+		backend ipfs ipfs:4001
+		hello_timeout 2s
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Backends) != 2 || s.Backends["swarm"] != "bee:1634" || s.HelloTimeout != caddy.Duration(2*time.Second) {
+		t.Errorf("parsed %+v", s)
+	}
+	for _, input := range []string{
+		`dnslink`,
+		`dnslink swarm`,
+		`dnslink {
+			backend swarm
+		}`,
+		`dnslink {
+			dial_timeout soon
+		}`,
+		`dnslink {
+			route swarm bee:1634
+		}`,
+	} {
+		if err := new(SNIRouter).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("UnmarshalCaddyfile(%q) succeeded, want error", input)
+		}
+	}
+}
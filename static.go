@@ -0,0 +1,119 @@
+package dnslink
+
+import (
+	"fmt"
+	"strings"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+	"golang.org/x/net/idna"
+)
+
+// parseLink splits a DNSLink value such as /ipfs/QmXyz into its
+// namespace and identifier, unwrapping an embedded namespace path.
+func parseLink(value string) (namespace, identifier string, err error) {
+	ns, id, ok := strings.Cut(strings.TrimPrefix(value, "/"), "/")
+	if !strings.HasPrefix(value, "/") || !ok || ns == "" || id == "" {
+		return "", "", fmt.Errorf("invalid DNSLink value '%s': want /<namespace>/<identifier>", value)
+	}
+	ns, id = unwrapLink(ns, id)
+	return ns, id, nil
+}
+
+// staticEntry builds the entry for a configured DNSLink value.
+func staticEntry(value string) (CacheEntry, error) {
+	ns, id, err := parseLink(value)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	return CacheEntry{
+		Namespace:  ns,
+		Identifier: id,
+		Links:      map[string]dnslinkpkg.NamespaceEntries{ns: {{Identifier: id}}},
+	}, nil
+}
+
+// provisionStatic parses the Static, Fallback, LookupDomains and
+// AliasDomains mappings.
+func (a *App) provisionStatic() error {
+	var err error
+	if a.static, err = parseMappings(a.Static); err != nil {
+		return fmt.Errorf("static %v", err)
+	}
+	if a.fallback, err = parseMappings(a.Fallback); err != nil {
+		return fmt.Errorf("fallback %v", err)
+	}
+	a.lookupDomains = make(map[string]string, len(a.LookupDomains))
+	for host, domain := range a.LookupDomains {
+		if domain = mappingKey(domain); domain == "" {
+			return fmt.Errorf("lookup domain of %s is empty", host)
+		}
+		a.lookupDomains[mappingKey(host)] = domain
+	}
+	a.aliasDomains = make(map[string][]string, len(a.AliasDomains))
+	for host, domains := range a.AliasDomains {
+		host = mappingKey(host)
+		for _, domain := range domains {
+			if domain = mappingKey(domain); domain == "" {
+				return fmt.Errorf("alias domain of %s is empty", host)
+			}
+			a.aliasDomains[host] = append(a.aliasDomains[host], domain)
+		}
+	}
+	return nil
+}
+
+// lookupDomain returns the normalized domain whose DNSLink record host is
+// served from: its LookupDomains mapping if any, or else host itself.
+func (a *App) lookupDomain(host string) string {
+	host = mappingKey(host)
+	if domain, ok := a.lookupDomains[host]; ok {
+		return domain
+	}
+	return host
+}
+
+// parseMappings parses host to DNSLink value mappings, keyed by
+// normalized host.
+func parseMappings(mappings map[string]string) (map[string]CacheEntry, error) {
+	entries := make(map[string]CacheEntry, len(mappings))
+	for host, value := range mappings {
+		entry, err := staticEntry(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", host, err)
+		}
+		entries[mappingKey(host)] = entry
+	}
+	return entries, nil
+}
+
+// mappingKey normalizes a host for matching against mappings and for use as
+// a cache key: lowercase, without a trailing dot, and with internationalized
+// labels in punycode, so every spelling of a host shares one entry. Hosts
+// that are not valid IDNA names are only lowercased.
+func mappingKey(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// lookupStatic returns the static mapping for host, if any, from the
+// config or the mappings file.
+func (a *App) lookupStatic(host string) (CacheEntry, bool) {
+	key := mappingKey(host)
+	if entry, ok := a.static[key]; ok {
+		return entry, true
+	}
+	if file := a.fileMappings.Load(); file != nil {
+		entry, ok := (*file)[key]
+		return entry, ok
+	}
+	return CacheEntry{}, false
+}
+
+// lookupFallback returns the fallback mapping for host, if any.
+func (a *App) lookupFallback(host string) (CacheEntry, bool) {
+	entry, ok := a.fallback[mappingKey(host)]
+	return entry, ok
+}
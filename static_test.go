@@ -0,0 +1,220 @@
+package dnslink
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		value      string
+		namespace  string
+		identifier string
+		wantErr    bool
+	}{
+		{value: "/ipfs/QmXyz", namespace: "ipfs", identifier: "QmXyz"},
+		{value: "/ipns/example.com/sub/path", namespace: "ipns", identifier: "example.com/sub/path"},
+		{value: "/ipfs//ipns/example.com", namespace: "ipns", identifier: "example.com"},
+		{value: "ipfs/QmXyz", wantErr: true},
+		{value: "/ipfs/", wantErr: true},
+		{value: "/ipfs", wantErr: true},
+		{value: "//QmXyz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ns, id, err := parseLink(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ns != tt.namespace || id != tt.identifier {
+				t.Errorf("parseLink() = %q, %q, want %q, %q", ns, id, tt.namespace, tt.identifier)
+			}
+		})
+	}
+}
+
+func TestStaticResolve(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	a := &App{
+		Static: map[string]string{"Staging.Example.com": "/ipfs/QmStaging"},
+		cache:  new(MemoryCache),
+		lookup: func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+			t.Error("static host queried DNS")
+			return nil, nil
+		},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, _, err := a.resolve(context.Background(), "staging.example.com")
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if entry.Namespace != "ipfs" || entry.Identifier != "QmStaging" {
+		t.Errorf("resolve() = /%s/%s, want /ipfs/QmStaging", entry.Namespace, entry.Identifier)
+	}
+
+	if err := (&App{Static: map[string]string{"bad.example.com": "QmNoNamespace"}}).provisionStatic(); err == nil {
+		t.Error("provisionStatic() with invalid value succeeded, want error")
+	}
+}
+
+func TestFallbackResolve(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	errs := map[string]error{
+		"_dnslink.down.example.com":    dnslinkpkg.NewDNSRCodeError(dns.RcodeServerFailure, "down.example.com"),
+		"_dnslink.missing.example.com": dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, "missing.example.com"),
+		"missing.example.com":          dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, "missing.example.com"),
+	}
+	a := &App{
+		Fallback: map[string]string{
+			"down.example.com":    "/ipfs/QmKnownGood",
+			"missing.example.com": "/ipfs/QmUnused",
+		},
+		cache:  new(MemoryCache),
+		logger: zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return nil, errs[name]
+		},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host      string
+		namespace string
+		ident     string
+	}{
+		{host: "down.example.com", namespace: "ipfs", ident: "QmKnownGood"},
+		{host: "missing.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			entry, _, err := a.resolve(context.Background(), tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if entry.Namespace != tt.namespace || entry.Identifier != tt.ident {
+				t.Errorf("resolve() = %q, %q, want %q, %q", entry.Namespace, entry.Identifier, tt.namespace, tt.ident)
+			}
+			if _, ok, _ := a.cache.Load(context.Background(), tt.host); ok {
+				t.Error("result was cached, want fallback results uncached")
+			}
+		})
+	}
+}
+
+func TestLookupDomains(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	var lookups []string
+	a := &App{
+		LookupDomains: map[string]string{"Preview.Internal": "mysite.example.org."},
+		CacheTTL:      caddy.Duration(time.Minute),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+			lookups = append(lookups, host)
+			return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}}, nil
+		})},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, host := range []string{"preview.internal", "mysite.example.org"} {
+		entry, cached, err := a.resolve(context.Background(), host)
+		if err != nil {
+			t.Fatalf("resolve(%s) error = %v", host, err)
+		}
+		if entry.Namespace != "ipfs" || entry.Identifier != "QmSite" {
+			t.Errorf("resolve(%s) = /%s/%s, want /ipfs/QmSite", host, entry.Namespace, entry.Identifier)
+		}
+		if cached != (i > 0) {
+			t.Errorf("resolve(%s) cached = %v", host, cached)
+		}
+	}
+	if !slices.Equal(lookups, []string{"mysite.example.org"}) {
+		t.Errorf("looked up %q, want only mysite.example.org", lookups)
+	}
+
+	if err := (&App{LookupDomains: map[string]string{"preview.internal": "."}}).provisionStatic(); err == nil {
+		t.Error("provisionStatic() with an empty lookup domain succeeded")
+	}
+}
+
+func TestAliasDomains(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	records := map[string]string{
+		"_dnslink.legacy.example.org": "dnslink=/ipfs/QmLegacy",
+		"_dnslink.example.net":        "dnslink=/ipfs/QmNet",
+		"_dnslink.own.example":        "dnslink=/ipfs/QmOwn",
+	}
+	a := &App{
+		AliasDomains: map[string][]string{
+			"Example.ORG":  {"legacy.example.org.", "example.net"},
+			"example.com":  {"missing.example", "example.net"},
+			"own.example":  {"legacy.example.org"},
+			"none.example": {"missing.example"},
+		},
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if txt, ok := records[name]; ok {
+				return []dnslinkpkg.LookupEntry{{Value: txt}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	if err := a.provisionStatic(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"example.org":  "QmLegacy",
+		"example.com":  "QmNet",
+		"own.example":  "QmOwn",
+		"none.example": "",
+	}
+	for host, want := range tests {
+		entry, _, err := a.resolve(context.Background(), host)
+		if err != nil {
+			t.Fatalf("resolve(%s) error = %v", host, err)
+		}
+		if entry.Identifier != want {
+			t.Errorf("resolve(%s) identifier = %q, want %q", host, entry.Identifier, want)
+		}
+	}
+
+	if err := (&App{AliasDomains: map[string][]string{"example.org": {"."}}}).provisionStatic(); err == nil {
+		t.Error("provisionStatic() with an empty alias domain succeeded")
+	}
+}
+
+func TestMappingKey(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM.":          "example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"BÜCHER.example.":       "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"under_score.example":   "under_score.example",
+	}
+	for host, want := range tests {
+		if got := mappingKey(host); got != want {
+			t.Errorf("mappingKey(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package dnslink
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+)
+
+func init() {
+	// Caddy's admin API serves expvars at /debug/vars.
+	expvar.Publish("dnslink", expvar.Func(func() any { return collectStats() }))
+}
+
+// resolutionStats counts the resolutions of an app.
+type resolutionStats struct {
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	inflight atomic.Int64
+}
+
+// cacheStats is a snapshot of the resolution statistics of every active
+// app. Entries and evictions only cover in-memory caches, since shared
+// backends can't be enumerated cheaply.
+type cacheStats struct {
+	Entries         int    `json:"entries"`
+	Hits            uint64 `json:"hits"`
+	Misses          uint64 `json:"misses"`
+	Evictions       uint64 `json:"evictions"`
+	InflightLookups int64  `json:"inflight_lookups"`
+}
+
+// collectStats sums the statistics of all active apps and caches.
+func collectStats() cacheStats {
+	var stats cacheStats
+	for _, a := range activeApps() {
+		stats.Hits += a.stats.hits.Load()
+		stats.Misses += a.stats.misses.Load()
+		stats.InflightLookups += a.stats.inflight.Load()
+	}
+	for _, c := range activeCaches() {
+		m, ok := c.(*MemoryCache)
+		if !ok {
+			continue
+		}
+		stats.Evictions += m.evictions.Load()
+		_ = m.Range(context.Background(), func(string, CacheEntry) bool {
+			stats.Entries++
+			return true
+		})
+	}
+	return stats
+}
@@ -0,0 +1,352 @@
+package dnslink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(Status))
+	httpcaddyfile.RegisterHandlerDirective("dnslink_status", parseStatusCaddyfile)
+}
+
+// Bounds of the recent activity kept per app and shown by Status.
+const (
+	maxRecent     = 50
+	defaultRecent = 20
+)
+
+// Status is a handler that renders a status page of the gateway: the
+// prefixes and upstreams of every dnslink handler, the health of the
+// static upstreams, the resolution cache statistics, and the latest
+// resolutions and errors. It answers with HTML, or with JSON for
+// `?format=json` and clients that accept application/json but not HTML.
+// The page exposes the configuration of the gateway, so it is meant to be
+// put behind authentication or a matcher like the admin API would be.
+type Status struct {
+	// Recent is how many of the latest resolutions and errors are shown,
+	// up to 50. Default is 20.
+	Recent int `json:"recent,omitempty"`
+}
+
+// statusReport is the content of the status page.
+type statusReport struct {
+	Status      string             `json:"status"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Prefixes    []prefixUpstream   `json:"prefixes"`
+	Upstreams   []upstreamHealth   `json:"upstreams"`
+	Cache       statusCache        `json:"cache"`
+	Resolutions []recentResolution `json:"resolutions"`
+	Errors      []recentError      `json:"errors"`
+}
+
+// statusCache is the cache statistics with the share of the resolutions
+// served from the cache.
+type statusCache struct {
+	cacheStats
+	HitRate float64 `json:"hit_rate"`
+}
+
+// HitPercent returns the hit rate as a percentage, for the HTML page.
+func (c statusCache) HitPercent() float64 {
+	return c.HitRate * 100
+}
+
+func (*Status) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.dnslink_status",
+		New: func() caddy.Module { return new(Status) },
+	}
+}
+
+func (s *Status) Provision(caddy.Context) error {
+	if s.Recent == 0 {
+		s.Recent = defaultRecent
+	}
+	return nil
+}
+
+func (s *Status) Validate() error {
+	if s.Recent < 0 || s.Recent > maxRecent {
+		return fmt.Errorf("recent %d out of range, want at most %d", s.Recent, maxRecent)
+	}
+	return nil
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	report := buildStatus(s.Recent, time.Now())
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(report)
+	}
+	// Render into a buffer so a failing template doesn't leave a
+	// half-written response.
+	var buf bytes.Buffer
+	if err := statusPage.Execute(&buf, report); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// wantsJSON reports whether r asks for the JSON status report.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// buildStatus builds the status report of all active apps and handlers,
+// with the latest recent resolutions and errors, newest first. The status
+// is unavailable if a prefix has static upstreams and none of them is
+// healthy; the resolvers aren't probed, unlike for the health endpoint,
+// so loading the page doesn't send DNS queries.
+func buildStatus(recent int, now time.Time) statusReport {
+	upstreams, healthy := activeUpstreamHealth()
+	report := statusReport{
+		Status:      healthOK,
+		GeneratedAt: now,
+		Prefixes:    activeUpstreams(),
+		Upstreams:   upstreams,
+		Cache:       statusCache{cacheStats: collectStats()},
+		Resolutions: []recentResolution{},
+		Errors:      []recentError{},
+	}
+	if !healthy {
+		report.Status = healthUnavailable
+	}
+	if total := report.Cache.Hits + report.Cache.Misses; total > 0 {
+		report.Cache.HitRate = float64(report.Cache.Hits) / float64(total)
+	}
+	for _, a := range activeApps() {
+		resolutions, errs := a.recent.snapshot()
+		report.Resolutions = append(report.Resolutions, resolutions...)
+		report.Errors = append(report.Errors, errs...)
+	}
+	sort.SliceStable(report.Resolutions, func(i, j int) bool {
+		return report.Resolutions[i].Time.After(report.Resolutions[j].Time)
+	})
+	sort.SliceStable(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Time.After(report.Errors[j].Time)
+	})
+	if len(report.Resolutions) > recent {
+		report.Resolutions = report.Resolutions[:recent]
+	}
+	if len(report.Errors) > recent {
+		report.Errors = report.Errors[:recent]
+	}
+	return report
+}
+
+// recentActivity keeps the latest resolutions and errors of an app, oldest
+// first. Cache hits and static mappings are not kept, since they would
+// crowd out the lookups worth looking at.
+type recentActivity struct {
+	mu          sync.Mutex
+	resolutions []recentResolution
+	errors      []recentError
+}
+
+// recentResolution is a resolution that wasn't served from the cache.
+type recentResolution struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Outcome    string    `json:"outcome"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Identifier string    `json:"identifier,omitempty"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// recentError is a failed resolution, or a request of a prefix that
+// failed on its way to the upstream.
+type recentError struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Prefix string    `json:"prefix,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// resolved keeps a resolution of host with outcome, started at start.
+func (ra *recentActivity) resolved(host, outcome string, entry CacheEntry, start time.Time, err error) {
+	if outcome == outcomeHit || outcome == outcomeStatic {
+		return
+	}
+	now := time.Now()
+	res := recentResolution{
+		Time:       now,
+		Host:       host,
+		Outcome:    outcome,
+		Namespace:  entry.Namespace,
+		Identifier: entry.Identifier,
+		LatencyMS:  float64(now.Sub(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.resolutions = append(ra.resolutions, res)
+	if len(ra.resolutions) > maxRecent {
+		ra.resolutions = ra.resolutions[1:]
+	}
+	if err != nil && outcome != outcomeNoLink {
+		ra.addError(recentError{Time: now, Host: host, Error: res.Error})
+	}
+}
+
+// failed keeps the error of a request of host to the upstream of prefix.
+func (ra *recentActivity) failed(host, prefix string, err error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.addError(recentError{Time: time.Now(), Host: host, Prefix: prefix, Error: err.Error()})
+}
+
+// addError keeps e, dropping the oldest error over maxRecent. ra.mu must
+// be held.
+func (ra *recentActivity) addError(e recentError) {
+	ra.errors = append(ra.errors, e)
+	if len(ra.errors) > maxRecent {
+		ra.errors = ra.errors[1:]
+	}
+}
+
+// snapshot returns copies of the kept resolutions and errors.
+func (ra *recentActivity) snapshot() ([]recentResolution, []recentError) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return append([]recentResolution(nil), ra.resolutions...), append([]recentError(nil), ra.errors...)
+}
+
+// statusPage renders a statusReport.
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>DNSLink gateway status</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; }
+code { font-size: 0.9em; }
+.ok { color: #197a27; }
+.unavailable, .error { color: #b3261e; }
+</style>
+</head>
+<body>
+<h1>DNSLink gateway <span class="{{.Status}}">{{.Status}}</span></h1>
+<p>Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}.</p>
+
+<h2>Prefixes</h2>
+<table>
+<tr><th>Prefix</th><th>Upstream</th></tr>
+{{- range .Prefixes}}
+<tr><td><code>{{.Prefix}}</code></td><td>{{if .Dynamic}}dynamic{{else if .Route}}route <code>{{.Route}}</code>{{else}}<code>{{.Upstream}}</code>{{end}}</td></tr>
+{{- else}}
+<tr><td colspan="2">No prefixes.</td></tr>
+{{- end}}
+</table>
+
+<h2>Upstream health</h2>
+<table>
+<tr><th>Prefix</th><th>Address</th><th>Health</th><th>Requests</th><th>Fails</th></tr>
+{{- range .Upstreams}}
+<tr><td><code>{{.Prefix}}</code></td><td><code>{{.Address}}</code></td><td>{{if .Healthy}}<span class="ok">healthy</span>{{else}}<span class="error">unhealthy</span>{{end}}</td><td>{{.Requests}}</td><td>{{.Fails}}</td></tr>
+{{- else}}
+<tr><td colspan="5">No static upstreams.</td></tr>
+{{- end}}
+</table>
+
+<h2>Cache</h2>
+<table>
+<tr><th>Entries</th><th>Hits</th><th>Misses</th><th>Hit rate</th><th>Evictions</th><th>Lookups in flight</th></tr>
+<tr><td>{{.Cache.Entries}}</td><td>{{.Cache.Hits}}</td><td>{{.Cache.Misses}}</td><td>{{printf "%.1f%%" .Cache.HitPercent}}</td><td>{{.Cache.Evictions}}</td><td>{{.Cache.InflightLookups}}</td></tr>
+</table>
+
+<h2>Recent resolutions</h2>
+<table>
+<tr><th>Time</th><th>Host</th><th>Outcome</th><th>Link</th><th>Latency</th></tr>
+{{- range .Resolutions}}
+<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Host}}</td><td>{{.Outcome}}</td><td>{{if .Namespace}}<code>/{{.Namespace}}/{{.Identifier}}</code>{{else if .Error}}<span class="error">{{.Error}}</span>{{end}}</td><td>{{printf "%.1f ms" .LatencyMS}}</td></tr>
+{{- else}}
+<tr><td colspan="5">No resolutions yet.</td></tr>
+{{- end}}
+</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Host</th><th>Prefix</th><th>Error</th></tr>
+{{- range .Errors}}
+<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Host}}</td><td>{{if .Prefix}}<code>{{.Prefix}}</code>{{else}}resolution{{end}}</td><td class="error">{{.Error}}</td></tr>
+{{- else}}
+<tr><td colspan="4">No errors.</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// parseStatusCaddyfile parses the dnslink_status directive.
+// Syntax:
+//
+//	dnslink_status {
+//	    recent <n>
+//	}
+func parseStatusCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	s := new(Status)
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		for nesting := h.Nesting(); h.NextBlock(nesting); {
+			switch opt := h.Val(); opt {
+			case "recent":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				n, err := strconv.Atoi(h.Val())
+				if err != nil || n < 1 || n > maxRecent {
+					return nil, h.Errf("invalid %s '%s'", opt, h.Val())
+				}
+				s.Recent = n
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+			default:
+				return nil, h.Errf("unknown subdirective '%s'", opt)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Status)(nil)
+	_ caddy.Provisioner           = (*Status)(nil)
+	_ caddy.Validator             = (*Status)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Status)(nil)
+)
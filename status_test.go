@@ -0,0 +1,158 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func TestRecentActivity(t *testing.T) {
+	var ra recentActivity
+	start := time.Now()
+	ra.resolved("cached.example.com", outcomeHit, CacheEntry{Namespace: "ipfs", Identifier: "QmCached"}, start, nil)
+	for i := 0; i < maxRecent+10; i++ {
+		ra.resolved(fmt.Sprintf("%d.example.com", i), outcomeMiss, CacheEntry{Namespace: "ipfs", Identifier: "QmFake"}, start, nil)
+	}
+	ra.resolved("none.example.com", outcomeNoLink, CacheEntry{}, start, errors.New("NXDOMAIN"))
+	ra.resolved("broken.example.com", outcomeError, CacheEntry{}, start, errors.New("connection refused"))
+	ra.failed("a.example.com", "/ipfs", errors.New("dial tcp: connection refused"))
+
+	resolutions, errs := ra.snapshot()
+	if len(resolutions) != maxRecent {
+		t.Fatalf("kept %d resolutions, want %d", len(resolutions), maxRecent)
+	}
+	if resolutions[0].Host != "12.example.com" || resolutions[maxRecent-1].Host != "broken.example.com" {
+		t.Errorf("kept resolutions from %s to %s, want the latest", resolutions[0].Host, resolutions[maxRecent-1].Host)
+	}
+	for _, res := range resolutions {
+		if res.Outcome == outcomeHit {
+			t.Errorf("kept cache hit %+v", res)
+		}
+	}
+	want := []recentError{
+		{Host: "broken.example.com", Error: "connection refused"},
+		{Host: "a.example.com", Prefix: "/ipfs", Error: "dial tcp: connection refused"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors = %+v, want %+v", errs, want)
+	}
+	for i, e := range errs {
+		e.Time = time.Time{}
+		if e != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	a := &App{cache: new(MemoryCache), logger: zap.NewNop()}
+	a.stats.hits.Add(3)
+	a.stats.misses.Add(1)
+	a.recent.resolved("example.com", outcomeMiss, CacheEntry{Namespace: "ipfs", Identifier: "QmFake"}, time.Now(), nil)
+	a.recent.failed("example.com", "/ipfs", errors.New("dial tcp: connection refused"))
+	registerApp(a)
+	defer unregisterApp(a)
+	d := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "ipfs:8080"},
+		Routes:    map[string]string{"/swarm": "bee"},
+		proxies: map[string]*reverseproxy.Handler{
+			"/ipfs": {Upstreams: reverseproxy.UpstreamPool{{Dial: "ipfs:8080"}}},
+		},
+	}
+	registerHandler(d)
+	defer unregisterHandler(d)
+
+	s := &Status{Recent: 1}
+	rec := httptest.NewRecorder()
+	if err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status?format=json", nil), nil); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	var report statusReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if report.Status != healthOK || len(report.Prefixes) != 2 || len(report.Upstreams) != 1 {
+		t.Errorf("report = %+v, want ok with both prefixes and the ipfs upstream", report)
+	}
+	if report.Cache.HitRate != 0.75 {
+		t.Errorf("hit rate = %g, want 0.75", report.Cache.HitRate)
+	}
+	if len(report.Resolutions) != 1 || report.Resolutions[0].Identifier != "QmFake" || len(report.Errors) != 1 || report.Errors[0].Prefix != "/ipfs" {
+		t.Errorf("recent resolutions = %+v, errors = %+v", report.Resolutions, report.Errors)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/json;q=0.9")
+	rec = httptest.NewRecorder()
+	if err := s.ServeHTTP(rec, req, nil); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(body, "ipfs:8080") || !strings.Contains(body, "75.0%") || !strings.Contains(body, "/ipfs/QmFake") {
+		t.Errorf("HTML page = %s", body)
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+
+	err := s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/status", nil), nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST error = %v, want 405", err)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		url, accept string
+		want        bool
+	}{
+		{url: "/status"},
+		{url: "/status?format=json", want: true},
+		{url: "/status?format=html", accept: "application/json"},
+		{url: "/status", accept: "application/json", want: true},
+		{url: "/status", accept: "text/html,application/json;q=0.9"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("wantsJSON(%s, Accept %q) = %v, want %v", tt.url, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestParseStatusCaddyfile(t *testing.T) {
+	handler, err := parseStatusCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser("dnslink_status {\n recent 10\n}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := handler.(*Status); s.Recent != 10 {
+		t.Errorf("Recent = %d, want 10", s.Recent)
+	}
+
+	for _, input := range []string{
+		"dnslink_status now",
+		"dnslink_status {\n recent 0\n}",
+		"dnslink_status {\n recent 100\n}",
+		"dnslink_status {\n recent 10 20\n}",
+		"dnslink_status {\n unknown\n}",
+	} {
+		if _, err := parseStatusCaddyfile(httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}); err == nil {
+			t.Errorf("parseStatusCaddyfile(%q) succeeded", input)
+		}
+	}
+}
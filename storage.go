@@ -0,0 +1,99 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// storagePrefix is the storage key prefix under which resolved
+// entries are persisted.
+const storagePrefix = "dnslink/cache"
+
+// persistedLookup is the storage representation of a CacheEntry.
+type persistedLookup struct {
+	Host string `json:"host"`
+	CacheEntry
+}
+
+// storageKey returns the storage key for a host. The host comes from the
+// request, so it is sanitized before being used as a key.
+func storageKey(host string) string {
+	return path.Join(storagePrefix, certmagic.StorageKeys.Safe(host)+".json")
+}
+
+// persist writes a resolved entry to storage. Failures are logged but
+// otherwise ignored since the cache backend remains authoritative.
+func (a *App) persist(host string, entry CacheEntry) {
+	data, err := json.Marshal(persistedLookup{Host: host, CacheEntry: entry})
+	if err != nil {
+		a.logger.Error("encoding cache entry", zap.String("host", host), zap.Error(err))
+		return
+	}
+	if err := a.storage.Store(context.Background(), storageKey(host), data); err != nil {
+		a.logger.Error("persisting cache entry", zap.String("host", host), zap.Error(err))
+	}
+}
+
+// unpersist removes the persisted entry for host, if any.
+func (a *App) unpersist(ctx context.Context, host string) error {
+	err := a.storage.Delete(ctx, storageKey(host))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// unpersistAll removes all persisted entries.
+func (a *App) unpersistAll(ctx context.Context) error {
+	err := a.storage.Delete(ctx, storagePrefix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// loadPersisted warm-starts the cache from entries previously written to
+// storage. Entries that have already expired are removed from storage.
+func (a *App) loadPersisted(ctx context.Context) error {
+	keys, err := a.storage.List(ctx, storagePrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var loaded int
+	for _, key := range keys {
+		data, err := a.storage.Load(ctx, key)
+		if err != nil {
+			a.logger.Warn("loading persisted cache entry", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		var p persistedLookup
+		if err := json.Unmarshal(data, &p); err != nil {
+			a.logger.Warn("decoding persisted cache entry", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if p.Expired(now) {
+			_ = a.storage.Delete(ctx, key)
+			continue
+		}
+		if err := a.cache.Store(ctx, p.Host, p.CacheEntry); err != nil {
+			a.logger.Warn("restoring persisted cache entry", zap.String("host", p.Host), zap.Error(err))
+			continue
+		}
+		loaded++
+	}
+
+	a.logger.Debug("loaded persisted cache entries", zap.Int("count", loaded))
+	return nil
+}
@@ -0,0 +1,80 @@
+package dnslink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestPersistRoundTrip(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	writer := &App{cache: new(MemoryCache), storage: storage, logger: zap.NewNop()}
+	writer.persist("example.com", CacheEntry{
+		Namespace:  "ipfs",
+		Identifier: "QmXyz789",
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+	writer.persist("expired.example.com", CacheEntry{
+		Namespace:  "swarm",
+		Identifier: "abc123",
+		ExpiresAt:  time.Now().Add(-time.Minute),
+	})
+
+	reader := &App{cache: new(MemoryCache), storage: storage, logger: zap.NewNop()}
+	if err := reader.loadPersisted(context.Background()); err != nil {
+		t.Fatalf("loadPersisted() error = %v", err)
+	}
+
+	ctx := context.Background()
+	entry, ok, _ := reader.cache.Load(ctx, "example.com")
+	if !ok {
+		t.Fatal("expected example.com to be loaded from storage")
+	}
+	if entry.Namespace != "ipfs" || entry.Identifier != "QmXyz789" {
+		t.Errorf("loaded entry = %+v, want ipfs/QmXyz789", entry)
+	}
+
+	if _, ok, _ := reader.cache.Load(ctx, "expired.example.com"); ok {
+		t.Error("expired entry should not be loaded")
+	}
+	if storage.Exists(ctx, storageKey("expired.example.com")) {
+		t.Error("expired entry should be removed from storage")
+	}
+}
+
+func TestLoadPersistedEmptyStorage(t *testing.T) {
+	d := &App{cache: new(MemoryCache), storage: &certmagic.FileStorage{Path: t.TempDir()}, logger: zap.NewNop()}
+	if err := d.loadPersisted(context.Background()); err != nil {
+		t.Fatalf("loadPersisted() error = %v", err)
+	}
+}
+
+func TestCleanupWaitsForPersist(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		storage:       storage,
+		logger:        zap.NewNop(),
+		lookup: func(context.Context, string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmXyz789"}}, nil
+		},
+	}
+	if _, _, err := a.resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Cleanup(); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if !storage.Exists(context.Background(), storageKey("example.com")) {
+		t.Error("Cleanup() returned before the resolution was persisted")
+	}
+}
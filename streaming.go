@@ -0,0 +1,127 @@
+package dnslink
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/dustin/go-humanize"
+)
+
+// Streaming tunes how the reverse proxy of a prefix streams bodies, e.g.
+// flushing video segments immediately or keeping websocket connections to
+// a pubsub gateway open across config reloads. Unset fields keep the
+// reverse proxy's defaults.
+type Streaming struct {
+	// FlushInterval is how often the response is flushed to the client
+	// while it is copied from the upstream. -1 flushes after every write.
+	// Default is to flush only chunked, event stream and unknown-length
+	// responses immediately.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// RequestBuffers and ResponseBuffers are how many bytes of request and
+	// response bodies are buffered, -1 for no limit. Buffering a request
+	// lets upstreams that can't handle chunked uploads see its length.
+	// Default is no buffering.
+	RequestBuffers  int64 `json:"request_buffers,omitempty"`
+	ResponseBuffers int64 `json:"response_buffers,omitempty"`
+
+	// StreamTimeout closes streams such as websocket connections once
+	// they have been open this long. Default is no timeout.
+	StreamTimeout caddy.Duration `json:"stream_timeout,omitempty"`
+
+	// StreamCloseDelay keeps streams open this long after a config reload
+	// instead of closing them right away, so clients don't all reconnect
+	// at once. Default is 0.
+	StreamCloseDelay caddy.Duration `json:"stream_close_delay,omitempty"`
+}
+
+// validate checks the streaming configuration.
+func (s *Streaming) validate() error {
+	if s.FlushInterval < -1 {
+		return fmt.Errorf("invalid flush_interval %v", time.Duration(s.FlushInterval))
+	}
+	if s.RequestBuffers < -1 || s.ResponseBuffers < -1 {
+		return fmt.Errorf("negative buffer size")
+	}
+	if s.StreamTimeout < 0 || s.StreamCloseDelay < 0 {
+		return fmt.Errorf("negative stream timeout")
+	}
+	return nil
+}
+
+// apply sets the streaming options of s on rp.
+func (s *Streaming) apply(rp *reverseproxy.Handler) {
+	rp.FlushInterval = s.FlushInterval
+	rp.RequestBuffers = s.RequestBuffers
+	rp.ResponseBuffers = s.ResponseBuffers
+	rp.StreamTimeout = s.StreamTimeout
+	rp.StreamCloseDelay = s.StreamCloseDelay
+}
+
+// unmarshalStreaming parses the streaming subdirective:
+//
+//	streaming <prefix> {
+//	    flush_interval <duration>|-1
+//	    request_buffers <size>|unlimited
+//	    response_buffers <size>|unlimited
+//	    stream_timeout <duration>
+//	    stream_close_delay <duration>
+//	}
+func unmarshalStreaming(d *caddyfile.Dispenser) (string, *Streaming, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	s := new(Streaming)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		opt := d.Val()
+		if !d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+		switch opt {
+		case "flush_interval", "stream_timeout", "stream_close_delay":
+			if opt == "flush_interval" && d.Val() == "-1" {
+				s.FlushInterval = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur < 0 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			switch opt {
+			case "flush_interval":
+				s.FlushInterval = caddy.Duration(dur)
+			case "stream_timeout":
+				s.StreamTimeout = caddy.Duration(dur)
+			default:
+				s.StreamCloseDelay = caddy.Duration(dur)
+			}
+		case "request_buffers", "response_buffers":
+			size := int64(-1)
+			if d.Val() != "unlimited" {
+				n, err := humanize.ParseBytes(d.Val())
+				if err != nil || n > 1<<62 {
+					return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+				}
+				size = int64(n)
+			}
+			if opt == "request_buffers" {
+				s.RequestBuffers = size
+			} else {
+				s.ResponseBuffers = size
+			}
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	return prefix, s, nil
+}
@@ -0,0 +1,72 @@
+package dnslink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func TestParseStreaming(t *testing.T) {
+	input := `streaming /ipfs {
+		flush_interval -1
+		request_buffers 4MiB
+		response_buffers unlimited
+		stream_timeout 24h
+		stream_close_delay 5m
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	d.Next()
+	prefix, s, err := unmarshalStreaming(d)
+	if err != nil {
+		t.Fatalf("unmarshalStreaming() error = %v", err)
+	}
+	if prefix != "/ipfs" {
+		t.Errorf("prefix = %q, want /ipfs", prefix)
+	}
+	want := Streaming{
+		FlushInterval:    -1,
+		RequestBuffers:   4 << 20,
+		ResponseBuffers:  -1,
+		StreamTimeout:    caddy.Duration(24 * time.Hour),
+		StreamCloseDelay: caddy.Duration(5 * time.Minute),
+	}
+	if *s != want {
+		t.Errorf("Streaming = %+v, want %+v", *s, want)
+	}
+
+	for _, input := range []string{
+		"streaming /ipfs {\n flush_interval -2s\n}",
+		"streaming /ipfs {\n request_buffers lots\n}",
+		"streaming /ipfs {\n stream_timeout\n}",
+		"streaming /ipfs {\n buffer_requests on\n}",
+		"streaming /ipfs extra",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, _, err := unmarshalStreaming(d); err == nil {
+			t.Errorf("unmarshalStreaming(%q) succeeded", input)
+		}
+	}
+}
+
+func TestStreamingApply(t *testing.T) {
+	rp := new(reverseproxy.Handler)
+	(&Streaming{FlushInterval: -1, ResponseBuffers: 1024, StreamTimeout: caddy.Duration(time.Hour)}).apply(rp)
+	if rp.FlushInterval != -1 || rp.ResponseBuffers != 1024 || rp.RequestBuffers != 0 || rp.StreamTimeout != caddy.Duration(time.Hour) {
+		t.Errorf("reverse proxy = flush %v, buffers %d/%d, timeout %v", rp.FlushInterval, rp.RequestBuffers, rp.ResponseBuffers, rp.StreamTimeout)
+	}
+
+	if err := (&Streaming{ResponseBuffers: -2}).validate(); err == nil {
+		t.Error("validate() accepted a negative buffer size")
+	}
+	d := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "ipfs:8080"},
+		Streaming: map[string]*Streaming{"/swarm": {FlushInterval: -1}},
+	}
+	if err := d.Validate(); err == nil {
+		t.Error("Validate() accepted streaming for a prefix without upstream")
+	}
+}
@@ -0,0 +1,252 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// maxLabelLength is the maximum length of a DNS label.
+const maxLabelLength = 63
+
+// Multicodec and multihash codes of IPNS names.
+const (
+	codecLibp2pKey  = 0x72
+	hashIdentity    = 0x00
+	hashSHA256      = 0x12
+	sha256Length    = 32
+	identityMaxSize = 42
+)
+
+// SubdomainRedirect redirects requests for ipfs and ipns links to a
+// subdomain gateway, e.g. https://<cidv1>.ipfs.dweb.link/<path>, so every
+// site gets its own origin, instead of proxying them from the DNSLink host.
+type SubdomainRedirect struct {
+	// Gateway is the domain of the subdomain gateway, e.g. "dweb.link".
+	Gateway string `json:"gateway"`
+
+	// Scheme is the scheme of the redirect URL. Default is https.
+	Scheme string `json:"scheme,omitempty"`
+
+	// Status is the redirect status. Default is 302 Found, since the
+	// target changes whenever the host's link does.
+	Status int `json:"status,omitempty"`
+}
+
+// provision validates the configuration and sets the defaults.
+func (s *SubdomainRedirect) provision() error {
+	host := s.Gateway
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !isDomainName(host) {
+		return fmt.Errorf("invalid gateway '%s'", s.Gateway)
+	}
+	if s.Scheme == "" {
+		s.Scheme = "https"
+	}
+	if s.Scheme != "http" && s.Scheme != "https" {
+		return fmt.Errorf("invalid scheme '%s'", s.Scheme)
+	}
+	if s.Status == 0 {
+		s.Status = http.StatusFound
+	}
+	if s.Status < 300 || s.Status > 399 {
+		return fmt.Errorf("invalid redirect status %d", s.Status)
+	}
+	return nil
+}
+
+// location returns the subdomain gateway URL of an escaped identifier in
+// namespace and the escaped request path and query. ok is false for
+// namespaces subdomain gateways do not serve.
+func (s *SubdomainRedirect) location(namespace, identifier, requestPath, rawQuery string) (loc string, ok bool, err error) {
+	if namespace != "ipfs" && namespace != "ipns" {
+		return "", false, nil
+	}
+	root, rest, _ := strings.Cut(identifier, "/")
+	label, err := subdomainLabel(namespace, root)
+	if err != nil {
+		return "", true, err
+	}
+	loc = s.Scheme + "://" + label + "." + namespace + "." + s.Gateway
+	if rest != "" {
+		loc += "/" + strings.TrimSuffix(rest, "/")
+	}
+	loc += requestPath
+	if rawQuery != "" {
+		loc += "?" + rawQuery
+	}
+	return loc, true, nil
+}
+
+// subdomainLabel returns the DNS label under which a subdomain gateway
+// serves root: a base32 CIDv1 for ipfs, and for ipns a base36 libp2p-key
+// CIDv1 or a DNS-inlined domain name, with "-" doubled and "." replaced
+// by "-".
+func subdomainLabel(namespace, root string) (string, error) {
+	var label string
+	switch {
+	case namespace == "ipns" && isDomainName(root):
+		label = strings.ReplaceAll(strings.ReplaceAll(strings.TrimSuffix(root, "."), "-", "--"), ".", "-")
+	case namespace == "ipns":
+		key, err := decodeIPNSKey(root)
+		if err != nil {
+			return "", fmt.Errorf("invalid ipns name '%s': %v", root, err)
+		}
+		label = "k" + encodeBase(key, base36Alphabet)
+	default:
+		cid, err := decodeCID(root)
+		if err != nil {
+			return "", fmt.Errorf("invalid ipfs identifier '%s': %v", root, err)
+		}
+		label = "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(cid))
+	}
+	if len(label) > maxLabelLength {
+		return "", fmt.Errorf("'%s' is too long for a DNS label", label)
+	}
+	return strings.ToLower(label), nil
+}
+
+// decodeIPNSKey returns the libp2p-key CIDv1 of an IPNS name given as a
+// CID or as a base58 peer ID.
+func decodeIPNSKey(name string) ([]byte, error) {
+	var cid []byte
+	if strings.HasPrefix(name, "Qm") || strings.HasPrefix(name, "1") {
+		mh, err := decodeBase(name, base58Alphabet)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateMultihash(mh); err != nil {
+			return nil, err
+		}
+		cid = append([]byte{0x01, codecLibp2pKey}, mh...)
+	} else {
+		var err error
+		if cid, err = decodeCID(name); err != nil {
+			return nil, err
+		}
+		// Rewrite the codec, which may be dag-pb for CIDv0-derived
+		// names, to libp2p-key.
+		_, n := binary.Uvarint(cid[1:])
+		cid = append([]byte{0x01, codecLibp2pKey}, cid[1+n:]...)
+	}
+	return cid, nil
+}
+
+// validateMultihash checks that mh is a sha2-256 or identity multihash,
+// the forms of peer IDs.
+func validateMultihash(mh []byte) error {
+	if len(mh) < 2 {
+		return errors.New("not a multihash")
+	}
+	switch fn, length := mh[0], int(mh[1]); {
+	case fn == hashSHA256 && length == sha256Length && len(mh) == 2+length:
+	case fn == hashIdentity && length <= identityMaxSize && len(mh) == 2+length:
+	default:
+		return errors.New("not a peer ID")
+	}
+	return nil
+}
+
+// subdomainHost splits a host of the form <label>.<namespace>.<gateway>,
+// for namespace ipfs or ipns and one of gateways, into its namespace and
+// label.
+func subdomainHost(host string, gateways []string) (namespace, label string, ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, gateway := range gateways {
+		rest, found := strings.CutSuffix(host, "."+gateway)
+		if !found {
+			continue
+		}
+		label, namespace, found := strings.Cut(rest, ".")
+		if found && label != "" && (namespace == "ipfs" || namespace == "ipns") {
+			return namespace, label, true
+		}
+	}
+	return "", "", false
+}
+
+// uninlineDomain reverses the DNS inlining of a domain name in a
+// subdomain gateway label: "--" is a "-" and any other "-" a ".".
+func uninlineDomain(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		switch {
+		case strings.HasPrefix(label[i:], "--"):
+			b.WriteByte('-')
+			i++
+		case label[i] == '-':
+			b.WriteByte('.')
+		default:
+			b.WriteByte(label[i])
+		}
+	}
+	return b.String()
+}
+
+// resolveSubdomain returns the link of a subdomain gateway label in
+// namespace. CIDs and IPNS keys are used as they are; other ipns labels
+// are un-inlined to a domain whose DNSLink record is resolved. Labels that
+// are neither give an entry without a link.
+func (d *DNSLink) resolveSubdomain(ctx context.Context, namespace, label string) (CacheEntry, error) {
+	if validateCID(label) == nil {
+		return CacheEntry{
+			Namespace:  namespace,
+			Identifier: label,
+			Links:      map[string]dnslinkpkg.NamespaceEntries{namespace: {{Identifier: label}}},
+		}, nil
+	}
+	if namespace != "ipns" {
+		return CacheEntry{}, nil
+	}
+	domain := uninlineDomain(label)
+	if !isDomainName(domain) {
+		return CacheEntry{}, nil
+	}
+	entry, _, err := d.app.resolveEntry(ctx, domain)
+	return entry, err
+}
+
+// unmarshalSubdomainRedirect parses the subdomain_redirect subdirective:
+//
+//	subdomain_redirect <gateway> [<status>] {
+//	    scheme http|https
+//	}
+func unmarshalSubdomainRedirect(d *caddyfile.Dispenser) (*SubdomainRedirect, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	s := &SubdomainRedirect{Gateway: d.Val()}
+	if d.NextArg() {
+		status, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid status '%s'", d.Val())
+		}
+		s.Status = status
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "scheme":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			s.Scheme = d.Val()
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return s, nil
+}
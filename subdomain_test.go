@@ -0,0 +1,158 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestSubdomainLabel(t *testing.T) {
+	tests := []struct {
+		namespace string
+		root      string
+		want      string
+		wantErr   bool
+	}{
+		{namespace: "ipfs", root: "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR", want: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"},
+		{namespace: "ipfs", root: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", want: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"},
+		{namespace: "ipfs", root: "f01701220c3c4733ec8affd06cf9e9ff50ffc6bcd2ec85a6170004bb709669c31de94391a", want: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"},
+		{namespace: "ipns", root: "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8", want: "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8"},
+		{namespace: "ipns", root: "12D3KooWRBy97UB99e3J6hiPesre1MZeuNQvfan4gBziswrRJsNK", want: "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8"},
+		{namespace: "ipns", root: "docs.ipfs-tech.example", want: "docs-ipfs--tech-example"},
+		{namespace: "ipfs", root: "not-a-cid", wantErr: true},
+		{namespace: "ipns", root: "12D3KooWnotapeerid", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.root, func(t *testing.T) {
+			got, err := subdomainLabel(tt.namespace, tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("subdomainLabel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("subdomainLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubdomainRedirect(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	links := map[string]string{
+		"ipfs.example.com":  "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR/site",
+		"swarm.example.com": "d1de9994b4d039f6548d191eb26786769f580809256b4685ef316805265ea162",
+	}
+	d := &DNSLink{
+		SubdomainRedirect: &SubdomainRedirect{Gateway: "dweb.link"},
+		proxies:           map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				namespace := "ipfs"
+				if host == "swarm.example.com" {
+					namespace = "swarm"
+				}
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					namespace: {{Identifier: links[host]}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.SubdomainRedirect.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	var passed bool
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		passed = true
+		return nil
+	})
+	rec := httptest.NewRecorder()
+	if err := d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://ipfs.example.com/a/b.html?x=1", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	want := "https://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi.ipfs.dweb.link/site/a/b.html?x=1"
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != want {
+		t.Errorf("response = %d %q, want 302 %q", rec.Code, rec.Header().Get("Location"), want)
+	}
+
+	// Namespaces without subdomain gateways are not redirected.
+	rec = httptest.NewRecorder()
+	if err := d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://swarm.example.com/", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Location") != "" || !passed {
+		t.Errorf("swarm link redirected to %q", rec.Header().Get("Location"))
+	}
+
+	for _, bad := range []SubdomainRedirect{{Gateway: "localhost"}, {Gateway: "dweb.link", Status: 200}, {Gateway: "dweb.link", Scheme: "ftp"}} {
+		if err := bad.provision(); err == nil {
+			t.Errorf("provision(%+v) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestSubdomainGateway(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	tests := []struct {
+		host          string
+		wantNamespace string
+		wantLabel     string
+		wantOK        bool
+	}{
+		{host: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi.ipfs.example.com", wantNamespace: "ipfs", wantLabel: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", wantOK: true},
+		{host: "Docs-IPFS-tech.IPNS.example.com.", wantNamespace: "ipns", wantLabel: "docs-ipfs-tech", wantOK: true},
+		{host: "ipfs.example.com"},
+		{host: "a.b.ipfs.example.com"},
+		{host: "site.swarm.example.com"},
+		{host: "bafy.ipfs.other.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			namespace, label, ok := subdomainHost(tt.host, []string{"gw.example.org", "example.com"})
+			if namespace != tt.wantNamespace || label != tt.wantLabel || ok != tt.wantOK {
+				t.Errorf("subdomainHost() = %q, %q, %v, want %q, %q, %v", namespace, label, ok, tt.wantNamespace, tt.wantLabel, tt.wantOK)
+			}
+		})
+	}
+	if got := uninlineDomain("my--site-example-com"); got != "my-site.example.com" {
+		t.Errorf("uninlineDomain() = %q, want my-site.example.com", got)
+	}
+
+	var resolved []string
+	d := &DNSLink{
+		SubdomainGateways: []string{"example.com"},
+		app: &App{
+			cache:  new(MemoryCache),
+			logger: zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				resolved = append(resolved, host)
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					"ipfs": {{Identifier: "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"}},
+				}}, nil
+			})},
+		},
+	}
+	ctx := context.Background()
+	entry, err := d.resolveSubdomain(ctx, "ipfs", "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	if err != nil || entry.Namespace != "ipfs" || entry.Identifier != "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi" {
+		t.Errorf("resolveSubdomain(cid) = %+v, %v", entry, err)
+	}
+	entry, err = d.resolveSubdomain(ctx, "ipns", "docs-ipfs-tech")
+	if err != nil || entry.Namespace != "ipfs" || len(resolved) != 1 || resolved[0] != "docs.ipfs.tech" {
+		t.Errorf("resolveSubdomain(domain) = %+v, %v, resolved %q", entry, err, resolved)
+	}
+	entry, err = d.resolveSubdomain(ctx, "ipfs", "www")
+	if err != nil || entry.Namespace != "" || len(resolved) != 1 {
+		t.Errorf("resolveSubdomain(www) = %+v, %v, want no link and no lookup", entry, err)
+	}
+}
@@ -0,0 +1,104 @@
+package dnslink
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Placeholders available in path templates.
+const (
+	placeholderNamespace  = "{namespace}"
+	placeholderIdentifier = "{identifier}"
+	placeholderPath       = "{path}"
+)
+
+// defaultPathTemplates maps namespaces to the path template used by their
+// prefix when it has neither a template nor a replacement: ar.io-style
+// Arweave gateways serve transactions at /<id>, without a namespace.
+var defaultPathTemplates = map[string]string{
+	"arweave": "/" + placeholderIdentifier + placeholderPath,
+	"ar":      "/" + placeholderIdentifier + placeholderPath,
+}
+
+// validateTemplate checks that a path template references the identifier,
+// or the components of a multiaddr link; without them every host would be
+// proxied to the same content.
+func validateTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, placeholderIdentifier) && !hasMultiaddrPlaceholders(tmpl) {
+		return fmt.Errorf("path template %q does not contain %s", tmpl, placeholderIdentifier)
+	}
+	return nil
+}
+
+// identifierQueryTemplate returns the path template of an upstream that
+// takes the identifier and request path in the query parameter param of
+// path, e.g. /api/v0/dag/get?arg={identifier}{path}.
+func identifierQueryTemplate(path, param string) string {
+	return path + "?" + url.QueryEscape(param) + "=" + placeholderIdentifier + placeholderPath
+}
+
+// expandTemplate fills in a path template such as /bzz/{identifier}{path}
+// or /api/v0/cat?arg={identifier}{path}. identifier and path must already
+// be escaped for use in a URL path (see escapeIdentifier and cleanPath).
+// Placeholders after the first ? are query-escaped instead, and the query
+// part is returned separately. A trailing slash of identifier is dropped,
+// since path always starts with one.
+func expandTemplate(tmpl, namespace, identifier, path string) (rawPath, rawQuery string) {
+	identifier = strings.TrimSuffix(identifier, "/")
+	pathTmpl, queryTmpl, hasQuery := strings.Cut(tmpl, "?")
+	rawPath = strings.NewReplacer(
+		placeholderNamespace, url.PathEscape(namespace),
+		placeholderIdentifier, identifier,
+		placeholderPath, path,
+	).Replace(pathTmpl)
+	if hasQuery {
+		rawQuery = strings.NewReplacer(
+			placeholderNamespace, url.QueryEscape(namespace),
+			placeholderIdentifier, queryEscapePath(identifier),
+			placeholderPath, queryEscapePath(path),
+		).Replace(queryTmpl)
+	}
+	return rawPath, rawQuery
+}
+
+// queryEscapePath re-escapes an escaped path for use in a query value.
+func queryEscapePath(p string) string {
+	unescaped, err := url.PathUnescape(p)
+	if err != nil {
+		unescaped = p
+	}
+	return url.QueryEscape(unescaped)
+}
+
+// mergeQuery appends the client's query to the one of an expanded
+// template. Client parameters named like a template parameter are
+// dropped, so a request cannot override or duplicate the identifier
+// argument.
+func mergeQuery(templateQuery, clientQuery string) string {
+	if templateQuery == "" || clientQuery == "" {
+		return templateQuery + clientQuery
+	}
+	names := make(map[string]bool)
+	for _, param := range strings.Split(templateQuery, "&") {
+		names[queryParamName(param)] = true
+	}
+	merged := templateQuery
+	for _, param := range strings.Split(clientQuery, "&") {
+		if param == "" || names[queryParamName(param)] {
+			continue
+		}
+		merged += "&" + param
+	}
+	return merged
+}
+
+// queryParamName returns the unescaped name of a name=value query
+// parameter.
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
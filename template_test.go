@@ -0,0 +1,127 @@
+package dnslink
+
+import "testing"
+
+func TestExpandTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		tmpl       string
+		namespace  string
+		identifier string
+		path       string
+		wantPath   string
+		wantQuery  string
+	}{
+		{
+			name:       "bzz layout",
+			tmpl:       "/bzz/{identifier}{path}",
+			namespace:  "swarm",
+			identifier: "abc123",
+			path:       "/index.html",
+			wantPath:   "/bzz/abc123/index.html",
+		},
+		{
+			name:       "identifier with trailing slash",
+			tmpl:       "/bzz/{identifier}{path}",
+			namespace:  "swarm",
+			identifier: "abc123/",
+			path:       "/",
+			wantPath:   "/bzz/abc123/",
+		},
+		{
+			name:       "namespace placeholder",
+			tmpl:       "/gw/{namespace}/{identifier}{path}",
+			namespace:  "ipfs",
+			identifier: "QmXyz789",
+			path:       "/a%20b",
+			wantPath:   "/gw/ipfs/QmXyz789/a%20b",
+		},
+		{
+			name:       "kubo cat api",
+			tmpl:       "/api/v0/cat?arg={identifier}{path}",
+			namespace:  "ipfs",
+			identifier: "QmXyz789",
+			path:       "/docs/a%20b&c.txt",
+			wantPath:   "/api/v0/cat",
+			wantQuery:  "arg=QmXyz789%2Fdocs%2Fa+b%26c.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, query := expandTemplate(tt.tmpl, tt.namespace, tt.identifier, tt.path)
+			if path != tt.wantPath || query != tt.wantQuery {
+				t.Errorf("expandTemplate() = %q, %q, want %q, %q", path, query, tt.wantPath, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	if err := validateTemplate("/bzz/{identifier}{path}"); err != nil {
+		t.Errorf("validateTemplate() error: %v", err)
+	}
+	if err := validateTemplate("/bzz/{path}"); err == nil {
+		t.Error("validateTemplate() accepted a template without {identifier}")
+	}
+}
+
+func TestMergeQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		client   string
+		want     string
+	}{
+		{name: "no client query", template: "arg=QmXyz789", want: "arg=QmXyz789"},
+		{name: "no template query", client: "download=true", want: "download=true"},
+		{name: "appended", template: "arg=QmXyz789", client: "download=true&x=1", want: "arg=QmXyz789&download=true&x=1"},
+		{name: "overriding parameter dropped", template: "arg=QmXyz789", client: "arg=QmEvil&x=1", want: "arg=QmXyz789&x=1"},
+		{name: "escaped name dropped", template: "arg=QmXyz789", client: "%61rg=QmEvil", want: "arg=QmXyz789"},
+		{name: "empty parameters skipped", template: "arg=QmXyz789", client: "&&x", want: "arg=QmXyz789&x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeQuery(tt.template, tt.client); got != tt.want {
+				t.Errorf("mergeQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentifierQueryTemplate(t *testing.T) {
+	tmpl := identifierQueryTemplate("/api/v0/dag/get", "arg")
+	if err := validateTemplate(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	path, query := expandTemplate(tmpl, "ipfs", "QmXyz789", "/a/b.json")
+	if path != "/api/v0/dag/get" || query != "arg=QmXyz789%2Fa%2Fb.json" {
+		t.Errorf("expandTemplate() = %q, %q", path, query)
+	}
+}
+
+func TestDefaultPathTemplate(t *testing.T) {
+	d := &DNSLink{
+		PathTemplates: map[string]string{"/ipfs": "/ipfs/{identifier}{path}"},
+		Replacements:  map[string]string{"/ar": "/raw"},
+	}
+	tests := []struct {
+		prefix string
+		want   string
+		wantOK bool
+	}{
+		{prefix: "/ipfs", want: "/ipfs/{identifier}{path}", wantOK: true},
+		{prefix: "/arweave", want: "/{identifier}{path}", wantOK: true},
+		{prefix: "/ar"},
+		{prefix: "/swarm"},
+	}
+	for _, tt := range tests {
+		tmpl, ok := d.pathTemplate(tt.prefix)
+		if tmpl != tt.want || ok != tt.wantOK {
+			t.Errorf("pathTemplate(%s) = %q, %v, want %q, %v", tt.prefix, tmpl, ok, tt.want, tt.wantOK)
+		}
+	}
+	path, _ := expandTemplate(defaultPathTemplates["arweave"], "arweave", "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U", "/index.html")
+	if path != "/bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U/index.html" {
+		t.Errorf("expandTemplate() = %q", path)
+	}
+}
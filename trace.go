@@ -0,0 +1,181 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// defaultTraceHeader is the default Trace header.
+const defaultTraceHeader = "X-Dnslink-Trace"
+
+// Trace answers authorized requests carrying its header with a JSON
+// description of how they would have been routed, instead of routing
+// them: the host's records, the link chosen, how the cache was used, the
+// prefix matched, and the upstream and rewritten path the request would
+// have been proxied to.
+type Trace struct {
+	// Header is the request header asking for a trace. Default is
+	// X-Dnslink-Trace.
+	Header string `json:"header,omitempty"`
+
+	// Secret, if set, must be the value of the header. It may be a global
+	// placeholder such as {env.DNSLINK_TRACE_SECRET}.
+	Secret string `json:"secret,omitempty"`
+
+	// TrustedIPs, if set, lists the IP ranges (CIDR or single addresses,
+	// or "private_ranges") of the clients allowed to trace. At least one
+	// of Secret and TrustedIPs is required.
+	TrustedIPs []string `json:"trusted_ips,omitempty"`
+
+	auth requestAuth
+}
+
+// provision validates the configuration and sets the defaults.
+func (t *Trace) provision() error {
+	if t.Header == "" {
+		t.Header = defaultTraceHeader
+	}
+	auth, err := newRequestAuth(t.Secret, t.TrustedIPs)
+	if err != nil {
+		return err
+	}
+	t.auth = auth
+	return nil
+}
+
+// requested reports whether r asks for a trace and is allowed to. The
+// trace header is removed from r either way.
+func (t *Trace) requested(r *http.Request) bool {
+	value := r.Header.Get(t.Header)
+	r.Header.Del(t.Header)
+	return t.auth.allowed(r, value)
+}
+
+// Outcomes of a traced request.
+const (
+	traceProxy    = "proxy"
+	traceRedirect = "redirect"
+	traceFail     = "fail"
+	traceNext     = "next"
+)
+
+// requestTrace is the response to a traced request.
+type requestTrace struct {
+	Host  string `json:"host"`
+	Cache string `json:"cache,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	Links      map[string]dnslinkpkg.NamespaceEntries `json:"links,omitempty"`
+	Namespace  string                                 `json:"namespace,omitempty"`
+	Identifier string                                 `json:"identifier,omitempty"`
+	ExpiresAt  *time.Time                             `json:"expires_at,omitempty"`
+
+	// CanonicalName is the name the records were found at through CNAME
+	// records, if any.
+	CanonicalName string `json:"canonical_name,omitempty"`
+
+	Prefix          string          `json:"prefix,omitempty"`
+	Upstream        string          `json:"upstream,omitempty"`
+	DynamicUpstream json.RawMessage `json:"dynamic_upstream,omitempty"`
+	Failover        []string        `json:"failover,omitempty"`
+	UpstreamPath    string          `json:"upstream_path,omitempty"`
+	Redirect        string          `json:"redirect,omitempty"`
+
+	// Outcome is what would have been done with the request: proxy,
+	// redirect, fail with Status and Message, or pass it to the next
+	// handler.
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// traceKey is the context key of a request's trace.
+type traceKey struct{}
+
+// withTrace returns r with tr attached to its context.
+func withTrace(r *http.Request, tr *requestTrace) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, tr))
+}
+
+// traceFrom returns the trace attached to r by withTrace, or nil.
+func traceFrom(r *http.Request) *requestTrace {
+	tr, _ := r.Context().Value(traceKey{}).(*requestTrace)
+	return tr
+}
+
+// setEntry records the resolved entry in the trace.
+func (tr *requestTrace) setEntry(entry CacheEntry) {
+	tr.Links = entry.Links
+	tr.Namespace = entry.Namespace
+	tr.Identifier = entry.Identifier
+	tr.CanonicalName = entry.CanonicalName
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt := entry.ExpiresAt
+		tr.ExpiresAt = &expiresAt
+	}
+}
+
+// setPrefix records the prefix matched and its upstreams in the trace.
+func (tr *requestTrace) setPrefix(d *DNSLink, prefix string) {
+	tr.Prefix = prefix
+	tr.Upstream, tr.DynamicUpstream = d.upstream(prefix)
+	if f, ok := d.Failover[prefix]; ok {
+		tr.Failover = f.Upstreams
+	}
+}
+
+// write sends the trace as the response.
+func (tr *requestTrace) write(w http.ResponseWriter) error {
+	body, err := json.MarshalIndent(tr, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+// unmarshalTrace parses the trace subdirective:
+//
+//	trace {
+//	    header <name>
+//	    secret <secret>
+//	    trusted_ips <ranges>...
+//	}
+func unmarshalTrace(d *caddyfile.Dispenser) (*Trace, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	t := new(Trace)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "header", "secret":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if opt == "header" {
+				t.Header = d.Val()
+			} else {
+				t.Secret = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "trusted_ips":
+			ranges := d.RemainingArgs()
+			if len(ranges) == 0 {
+				return nil, d.ArgErr()
+			}
+			t.TrustedIPs = append(t.TrustedIPs, ranges...)
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+	}
+	return t, nil
+}
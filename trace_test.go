@@ -0,0 +1,129 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestTrace(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	links := map[string]dnslinkpkg.Result{
+		"ipfs.example.com":  {Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}},
+		"swarm.example.com": {Links: map[string]dnslinkpkg.NamespaceEntries{"swarm": {{Identifier: "abc"}}}},
+	}
+	d := &DNSLink{
+		Upstreams:      map[string]string{"/ipfs": "localhost:8080"},
+		NormalizePaths: []string{"/ipfs"},
+		Trace:          &Trace{Secret: "s3cret"},
+		OnMiss:         http.StatusNotFound,
+		proxies:        map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				return links[host], nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Trace.provision(); err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		secret string
+		want   requestTrace
+	}{
+		{
+			name:   "proxy",
+			target: "http://ipfs.example.com/a/b?x=1",
+			secret: "s3cret",
+			want: requestTrace{
+				Host: "ipfs.example.com", Cache: cacheStatusMiss, Namespace: "ipfs", Identifier: "QmSite",
+				Prefix: "/ipfs", Upstream: "localhost:8080", UpstreamPath: "/ipfs/QmSite/a/b?x=1", Outcome: traceProxy,
+			},
+		},
+		{
+			name:   "escaped path",
+			target: "http://ipfs.example.com//a%2Fb//c%20d%3F",
+			secret: "s3cret",
+			want: requestTrace{
+				Host: "ipfs.example.com", Cache: cacheStatusHit, Namespace: "ipfs", Identifier: "QmSite",
+				Prefix: "/ipfs", Upstream: "localhost:8080", UpstreamPath: "/ipfs/QmSite/a%2Fb/c%20d%3F", Outcome: traceProxy,
+			},
+		},
+		{
+			name:   "cached",
+			target: "http://ipfs.example.com/",
+			secret: "s3cret",
+			want: requestTrace{
+				Host: "ipfs.example.com", Cache: cacheStatusHit, Namespace: "ipfs", Identifier: "QmSite",
+				Prefix: "/ipfs", Upstream: "localhost:8080", UpstreamPath: "/ipfs/QmSite/", Outcome: traceProxy,
+			},
+		},
+		{
+			name:   "unserved namespace",
+			target: "http://swarm.example.com/",
+			secret: "s3cret",
+			want: requestTrace{
+				Host: "swarm.example.com", Cache: cacheStatusMiss, Namespace: "swarm", Identifier: "abc",
+				Outcome: traceFail, Status: http.StatusNotFound, Message: "namespace swarm is not served for swarm.example.com",
+			},
+		},
+		{
+			name:   "wrong secret",
+			target: "http://swarm.example.com/",
+			secret: "guess",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set(defaultTraceHeader, tt.secret)
+			w := httptest.NewRecorder()
+			if err := d.ServeHTTP(w, r, next); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.Outcome == "" {
+				if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") == "application/json" {
+					t.Errorf("untraced request got status %d and %s", w.Code, w.Header().Get("Content-Type"))
+				}
+				return
+			}
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("trace response status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+			}
+			var got requestTrace
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Links == nil {
+				t.Error("trace has no links")
+			}
+			got.Links, got.ExpiresAt = nil, nil
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("trace = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package dnslink
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies this module's spans.
+const tracerName = "github.com/o8is/caddy-dnslink"
+
+// Span attribute keys.
+const (
+	attrHost       = attribute.Key("dnslink.host")
+	attrNamespace  = attribute.Key("dnslink.namespace")
+	attrIdentifier = attribute.Key("dnslink.identifier")
+	attrCacheHit   = attribute.Key("dnslink.cache_hit")
+)
+
+// startSpan starts a child span of the span in ctx, using the parent's
+// tracer provider. When Caddy's tracing handler is not in use there is no
+// parent span and the returned span is a no-op.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
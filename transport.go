@@ -0,0 +1,189 @@
+package dnslink
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// Defaults of the reverse proxy's HTTP transport, which it only applies
+// when no keep-alive settings are given at all.
+const (
+	defaultKeepAliveInterval   = 30 * time.Second
+	defaultKeepAliveIdle       = 2 * time.Minute
+	defaultMaxIdleConnsPerHost = 32
+)
+
+// Transport tunes the connections of a prefix to its upstreams, e.g. a
+// long response header timeout for an IPFS gateway fetching cold content
+// from the DHT. Unset fields keep the reverse proxy's defaults.
+type Transport struct {
+	// DialTimeout bounds connecting to an upstream. Default is 3s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// ResponseHeaderTimeout bounds the wait for an upstream's response
+	// headers once the request is sent. Default is no timeout.
+	ResponseHeaderTimeout caddy.Duration `json:"response_header_timeout,omitempty"`
+
+	// KeepAlive is how long idle connections are kept open. Default is 2m.
+	KeepAlive caddy.Duration `json:"keepalive,omitempty"`
+
+	// DisableKeepAlive opens a new connection for every request.
+	DisableKeepAlive bool `json:"disable_keepalive,omitempty"`
+
+	// KeepAliveInterval is how often open connections are probed for
+	// liveness. Default is 30s.
+	KeepAliveInterval caddy.Duration `json:"keepalive_interval,omitempty"`
+
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// open, in total and per upstream. Defaults are no limit and 32.
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+
+	// H2C speaks HTTP/2 over cleartext to the upstreams, for dweb services
+	// that only serve HTTP/2 or gRPC without TLS. Streamed responses are
+	// flushed as they arrive. Default is HTTP/1.1.
+	H2C bool `json:"h2c,omitempty"`
+
+	// HTTP3 speaks HTTP/3 over QUIC, and so TLS, to the upstreams, for
+	// remote gateways across lossy links where a lost packet of one
+	// stream should not stall the others. The upstream address is dialed
+	// over UDP and must be valid for its certificate. The other settings
+	// do not apply to HTTP/3 connections and cannot be combined with it.
+	HTTP3 bool `json:"http3,omitempty"`
+}
+
+// validate checks the transport configuration.
+func (t *Transport) validate() error {
+	for name, d := range map[string]caddy.Duration{
+		"dial_timeout":            t.DialTimeout,
+		"response_header_timeout": t.ResponseHeaderTimeout,
+		"keepalive":               t.KeepAlive,
+		"keepalive_interval":      t.KeepAliveInterval,
+	} {
+		if d < 0 {
+			return fmt.Errorf("negative %s %v", name, time.Duration(d))
+		}
+	}
+	if t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("negative idle connection limit")
+	}
+	if t.HTTP3 && *t != (Transport{HTTP3: true}) {
+		return fmt.Errorf("http3 cannot be combined with other transport settings")
+	}
+	return nil
+}
+
+// httpTransport returns the reverse proxy transport of t.
+func (t *Transport) httpTransport() *reverseproxy.HTTPTransport {
+	ka := &reverseproxy.KeepAlive{
+		ProbeInterval:       caddy.Duration(defaultKeepAliveInterval),
+		IdleConnTimeout:     caddy.Duration(defaultKeepAliveIdle),
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+	}
+	if t.KeepAliveInterval != 0 {
+		ka.ProbeInterval = t.KeepAliveInterval
+	}
+	if t.KeepAlive != 0 {
+		ka.IdleConnTimeout = t.KeepAlive
+	}
+	if t.MaxIdleConnsPerHost != 0 {
+		ka.MaxIdleConnsPerHost = t.MaxIdleConnsPerHost
+	}
+	if t.DisableKeepAlive {
+		enabled := false
+		ka.Enabled = &enabled
+	}
+	ht := &reverseproxy.HTTPTransport{
+		DialTimeout:           t.DialTimeout,
+		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		KeepAlive:             ka,
+	}
+	if t.H2C {
+		ht.Versions = []string{"h2c", "2"}
+	}
+	// The reverse proxy only speaks HTTP/3 to HTTPS upstreams, and no
+	// other version with it.
+	if t.HTTP3 {
+		ht.Versions = []string{"3"}
+		ht.TLS = new(reverseproxy.TLSConfig)
+	}
+	return ht
+}
+
+// unmarshalTransport parses the transport subdirective:
+//
+//	transport <prefix> {
+//	    dial_timeout <duration>
+//	    response_header_timeout <duration>
+//	    keepalive <duration>|off
+//	    keepalive_interval <duration>
+//	    max_idle_conns <n>
+//	    max_idle_conns_per_host <n>
+//	    h2c
+//	    http3
+//	}
+func unmarshalTransport(d *caddyfile.Dispenser) (string, *Transport, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	t := new(Transport)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "h2c":
+			t.H2C = true
+		case "http3":
+			t.HTTP3 = true
+		case "dial_timeout", "response_header_timeout", "keepalive", "keepalive_interval":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			if opt == "keepalive" && d.Val() == "off" {
+				t.DisableKeepAlive = true
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			switch opt {
+			case "dial_timeout":
+				t.DialTimeout = caddy.Duration(dur)
+			case "response_header_timeout":
+				t.ResponseHeaderTimeout = caddy.Duration(dur)
+			case "keepalive":
+				t.KeepAlive = caddy.Duration(dur)
+			default:
+				t.KeepAliveInterval = caddy.Duration(dur)
+			}
+		case "max_idle_conns", "max_idle_conns_per_host":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			if opt == "max_idle_conns" {
+				t.MaxIdleConns = n
+			} else {
+				t.MaxIdleConnsPerHost = n
+			}
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	return prefix, t, nil
+}
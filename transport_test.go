@@ -0,0 +1,88 @@
+package dnslink
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestParseTransport(t *testing.T) {
+	input := `transport /ipfs {
+		dial_timeout 5s
+		response_header_timeout 2m
+		keepalive 90s
+		max_idle_conns 100
+		max_idle_conns_per_host 64
+		h2c
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	d.Next()
+	prefix, tr, err := unmarshalTransport(d)
+	if err != nil {
+		t.Fatalf("unmarshalTransport() error = %v", err)
+	}
+	if prefix != "/ipfs" {
+		t.Errorf("prefix = %q, want /ipfs", prefix)
+	}
+	want := Transport{
+		DialTimeout:           caddy.Duration(5 * time.Second),
+		ResponseHeaderTimeout: caddy.Duration(2 * time.Minute),
+		KeepAlive:             caddy.Duration(90 * time.Second),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   64,
+		H2C:                   true,
+	}
+	if *tr != want {
+		t.Errorf("Transport = %+v, want %+v", *tr, want)
+	}
+
+	for _, input := range []string{
+		"transport /ipfs {\n keepalive forever\n}",
+		"transport /ipfs {\n max_idle_conns -1\n}",
+		"transport /ipfs {\n retries 3\n}",
+		"transport /ipfs {\n h2c on\n}",
+		"transport /ipfs {\n http3 yes\n}",
+		"transport /ipfs extra",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, _, err := unmarshalTransport(d); err == nil {
+			t.Errorf("unmarshalTransport(%q) succeeded", input)
+		}
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	ht := (&Transport{ResponseHeaderTimeout: caddy.Duration(time.Minute), MaxIdleConns: 10}).httpTransport()
+	if ht.ResponseHeaderTimeout != caddy.Duration(time.Minute) || ht.DialTimeout != 0 {
+		t.Errorf("timeouts = %v, %v", ht.ResponseHeaderTimeout, ht.DialTimeout)
+	}
+	ka := ht.KeepAlive
+	if ka.Enabled != nil || ka.MaxIdleConns != 10 || ka.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost ||
+		ka.ProbeInterval != caddy.Duration(defaultKeepAliveInterval) || ka.IdleConnTimeout != caddy.Duration(defaultKeepAliveIdle) {
+		t.Errorf("KeepAlive = %+v, want the defaults with 10 idle connections", *ka)
+	}
+
+	ka = (&Transport{DisableKeepAlive: true}).httpTransport().KeepAlive
+	if ka.Enabled == nil || *ka.Enabled {
+		t.Error("keep-alive was not disabled")
+	}
+	if ht.Versions != nil {
+		t.Errorf("Versions = %v, want the default", ht.Versions)
+	}
+	if v := (&Transport{H2C: true}).httpTransport().Versions; !slices.Equal(v, []string{"h2c", "2"}) {
+		t.Errorf("h2c Versions = %v, want [h2c 2]", v)
+	}
+	if h3 := (&Transport{HTTP3: true}).httpTransport(); !slices.Equal(h3.Versions, []string{"3"}) || h3.TLS == nil {
+		t.Errorf("http3 Versions = %v, TLS = %v, want [3] over TLS", h3.Versions, h3.TLS)
+	}
+	if err := (&Transport{DialTimeout: -1}).validate(); err == nil {
+		t.Error("validate() accepted a negative dial timeout")
+	}
+	if err := (&Transport{HTTP3: true, ResponseHeaderTimeout: caddy.Duration(time.Minute)}).validate(); err == nil {
+		t.Error("validate() accepted http3 with a response header timeout")
+	}
+}
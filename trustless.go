@@ -0,0 +1,548 @@
+package dnslink
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+)
+
+// defaultTrustlessMaxSize bounds CAR responses and the files assembled
+// from them by default.
+const defaultTrustlessMaxSize = 64 << 20
+
+// maxDAGDepth bounds the depth of the file DAGs read, well above that of
+// the balanced DAGs of files within any reasonable max_size.
+const maxDAGDepth = 64
+
+// maxBlockVisits bounds how many times the blocks of a CAR are read on
+// average while assembling a file. Chunks shared within a file, such as
+// runs of zeros, are read once per link, but a CAR of nodes linking to the
+// same child over and over must not take exponential time.
+const maxBlockVisits = 16
+
+// carContentType is the media type of CAR responses of trustless gateways.
+const carContentType = "application/vnd.ipld.car"
+
+// Multicodec codes of the CIDs that can be verified.
+const (
+	codecRaw    = 0x55
+	codecDagPB  = 0x70
+	mhIdentity  = 0x00
+	mhSHA256    = 0x12
+	sha256Bytes = 32
+)
+
+// UnixFS node types.
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsSymlink   = 4
+	unixfsHAMTShard = 5
+)
+
+// Trustless treats the upstreams of a prefix as trustless gateways: instead
+// of proxying responses as they are, the blocks of the requested file are
+// fetched as a CAR, every block is verified against its CID and the path
+// is walked from the CID of the DNSLink root, so only content matching the
+// link is served. Gateway operators can then front third-party IPFS
+// infrastructure. Only /ipfs links of UnixFS files and directories with an
+// index.html can be verified; sharded directories and symlinks are
+// answered with 502.
+type Trustless struct {
+	// MaxSize bounds the bytes of a CAR response and of the file served
+	// from it. Default is 64 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// validate checks the trustless configuration.
+func (t *Trustless) validate() error {
+	if t.MaxSize < 0 {
+		return fmt.Errorf("negative max_size %d", t.MaxSize)
+	}
+	return nil
+}
+
+// maxSize returns MaxSize or its default.
+func (t *Trustless) maxSize() int64 {
+	if t.MaxSize == 0 {
+		return defaultTrustlessMaxSize
+	}
+	return t.MaxSize
+}
+
+// errNotInDAG reports a path that does not exist under the root.
+var errNotInDAG = errors.New("no such file or directory")
+
+// serve answers r, whose path is the upstream path of an /ipfs link, with
+// the verified file it names. fetch proxies a request to the upstreams of
+// prefix.
+func (t *Trustless) serve(w http.ResponseWriter, r *http.Request, prefix string, fetch func(http.ResponseWriter, *http.Request) error) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("%s of verified content", r.Method))
+	}
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/ipfs/")
+	if !ok {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("cannot verify %s, only /ipfs links", r.URL.EscapedPath()))
+	}
+	var segments []string
+	for _, s := range strings.Split(rest, "/") {
+		if s == "" {
+			continue
+		}
+		s, err := url.PathUnescape(s)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		segments = append(segments, s)
+	}
+	if len(segments) == 0 {
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("link has no CID"))
+	}
+	raw, err := decodeCID(segments[0])
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("invalid CID %s: %v", segments[0], err))
+	}
+	root, n, err := parseCID(raw)
+	if err != nil || n != len(raw) {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("invalid CID %s", segments[0]))
+	}
+
+	blocks, node, err := t.fetchNode(r, prefix, fetch, root, segments)
+	if err == nil && node.kind == unixfsDirectory {
+		// The CAR of a directory only holds the directory itself.
+		segments = append(segments[:len(segments):len(segments)], "index.html")
+		blocks, node, err = t.fetchNode(r, prefix, fetch, root, segments)
+	}
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	if err := blocks.read(node, &body, t.maxSize()); err != nil {
+		return t.unverified(prefix, err)
+	}
+
+	ctype := mime.TypeByExtension(path.Ext(segments[len(segments)-1]))
+	if ctype == "" {
+		ctype = http.DetectContentType(body.Bytes())
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body.Bytes()))
+	return nil
+}
+
+// fetchNode fetches the CAR of the path given by segments, the CID first,
+// and returns its verified blocks and the node the path names.
+func (t *Trustless) fetchNode(r *http.Request, prefix string, fetch func(http.ResponseWriter, *http.Request) error, root parsedCID, segments []string) (carBlocks, unixfsNode, error) {
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = url.PathEscape(s)
+	}
+	up := r.Clone(r.Context())
+	up.Method, up.Body, up.ContentLength = http.MethodGet, http.NoBody, 0
+	up.URL.Path = "/ipfs/" + strings.Join(segments, "/")
+	up.URL.RawPath = "/ipfs/" + strings.Join(escaped, "/")
+	up.URL.RawQuery = "format=car&dag-scope=entity"
+	up.Header.Set("Accept", carContentType)
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		up.Header.Del(name)
+	}
+
+	rec := &limitedRecorder{header: make(http.Header), limit: t.maxSize()}
+	err := fetch(rec, up)
+	switch {
+	case rec.overflow:
+		return nil, unixfsNode{}, caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("CAR of %s exceeds %d bytes", up.URL.RawPath, rec.limit))
+	case err != nil:
+		return nil, unixfsNode{}, err
+	case rec.status == http.StatusNotFound:
+		return nil, unixfsNode{}, caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s not found upstream", up.URL.RawPath))
+	case rec.status != http.StatusOK:
+		return nil, unixfsNode{}, caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("trustless gateway answered %d for %s", rec.status, up.URL.RawPath))
+	}
+
+	blocks, err := readCAR(rec.body.Bytes())
+	if err != nil {
+		return nil, unixfsNode{}, t.unverified(prefix, err)
+	}
+	node, err := blocks.walk(root, segments[1:])
+	if errors.Is(err, errNotInDAG) {
+		return nil, unixfsNode{}, caddyhttp.Error(http.StatusNotFound, fmt.Errorf("%s: %v", up.URL.RawPath, err))
+	}
+	if err != nil {
+		return nil, unixfsNode{}, t.unverified(prefix, err)
+	}
+	return blocks, node, nil
+}
+
+// unverified counts a response of prefix that failed verification and
+// returns the error answering it.
+func (t *Trustless) unverified(prefix string, err error) error {
+	dnslinkMetrics.unverifiedResponses.WithLabelValues(prefix).Inc()
+	return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("verifying trustless gateway response: %v", err))
+}
+
+// limitedRecorder buffers the response of an upstream, up to limit bytes.
+type limitedRecorder struct {
+	header   http.Header
+	limit    int64
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *limitedRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *limitedRecorder) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *limitedRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if int64(w.body.Len()+len(b)) > w.limit {
+		w.overflow = true
+		return 0, errors.New("response too large")
+	}
+	return w.body.Write(b)
+}
+
+// Flush is a no-op, as the response is only used once complete.
+func (w *limitedRecorder) Flush() {}
+
+// parsedCID is a CID whose block can be verified.
+type parsedCID struct {
+	codec     uint64
+	multihash []byte
+	hashCode  uint64
+	digest    []byte
+}
+
+// parseCID parses the binary CID at the start of b, returning it and its
+// length.
+func parseCID(b []byte) (parsedCID, int, error) {
+	var c parsedCID
+	n := 0
+	if len(b) >= 2 && b[0] == mhSHA256 && b[1] == sha256Bytes {
+		c.codec = codecDagPB
+	} else {
+		version, k := binary.Uvarint(b)
+		if k <= 0 || version != 1 {
+			return c, 0, errors.New("invalid CID version")
+		}
+		codec, k2 := binary.Uvarint(b[k:])
+		if k2 <= 0 {
+			return c, 0, errors.New("invalid CID codec")
+		}
+		c.codec, n = codec, k+k2
+	}
+
+	code, k := binary.Uvarint(b[n:])
+	if k <= 0 {
+		return c, 0, errors.New("invalid multihash")
+	}
+	size, k2 := binary.Uvarint(b[n+k:])
+	if k2 <= 0 || size > uint64(len(b)-n-k-k2) {
+		return c, 0, errors.New("truncated multihash")
+	}
+	end := n + k + k2 + int(size)
+	c.hashCode, c.multihash, c.digest = code, b[n:end], b[n+k+k2:end]
+	return c, end, nil
+}
+
+// verify checks that data is the block c names.
+func (c parsedCID) verify(data []byte) error {
+	switch c.hashCode {
+	case mhIdentity:
+		if !bytes.Equal(c.digest, data) {
+			return errors.New("identity block does not match its CID")
+		}
+	case mhSHA256:
+		sum := sha256.Sum256(data)
+		if !bytes.Equal(c.digest, sum[:]) {
+			return fmt.Errorf("block %x does not match its hash", c.digest)
+		}
+	default:
+		return fmt.Errorf("unsupported multihash 0x%x", c.hashCode)
+	}
+	return nil
+}
+
+// carBlocks holds verified blocks by multihash.
+type carBlocks map[string][]byte
+
+// readCAR parses a CARv1 and verifies its blocks.
+func readCAR(b []byte) (carBlocks, error) {
+	size, k := binary.Uvarint(b)
+	if k <= 0 || size > uint64(len(b)-k) {
+		return nil, errors.New("invalid CAR header")
+	}
+	b = b[k+int(size):]
+	blocks := make(carBlocks)
+	for len(b) > 0 {
+		size, k := binary.Uvarint(b)
+		if k <= 0 || size > uint64(len(b)-k) {
+			return nil, errors.New("truncated CAR section")
+		}
+		section := b[k : k+int(size)]
+		b = b[k+int(size):]
+		c, n, err := parseCID(section)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.verify(section[n:]); err != nil {
+			return nil, err
+		}
+		blocks[string(c.multihash)] = section[n:]
+	}
+	return blocks, nil
+}
+
+// block returns the data of c.
+func (bs carBlocks) block(c parsedCID) ([]byte, error) {
+	if c.hashCode == mhIdentity {
+		return c.digest, nil
+	}
+	data, ok := bs[string(c.multihash)]
+	if !ok {
+		return nil, fmt.Errorf("CAR lacks block %x", c.digest)
+	}
+	return data, nil
+}
+
+// unixfsNode is a UnixFS node, or a raw block as a unixfsRaw node.
+type unixfsNode struct {
+	kind  uint64
+	data  []byte
+	links []pbLink
+}
+
+// pbLink is a link of a dag-pb node.
+type pbLink struct {
+	hash []byte
+	name string
+}
+
+// node decodes the block of c.
+func (bs carBlocks) node(c parsedCID) (unixfsNode, error) {
+	b, err := bs.block(c)
+	if err != nil {
+		return unixfsNode{}, err
+	}
+	switch c.codec {
+	case codecRaw:
+		return unixfsNode{kind: unixfsRaw, data: b}, nil
+	case codecDagPB:
+		return decodePBNode(b)
+	default:
+		return unixfsNode{}, fmt.Errorf("unsupported codec 0x%x", c.codec)
+	}
+}
+
+// walk follows the named links of segments from root.
+func (bs carBlocks) walk(root parsedCID, segments []string) (unixfsNode, error) {
+	node, err := bs.node(root)
+	if err != nil {
+		return unixfsNode{}, err
+	}
+	for _, name := range segments {
+		switch node.kind {
+		case unixfsDirectory:
+		case unixfsHAMTShard:
+			return unixfsNode{}, errors.New("sharded directories are not supported")
+		default:
+			return unixfsNode{}, errNotInDAG
+		}
+		i := slices.IndexFunc(node.links, func(l pbLink) bool { return l.name == name })
+		if i < 0 {
+			return unixfsNode{}, errNotInDAG
+		}
+		c, n, err := parseCID(node.links[i].hash)
+		if err != nil || n != len(node.links[i].hash) {
+			return unixfsNode{}, fmt.Errorf("invalid link %s", name)
+		}
+		if node, err = bs.node(c); err != nil {
+			return unixfsNode{}, err
+		}
+	}
+	return node, nil
+}
+
+// read appends the content of the file node to buf, up to limit bytes.
+// The DAG may be at most maxDAGDepth deep, and its nodes are read at most
+// maxBlockVisits times per block of the CAR.
+func (bs carBlocks) read(node unixfsNode, buf *bytes.Buffer, limit int64) error {
+	visits := maxBlockVisits * (len(bs) + 1)
+	return bs.readNode(node, buf, limit, 0, &visits)
+}
+
+// readNode reads node, at depth in the DAG, for read, which gets it the
+// number of visits left.
+func (bs carBlocks) readNode(node unixfsNode, buf *bytes.Buffer, limit int64, depth int, visits *int) error {
+	if depth > maxDAGDepth {
+		return fmt.Errorf("file DAG deeper than %d", maxDAGDepth)
+	}
+	if *visits--; *visits < 0 {
+		return fmt.Errorf("file DAG links to its %d blocks more than %d times", len(bs), maxBlockVisits*(len(bs)+1))
+	}
+	switch node.kind {
+	case unixfsRaw, unixfsFile:
+	case unixfsSymlink:
+		return errors.New("symlinks are not supported")
+	default:
+		return fmt.Errorf("unsupported UnixFS type %d", node.kind)
+	}
+	if int64(buf.Len()+len(node.data)) > limit {
+		return fmt.Errorf("file exceeds %d bytes", limit)
+	}
+	buf.Write(node.data)
+	for _, l := range node.links {
+		c, n, err := parseCID(l.hash)
+		if err != nil || n != len(l.hash) {
+			return errors.New("invalid file link")
+		}
+		child, err := bs.node(c)
+		if err != nil {
+			return err
+		}
+		if err := bs.readNode(child, buf, limit, depth+1, visits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePBNode decodes a dag-pb node and its UnixFS data.
+func decodePBNode(b []byte) (unixfsNode, error) {
+	var node unixfsNode
+	var data []byte
+	err := protoFields(b, func(field, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			data = value
+		case 2:
+			var l pbLink
+			err := protoFields(value, func(field, _ uint64, value []byte) error {
+				switch field {
+				case 1:
+					l.hash = value
+				case 2:
+					l.name = string(value)
+				}
+				return nil
+			})
+			node.links = append(node.links, l)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return node, fmt.Errorf("invalid dag-pb node: %v", err)
+	}
+	err = protoFields(data, func(field, n uint64, value []byte) error {
+		switch field {
+		case 1:
+			node.kind = n
+		case 2:
+			node.data = value
+		}
+		return nil
+	})
+	if err != nil {
+		return node, fmt.Errorf("invalid UnixFS data: %v", err)
+	}
+	return node, nil
+}
+
+// protoFields calls fn with the number and value of each varint or
+// length-delimited field of the protobuf message b.
+func protoFields(b []byte, fn func(field, n uint64, value []byte) error) error {
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		if k <= 0 {
+			return errors.New("invalid field key")
+		}
+		b = b[k:]
+		var n uint64
+		var value []byte
+		switch key & 7 {
+		case 0:
+			if n, k = binary.Uvarint(b); k <= 0 {
+				return errors.New("invalid varint")
+			}
+			b = b[k:]
+		case 2:
+			size, k := binary.Uvarint(b)
+			if k <= 0 || size > uint64(len(b)-k) {
+				return errors.New("truncated field")
+			}
+			value, b = b[k:k+int(size)], b[k+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := fn(key>>3, n, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalTrustless parses the trustless subdirective:
+//
+//	trustless <prefix> {
+//	    max_size <size>
+//	}
+func unmarshalTrustless(d *caddyfile.Dispenser) (string, *Trustless, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	t := new(Trustless)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch opt := d.Val(); opt {
+		case "max_size":
+			if !d.NextArg() {
+				return "", nil, d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil || n == 0 || n > 1<<62 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			t.MaxSize = int64(n)
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	return prefix, t, nil
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*limitedRecorder)(nil)
+	_ http.Flusher        = (*limitedRecorder)(nil)
+)
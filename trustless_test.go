@@ -0,0 +1,191 @@
+package dnslink
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// protoField encodes a length-delimited protobuf field.
+func protoField(field uint64, value []byte) []byte {
+	b := binary.AppendUvarint(nil, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// testBlock returns the CIDv1 of data with codec.
+func testBlock(codec uint64, data []byte) []byte {
+	sum := sha256.Sum256(data)
+	b := binary.AppendUvarint([]byte{0x01}, codec)
+	return append(append(b, mhSHA256, sha256Bytes), sum[:]...)
+}
+
+// testPBNode encodes a dag-pb node of UnixFS type kind with links.
+func testPBNode(kind uint64, links map[string][]byte, order ...string) []byte {
+	var b []byte
+	for _, name := range order {
+		b = append(b, protoField(2, append(protoField(1, links[name]), protoField(2, []byte(name))...))...)
+	}
+	unixfs := append(binary.AppendUvarint(nil, 1<<3), byte(kind))
+	return append(b, protoField(1, unixfs)...)
+}
+
+// testCAR encodes a CARv1 of blocks, given as CID and data pairs.
+func testCAR(blocks ...[]byte) []byte {
+	header := []byte("header")
+	car := append(binary.AppendUvarint(nil, uint64(len(header))), header...)
+	for i := 0; i < len(blocks); i += 2 {
+		car = binary.AppendUvarint(car, uint64(len(blocks[i])+len(blocks[i+1])))
+		car = append(append(car, blocks[i]...), blocks[i+1]...)
+	}
+	return car
+}
+
+func TestTrustlessServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	hello, world, index := []byte("hello "), []byte("world"), []byte("<h1>index</h1>")
+	helloCID, worldCID, indexCID := testBlock(codecRaw, hello), testBlock(codecRaw, world), testBlock(codecRaw, index)
+	file := testPBNode(unixfsFile, map[string][]byte{"0": helloCID, "1": worldCID}, "0", "1")
+	fileCID := testBlock(codecDagPB, file)
+	dir := testPBNode(unixfsDirectory, map[string][]byte{"hello.txt": fileCID, "index.html": indexCID}, "hello.txt", "index.html")
+	dirCID := testBlock(codecDagPB, dir)
+	root := "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(dirCID))
+
+	car := testCAR(dirCID, dir, fileCID, file, helloCID, hello, worldCID, world, indexCID, index)
+	tampered := testCAR(dirCID, dir, fileCID, file, helloCID, []byte("HELLO "), worldCID, world)
+
+	// A file whose every level links twice to the next takes 2^40 reads
+	// of its 41 blocks, and a chain of single links runs too deep.
+	empty := testPBNode(unixfsFile, nil)
+	fanOut, fanOutCID := [][]byte{testBlock(codecDagPB, empty), empty}, testBlock(codecDagPB, empty)
+	for i := 0; i < 40; i++ {
+		level := testPBNode(unixfsFile, map[string][]byte{"": fanOutCID}, "", "")
+		fanOutCID = testBlock(codecDagPB, level)
+		fanOut = append(fanOut, fanOutCID, level)
+	}
+	chain, chainCID := [][]byte{testBlock(codecDagPB, empty), empty}, testBlock(codecDagPB, empty)
+	for i := 0; i < maxDAGDepth+1; i++ {
+		level := testPBNode(unixfsFile, map[string][]byte{"": chainCID}, "")
+		chainCID = testBlock(codecDagPB, level)
+		chain = append(chain, chainCID, level)
+	}
+	bombs := testPBNode(unixfsDirectory, map[string][]byte{"fan-out": fanOutCID, "chain": chainCID}, "fan-out", "chain")
+	bombsCID := testBlock(codecDagPB, bombs)
+	bombsRoot := "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bombsCID))
+	bombsCAR := testCAR(append(append([][]byte{bombsCID, bombs}, fanOut...), chain...)...)
+
+	tests := []struct {
+		name, path, rangeHeader string
+		car                     []byte
+		wantStatus              int
+		wantBody                string
+		wantFetches             int
+	}{
+		{name: "file", path: "/ipfs/" + root + "/hello.txt", car: car, wantStatus: http.StatusOK, wantBody: "hello world", wantFetches: 1},
+		{name: "range", path: "/ipfs/" + root + "/hello.txt", rangeHeader: "bytes=2-7", car: car, wantStatus: http.StatusPartialContent, wantBody: "llo wo", wantFetches: 1},
+		{name: "directory index", path: "/ipfs/" + root + "/", car: car, wantStatus: http.StatusOK, wantBody: "<h1>index</h1>", wantFetches: 2},
+		{name: "missing file", path: "/ipfs/" + root + "/missing.txt", car: car, wantStatus: http.StatusNotFound, wantFetches: 1},
+		{name: "tampered block", path: "/ipfs/" + root + "/hello.txt", car: tampered, wantStatus: http.StatusBadGateway, wantFetches: 1},
+		{name: "missing block", path: "/ipfs/" + root + "/hello.txt", car: testCAR(dirCID, dir, fileCID, file), wantStatus: http.StatusBadGateway, wantFetches: 1},
+		{name: "truncated CAR", path: "/ipfs/" + root + "/hello.txt", car: car[:len(car)-3], wantStatus: http.StatusBadGateway, wantFetches: 1},
+		{name: "fan-out", path: "/ipfs/" + bombsRoot + "/fan-out", car: bombsCAR, wantStatus: http.StatusBadGateway, wantFetches: 1},
+		{name: "deep chain", path: "/ipfs/" + bombsRoot + "/chain", car: bombsCAR, wantStatus: http.StatusBadGateway, wantFetches: 1},
+		{name: "other namespace", path: "/ipns/example.com/", car: car, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches int
+			fetch := func(w http.ResponseWriter, r *http.Request) error {
+				fetches++
+				if r.URL.Query().Get("format") != "car" || r.Header.Get("Accept") != carContentType || r.Header.Get("Range") != "" {
+					t.Errorf("fetched %s with Accept %q and Range %q", r.URL, r.Header.Get("Accept"), r.Header.Get("Range"))
+				}
+				w.Header().Set("Content-Type", carContentType)
+				_, err := w.Write(tt.car)
+				return err
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			if tt.rangeHeader != "" {
+				r.Header.Set("Range", tt.rangeHeader)
+			}
+			status := http.StatusOK
+			err := new(Trustless).serve(w, r, "/ipfs", fetch)
+			var herr caddyhttp.HandlerError
+			switch {
+			case errors.As(err, &herr):
+				status = herr.StatusCode
+			case err != nil:
+				t.Fatalf("serve() error = %v", err)
+			default:
+				status = w.Code
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d (error %v)", status, tt.wantStatus, err)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if fetches != tt.wantFetches {
+				t.Errorf("fetches = %d, want %d", fetches, tt.wantFetches)
+			}
+		})
+	}
+
+	t.Run("max size", func(t *testing.T) {
+		fetch := func(w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write(car)
+			return err
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/ipfs/"+root+"/hello.txt", nil)
+		err := (&Trustless{MaxSize: 64}).serve(httptest.NewRecorder(), r, "/ipfs", fetch)
+		var herr caddyhttp.HandlerError
+		if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadGateway {
+			t.Errorf("serve() error = %v, want 502", err)
+		}
+	})
+}
+
+func TestParseTrustless(t *testing.T) {
+	d := caddyfile.NewTestDispenser("trustless /ipfs {\n max_size 1MiB\n}")
+	d.Next()
+	prefix, tl, err := unmarshalTrustless(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "/ipfs" || tl.MaxSize != 1<<20 {
+		t.Errorf("unmarshalTrustless() = %s, %+v", prefix, tl)
+	}
+
+	for _, input := range []string{
+		"trustless",
+		"trustless /ipfs /ipns",
+		"trustless /ipfs {\n max_size none\n}",
+		"trustless /ipfs {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, _, err := unmarshalTrustless(d); err == nil {
+			t.Errorf("unmarshalTrustless(%q) succeeded", input)
+		}
+	}
+
+	for _, dl := range []*DNSLink{
+		{Trustless: map[string]*Trustless{"/ipfs": {}}},
+		{Upstreams: map[string]string{"/ipfs": "gateway:8080"}, Replacements: map[string]string{"/ipfs": "/content"}, Trustless: map[string]*Trustless{"/ipfs": {}}},
+		{Upstreams: map[string]string{"/ipfs": "gateway:8080"}, Trustless: map[string]*Trustless{"/ipfs": {MaxSize: -1}}},
+	} {
+		if err := dl.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", dl)
+		}
+	}
+}
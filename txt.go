@@ -0,0 +1,172 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// Tolerances of lenient TXT parsing.
+const (
+	// tolerateWhitespace ignores whitespace around the record and around
+	// "=", and matches the dnslink= key case-insensitively.
+	tolerateWhitespace = "whitespace"
+	// tolerateSlash accepts values without a leading slash and collapses
+	// repeated slashes, e.g. dnslink=ipfs//QmXyz.
+	tolerateSlash = "slash"
+	// tolerateNamespace matches namespaces case-insensitively and reads a
+	// value without a namespace as an /ipfs link if it is a CID.
+	tolerateNamespace = "namespace"
+)
+
+// txtTolerances are all tolerances, the default of lenient_txt in the
+// Caddyfile.
+var txtTolerances = []string{tolerateWhitespace, tolerateSlash, tolerateNamespace}
+
+// txtParser parses DNSLink TXT records directly instead of through the
+// dnslink library, applying the configured tolerances for malformed
+// records that the library ignores.
+type txtParser struct {
+	whitespace, slash, namespace bool
+}
+
+// newTXTParser returns the parser applying tolerances, or nil to parse
+// records with the dnslink library if there are none.
+func newTXTParser(tolerances []string) (*txtParser, error) {
+	if len(tolerances) == 0 {
+		return nil, nil
+	}
+	p := new(txtParser)
+	for _, t := range tolerances {
+		switch t {
+		case tolerateWhitespace:
+			p.whitespace = true
+		case tolerateSlash:
+			p.slash = true
+		case tolerateNamespace:
+			p.namespace = true
+		default:
+			return nil, fmt.Errorf("unknown lenient_txt tolerance '%s'", t)
+		}
+	}
+	return p, nil
+}
+
+// parse reads a TXT value as a DNSLink record. isLink is false for values
+// that are not DNSLink records at all; reason explains why a record could
+// not be read, with the codes of the dnslink library.
+func (p *txtParser) parse(value string) (namespace, identifier string, isLink bool, reason string) {
+	key, link, found := strings.Cut(value, "=")
+	if p.whitespace {
+		key, link = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(link)
+	}
+	if !found || key != "dnslink" {
+		return "", "", false, ""
+	}
+	for _, r := range link {
+		if r < 0x20 || r > 0x7e {
+			return "", "", true, "INVALID_CHARACTER"
+		}
+	}
+	if p.slash {
+		for strings.Contains(link, "//") {
+			link = strings.ReplaceAll(link, "//", "/")
+		}
+		if !strings.HasPrefix(link, "/") {
+			link = "/" + link
+		}
+	}
+	if !strings.HasPrefix(link, "/") {
+		return "", "", true, "WRONG_START"
+	}
+	namespace, identifier, _ = strings.Cut(link[1:], "/")
+	if p.namespace {
+		if identifier == "" && validateCID(namespace) == nil {
+			namespace, identifier = "ipfs", namespace
+		}
+		namespace = strings.ToLower(namespace)
+	}
+	switch {
+	case namespace == "":
+		return "", "", true, "NAMESPACE_MISSING"
+	case identifier == "":
+		return "", "", true, "NO_IDENTIFIER"
+	}
+	return namespace, identifier, true, ""
+}
+
+// resolve resolves host like the dnslink library: the TXT records of
+// _dnslink.<host>, falling back to those of the host itself if there is no
+// such name, parsed with p.
+func (p *txtParser) resolve(ctx context.Context, lookup txtLookup, host string) (dnslinkpkg.Result, error) {
+	var result dnslinkpkg.Result
+	host = strings.TrimSuffix(strings.TrimPrefix(host, defaultTXTLabel+"."), ".")
+	if err := checkHostName(host); err != nil {
+		return result, err
+	}
+	entries, err := lookup(ctx, defaultTXTLabel+"."+host)
+	var rcodeErr dnslinkpkg.DNSRCodeError
+	if errors.As(err, &rcodeErr) && rcodeErr.DNSRCode == rcodeNXDomain {
+		entries, err = lookup(ctx, host)
+		result.Log = append(result.Log, dnslinkpkg.LogStatement{Code: "FALLBACK"})
+	}
+	if err != nil {
+		return dnslinkpkg.Result{}, err
+	}
+
+	result.Links = make(map[string]dnslinkpkg.NamespaceEntries)
+	for _, e := range entries {
+		ns, id, isLink, reason := p.parse(e.Value)
+		switch {
+		case !isLink:
+			continue
+		case reason != "":
+			result.Log = append(result.Log, dnslinkpkg.LogStatement{Code: "INVALID_ENTRY", Entry: e.Value, Reason: reason})
+			continue
+		}
+		result.Links[ns] = append(result.Links[ns], dnslinkpkg.NamespaceEntry{Identifier: id, Ttl: e.Ttl})
+	}
+	namespaces := make([]string, 0, len(result.Links))
+	for ns := range result.Links {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		links := result.Links[ns]
+		sort.Slice(links, func(i, j int) bool { return links[i].Identifier < links[j].Identifier })
+		for _, l := range links {
+			result.TxtEntries = append(result.TxtEntries, dnslinkpkg.TxtEntry{Value: "/" + ns + "/" + l.Identifier, Ttl: l.Ttl})
+		}
+	}
+	return result, nil
+}
+
+// checkHostName rejects hosts that cannot be looked up, as the dnslink
+// library does.
+func checkHostName(host string) error {
+	if len(host) > 253-len(defaultTXTLabel+".") {
+		return errors.New("TOO_LONG")
+	}
+	for _, label := range strings.Split(host, ".") {
+		switch {
+		case label == "":
+			return errors.New("EMPTY_PART")
+		case len(label) > 63:
+			return errors.New("TOO_LONG")
+		}
+	}
+	return nil
+}
+
+// resolveTXT resolves the DNSLink links of host with lookup, through the
+// dnslink library, or with parser if lenient parsing is configured.
+func resolveTXT(ctx context.Context, lookup txtLookup, parser *txtParser, host string) (dnslinkpkg.Result, error) {
+	if parser != nil {
+		return parser.resolve(ctx, lookup, host)
+	}
+	return libraryResolver(ctx, lookup).Resolve(host)
+}
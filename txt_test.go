@@ -0,0 +1,100 @@
+package dnslink
+
+import (
+	"context"
+	"testing"
+
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+func TestTXTParser(t *testing.T) {
+	const cid = "bafybeibj6lixxzqtsb45ysdjnupvqkufgdvzqbnvmhw2kf7cfkesy7r7d4"
+	tests := []struct {
+		tolerances []string
+		value      string
+		namespace  string
+		identifier string
+		reason     string
+		notLink    bool
+	}{
+		{tolerances: txtTolerances, value: "dnslink=/ipfs/QmXyz", namespace: "ipfs", identifier: "QmXyz"},
+		{tolerances: txtTolerances, value: "  DNSLink = /ipfs/QmXyz ", namespace: "ipfs", identifier: "QmXyz"},
+		{tolerances: txtTolerances, value: "dnslink=ipfs/QmXyz", namespace: "ipfs", identifier: "QmXyz"},
+		{tolerances: txtTolerances, value: "dnslink=//ipns//example.com/docs", namespace: "ipns", identifier: "example.com/docs"},
+		{tolerances: txtTolerances, value: "dnslink=/IPFS/QmXyz", namespace: "ipfs", identifier: "QmXyz"},
+		{tolerances: txtTolerances, value: "dnslink=" + cid, namespace: "ipfs", identifier: cid},
+		{tolerances: txtTolerances, value: "dnslink=/hyper/anything", namespace: "hyper", identifier: "anything"},
+		{tolerances: txtTolerances, value: "dnslink=/ipfs/", reason: "NO_IDENTIFIER"},
+		{tolerances: txtTolerances, value: "dnslink=/ipfs/Qmé", reason: "INVALID_CHARACTER"},
+		{tolerances: txtTolerances, value: "v=spf1 -all", notLink: true},
+		{tolerances: []string{tolerateSlash}, value: "dnslink = /ipfs/QmXyz", notLink: true},
+		{tolerances: []string{tolerateWhitespace}, value: "dnslink=ipfs/QmXyz", reason: "WRONG_START"},
+		{tolerances: []string{tolerateSlash}, value: "dnslink=/" + cid, reason: "NO_IDENTIFIER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			p, err := newTXTParser(tt.tolerances)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns, id, isLink, reason := p.parse(tt.value)
+			if ns != tt.namespace || id != tt.identifier || isLink == tt.notLink || reason != tt.reason {
+				t.Errorf("parse() = %q, %q, %v, %q, want %q, %q, %v, %q", ns, id, isLink, reason, tt.namespace, tt.identifier, !tt.notLink, tt.reason)
+			}
+		})
+	}
+
+	if p, err := newTXTParser(nil); p != nil || err != nil {
+		t.Errorf("newTXTParser(nil) = %v, %v, want strict parsing", p, err)
+	}
+	if _, err := newTXTParser([]string{"everything"}); err == nil {
+		t.Error("newTXTParser() accepted an unknown tolerance")
+	}
+}
+
+func TestTXTParserResolve(t *testing.T) {
+	records := map[string][]string{
+		"_dnslink.example.com": {"dnslink=ipfs/QmB", "dnslink=/ipfs/QmA", "dnslink=/swarm/", "other=value"},
+		"fallback.example.com": {" dnslink=/ipns/example.com"},
+	}
+	lookup := func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+		values, ok := records[name]
+		if !ok {
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		}
+		var entries []dnslinkpkg.LookupEntry
+		for _, v := range values {
+			entries = append(entries, dnslinkpkg.LookupEntry{Value: v, Ttl: 60})
+		}
+		return entries, nil
+	}
+	p, _ := newTXTParser(txtTolerances)
+
+	result, err := resolveTXT(context.Background(), lookup, p, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipfs := result.Links["ipfs"]; len(ipfs) != 2 || ipfs[0].Identifier != "QmA" || ipfs[1].Ttl != 60 {
+		t.Errorf("Links[ipfs] = %+v, want QmA and QmB", ipfs)
+	}
+	if len(result.Log) != 1 || result.Log[0].Reason != "NO_IDENTIFIER" {
+		t.Errorf("Log = %+v, want the invalid swarm record", result.Log)
+	}
+
+	result, err = resolveTXT(context.Background(), lookup, p, "fallback.example.com")
+	if err != nil || len(result.Links["ipns"]) != 1 || result.Log[0].Code != "FALLBACK" {
+		t.Errorf("resolveTXT() = %+v, %v, want the host's own record", result, err)
+	}
+	if _, err := resolveTXT(context.Background(), lookup, p, "missing.example.com"); err == nil {
+		t.Error("resolveTXT() of a missing host succeeded")
+	}
+	if _, err := resolveTXT(context.Background(), lookup, p, "a..example.com"); err == nil {
+		t.Error("resolveTXT() accepted an empty label")
+	}
+
+	// Without tolerances, the library ignores the malformed record.
+	result, err = resolveTXT(context.Background(), lookup, nil, "example.com")
+	if err != nil || len(result.Links["ipfs"]) != 1 {
+		t.Errorf("strict resolveTXT() = %+v, %v, want only QmA", result.Links, err)
+	}
+}
@@ -0,0 +1,95 @@
+package dnslink
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UpstreamAuth holds the credentials sent to the upstream of a prefix, so
+// protected endpoints such as a Kubo RPC API or a Bee node behind an
+// authenticating gateway can be used without another proxy adding them.
+// Exactly one kind of credentials is set. Values may be global
+// placeholders such as {env.KUBO_PASSWORD}. The header replaces any the
+// client sent.
+type UpstreamAuth struct {
+	// Username and Password are sent with HTTP basic authentication.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Bearer is a token sent in an Authorization: Bearer header.
+	Bearer string `json:"bearer,omitempty"`
+
+	// Header and Value are those of a custom header, e.g. X-Api-Key.
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// validate rejects credentials of no kind or of several.
+func (a *UpstreamAuth) validate() error {
+	kinds := 0
+	if a.Username != "" || a.Password != "" {
+		if a.Username == "" {
+			return fmt.Errorf("basic credentials without a username")
+		}
+		kinds++
+	}
+	if a.Bearer != "" {
+		kinds++
+	}
+	if a.Header != "" || a.Value != "" {
+		switch {
+		case a.Header == "" || a.Value == "":
+			return fmt.Errorf("custom header needs a name and a value")
+		case strings.EqualFold(a.Header, "Host"):
+			return fmt.Errorf("custom header cannot be Host; use host_header")
+		}
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("needs exactly one of basic credentials, a bearer token or a custom header")
+	}
+	return nil
+}
+
+// header returns the name and value of the header carrying the
+// credentials, with their global placeholders expanded.
+func (a *UpstreamAuth) header() (string, string) {
+	repl := caddy.NewReplacer()
+	switch {
+	case a.Bearer != "":
+		return "Authorization", "Bearer " + repl.ReplaceKnown(a.Bearer, "")
+	case a.Header != "":
+		return http.CanonicalHeaderKey(a.Header), repl.ReplaceKnown(a.Value, "")
+	}
+	userinfo := repl.ReplaceKnown(a.Username, "") + ":" + repl.ReplaceKnown(a.Password, "")
+	return "Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(userinfo))
+}
+
+// unmarshalUpstreamAuth parses the arguments of the upstream_auth
+// subdirective after its prefix:
+//
+//	upstream_auth <prefix> basic <username> <password>
+//	upstream_auth <prefix> bearer <token>
+//	upstream_auth <prefix> header <name> <value>
+func unmarshalUpstreamAuth(d *caddyfile.Dispenser) (*UpstreamAuth, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	switch kind := args[0]; {
+	case kind == "basic" && len(args) == 3:
+		return &UpstreamAuth{Username: args[1], Password: args[2]}, nil
+	case kind == "bearer" && len(args) == 2:
+		return &UpstreamAuth{Bearer: args[1]}, nil
+	case kind == "header" && len(args) == 3:
+		return &UpstreamAuth{Header: args[1], Value: args[2]}, nil
+	case kind != "basic" && kind != "bearer" && kind != "header":
+		return nil, d.Errf("unknown upstream_auth kind '%s'", kind)
+	}
+	return nil, d.ArgErr()
+}
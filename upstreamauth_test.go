@@ -0,0 +1,107 @@
+package dnslink
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+)
+
+func TestUpstreamAuthHeader(t *testing.T) {
+	t.Setenv("DNSLINK_TEST_TOKEN", "s3cret")
+	tests := []struct {
+		auth        UpstreamAuth
+		name, value string
+	}{
+		{auth: UpstreamAuth{Username: "kubo", Password: "pass"}, name: "Authorization", value: "Basic a3VibzpwYXNz"},
+		{auth: UpstreamAuth{Bearer: "{env.DNSLINK_TEST_TOKEN}"}, name: "Authorization", value: "Bearer s3cret"},
+		{auth: UpstreamAuth{Header: "x-api-key", Value: "{env.DNSLINK_TEST_TOKEN}"}, name: "X-Api-Key", value: "s3cret"},
+		// Request placeholders are left to the reverse proxy.
+		{auth: UpstreamAuth{Header: "X-Client", Value: "{http.request.host}"}, name: "X-Client", value: "{http.request.host}"},
+	}
+	for _, tt := range tests {
+		if err := tt.auth.validate(); err != nil {
+			t.Errorf("validate(%+v) error = %v", tt.auth, err)
+		}
+		name, value := tt.auth.header()
+		if name != tt.name || value != tt.value {
+			t.Errorf("header(%+v) = %s: %s, want %s: %s", tt.auth, name, value, tt.name, tt.value)
+		}
+	}
+}
+
+func TestValidateUpstreamAuth(t *testing.T) {
+	for _, auth := range []UpstreamAuth{
+		{},
+		{Password: "pass"},
+		{Header: "X-Api-Key"},
+		{Header: "Host", Value: "example.com"},
+		{Username: "kubo", Password: "pass", Bearer: "token"},
+		{Bearer: "token", Header: "X-Api-Key", Value: "key"},
+	} {
+		if err := auth.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", auth)
+		}
+	}
+
+	d := &DNSLink{
+		Upstreams:    map[string]string{"/ipfs": "kubo:5001"},
+		UpstreamAuth: map[string]*UpstreamAuth{"/swarm": {Bearer: "token"}},
+	}
+	if err := d.Validate(); err == nil {
+		t.Error("Validate() accepted credentials for a prefix without an upstream")
+	}
+}
+
+func TestProxyHeadersAuth(t *testing.T) {
+	ops := &headers.Handler{Request: &headers.HeaderOps{Set: http.Header{"Authorization": {"Bearer client"}, "X-Gateway": {"dnslink"}}}}
+	merged := proxyHeaders(ops, "upstream", &UpstreamAuth{Bearer: "token"})
+	if got := merged.Request.Set.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("merged headers set Authorization %q, want the credentials", got)
+	}
+	if merged.Request.Set.Get("Host") == "" || merged.Request.Set.Get("X-Gateway") != "dnslink" {
+		t.Errorf("merged headers = %v, want Host and X-Gateway kept", merged.Request.Set)
+	}
+	if ops.Request.Set.Get("Authorization") != "Bearer client" {
+		t.Error("proxyHeaders() modified the configured operations")
+	}
+
+	if merged := proxyHeaders(nil, "", &UpstreamAuth{Header: "X-Api-Key", Value: "key"}); merged == nil || merged.Request.Set.Get("X-Api-Key") != "key" {
+		t.Errorf("proxyHeaders(nil) = %+v, want the custom header", merged)
+	}
+}
+
+func TestUnmarshalUpstreamAuth(t *testing.T) {
+	tests := []struct {
+		input string
+		want  UpstreamAuth
+	}{
+		{input: "upstream_auth /ipfs basic kubo {env.KUBO_PASSWORD}", want: UpstreamAuth{Username: "kubo", Password: "{env.KUBO_PASSWORD}"}},
+		{input: "upstream_auth /swarm bearer {env.BEE_TOKEN}", want: UpstreamAuth{Bearer: "{env.BEE_TOKEN}"}},
+		{input: "upstream_auth /ipfs header X-Api-Key secret", want: UpstreamAuth{Header: "X-Api-Key", Value: "secret"}},
+	}
+	for _, tt := range tests {
+		d := caddyfile.NewTestDispenser(tt.input)
+		d.Next()
+		d.NextArg()
+		got, err := unmarshalUpstreamAuth(d)
+		if err != nil || *got != tt.want {
+			t.Errorf("unmarshalUpstreamAuth(%q) = %+v, %v, want %+v", tt.input, got, err, tt.want)
+		}
+	}
+
+	for _, input := range []string{
+		"upstream_auth /ipfs",
+		"upstream_auth /ipfs basic kubo",
+		"upstream_auth /ipfs bearer a b",
+		"upstream_auth /ipfs digest kubo pass",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		d.NextArg()
+		if _, err := unmarshalUpstreamAuth(d); err == nil {
+			t.Errorf("unmarshalUpstreamAuth(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Errors of requests rejected by an UpstreamLimit.
+var (
+	errUpstreamRateLimited = errors.New("upstream rate limit exceeded")
+	errUpstreamBusy        = errors.New("upstream concurrency limit exceeded")
+)
+
+// defaultQueueTimeout is the default UpstreamLimit QueueTimeout.
+const defaultQueueTimeout = 10 * time.Second
+
+// UpstreamLimit caps the requests a prefix sends to its upstreams, so a
+// traffic spike on one site can't overwhelm a backend every other site of
+// the prefix depends on. Requests over Rate are answered with 429, and
+// those over MaxInFlight with 503 once the queue, if any, is full or they
+// waited QueueTimeout. Requests served from the content cache are not
+// counted.
+type UpstreamLimit struct {
+	// Rate is the number of requests per second sent to the upstreams.
+	// 0 means unlimited.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Burst is the number of requests that may be sent at once above
+	// Rate. Default is Rate, rounded up.
+	Burst int `json:"burst,omitempty"`
+
+	// MaxInFlight is the number of requests the upstreams serve at once.
+	// 0 means unlimited.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// Queue is the number of requests over MaxInFlight that wait for
+	// another to finish instead of being rejected right away.
+	Queue int `json:"queue,omitempty"`
+
+	// QueueTimeout bounds the wait of queued requests. Default is 10s.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+}
+
+// validate checks the limit configuration.
+func (l *UpstreamLimit) validate() error {
+	switch {
+	case l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 || l.Queue < 0 || l.QueueTimeout < 0:
+		return fmt.Errorf("negative limit")
+	case l.Rate == 0 && l.MaxInFlight == 0:
+		return fmt.Errorf("needs a rate or max_in_flight")
+	case l.Burst > 0 && l.Rate == 0:
+		return fmt.Errorf("burst without a rate")
+	case (l.Queue > 0 || l.QueueTimeout > 0) && l.MaxInFlight == 0:
+		return fmt.Errorf("queue without max_in_flight")
+	}
+	return nil
+}
+
+// newLimiter returns the limiter enforcing l.
+func (l *UpstreamLimit) newLimiter() *upstreamLimiter {
+	lim := &upstreamLimiter{queue: int32(l.Queue), queueTimeout: time.Duration(l.QueueTimeout)}
+	if lim.queueTimeout == 0 {
+		lim.queueTimeout = defaultQueueTimeout
+	}
+	if l.Rate > 0 {
+		burst := float64(l.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(l.Rate))
+		}
+		lim.bucket = &tokenBucket{rate: l.Rate, burst: burst}
+	}
+	if l.MaxInFlight > 0 {
+		lim.slots = make(chan struct{}, l.MaxInFlight)
+	}
+	return lim
+}
+
+// upstreamLimiter holds the state of an UpstreamLimit. Copies of a handler
+// for host configs share the limiters of their parent for the prefixes
+// whose upstream they keep.
+type upstreamLimiter struct {
+	bucket       *tokenBucket
+	slots        chan struct{}
+	queue        int32
+	queueTimeout time.Duration
+	waiting      atomic.Int32
+}
+
+// acquire admits a request, waiting in the queue if needed, and returns
+// the function to call once it is served.
+func (l *upstreamLimiter) acquire(ctx context.Context, now time.Time) (func(), error) {
+	if l.bucket != nil && !l.bucket.allow(now) {
+		return nil, errUpstreamRateLimited
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.waiting.Add(1) > l.queue {
+		l.waiting.Add(-1)
+		return nil, errUpstreamBusy
+	}
+	defer l.waiting.Add(-1)
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errUpstreamBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tokenBucket allows events at rate per second on average, and up to
+// burst at once.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for an event at now, reporting whether there was
+// one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rejectLimited answers r, a request of host rejected with err by the
+// limit of prefix.
+func (d *DNSLink) rejectLimited(w http.ResponseWriter, r *http.Request, prefix, host, namespace string, err error) error {
+	if r.Context().Err() != nil {
+		return err
+	}
+	f := failure{
+		Status:    http.StatusServiceUnavailable,
+		Host:      host,
+		Namespace: namespace,
+		Message:   "upstream of " + host + " is busy, try again later",
+	}
+	limit := limitConcurrency
+	if errors.Is(err, errUpstreamRateLimited) {
+		f.Status, f.Message, limit = http.StatusTooManyRequests, "too many requests for "+host+", try again later", limitRate
+	}
+	dnslinkMetrics.limitedRequests.WithLabelValues(prefix, limit).Inc()
+	d.logger.Debug("upstream limit exceeded", zap.String("host", host), zap.String("prefix", prefix), zap.Error(err))
+	w.Header().Set("Retry-After", "1")
+	return d.writeFailure(w, f)
+}
+
+// unmarshalUpstreamLimit parses the upstream_limit subdirective:
+//
+//	upstream_limit <prefix> {
+//	    rate <requests per second>
+//	    burst <n>
+//	    max_in_flight <n>
+//	    queue <n>
+//	    queue_timeout <duration>
+//	}
+func unmarshalUpstreamLimit(d *caddyfile.Dispenser) (string, *UpstreamLimit, error) {
+	if !d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	prefix := d.Val()
+	if d.NextArg() {
+		return "", nil, d.ArgErr()
+	}
+	l := new(UpstreamLimit)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		opt := d.Val()
+		switch opt {
+		case "rate", "burst", "max_in_flight", "queue", "queue_timeout":
+		default:
+			return "", nil, d.Errf("unknown subdirective '%s'", opt)
+		}
+		if !d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+		switch opt {
+		case "rate":
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || rate <= 0 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			l.Rate = rate
+		case "burst", "max_in_flight", "queue":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 1 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			switch opt {
+			case "burst":
+				l.Burst = n
+			case "max_in_flight":
+				l.MaxInFlight = n
+			default:
+				l.Queue = n
+			}
+		case "queue_timeout":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return "", nil, d.Errf("invalid %s '%s'", opt, d.Val())
+			}
+			l.QueueTimeout = caddy.Duration(dur)
+		}
+		if d.NextArg() {
+			return "", nil, d.ArgErr()
+		}
+	}
+	return prefix, l, nil
+}
@@ -0,0 +1,193 @@
+package dnslink
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := (&UpstreamLimit{Rate: 2, Burst: 3}).newLimiter().bucket
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("allow() rejected event %d of the burst", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("allow() accepted an event over the burst")
+	}
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("allow() rejected an event after a refill")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("allow() accepted two events after refilling one")
+	}
+	// The bucket never holds more than the burst.
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.allow(later)
+	}
+	if b.allow(later) {
+		t.Error("allow() refilled the bucket over the burst")
+	}
+
+	if got := (&UpstreamLimit{Rate: 0.5}).newLimiter().bucket.burst; got != 1 {
+		t.Errorf("default burst of rate 0.5 = %g, want 1", got)
+	}
+}
+
+func TestUpstreamLimiterConcurrency(t *testing.T) {
+	l := (&UpstreamLimit{MaxInFlight: 1, Queue: 1, QueueTimeout: caddy.Duration(time.Minute)}).newLimiter()
+	release, err := l.acquire(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	queued := make(chan error)
+	go func() {
+		release, err := l.acquire(context.Background(), time.Now())
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for l.waiting.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.acquire(context.Background(), time.Now()); !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("acquire() with a full queue error = %v, want %v", err, errUpstreamBusy)
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued acquire() error = %v", err)
+	}
+
+	l = (&UpstreamLimit{MaxInFlight: 1, Queue: 1, QueueTimeout: caddy.Duration(10 * time.Millisecond)}).newLimiter()
+	release, _ = l.acquire(context.Background(), time.Now())
+	defer release()
+	if _, err := l.acquire(context.Background(), time.Now()); !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("acquire() after the queue timeout error = %v, want %v", err, errUpstreamBusy)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx, time.Now()); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() of a canceled request error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestUpstreamLimitServe(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	server := &caddyhttp.Server{NamedRoutes: map[string]*caddyhttp.Route{"ipfs-route": {}}}
+	d := &DNSLink{
+		Routes:         map[string]string{"/ipfs": "ipfs-route"},
+		UpstreamLimits: map[string]*UpstreamLimit{"/ipfs": {Rate: 1}},
+		OnMiss:         http.StatusNotFound,
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(context.Context, string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{
+					"ipfs": {{Identifier: "QmFake"}},
+				}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	d.limiters = map[string]*upstreamLimiter{"/ipfs": d.UpstreamLimits["/ipfs"].newLimiter()}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	for _, want := range []int{http.StatusTeapot, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "http://a.example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ServerCtxKey, server))
+		rec := httptest.NewRecorder()
+		if err := d.ServeHTTP(rec, req, next); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+		if rec.Code != want {
+			t.Errorf("status = %d, want %d", rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("rejected response has no Retry-After header")
+		}
+	}
+}
+
+func TestValidateUpstreamLimits(t *testing.T) {
+	for _, l := range []*UpstreamLimit{
+		{},
+		{Rate: -1},
+		{Burst: 5, MaxInFlight: 10},
+		{Rate: 10, Queue: 5},
+		{MaxInFlight: 10, Queue: -1},
+	} {
+		if err := l.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", l)
+		}
+	}
+
+	d := &DNSLink{
+		Upstreams:      map[string]string{"/ipfs": "ipfs:8080"},
+		UpstreamLimits: map[string]*UpstreamLimit{"/swarm": {Rate: 10}},
+	}
+	if err := d.Validate(); err == nil {
+		t.Error("Validate() accepted a limit for a prefix without an upstream")
+	}
+	d.UpstreamLimits = map[string]*UpstreamLimit{"/ipfs": {Rate: 10, MaxInFlight: 50, Queue: 100}}
+	if err := d.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestUnmarshalUpstreamLimit(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`upstream_limit /swarm {
+		rate 2.5
+		burst 10
+		max_in_flight 20
+		queue 50
+		queue_timeout 5s
+	}`)
+	d.Next()
+	prefix, l, err := unmarshalUpstreamLimit(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UpstreamLimit{Rate: 2.5, Burst: 10, MaxInFlight: 20, Queue: 50, QueueTimeout: caddy.Duration(5 * time.Second)}
+	if prefix != "/swarm" || *l != want {
+		t.Errorf("unmarshalUpstreamLimit() = %s, %+v, want /swarm, %+v", prefix, l, want)
+	}
+
+	for _, input := range []string{
+		"upstream_limit",
+		"upstream_limit /ipfs 10",
+		"upstream_limit /ipfs {\n rate\n}",
+		"upstream_limit /ipfs {\n rate none\n}",
+		"upstream_limit /ipfs {\n burst 0\n}",
+		"upstream_limit /ipfs {\n queue_timeout soon\n}",
+		"upstream_limit /ipfs {\n max_in_flight 10 20\n}",
+		"upstream_limit /ipfs {\n unknown\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if _, _, err := unmarshalUpstreamLimit(d); err == nil {
+			t.Errorf("unmarshalUpstreamLimit(%q) succeeded", input)
+		}
+	}
+}
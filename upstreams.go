@@ -0,0 +1,156 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// proxy returns the reverse proxy of prefix.
+func (d *DNSLink) proxy(prefix string) (*reverseproxy.Handler, bool) {
+	d.upstreamsMu.RLock()
+	defer d.upstreamsMu.RUnlock()
+	rp, ok := d.proxies[prefix]
+	return rp, ok
+}
+
+// upstream returns the static upstream of prefix, or else the source of
+// its dynamic upstreams.
+func (d *DNSLink) upstream(prefix string) (string, json.RawMessage) {
+	d.upstreamsMu.RLock()
+	defer d.upstreamsMu.RUnlock()
+	return d.Upstreams[prefix], d.DynamicUpstreams[prefix]
+}
+
+// prefixUpstream describes the upstream of a prefix in the admin API.
+type prefixUpstream struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream,omitempty"`
+	Dynamic  bool   `json:"dynamic,omitempty"`
+	Route    string `json:"route,omitempty"`
+}
+
+// upstreams lists the upstreams of the handler by prefix, along with the
+// prefixes invoking named routes.
+func (d *DNSLink) upstreams() []prefixUpstream {
+	d.upstreamsMu.RLock()
+	defer d.upstreamsMu.RUnlock()
+	list := make([]prefixUpstream, 0, len(d.Upstreams)+len(d.DynamicUpstreams)+len(d.Routes))
+	for prefix, upstream := range d.Upstreams {
+		list = append(list, prefixUpstream{Prefix: prefix, Upstream: upstream})
+	}
+	for prefix := range d.DynamicUpstreams {
+		list = append(list, prefixUpstream{Prefix: prefix, Dynamic: true})
+	}
+	for prefix, name := range d.Routes {
+		list = append(list, prefixUpstream{Prefix: prefix, Route: name})
+	}
+	return list
+}
+
+// normalizeUpstream strips the scheme of an upstream address, as in a
+// proxies line, and expands its global placeholders.
+func normalizeUpstream(upstream string) string {
+	upstream = strings.TrimPrefix(upstream, "http://")
+	upstream = strings.TrimPrefix(upstream, "https://")
+	return caddy.NewReplacer().ReplaceKnown(upstream, "")
+}
+
+// setUpstream points prefix at upstream, adding the prefix if the handler
+// has none, without a config reload: a reverse proxy is set up for the
+// new upstream and swapped in, and the previous one is released once
+// the swap is done, letting requests in flight finish. Other prefixes
+// keep their proxies and connections. Copies of the handler for host
+// configs follow, unless they override the prefix.
+func (d *DNSLink) setUpstream(prefix, upstream string) error {
+	if _, ok := d.Routes[prefix]; ok {
+		return fmt.Errorf("prefix %s invokes a named route", prefix)
+	}
+	rp, err := d.newProxy(d.ctx, prefix, &reverseproxy.Handler{Upstreams: staticPool(upstream)})
+	if err != nil {
+		return err
+	}
+
+	d.upstreamsMu.Lock()
+	prev := d.proxies[prefix]
+	proxies, static, dynamic := maps.Clone(d.proxies), maps.Clone(d.Upstreams), maps.Clone(d.DynamicUpstreams)
+	if proxies == nil {
+		proxies = make(map[string]*reverseproxy.Handler)
+	}
+	if static == nil {
+		static = make(map[string]string)
+	}
+	proxies[prefix], static[prefix] = rp, upstream
+	delete(dynamic, prefix)
+	d.proxies, d.Upstreams, d.DynamicUpstreams = proxies, static, dynamic
+	d.upstreamsMu.Unlock()
+
+	d.logger.Info("upstream changed", zap.String("prefix", prefix), zap.String("upstream", upstream))
+	if prev != nil {
+		if err := releaseProxy(prev); err != nil {
+			d.logger.Warn("cleaning up previous reverse proxy", zap.String("prefix", prefix), zap.Error(err))
+		}
+	}
+	for _, hc := range d.HostConfigs {
+		if _, ok := hc.Upstreams[prefix]; ok || hc.handler == nil {
+			continue
+		}
+		if err := hc.handler.setUpstream(prefix, upstream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUpstream removes the upstream of prefix without a config reload,
+// reporting whether the handler had one. Links of the prefix are then
+// handled as those of namespaces without an upstream.
+func (d *DNSLink) removeUpstream(prefix string) bool {
+	for _, hc := range d.HostConfigs {
+		if _, ok := hc.Upstreams[prefix]; !ok && hc.handler != nil {
+			hc.handler.removeUpstream(prefix)
+		}
+	}
+
+	d.upstreamsMu.Lock()
+	prev, ok := d.proxies[prefix]
+	if !ok {
+		d.upstreamsMu.Unlock()
+		return false
+	}
+	proxies, static, dynamic := maps.Clone(d.proxies), maps.Clone(d.Upstreams), maps.Clone(d.DynamicUpstreams)
+	delete(proxies, prefix)
+	delete(static, prefix)
+	delete(dynamic, prefix)
+	d.proxies, d.Upstreams, d.DynamicUpstreams = proxies, static, dynamic
+	d.upstreamsMu.Unlock()
+
+	d.logger.Info("upstream removed", zap.String("prefix", prefix))
+	if prev != nil {
+		if err := releaseProxy(prev); err != nil {
+			d.logger.Warn("cleaning up previous reverse proxy", zap.String("prefix", prefix), zap.Error(err))
+		}
+	}
+	return true
+}
+
+// upstreamPrefix returns the prefix named by the last segment of an admin
+// API path, e.g. "/swarm" for "swarm" and "default" for "default".
+func upstreamPrefix(name string) (string, error) {
+	prefix := name
+	if prefix != defaultPrefix {
+		prefix = "/" + prefix
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid prefix '%s'", name)
+	}
+	if err := validatePrefix(prefix); err != nil {
+		return "", err
+	}
+	return prefix, nil
+}
@@ -0,0 +1,238 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func TestUpstreamPrefix(t *testing.T) {
+	tests := []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{name: "swarm", want: "/swarm"},
+		{name: "default", want: "default"},
+		{name: "", wantErr: true},
+		{name: "ipfs/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := upstreamPrefix(tt.name)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("upstreamPrefix(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeUpstream(t *testing.T) {
+	for in, want := range map[string]string{
+		"bee:1633":         "bee:1633",
+		"http://bee:1633":  "bee:1633",
+		"https://bee:1633": "bee:1633",
+		"  ":               "  ",
+	} {
+		if got := normalizeUpstream(in); got != want {
+			t.Errorf("normalizeUpstream(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRemoveUpstream(t *testing.T) {
+	// Proxies are nil, as unprovisioned ones can't be cleaned up.
+	child := &DNSLink{
+		Upstreams: map[string]string{"/ipfs": "ipfs:8080", "/swarm": "bee:1633"},
+		proxies:   map[string]*reverseproxy.Handler{"/ipfs": nil, "/swarm": nil},
+		logger:    zap.NewNop(),
+	}
+	d := &DNSLink{
+		Upstreams:        map[string]string{"/ipfs": "ipfs:8080", "/swarm": "bee:1633"},
+		DynamicUpstreams: map[string]json.RawMessage{"/ipns": json.RawMessage(`{"source":"a"}`)},
+		HostConfigs: []*HostConfig{
+			{Hosts: []string{"tenant.example.com"}, Upstreams: map[string]string{"/swarm": "bee:1633"}, handler: child},
+		},
+		proxies: map[string]*reverseproxy.Handler{"/ipfs": nil, "/ipns": nil, "/swarm": nil},
+		logger:  zap.NewNop(),
+	}
+	proxies, upstreams := d.proxies, d.Upstreams
+
+	// Requests in flight read the prefixes while they are removed.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				d.proxy("/swarm")
+				d.upstream("/ipns")
+				d.upstreams()
+			}
+		}()
+	}
+	for _, prefix := range []string{"/swarm", "/ipns", "/ipfs"} {
+		if !d.removeUpstream(prefix) {
+			t.Errorf("removeUpstream(%s) = false, want true", prefix)
+		}
+	}
+	wg.Wait()
+
+	if d.removeUpstream("/swarm") {
+		t.Error("removeUpstream of a removed prefix = true, want false")
+	}
+	if got := d.upstreams(); len(got) != 0 {
+		t.Errorf("upstreams() = %+v, want none", got)
+	}
+	if len(proxies) != 3 || len(upstreams) != 2 {
+		t.Error("removeUpstream modified the previous maps in place")
+	}
+	// The host config keeps the prefix it overrides.
+	if _, ok := child.proxy("/swarm"); !ok {
+		t.Error("host config lost the /swarm upstream it overrides")
+	}
+	if _, ok := child.proxy("/ipfs"); ok {
+		t.Error("host config kept the removed /ipfs upstream")
+	}
+}
+
+func TestRemoveUpstreamInFlight(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	d, _ := loadTestHandler(t, &DNSLink{
+		Upstreams: map[string]string{"/ipfs": upstream.Listener.Addr().String()},
+	}, map[string]string{"example.com": "/ipfs/QmFake"})
+
+	// The upstream is removed and set again while requests are in flight.
+	// They are either proxied or, without the upstream, passed on, but
+	// never matched to the prefix left without a proxy. A reference to the
+	// proxy is held along, so setting the upstream again reuses it rather
+	// than provisioning another, and the prefix changes often.
+	keep, err := d.newProxy(d.ctx, "/ipfs", &reverseproxy.Handler{Upstreams: staticPool(upstream.Listener.Addr().String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseProxy(keep) }()
+	done := make(chan struct{})
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d.removeUpstream("/ipfs")
+			if err := d.setUpstream("/ipfs", upstream.Listener.Addr().String()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				req := caddyhttp.PrepareRequest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), caddy.NewReplacer(), nil, &caddyhttp.Server{})
+				rec := httptest.NewRecorder()
+				if err := d.ServeHTTP(rec, req, next); err != nil {
+					t.Errorf("ServeHTTP() error = %v", err)
+					return
+				}
+				if rec.Code != http.StatusOK && rec.Code != http.StatusTeapot {
+					t.Errorf("status = %d, want %d or %d", rec.Code, http.StatusOK, http.StatusTeapot)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-toggled
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	a := &DNSLink{
+		Upstreams:        map[string]string{"/ipfs": "ipfs:8080", "/swarm": "bee:1633"},
+		DynamicUpstreams: map[string]json.RawMessage{"/ipns": json.RawMessage(`{"source":"a"}`)},
+		proxies:          map[string]*reverseproxy.Handler{"/ipfs": nil, "/ipns": nil, "/swarm": nil},
+		logger:           zap.NewNop(),
+	}
+	b := &DNSLink{
+		Upstreams: map[string]string{"/swarm": "bee:1633"},
+		proxies:   map[string]*reverseproxy.Handler{"/swarm": nil},
+		logger:    zap.NewNop(),
+	}
+	registerHandler(a)
+	defer unregisterHandler(a)
+	registerHandler(b)
+	defer unregisterHandler(b)
+
+	list := func() []prefixUpstream {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleUpstreams(rec, httptest.NewRequest(http.MethodGet, "/dnslink/upstreams", nil)); err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		var got []prefixUpstream
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return got
+	}
+	want := []prefixUpstream{
+		{Prefix: "/ipfs", Upstream: "ipfs:8080"},
+		{Prefix: "/ipns", Dynamic: true},
+		{Prefix: "/swarm", Upstream: "bee:1633"},
+	}
+	if got := list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET = %+v, want %+v", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleUpstream(rec, httptest.NewRequest(http.MethodDelete, "/dnslink/upstreams/swarm", nil)); err != nil || rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, %v, want 204", rec.Code, err)
+	}
+	if got := list(); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("GET after DELETE = %+v, want %+v", got, want[:2])
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		wantStatus         int
+	}{
+		{http.MethodDelete, "/dnslink/upstreams/swarm", "", http.StatusNotFound},
+		{http.MethodDelete, "/dnslink/upstreams/", "", http.StatusBadRequest},
+		{http.MethodPut, "/dnslink/upstreams/ipfs/x", `{"upstream": "ipfs:8080"}`, http.StatusBadRequest},
+		{http.MethodPut, "/dnslink/upstreams/swarm", `{"upstream": ""}`, http.StatusBadRequest},
+		{http.MethodPut, "/dnslink/upstreams/swarm", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/dnslink/upstreams/swarm", `{"upstream": "bee2:1633"}`, http.StatusMethodNotAllowed},
+	} {
+		err := adminAPI{}.handleUpstream(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantStatus {
+			t.Errorf("%s %s %s error = %v, want status %d", tt.method, tt.path, tt.body, err, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dnslink
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// warmConcurrency bounds the number of parallel lookups while warming.
+const warmConcurrency = 8
+
+// warmResult describes the outcome of pre-resolving a host.
+type warmResult struct {
+	Host       string `json:"host"`
+	Namespace  string `json:"namespace,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// warm resolves hosts in parallel so they are cached before traffic
+// arrives. Hosts without a link are returned with an empty namespace.
+func (a *App) warm(ctx context.Context, hosts []string) []warmResult {
+	results := make([]warmResult, len(hosts))
+	sem := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			entry, _, _ := a.resolve(ctx, host)
+			results[i] = warmResult{Host: host, Namespace: entry.Namespace, Identifier: entry.Identifier}
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// preload warms the cache with the hosts of Preload and PreloadFile. It
+// blocks until every host is resolved or its lookup times out.
+func (a *App) preload(ctx context.Context) error {
+	hosts := a.Preload
+	if a.PreloadFile != "" {
+		fromFile, err := readHostsFile(a.PreloadFile)
+		if err != nil {
+			return err
+		}
+		hosts = append(append([]string(nil), hosts...), fromFile...)
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	var linked int
+	for _, res := range a.warm(ctx, hosts) {
+		if res.Namespace != "" {
+			linked++
+		}
+	}
+	a.logger.Info("preloaded dnslink cache",
+		zap.Int("hosts", len(hosts)),
+		zap.Int("linked", linked),
+		zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// readHostsFile reads one hostname per line from path. Blank lines and
+// lines starting with # are ignored.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
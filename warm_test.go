@@ -0,0 +1,64 @@
+package dnslink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestReadHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	content := "# known domains\nexample.com\n\n  example.org  \n#disabled.example.net\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := readHostsFile(path)
+	if err != nil {
+		t.Fatalf("readHostsFile() error = %v", err)
+	}
+	want := []string{"example.com", "example.org"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("readHostsFile() = %q, want %q", hosts, want)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	path := filepath.Join(t.TempDir(), "preload.txt")
+	if err := os.WriteFile(path, []byte("example.org\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		Preload:       []string{"example.com"},
+		PreloadFile:   path,
+		CacheTTL:      caddy.Duration(time.Minute),
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/QmPreloaded"}}, nil
+		},
+	}
+	if err := a.preload(context.Background()); err != nil {
+		t.Fatalf("preload() error = %v", err)
+	}
+	for _, host := range []string{"example.com", "example.org"} {
+		if entry, ok, _ := a.cache.Load(context.Background(), host); !ok || entry.Identifier != "QmPreloaded" {
+			t.Errorf("cache entry for %s = %+v, %v, want preloaded", host, entry, ok)
+		}
+	}
+
+	a.PreloadFile = filepath.Join(t.TempDir(), "missing.txt")
+	if err := a.preload(context.Background()); err == nil {
+		t.Error("preload() with a missing file succeeded, want error")
+	}
+}
@@ -0,0 +1,249 @@
+package dnslink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// defaultWatchInterval is the default Watch interval.
+const defaultWatchInterval = 5 * time.Minute
+
+// webhookTimeout bounds each webhook request.
+const webhookTimeout = 10 * time.Second
+
+// Watch periodically re-resolves a set of hosts and notifies a webhook
+// when one of them publishes a new link, e.g. to purge a CDN or pin the
+// new root. Changes also emit dnslink.changed events.
+type Watch struct {
+	// Hosts are the hosts to watch.
+	Hosts []string `json:"hosts"`
+
+	// Interval is how often the hosts are re-resolved. Default is 5m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Webhook, if set, is the URL a watchChange is POSTed to as JSON
+	// whenever a host's link changes.
+	Webhook string `json:"webhook,omitempty"`
+
+	// Headers are added to every webhook request, e.g. for
+	// authentication. Values may contain global placeholders such as
+	// {env.WEBHOOK_TOKEN}.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	headers http.Header
+	client  *http.Client
+
+	// last holds the link last seen per host. It is only used by the
+	// watcher goroutine.
+	last map[string]CacheEntry
+
+	// cancel stops the watcher goroutine, which closes done on exit.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// watchChange is the webhook payload describing a changed link.
+type watchChange struct {
+	Host               string    `json:"host"`
+	Namespace          string    `json:"namespace"`
+	Identifier         string    `json:"identifier"`
+	PreviousNamespace  string    `json:"previous_namespace"`
+	PreviousIdentifier string    `json:"previous_identifier"`
+	ChangedAt          time.Time `json:"changed_at"`
+}
+
+// provision validates the configuration and sets the defaults.
+func (w *Watch) provision() error {
+	if len(w.Hosts) == 0 {
+		return fmt.Errorf("no hosts to watch")
+	}
+	for i, host := range w.Hosts {
+		w.Hosts[i] = mappingKey(host)
+	}
+	if w.Interval == 0 {
+		w.Interval = caddy.Duration(defaultWatchInterval)
+	}
+	if w.Webhook != "" {
+		u, err := url.Parse(w.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook '%s'", w.Webhook)
+		}
+	}
+
+	repl := caddy.NewReplacer()
+	w.headers = make(http.Header, len(w.Headers))
+	for name, value := range w.Headers {
+		w.headers.Set(name, repl.ReplaceAll(value, ""))
+	}
+	if w.client == nil {
+		w.client = &http.Client{Timeout: webhookTimeout}
+	}
+	w.last = make(map[string]CacheEntry, len(w.Hosts))
+	return nil
+}
+
+// start runs the watcher for a until stopWatching is called or ctx is
+// done.
+func (w *Watch) start(ctx context.Context, a *App) {
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.done = make(chan struct{})
+	go func(done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(w.Interval))
+		defer ticker.Stop()
+		for {
+			w.check(ctx, a)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(w.done)
+}
+
+// stopWatching stops the watcher started by start, cancelling any check
+// in progress, and waits for it to exit.
+func (w *Watch) stopWatching() {
+	if w.cancel != nil {
+		w.cancel()
+		<-w.done
+		w.cancel = nil
+	}
+}
+
+// check re-resolves every watched host and reports those whose link
+// changed since the last check. On the first check, the cached entry, if
+// any, is taken as the previous link. Failed lookups and hosts without a
+// link are not reported as changes.
+func (w *Watch) check(ctx context.Context, a *App) {
+	for _, host := range w.Hosts {
+		prev, hadPrev := w.last[host]
+		if !hadPrev {
+			prev, hadPrev, _ = a.cache.Load(ctx, host)
+		}
+
+		entry, err := a.resolveLive(ctx, host)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logger.Warn("watching dnslink", zap.String("host", host), zap.Error(err))
+			continue
+		}
+		if entry.Namespace == "" {
+			continue
+		}
+		w.last[host] = entry
+		if !hadPrev || prev.Namespace == "" || (prev.Namespace == entry.Namespace && prev.Identifier == entry.Identifier) {
+			continue
+		}
+
+		a.logger.Info("dnslink changed",
+			zap.String("host", host),
+			zap.String("namespace", entry.Namespace),
+			zap.String("identifier", entry.Identifier),
+			zap.String("previous_namespace", prev.Namespace),
+			zap.String("previous_identifier", prev.Identifier))
+		if w.Webhook == "" {
+			continue
+		}
+		change := watchChange{
+			Host:               host,
+			Namespace:          entry.Namespace,
+			Identifier:         entry.Identifier,
+			PreviousNamespace:  prev.Namespace,
+			PreviousIdentifier: prev.Identifier,
+			ChangedAt:          time.Now().UTC(),
+		}
+		if err := w.notify(ctx, change); err != nil {
+			a.logger.Warn("sending dnslink webhook", zap.String("host", host), zap.Error(err))
+		}
+	}
+}
+
+// notify POSTs change to the webhook.
+func (w *Watch) notify(ctx context.Context, change watchChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// unmarshalWatch parses the watch option:
+//
+//	watch [<host>...] {
+//	    hosts <host>...
+//	    interval <duration>
+//	    webhook <url>
+//	    header <name> <value>
+//	}
+func unmarshalWatch(d *caddyfile.Dispenser) (*Watch, error) {
+	w := &Watch{Hosts: d.RemainingArgs()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return nil, d.ArgErr()
+			}
+			w.Hosts = append(w.Hosts, hosts...)
+		case "interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, err
+			}
+			w.Interval = caddy.Duration(dur)
+		case "webhook":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			w.Webhook = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if w.Headers == nil {
+				w.Headers = make(map[string]string)
+			}
+			w.Headers[args[0]] = args[1]
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,102 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestWatch(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	changes := make(chan watchChange, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the configured header", got)
+		}
+		var change watchChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("decoding webhook: %v", err)
+		}
+		changes <- change
+	}))
+	defer srv.Close()
+
+	identifier := "QmOld"
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Second),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(_ context.Context, name string) ([]dnslinkpkg.LookupEntry, error) {
+			if name == "_dnslink.example.com" {
+				return []dnslinkpkg.LookupEntry{{Value: "dnslink=/ipfs/" + identifier}}, nil
+			}
+			return nil, dnslinkpkg.NewDNSRCodeError(rcodeNXDomain, name)
+		},
+	}
+	w := &Watch{
+		Hosts:   []string{"Example.com", "nolink.example.com"},
+		Webhook: srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}
+	if err := w.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	w.check(ctx, a)
+	w.check(ctx, a)
+	identifier = "QmNew"
+	w.check(ctx, a)
+
+	select {
+	case change := <-changes:
+		if change.Host != "example.com" || change.PreviousIdentifier != "QmOld" || change.Identifier != "QmNew" {
+			t.Errorf("webhook change = %+v, want example.com from QmOld to QmNew", change)
+		}
+	default:
+		t.Fatal("no webhook sent for the changed link")
+	}
+	if len(changes) != 0 {
+		t.Errorf("%d extra webhooks sent", len(changes))
+	}
+}
+
+func TestWatchStop(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	a := &App{
+		LookupTimeout: caddy.Duration(time.Minute),
+		cache:         new(MemoryCache),
+		logger:        zap.NewNop(),
+		lookup: func(ctx context.Context, _ string) ([]dnslinkpkg.LookupEntry, error) {
+			// A resolver that hangs until the lookup is cancelled.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	w := &Watch{Hosts: []string{"example.com"}}
+	if err := w.provision(); err != nil {
+		t.Fatal(err)
+	}
+	w.start(context.Background(), a)
+
+	stopped := make(chan struct{})
+	go func() {
+		w.stopWatching()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopWatching() did not cancel the check in progress")
+	}
+	w.stopWatching() // stopping twice is a no-op
+}
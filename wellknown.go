@@ -0,0 +1,64 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	dnslinkpkg "github.com/dnslink-std/go"
+)
+
+// wellKnownPath is the path of the WellKnown document of a host.
+const wellKnownPath = "/.well-known/dnslink"
+
+// wellKnownDocument describes the link the gateway resolved for a host.
+type wellKnownDocument struct {
+	Host       string                                 `json:"host"`
+	Namespace  string                                 `json:"namespace"`
+	Identifier string                                 `json:"identifier"`
+	Links      map[string]dnslinkpkg.NamespaceEntries `json:"links,omitempty"`
+	Cache      string                                 `json:"cache,omitempty"`
+
+	// TTL is the number of seconds until the link is resolved again.
+	TTL        *int64     `json:"ttl,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// newWellKnownDocument describes entry, resolved for host as cacheStatus,
+// at now. Links that never expire, such as static mappings, have no TTL.
+func newWellKnownDocument(host string, entry CacheEntry, cacheStatus string, now time.Time) wellKnownDocument {
+	doc := wellKnownDocument{
+		Host:       host,
+		Namespace:  entry.Namespace,
+		Identifier: entry.Identifier,
+		Links:      entry.Links,
+		Cache:      cacheStatus,
+	}
+	if !entry.ExpiresAt.IsZero() {
+		ttl := max(int64(entry.ExpiresAt.Sub(now)/time.Second), 0)
+		doc.TTL, doc.ExpiresAt = &ttl, &entry.ExpiresAt
+	}
+	if !entry.ResolvedAt.IsZero() {
+		doc.ResolvedAt = &entry.ResolvedAt
+	}
+	return doc
+}
+
+// serveWellKnown answers r with doc.
+func serveWellKnown(w http.ResponseWriter, r *http.Request, doc wellKnownDocument) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,72 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	dnslinkpkg "github.com/dnslink-std/go"
+	"go.uber.org/zap"
+)
+
+func TestWellKnown(t *testing.T) {
+	dnslinkMetrics.init.Do(initMetrics)
+
+	d := &DNSLink{
+		WellKnown: true,
+		Upstreams: map[string]string{"/ipfs": "localhost:8080"},
+		proxies:   map[string]*reverseproxy.Handler{"/ipfs": nil},
+		app: &App{
+			CacheTTL: caddy.Duration(time.Minute),
+			cache:    new(MemoryCache),
+			logger:   zap.NewNop(),
+			chain: []Resolver{ResolverFunc(func(_ context.Context, host string) (dnslinkpkg.Result, error) {
+				return dnslinkpkg.Result{Links: map[string]dnslinkpkg.NamespaceEntries{"ipfs": {{Identifier: "QmSite"}}}}, nil
+			})},
+		},
+		logger: zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		t.Error("well-known request was passed on")
+		return nil
+	})
+
+	for _, cache := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+wellKnownPath, nil)
+		if err := d.ServeHTTP(w, r, next); err != nil {
+			t.Fatal(err)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		var doc wellKnownDocument
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Host != "example.com" || doc.Namespace != "ipfs" || doc.Identifier != "QmSite" || doc.Cache != cache {
+			t.Errorf("document = %+v, want /ipfs/QmSite of example.com from a cache %s", doc, cache)
+		}
+		if doc.TTL == nil || *doc.TTL < 58 || *doc.TTL > 60 || doc.ResolvedAt == nil {
+			t.Errorf("document TTL = %v, resolved at %v", doc.TTL, doc.ResolvedAt)
+		}
+	}
+}
+
+func TestNewWellKnownDocument(t *testing.T) {
+	now := time.Now()
+	doc := newWellKnownDocument("example.com", CacheEntry{Namespace: "ipfs", Identifier: "QmStatic"}, "static", now)
+	if doc.TTL != nil || doc.ExpiresAt != nil || doc.ResolvedAt != nil {
+		t.Errorf("static document = %+v, want no TTL or times", doc)
+	}
+	doc = newWellKnownDocument("example.com", CacheEntry{Namespace: "ipfs", ExpiresAt: now.Add(-time.Second), ResolvedAt: now.Add(-time.Minute)}, "stale", now)
+	if doc.TTL == nil || *doc.TTL != 0 {
+		t.Errorf("expired document TTL = %v, want 0", doc.TTL)
+	}
+}